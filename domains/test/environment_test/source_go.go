@@ -42,14 +42,71 @@
 package main
 
 import (
+    "bufio"
+    "bytes"
+    "cmp"
+    "compress/gzip"
+    "container/list"
+    "context"
+    "crypto/hmac"
+    "crypto/pbkdf2"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/subtle"
+    "crypto/tls"
+    "crypto/x509"
+    "database/sql"
+    "database/sql/driver"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/csv"
+    "encoding/hex"
     "encoding/json"
+    "encoding/xml"
+    "errors"
+    "expvar"
+    "flag"
     "fmt"
-    "log"
+    "image"
+    "image/color"
+    _ "image/gif"
+    _ "image/jpeg"
+    "image/png"
+    "io"
+    "iter"
+    "log/slog"
+    "maps"
     "math"
+    "mime"
+    "mime/quotedprintable"
+    mrand "math/rand/v2"
+    "net"
+    "net/http"
+    "net/http/pprof"
+    "net/mail"
+    "net/smtp"
+    "net/textproto"
+    "os"
+    "os/signal"
+    "net/url"
+    "path/filepath"
+    "reflect"
+    "regexp"
+    "runtime"
+    "runtime/debug"
+    "slices"
     "sort"
     "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "text/tabwriter"
+    "text/template"
     "time"
+    "unicode"
+    "unicode/utf8"
 )
 
 // Constants
@@ -59,6 +116,74 @@ const (
     MaxRetries = 3
 )
 
+// Errors
+var (
+    ErrNotFound            = errors.New("not found")
+    ErrEmailTaken          = errors.New("already taken")
+    ErrAlreadyExists       = errors.New("already exists")
+    ErrInvalidTransition   = errors.New("invalid status transition")
+    ErrForbidden           = errors.New("forbidden")
+    ErrInvalidCredentials  = errors.New("invalid credentials")
+    ErrInvalidToken        = errors.New("invalid token")
+    ErrIdempotencyConflict = errors.New("idempotency key reused with a different request")
+    ErrRateLimited         = errors.New("rate limit exceeded")
+    ErrAccountLocked       = errors.New("account locked")
+    ErrNotSupported        = errors.New("not supported")
+    // ErrInvalidInput marks errors caused by the caller's data, such as a
+    // malformed email, rather than by the service or its storage.
+    ErrInvalidInput = errors.New("invalid input")
+)
+
+// inputError tags err with ErrInvalidInput without changing its message.
+type inputError struct{ err error }
+
+func (e inputError) Error() string   { return e.err.Error() }
+func (e inputError) Unwrap() []error { return []error{e.err, ErrInvalidInput} }
+
+func invalidInput(err error) error {
+    if err == nil || errors.Is(err, ErrInvalidInput) {
+        return err
+    }
+    return inputError{err}
+}
+
+// BulkError reports the items of a bulk operation that failed. Items not
+// listed succeeded.
+type BulkError struct {
+    Total    int
+    Failures []BulkFailure
+}
+
+// BulkFailure identifies one failed item by its position in the input and,
+// when known, its ID.
+type BulkFailure struct {
+    Index int    `json:"index"`
+    ID    UserID `json:"id,omitempty"`
+    Err   error  `json:"-"`
+}
+
+func (e *BulkError) Error() string {
+    return fmt.Sprintf("%d of %d operations failed; first: item %d: %v",
+        len(e.Failures), e.Total, e.Failures[0].Index, e.Failures[0].Err)
+}
+
+func (e *BulkError) Unwrap() []error {
+    errs := make([]error, len(e.Failures))
+    for i, f := range e.Failures {
+        errs[i] = f.Err
+    }
+    return errs
+}
+
+// bulkError returns nil when nothing failed, so callers never get a non-nil
+// error wrapping an empty *BulkError.
+func bulkError(total int, failures []BulkFailure) error {
+    if len(failures) == 0 {
+        return nil
+    }
+    return &BulkError{Total: total, Failures: failures}
+}
+
 // Custom types
 type UserID int
 type Status string
@@ -70,233 +195,19507 @@ const (
     StatusPending  Status = "pending"
 )
 
-// Structs
-type User struct {
-    ID          UserID    `json:"id"`
-    Name        string    `json:"name"`
-    Email       string    `json:"email"`
-    Age         *int      `json:"age,omitempty"`
-    Status      Status    `json:"status"`
-    CreatedAt   time.Time `json:"created_at"`
-    Preferences UserPrefs `json:"preferences"`
+// Role grants permissions through a Policy.
+type Role string
+
+const (
+    RoleAdmin  Role = "admin"
+    RoleMember Role = "member"
+    RoleViewer Role = "viewer"
+)
+
+func (r Role) Valid() bool {
+    switch r {
+    case RoleAdmin, RoleMember, RoleViewer:
+        return true
+    }
+    return false
+}
+
+// statusTransitions is the user lifecycle: a pending user is activated or
+// turned away, and active users can be deactivated and reactivated. Nothing
+// goes back to pending.
+var statusTransitions = map[Status][]Status{
+    StatusPending:  {StatusActive, StatusInactive},
+    StatusActive:   {StatusInactive},
+    StatusInactive: {StatusActive},
+}
+
+// CanTransitionTo reports whether a user may move from s to next.
+func (s Status) CanTransitionTo(next Status) bool {
+    for _, allowed := range statusTransitions[s] {
+        if allowed == next {
+            return true
+        }
+    }
+    return false
+}
+
+// Structs
+type User struct {
+    ID          UserID    `json:"id"`
+    Name        string    `json:"name"`
+    Email       string    `json:"email"`
+    Age         *int      `json:"age,omitempty"`
+    Status      Status    `json:"status"`
+    Role        Role      `json:"role"`
+    CreatedAt   time.Time `json:"created_at"`
+    Preferences UserPrefs `json:"preferences"`
+    // Tags are normalized labels (see normalizeTag), kept sorted.
+    Tags []string `json:"tags,omitempty"`
+    // DeletedAt is set by UserRepository.Delete; soft-deleted users are hidden
+    // from reads until restored or purged.
+    DeletedAt *time.Time `json:"deleted_at,omitempty"`
+    // StatusChangedAt records the last Status transition; it is nil for users
+    // that still have the status they were created with.
+    StatusChangedAt *time.Time `json:"status_changed_at,omitempty"`
+    // AnonymizedAt is set by Anonymize. Users anonymized before the field
+    // existed carry the time they were backfilled instead.
+    AnonymizedAt *time.Time `json:"anonymized_at,omitempty"`
+    // AvatarURL points at the largest stored rendition; see SetAvatar.
+    AvatarURL string `json:"avatar_url,omitempty"`
+    // Phone and Address are optional contact details, validated on the
+    // way in (see NormalizePhone and the service's address validators).
+    Phone   *Phone   `json:"phone,omitempty"`
+    Address *Address `json:"address,omitempty"`
+    // Metadata holds integrator-defined values such as external IDs; see
+    // SetMetadata for the limits.
+    Metadata map[string]string `json:"metadata,omitempty"`
+    // TenantID is the customer the user belongs to; it never changes after
+    // the user is created. Single-tenant deployments leave it empty.
+    TenantID TenantID `json:"tenant_id,omitempty"`
+}
+
+// clone returns a deep copy of u, sharing nothing a caller could change
+// in place.
+func (u *User) clone() *User {
+    c := *u
+    c.Age = clonePtr(u.Age)
+    c.DeletedAt = clonePtr(u.DeletedAt)
+    c.StatusChangedAt = clonePtr(u.StatusChangedAt)
+    c.AnonymizedAt = clonePtr(u.AnonymizedAt)
+    c.Phone = clonePtr(u.Phone)
+    c.Address = clonePtr(u.Address)
+    c.Tags = slices.Clone(u.Tags)
+    c.Metadata = maps.Clone(u.Metadata)
+    c.Preferences.Custom = maps.Clone(u.Preferences.Custom)
+    return &c
+}
+
+func clonePtr[T any](p *T) *T {
+    if p == nil {
+        return nil
+    }
+    v := *p
+    return &v
+}
+
+// transition moves the user to next at the given time, rejecting moves the
+// lifecycle doesn't allow with ErrInvalidTransition.
+func (u *User) transition(next Status, at time.Time) error {
+    if !u.Status.CanTransitionTo(next) {
+        return fmt.Errorf("%s -> %s: %w", u.Status, next, ErrInvalidTransition)
+    }
+    u.Status = next
+    u.StatusChangedAt = &at
+    return nil
+}
+
+type UserPrefs struct {
+    Theme         string `json:"theme"`
+    Notifications bool   `json:"notifications"`
+    Language      string `json:"language"`
+    // Custom holds settings registered in a PrefSchema, in the canonical
+    // string form PrefSchema.Parse produces.
+    Custom map[string]string `json:"custom,omitempty"`
+}
+
+// Preference keys accepted by UserService.UpdatePreference.
+const (
+    PrefTheme         = "theme"
+    PrefNotifications = "notifications"
+    PrefLanguage      = "language"
+)
+
+var (
+    AllowedThemes    = []string{"light", "dark", "system"}
+    AllowedLanguages = []string{"en", "es", "fr", "de", "pt", "ja"}
+)
+
+// DefaultPrefs are given to new users and fill in preferences that were
+// never set, e.g. for imported users.
+var DefaultPrefs = UserPrefs{Theme: "light", Notifications: true, Language: "en"}
+
+// withDefaults returns p with empty string settings replaced by defaults.
+func (p UserPrefs) withDefaults() UserPrefs {
+    if p.Theme == "" {
+        p.Theme = DefaultPrefs.Theme
+    }
+    if p.Language == "" {
+        p.Language = DefaultPrefs.Language
+    }
+    return p
+}
+
+func validateChoice(key, value string, allowed []string) error {
+    for _, a := range allowed {
+        if value == a {
+            return nil
+        }
+    }
+    return fmt.Errorf("invalid %s %q, want one of %v", key, value, allowed)
+}
+
+type PrefType string
+
+const (
+    PrefBool   PrefType = "bool"
+    PrefString PrefType = "string"
+    PrefInt    PrefType = "int"
+    PrefEnum   PrefType = "enum"
+)
+
+// PrefDef declares one preference. Default is in the same string form
+// users submit; Values lists the choices of a PrefEnum.
+type PrefDef struct {
+    Key     string   `json:"key"`
+    Type    PrefType `json:"type"`
+    Default string   `json:"default"`
+    Values  []string `json:"values,omitempty"`
+}
+
+// parse converts raw to the def's Go type (bool, string or int) and its
+// canonical string form.
+func (d PrefDef) parse(raw string) (any, string, error) {
+    switch d.Type {
+    case PrefBool:
+        b, err := strconv.ParseBool(raw)
+        if err != nil {
+            return nil, "", fmt.Errorf("invalid %s %q: want true or false", d.Key, raw)
+        }
+        return b, strconv.FormatBool(b), nil
+    case PrefInt:
+        n, err := strconv.Atoi(raw)
+        if err != nil {
+            return nil, "", fmt.Errorf("invalid %s %q: want an integer", d.Key, raw)
+        }
+        return n, strconv.Itoa(n), nil
+    case PrefEnum:
+        if err := validateChoice(d.Key, raw, d.Values); err != nil {
+            return nil, "", err
+        }
+        return raw, raw, nil
+    case PrefString:
+        return raw, raw, nil
+    }
+    return nil, "", fmt.Errorf("preference %s has unknown type %q", d.Key, d.Type)
+}
+
+// PrefSchema is the set of preferences users may set. It starts with the
+// built-in UserPrefs fields; other teams Register their own keys at
+// startup, which are stored in UserPrefs.Custom without touching User. It
+// is safe for concurrent use.
+type PrefSchema struct {
+    mu   sync.RWMutex
+    defs map[string]PrefDef
+}
+
+func NewPrefSchema() *PrefSchema {
+    s := &PrefSchema{defs: make(map[string]PrefDef)}
+    for _, def := range []PrefDef{
+        {Key: PrefTheme, Type: PrefEnum, Default: DefaultPrefs.Theme, Values: AllowedThemes},
+        {Key: PrefNotifications, Type: PrefBool, Default: strconv.FormatBool(DefaultPrefs.Notifications)},
+        {Key: PrefLanguage, Type: PrefEnum, Default: DefaultPrefs.Language, Values: AllowedLanguages},
+    } {
+        s.defs[def.Key] = def
+    }
+    return s
+}
+
+// Register adds a custom preference. Keys must be unique and the default
+// must be valid for the type.
+func (s *PrefSchema) Register(def PrefDef) error {
+    if def.Key == "" {
+        return errors.New("preference key is required")
+    }
+    if _, _, err := def.parse(def.Default); err != nil {
+        return fmt.Errorf("default for %s: %w", def.Key, err)
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, exists := s.defs[def.Key]; exists {
+        return fmt.Errorf("preference %q %w", def.Key, ErrAlreadyExists)
+    }
+    s.defs[def.Key] = def
+    return nil
+}
+
+func (s *PrefSchema) Lookup(key string) (PrefDef, bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    def, ok := s.defs[key]
+    return def, ok
+}
+
+// Parse validates raw against key's definition and returns its canonical
+// string form.
+func (s *PrefSchema) Parse(key, raw string) (string, error) {
+    def, ok := s.Lookup(key)
+    if !ok {
+        return "", fmt.Errorf("unknown preference %q", key)
+    }
+    _, canonical, err := def.parse(raw)
+    return canonical, err
+}
+
+// Values returns every registered preference for p as typed values, with
+// defaults for anything unset. Stored custom values that no longer parse
+// (say, after an enum lost a choice) fall back to the default too.
+func (s *PrefSchema) Values(p UserPrefs) map[string]any {
+    p = p.withDefaults()
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    values := make(map[string]any, len(s.defs))
+    for key, def := range s.defs {
+        var raw string
+        switch key {
+        case PrefTheme:
+            raw = p.Theme
+        case PrefNotifications:
+            raw = strconv.FormatBool(p.Notifications)
+        case PrefLanguage:
+            raw = p.Language
+        default:
+            var ok bool
+            if raw, ok = p.Custom[key]; !ok {
+                raw = def.Default
+            }
+        }
+        v, _, err := def.parse(raw)
+        if err != nil {
+            v, _, _ = def.parse(def.Default)
+        }
+        values[key] = v
+    }
+    return values
+}
+
+// Interfaces
+
+// Repository is the storage contract shared by every entity type. Methods
+// take a context so callers can cancel, set deadlines, and carry tracing
+// data down to the backend. Save is an upsert: it creates the entity if the
+// ID is zero or unknown and updates it otherwise. Insert only creates,
+// failing with ErrAlreadyExists for a known ID.
+type Repository[ID comparable, T any] interface {
+    Save(ctx context.Context, entity T) error
+    Insert(ctx context.Context, entity T) error
+    FindByID(ctx context.Context, id ID) (T, error)
+    Delete(ctx context.Context, id ID) error
+}
+
+// Entity is implemented by types stored in the generic repositories.
+type Entity[ID comparable] interface {
+    EntityID() ID
+    SetEntityID(id ID)
+}
+
+func (u *User) EntityID() UserID      { return u.ID }
+func (u *User) SetEntityID(id UserID) { u.ID = id }
+
+// UserRepository adds user-specific queries to Repository[UserID, *User].
+// For users, Save preserves the stored CreatedAt on update, Save and Insert
+// fail with ErrEmailTaken if another live user has the email, and Delete
+// soft-deletes: Restore undoes it and PurgeDeleted permanently removes users
+// deleted more than olderThan ago.
+type UserRepository interface {
+    Repository[UserID, *User]
+    FindAll(ctx context.Context, order SortSpec) ([]*User, error)
+    // FindAllIter streams live users in ID order without building a slice.
+    // Iteration stops at the first error, which is yielded with a nil user.
+    // SQL backends hold a connection for the whole loop, so avoid calling
+    // back into a repository limited to one connection from the loop body.
+    FindAllIter(ctx context.Context) iter.Seq2[*User, error]
+    FindPage(ctx context.Context, page PageRequest) (*Page, error)
+    FindByEmail(ctx context.Context, email string) (*User, error)
+    Restore(ctx context.Context, id UserID) error
+    PurgeDeleted(ctx context.Context, olderThan time.Duration) (int, error)
+    // SaveAll and DeleteAll apply every item they can and return a
+    // *BulkError listing the ones that failed.
+    SaveAll(ctx context.Context, users []*User) error
+    DeleteAll(ctx context.Context, ids []UserID) error
+    FindWhere(ctx context.Context, filter UserFilter) ([]*User, error)
+}
+
+// Reindexer is implemented by repositories whose indexes can be rebuilt,
+// for when they are suspected to be stale or bloated.
+type Reindexer interface {
+    Reindex(ctx context.Context) error
+}
+
+// findRepository looks for a T in repo and the repositories it decorates,
+// followed through their Unwrap methods, for optional capabilities that
+// decorators don't forward.
+func findRepository[T any](repo UserRepository) (T, bool) {
+    for repo != nil {
+        if t, ok := repo.(T); ok {
+            return t, true
+        }
+        u, ok := repo.(interface{ Unwrap() UserRepository })
+        if !ok {
+            break
+        }
+        repo = u.Unwrap()
+    }
+    var zero T
+    return zero, false
+}
+
+// Logger takes a message and optional attributes, given as alternating
+// keys and values or as slog.Attr, like log/slog. Calls that pass only a
+// message work with both Logger and PlainLogger implementations.
+type Logger interface {
+    Info(msg string, attrs ...any)
+    Warn(msg string, attrs ...any)
+    Error(msg string, attrs ...any)
+    Debug(msg string, attrs ...any)
+}
+
+// PlainLogger is the message-only Logger interface from before
+// attributes and Warn; AdaptPlainLogger turns one into a Logger.
+type PlainLogger interface {
+    Info(msg string)
+    Error(msg string)
+    Debug(msg string)
+}
+
+// RepoOption configures a repository at construction time.
+type RepoOption func(*repoOptions)
+
+type repoOptions struct {
+    caseInsensitiveEmails bool
+    ids                   IDGenerator[UserID]
+}
+
+// WithCaseInsensitiveEmails makes email uniqueness and FindByEmail ignore
+// case, so "Ann@Example.com" and "ann@example.com" are the same address.
+func WithCaseInsensitiveEmails() RepoOption {
+    return func(o *repoOptions) { o.caseInsensitiveEmails = true }
+}
+
+// WithIDGenerator assigns IDs to new users from gen, such as a Snowflake
+// so that instances sharing a database, or later merging their data,
+// never hand out the same ID. The in-memory repository counts up from 1
+// otherwise, and SQL repositories leave it to the database.
+func WithIDGenerator(gen IDGenerator[UserID]) RepoOption {
+    return func(o *repoOptions) { o.ids = gen }
+}
+
+func newRepoOptions(opts []RepoOption) repoOptions {
+    var o repoOptions
+    for _, opt := range opts {
+        opt(&o)
+    }
+    return o
+}
+
+// emailKey is the form emails are compared in under these options.
+func (o repoOptions) emailKey(email string) string {
+    if o.caseInsensitiveEmails {
+        return strings.ToLower(email)
+    }
+    return email
+}
+
+// Transactor is implemented by repositories that can run several operations
+// atomically. Use the WithinTx helper rather than asserting it directly.
+type Transactor interface {
+    WithinTx(ctx context.Context, fn func(UserRepository) error) error
+}
+
+// WithinTx runs fn atomically when repo supports transactions, and simply
+// runs it against repo when it does not.
+func WithinTx(ctx context.Context, repo UserRepository, fn func(UserRepository) error) error {
+    if t, ok := repo.(Transactor); ok {
+        return t.WithinTx(ctx, fn)
+    }
+    return fn(repo)
+}
+
+// UserFilter selects users for UserRepository.FindWhere. Zero-valued fields
+// are ignored, so UserFilter{} matches every live user. Users without an age
+// never match an age bound. Soft-deleted users only match with IncludeDeleted.
+type UserFilter struct {
+    IncludeDeleted bool      `json:"include_deleted,omitempty"`
+    Status         Status    `json:"status,omitempty"`
+    MinAge         *int      `json:"min_age,omitempty"`
+    MaxAge         *int      `json:"max_age,omitempty"`
+    NamePrefix     string    `json:"name_prefix,omitempty"`
+    EmailDomain    string    `json:"email_domain,omitempty"`
+    CreatedAfter   time.Time `json:"created_after,omitempty"`  // inclusive
+    CreatedBefore  time.Time `json:"created_before,omitempty"` // exclusive
+    Tag            string    `json:"tag,omitempty"`            // normalized
+    // Metadata matches users having every listed key with exactly that value.
+    Metadata map[string]string `json:"metadata,omitempty"`
+    // TenantID, when set, limits matches to one tenant ("" included).
+    TenantID *TenantID `json:"tenant_id,omitempty"`
+    IDs      []UserID  `json:"ids,omitempty"`
+}
+
+func (f UserFilter) Matches(user *User) bool {
+    if user.DeletedAt != nil && !f.IncludeDeleted {
+        return false
+    }
+    if f.Status != "" && user.Status != f.Status {
+        return false
+    }
+    if f.MinAge != nil && (user.Age == nil || *user.Age < *f.MinAge) {
+        return false
+    }
+    if f.MaxAge != nil && (user.Age == nil || *user.Age > *f.MaxAge) {
+        return false
+    }
+    if f.NamePrefix != "" && !strings.HasPrefix(user.Name, f.NamePrefix) {
+        return false
+    }
+    if f.EmailDomain != "" && !strings.HasSuffix(strings.ToLower(user.Email), "@"+strings.ToLower(f.EmailDomain)) {
+        return false
+    }
+    if !f.CreatedAfter.IsZero() && user.CreatedAt.Before(f.CreatedAfter) {
+        return false
+    }
+    if !f.CreatedBefore.IsZero() && !user.CreatedAt.Before(f.CreatedBefore) {
+        return false
+    }
+    if f.Tag != "" && !slices.Contains(user.Tags, f.Tag) {
+        return false
+    }
+    for k, v := range f.Metadata {
+        if got, ok := user.Metadata[k]; !ok || got != v {
+            return false
+        }
+    }
+    if f.TenantID != nil && user.TenantID != *f.TenantID {
+        return false
+    }
+    if len(f.IDs) > 0 && !slices.Contains(f.IDs, user.ID) {
+        return false
+    }
+    return true
+}
+
+// SortSpec orders listings. The zero value sorts by ID ascending; ties on
+// the chosen field are always broken by ID so results are deterministic.
+// Users without an age sort last in either direction.
+type SortSpec struct {
+    Field SortField `json:"field,omitempty"`
+    Desc  bool      `json:"desc,omitempty"`
+}
+
+type SortField string
+
+const (
+    SortByID        SortField = "id"
+    SortByName      SortField = "name"
+    SortByCreatedAt SortField = "created_at"
+    SortByAge       SortField = "age"
+)
+
+func (s SortSpec) validate() error {
+    switch s.Field {
+    case "", SortByID, SortByName, SortByCreatedAt, SortByAge:
+        return nil
+    }
+    return fmt.Errorf("unknown sort field %q", s.Field)
+}
+
+// Less reports whether a sorts before b under s.
+func (s SortSpec) Less(a, b *User) bool {
+    if s.Field == SortByAge && (a.Age == nil) != (b.Age == nil) {
+        return b.Age == nil
+    }
+
+    var c int
+    switch s.Field {
+    case SortByName:
+        c = strings.Compare(a.Name, b.Name)
+    case SortByCreatedAt:
+        c = a.CreatedAt.Compare(b.CreatedAt)
+    case SortByAge:
+        if a.Age != nil && b.Age != nil {
+            c = cmp.Compare(*a.Age, *b.Age)
+        }
+    }
+    if c == 0 {
+        c = cmp.Compare(a.ID, b.ID)
+    }
+    if s.Desc {
+        return c > 0
+    }
+    return c < 0
+}
+
+func sortUsers(users []*User, order SortSpec) {
+    sort.Slice(users, func(i, j int) bool { return order.Less(users[i], users[j]) })
+}
+
+// PageRequest asks for Limit users starting at Offset in Sort order.
+// A Limit of zero means DefaultPageSize.
+type PageRequest struct {
+    Offset int      `json:"offset"`
+    Limit  int      `json:"limit"`
+    Sort   SortSpec `json:"sort"`
+    // TenantID, when set, limits the page to one tenant. TenantRepository
+    // sets it from the context; it is never read from requests.
+    TenantID *TenantID `json:"-"`
+}
+
+type Page struct {
+    Users  []*User `json:"users"`
+    Total  int     `json:"total"`
+    Offset int     `json:"offset"`
+    Limit  int     `json:"limit"`
+}
+
+const (
+    DefaultPageSize = 50
+    MaxPageSize     = 1000
+)
+
+func (p PageRequest) normalize() (PageRequest, error) {
+    if err := p.Sort.validate(); err != nil {
+        return p, err
+    }
+    if p.Offset < 0 {
+        return p, fmt.Errorf("negative page offset %d", p.Offset)
+    }
+    if p.Limit <= 0 {
+        p.Limit = DefaultPageSize
+    }
+    p.Limit = min(p.Limit, MaxPageSize)
+    return p, nil
+}
+
+// Implementations
+//
+// InMemoryRepository is safe for concurrent use: reads share a lock and
+// writes take it exclusively, so checking an email is free and saving the
+// user happen as one step.
+type InMemoryRepository struct {
+    mu sync.RWMutex
+    // held marks the view WithinTx hands to fn, which shares r's maps
+    // and runs under r's write lock already.
+    held bool
+
+    users map[UserID]*User
+    ids   IDGenerator[UserID]
+    // byEmail indexes live users by emailIndexKey so FindByEmail doesn't
+    // scan.
+    // Entries can go stale if a caller edits a stored *User in place, so
+    // lookups re-check the email before trusting an entry.
+    byEmail map[string]UserID
+    opts    repoOptions
+}
+
+func NewInMemoryRepository(opts ...RepoOption) *InMemoryRepository {
+    r := &InMemoryRepository{
+        users:   make(map[UserID]*User),
+        byEmail: make(map[string]UserID),
+        opts:    newRepoOptions(opts),
+    }
+    r.ids = r.opts.ids
+    if r.ids == nil {
+        r.ids = new(Counter[UserID])
+    }
+    return r
+}
+
+// lock takes the write lock and returns its unlock, for use as
+// defer r.lock()(); it does nothing on the view WithinTx hands to fn.
+func (r *InMemoryRepository) lock() func() {
+    if r.held {
+        return func() {}
+    }
+    r.mu.Lock()
+    return r.mu.Unlock
+}
+
+// rlock is lock for reads.
+func (r *InMemoryRepository) rlock() func() {
+    if r.held {
+        return func() {}
+    }
+    r.mu.RLock()
+    return r.mu.RUnlock
+}
+
+func (r *InMemoryRepository) Save(ctx context.Context, user *User) error {
+    defer r.lock()()
+    return r.save(user)
+}
+
+func (r *InMemoryRepository) save(user *User) error {
+    if user.DeletedAt == nil {
+        if owner, err := r.findByEmail(user.TenantID, user.Email); err == nil && owner.ID != user.ID {
+            return fmt.Errorf("email %q %w", user.Email, ErrEmailTaken)
+        }
+    }
+    if old, ok := r.users[user.ID]; ok && old.TenantID != user.TenantID {
+        return fmt.Errorf("user with ID %d %w", user.ID, ErrNotFound)
+    }
+    if user.ID == 0 {
+        user.ID = r.ids.NextID()
+    } else {
+        observeID(r.ids, user.ID)
+    }
+    if old, ok := r.users[user.ID]; ok {
+        if key := r.emailIndexKey(old); r.byEmail[key] == user.ID {
+            delete(r.byEmail, key)
+        }
+        user.CreatedAt = old.CreatedAt
+    } else if user.CreatedAt.IsZero() {
+        user.CreatedAt = time.Now()
+    }
+    r.users[user.ID] = user
+    if user.DeletedAt == nil {
+        r.byEmail[r.emailIndexKey(user)] = user.ID
+    }
+    return nil
+}
+
+func (r *InMemoryRepository) Insert(ctx context.Context, user *User) error {
+    defer r.lock()()
+    if _, exists := r.users[user.ID]; exists {
+        return fmt.Errorf("user with ID %d %w", user.ID, ErrAlreadyExists)
+    }
+    return r.save(user)
+}
+
+// FindByEmail looks in the tenant from ctx (see TenantScope).
+func (r *InMemoryRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+    defer r.rlock()()
+    tenant, all := TenantScope(ctx)
+    if !all {
+        return r.findByEmail(tenant, email)
+    }
+    // Emails are only unique per tenant; return the first owner, as the
+    // SQL backends do.
+    var found *User
+    for _, user := range r.users {
+        if user.DeletedAt == nil && r.opts.emailKey(user.Email) == r.opts.emailKey(email) && (found == nil || user.ID < found.ID) {
+            found = user
+        }
+    }
+    if found == nil {
+        return nil, fmt.Errorf("user with email %q %w", email, ErrNotFound)
+    }
+    return found, nil
+}
+
+func (r *InMemoryRepository) findByEmail(tenant TenantID, email string) (*User, error) {
+    key := r.emailIndexKey(&User{TenantID: tenant, Email: email})
+    if id, ok := r.byEmail[key]; ok {
+        if user, ok := r.users[id]; ok && r.emailIndexKey(user) == key && user.DeletedAt == nil {
+            return user, nil
+        }
+    }
+    return nil, fmt.Errorf("user with email %q %w", email, ErrNotFound)
+}
+
+// emailIndexKey scopes the email key by tenant, since addresses only have
+// to be unique within one.
+func (r *InMemoryRepository) emailIndexKey(user *User) string {
+    return string(user.TenantID) + "\x00" + r.opts.emailKey(user.Email)
+}
+
+// Reindex rebuilds the email index.
+func (r *InMemoryRepository) Reindex(ctx context.Context) error {
+    defer r.lock()()
+    r.reindex()
+    return nil
+}
+
+// reindex rebuilds byEmail from scratch. It refills the map rather than
+// replacing it, as the view WithinTx hands to fn shares it.
+func (r *InMemoryRepository) reindex() {
+    clear(r.byEmail)
+    for id, user := range r.users {
+        if user.DeletedAt == nil {
+            r.byEmail[r.emailIndexKey(user)] = id
+        }
+    }
+}
+
+func (r *InMemoryRepository) FindByID(ctx context.Context, id UserID) (*User, error) {
+    defer r.rlock()()
+    user, exists := r.users[id]
+    if !exists || user.DeletedAt != nil {
+        return nil, fmt.Errorf("user with ID %d %w", id, ErrNotFound)
+    }
+    return user, nil
+}
+
+func (r *InMemoryRepository) FindAll(ctx context.Context, order SortSpec) ([]*User, error) {
+    defer r.rlock()()
+    return r.findAll(order)
+}
+
+func (r *InMemoryRepository) findAll(order SortSpec) ([]*User, error) {
+    if err := order.validate(); err != nil {
+        return nil, err
+    }
+    users := make([]*User, 0, len(r.users))
+    for _, user := range r.users {
+        if user.DeletedAt == nil {
+            users = append(users, user)
+        }
+    }
+    sortUsers(users, order)
+    return users, nil
+}
+
+// FindAllIter collects the live users under the read lock before
+// yielding any, so a caller that writes while iterating doesn't deadlock.
+func (r *InMemoryRepository) FindAllIter(ctx context.Context) iter.Seq2[*User, error] {
+    return func(yield func(*User, error) bool) {
+        unlock := r.rlock()
+        users := make([]*User, 0, len(r.users))
+        for _, user := range r.users {
+            if user.DeletedAt == nil {
+                users = append(users, user)
+            }
+        }
+        unlock()
+        sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+        for _, user := range users {
+            if err := ctx.Err(); err != nil {
+                yield(nil, err)
+                return
+            }
+            if !yield(user, nil) {
+                return
+            }
+        }
+    }
+}
+
+func (r *InMemoryRepository) FindPage(ctx context.Context, page PageRequest) (*Page, error) {
+    page, err := page.normalize()
+    if err != nil {
+        return nil, err
+    }
+    defer r.rlock()()
+    users, err := r.findAll(page.Sort)
+    if err != nil {
+        return nil, err
+    }
+    if page.TenantID != nil {
+        users = slices.DeleteFunc(users, func(u *User) bool { return u.TenantID != *page.TenantID })
+    }
+    start := min(page.Offset, len(users))
+    end := min(start+page.Limit, len(users))
+    return &Page{Users: users[start:end], Total: len(users), Offset: page.Offset, Limit: page.Limit}, nil
+}
+
+// Delete and Restore replace the stored user with a modified copy rather
+// than mutating it, so callers holding the old pointer don't see it change.
+func (r *InMemoryRepository) Delete(ctx context.Context, id UserID) error {
+    defer r.lock()()
+    return r.delete(id)
+}
+
+func (r *InMemoryRepository) delete(id UserID) error {
+    user, exists := r.users[id]
+    if !exists || user.DeletedAt != nil {
+        return fmt.Errorf("user with ID %d %w", id, ErrNotFound)
+    }
+    deleted := *user
+    now := time.Now()
+    deleted.DeletedAt = &now
+    r.users[id] = &deleted
+    if key := r.emailIndexKey(user); r.byEmail[key] == id {
+        delete(r.byEmail, key)
+    }
+    return nil
+}
+
+// Restore fails with ErrEmailTaken if the address was reused while the user
+// was deleted.
+func (r *InMemoryRepository) Restore(ctx context.Context, id UserID) error {
+    defer r.lock()()
+    user, exists := r.users[id]
+    if !exists {
+        return fmt.Errorf("user with ID %d %w", id, ErrNotFound)
+    }
+    if user.DeletedAt == nil {
+        return nil
+    }
+    if _, err := r.findByEmail(user.TenantID, user.Email); err == nil {
+        return fmt.Errorf("email %q %w", user.Email, ErrEmailTaken)
+    }
+    restored := *user
+    restored.DeletedAt = nil
+    r.users[id] = &restored
+    r.byEmail[r.emailIndexKey(&restored)] = id
+    return nil
+}
+
+func (r *InMemoryRepository) PurgeDeleted(ctx context.Context, olderThan time.Duration) (int, error) {
+    defer r.lock()()
+    cutoff := time.Now().Add(-olderThan)
+    purged := 0
+    for id, user := range r.users {
+        if user.DeletedAt != nil && !user.DeletedAt.After(cutoff) {
+            delete(r.users, id)
+            purged++
+        }
+    }
+    return purged, nil
+}
+
+// WithinTx gives the in-memory repository all-or-nothing semantics by
+// restoring the previous users if fn fails. fn runs under the write lock,
+// so other callers wait for it; it must use the repository it is given
+// rather than r. IDs handed out inside a failed fn are not reused, as
+// with a database sequence.
+func (r *InMemoryRepository) WithinTx(ctx context.Context, fn func(UserRepository) error) error {
+    defer r.lock()()
+    // Deep copies, since fn may change users it read before saving them.
+    users := make(map[UserID]*User, len(r.users))
+    for id, user := range r.users {
+        users[id] = user.clone()
+    }
+
+    tx := r
+    if !r.held {
+        tx = &InMemoryRepository{held: true, users: r.users, ids: r.ids, byEmail: r.byEmail, opts: r.opts}
+    }
+    if err := fn(tx); err != nil {
+        clear(r.users)
+        maps.Copy(r.users, users)
+        r.reindex()
+        return err
+    }
+    return nil
+}
+
+func (r *InMemoryRepository) SaveAll(ctx context.Context, users []*User) error {
+    defer r.lock()()
+    var failures []BulkFailure
+    for i, user := range users {
+        if err := r.save(user); err != nil {
+            failures = append(failures, BulkFailure{Index: i, ID: user.ID, Err: err})
+        }
+    }
+    return bulkError(len(users), failures)
+}
+
+func (r *InMemoryRepository) DeleteAll(ctx context.Context, ids []UserID) error {
+    defer r.lock()()
+    var failures []BulkFailure
+    for i, id := range ids {
+        if err := r.delete(id); err != nil {
+            failures = append(failures, BulkFailure{Index: i, ID: id, Err: err})
+        }
+    }
+    return bulkError(len(ids), failures)
+}
+
+func (r *InMemoryRepository) FindWhere(ctx context.Context, filter UserFilter) ([]*User, error) {
+    defer r.rlock()()
+    users := []*User{}
+    for _, user := range r.users {
+        if filter.Matches(user) {
+            users = append(users, user)
+        }
+    }
+    sortUsers(users, SortSpec{})
+    return users, nil
+}
+
+// inMemoryState is the serialized form of an InMemoryRepository, used by
+// both snapshots and file persistence.
+type inMemoryState struct {
+    NextID UserID  `json:"next_id"` // 0 unless counting
+    Users  []*User `json:"users"`
+}
+
+// Snapshot captures every user, including soft-deleted ones, as JSON. The
+// bytes share nothing with the repository, so later writes don't leak into
+// a checkpoint taken by a test or tool.
+func (r *InMemoryRepository) Snapshot() ([]byte, error) {
+    defer r.rlock()()
+    state := inMemoryState{Users: make([]*User, 0, len(r.users))}
+    if c, ok := r.ids.(*Counter[UserID]); ok {
+        state.NextID = c.Last() + 1
+    }
+    for _, user := range r.users {
+        state.Users = append(state.Users, user)
+    }
+    sort.Slice(state.Users, func(i, j int) bool { return state.Users[i].ID < state.Users[j].ID })
+    return json.MarshalIndent(state, "", "  ")
+}
+
+// RestoreSnapshot replaces the repository contents with a Snapshot. (Restore
+// is taken: it undeletes a single user.)
+func (r *InMemoryRepository) RestoreSnapshot(data []byte) error {
+    defer r.lock()()
+    return r.restoreSnapshot(data)
+}
+
+func (r *InMemoryRepository) restoreSnapshot(data []byte) error {
+    var state inMemoryState
+    if err := json.Unmarshal(data, &state); err != nil {
+        return fmt.Errorf("restore snapshot: %w", err)
+    }
+
+    clear(r.users)
+    observeID(r.ids, state.NextID-1)
+    for _, user := range state.Users {
+        r.users[user.ID] = user
+        observeID(r.ids, user.ID)
+    }
+    r.reindex()
+    return nil
+}
+
+// Persist writes a snapshot to path atomically: the JSON goes to a temp file
+// in the same directory which is then renamed over path, so a crash never
+// leaves a half-written file behind.
+func (r *InMemoryRepository) Persist(path string) error {
+    data, err := r.Snapshot()
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic replaces path with data through a temp file and rename.
+func writeFileAtomic(path string, data []byte) error {
+    tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name()) // no-op once the rename succeeds
+
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
+
+// Load replaces the repository contents with the users stored at path.
+// A missing file is not an error: it just means nothing was persisted yet.
+func (r *InMemoryRepository) Load(path string) error {
+    data, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    defer r.lock()()
+    if err := r.restoreSnapshot(data); err != nil {
+        return fmt.Errorf("load %s: %w", path, err)
+    }
+    // Files saved before AnonymizedAt existed only mark anonymized users
+    // by their email; backfill them as migration 18 does for SQL.
+    now := time.Now()
+    for _, user := range r.users {
+        if user.AnonymizedAt == nil && strings.HasSuffix(user.Email, "@"+AnonymizedEmailDomain) {
+            user.AnonymizedAt = &now
+        }
+    }
+    return nil
+}
+
+// Generic in-memory repository
+//
+// MemoryRepository stores any Entity type in a map, for entities that don't
+// need the user-specific indexes of InMemoryRepository. It is safe for
+// concurrent use. newID assigns IDs to entities saved with a zero ID; when
+// it is nil, zero IDs are rejected.
+type MemoryRepository[ID comparable, T Entity[ID]] struct {
+    mu    sync.RWMutex
+    items map[ID]T
+    newID func() ID
+}
+
+func NewMemoryRepository[ID comparable, T Entity[ID]](newID func() ID) *MemoryRepository[ID, T] {
+    return &MemoryRepository[ID, T]{items: make(map[ID]T), newID: newID}
+}
+
+func (r *MemoryRepository[ID, T]) Save(ctx context.Context, entity T) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.save(entity)
+}
+
+func (r *MemoryRepository[ID, T]) Insert(ctx context.Context, entity T) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if _, exists := r.items[entity.EntityID()]; exists {
+        return fmt.Errorf("%T with ID %v %w", entity, entity.EntityID(), ErrAlreadyExists)
+    }
+    return r.save(entity)
+}
+
+func (r *MemoryRepository[ID, T]) save(entity T) error {
+    var zero ID
+    if entity.EntityID() == zero {
+        if r.newID == nil {
+            return fmt.Errorf("%T has no ID and no ID generator is configured", entity)
+        }
+        entity.SetEntityID(r.newID())
+    }
+    r.items[entity.EntityID()] = entity
+    return nil
+}
+
+func (r *MemoryRepository[ID, T]) FindByID(ctx context.Context, id ID) (T, error) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    entity, exists := r.items[id]
+    if !exists {
+        return entity, fmt.Errorf("%T with ID %v %w", entity, id, ErrNotFound)
+    }
+    return entity, nil
+}
+
+func (r *MemoryRepository[ID, T]) Delete(ctx context.Context, id ID) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if _, exists := r.items[id]; !exists {
+        var zero T
+        return fmt.Errorf("%T with ID %v %w", zero, id, ErrNotFound)
+    }
+    delete(r.items, id)
+    return nil
+}
+
+// FindAll returns every entity in no particular order.
+func (r *MemoryRepository[ID, T]) FindAll(ctx context.Context) ([]T, error) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    items := make([]T, 0, len(r.items))
+    for _, entity := range r.items {
+        items = append(items, entity)
+    }
+    return items, nil
+}
+
+// ID generation
+//
+// Repositories take IDs for new entities from an IDGenerator. Counter is
+// the default and only unique within one process; Snowflake and UUIDv7
+// stay unique across instances without coordinating, and sort roughly by
+// creation time. UserID is numeric, so users take a Counter or a
+// Snowflake (see WithIDGenerator); UUIDv7 suits entities keyed by UUID,
+// through NewMemoryRepository(gen.NextID). Each generator is safe for
+// concurrent use on its own; that says nothing about the repository using
+// it, which documents its own guarantees.
+
+type IDGenerator[ID any] interface {
+    NextID() ID
+}
+
+// idObserver is implemented by generators that must skip IDs assigned
+// some other way, like Counter.
+type idObserver[ID any] interface {
+    Observe(id ID)
+}
+
+// observeID tells gen that id is taken, if gen cares.
+func observeID[ID any](gen IDGenerator[ID], id ID) {
+    if o, ok := gen.(idObserver[ID]); ok {
+        o.Observe(id)
+    }
+}
+
+// Counter counts up from 1.
+type Counter[ID ~int | ~int64] struct {
+    n atomic.Int64
+}
+
+func (c *Counter[ID]) NextID() ID {
+    return ID(c.n.Add(1))
+}
+
+// Observe makes sure the counter is past id, so an entity saved with an
+// explicit ID, or restored from a snapshot, is never given away again.
+func (c *Counter[ID]) Observe(id ID) {
+    for {
+        n := c.n.Load()
+        if int64(id) <= n || c.n.CompareAndSwap(n, int64(id)) {
+            return
+        }
+    }
+}
+
+// Last returns the highest ID handed out or observed.
+func (c *Counter[ID]) Last() ID {
+    return ID(c.n.Load())
+}
+
+// Sequence returns an ID generator counting up from 1.
+func Sequence[ID ~int | ~int64]() func() ID {
+    return new(Counter[ID]).NextID
+}
+
+// Snowflake packs milliseconds since SnowflakeEpoch (41 bits, enough for
+// 69 years), a node number (10 bits) and a sequence within the
+// millisecond (12 bits) into a positive int64. Instances given distinct
+// nodes never collide. One generator's IDs strictly increase: if the
+// clock steps back, or a millisecond's 4096 IDs run out, it carries on
+// from the last millisecond it used instead of waiting.
+//
+// Snowflake IDs pass 2^53 25 days after SnowflakeEpoch, so they
+// can't be represented exactly as JavaScript numbers. The API still
+// writes them as JSON numbers; JavaScript clients must parse them with a
+// BigInt-aware JSON parser or they will round IDs and address the wrong
+// user.
+type Snowflake[ID ~int | ~int64] struct {
+    node int64
+
+    mu   sync.Mutex
+    last int64 // milliseconds since SnowflakeEpoch
+    seq  int64
+}
+
+var SnowflakeEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const MaxSnowflakeNode = 1<<10 - 1
+
+func NewSnowflake[ID ~int | ~int64](node int) (*Snowflake[ID], error) {
+    if node < 0 || node > MaxSnowflakeNode {
+        return nil, fmt.Errorf("snowflake node %d out of range 0-%d", node, MaxSnowflakeNode)
+    }
+    return &Snowflake[ID]{node: int64(node)}, nil
+}
+
+func (s *Snowflake[ID]) NextID() ID {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if now := time.Since(SnowflakeEpoch).Milliseconds(); now > s.last {
+        s.last, s.seq = now, 0
+    } else if s.seq++; s.seq > 1<<12-1 {
+        s.last, s.seq = s.last+1, 0
+    }
+    return ID(s.last<<22 | s.node<<12 | s.seq)
+}
+
+// UUID is an RFC 9562 UUID, written in the usual hyphenated hex form.
+type UUID [16]byte
+
+func (u UUID) String() string {
+    h := hex.EncodeToString(u[:])
+    return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+func ParseUUID(s string) (UUID, error) {
+    var u UUID
+    h := strings.ReplaceAll(s, "-", "")
+    if len(s) != 36 || len(h) != 32 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+        return u, fmt.Errorf("invalid UUID %q", s)
+    }
+    if _, err := hex.Decode(u[:], []byte(h)); err != nil {
+        return u, fmt.Errorf("invalid UUID %q", s)
+    }
+    return u, nil
+}
+
+func (u UUID) MarshalText() ([]byte, error) {
+    return []byte(u.String()), nil
+}
+
+func (u *UUID) UnmarshalText(text []byte) error {
+    v, err := ParseUUID(string(text))
+    if err == nil {
+        *u = v
+    }
+    return err
+}
+
+// UUIDv7 generates version 7 UUIDs: a 48-bit Unix millisecond timestamp
+// followed by random bits. One generator's UUIDs strictly increase, as
+// the 12 bits after the timestamp count within the millisecond (RFC 9562
+// method 1), starting from a random point in their lower half.
+type UUIDv7 struct {
+    mu   sync.Mutex
+    last int64 // Unix milliseconds
+    seq  int
+}
+
+func NewUUIDv7() *UUIDv7 {
+    return &UUIDv7{}
+}
+
+func (g *UUIDv7) NextID() UUID {
+    g.mu.Lock()
+    if now := time.Now().UnixMilli(); now > g.last {
+        g.last, g.seq = now, mrand.IntN(1<<11)
+    } else if g.seq++; g.seq > 1<<12-1 {
+        g.last, g.seq = g.last+1, 0
+    }
+    ms, seq := g.last, g.seq
+    g.mu.Unlock()
+
+    var u UUID
+    rand.Read(u[8:])
+    for i := range 6 {
+        u[i] = byte(ms >> (40 - 8*i))
+    }
+    u[6] = 0x70 | byte(seq>>8) // version 7
+    u[7] = byte(seq)
+    u[8] = 0x80 | u[8]&0x3f // RFC 9562 variant
+    return u
+}
+
+// SQL repositories
+//
+// PostgresRepository is a database/sql implementation (sqlRepository)
+// with the schema and placeholder style kept apart in a sqlDialect. The
+// driver is not imported here: open the *sql.DB with whichever driver the
+// binary links (e.g. sql.Open("pgx", dsn)) and hand it to
+// NewPostgresRepository.
+var _ UserRepository = (*PostgresRepository)(nil)
+
+type PostgresRepository struct {
+    *sqlRepository
+}
+
+// PoolConfig mirrors the database/sql connection pool knobs.
+// Zero values leave the database/sql defaults untouched.
+type PoolConfig struct {
+    MaxOpenConns    int
+    MaxIdleConns    int
+    ConnMaxLifetime time.Duration
+    ConnMaxIdleTime time.Duration
+}
+
+func (c PoolConfig) apply(db *sql.DB) {
+    if c.MaxOpenConns > 0 {
+        db.SetMaxOpenConns(c.MaxOpenConns)
+    }
+    if c.MaxIdleConns > 0 {
+        db.SetMaxIdleConns(c.MaxIdleConns)
+    }
+    if c.ConnMaxLifetime > 0 {
+        db.SetConnMaxLifetime(c.ConnMaxLifetime)
+    }
+    if c.ConnMaxIdleTime > 0 {
+        db.SetConnMaxIdleTime(c.ConnMaxIdleTime)
+    }
+}
+
+// Migration is one versioned schema change. Applied versions are recorded in
+// schema_migrations so each migration runs exactly once per database.
+type Migration struct {
+    Version int
+    Name    string
+    SQL     string
+}
+
+// sqlDialect captures the differences between SQL backends.
+type sqlDialect struct {
+    name       string
+    migrations []Migration
+    // numbered placeholders ($1, $2, ...) instead of ?
+    numbered bool
+    // contains formats a case-sensitive substring test of a column
+    // against one ? argument.
+    contains string
+    // advance formats, for a table, a statement moving its id sequence
+    // past an explicitly written ID, given twice; see advanceSequence.
+    advance string
+}
+
+var postgresDialect = sqlDialect{
+    name:     "postgres",
+    numbered: true,
+    contains: "strpos(%s, ?) > 0",
+    advance:  "SELECT setval(seq, ?) FROM (SELECT pg_get_serial_sequence('%s', 'id')::regclass AS seq) s WHERE ? > COALESCE(pg_sequence_last_value(seq), 0)",
+    migrations: []Migration{
+        {
+            Version: 1,
+            Name:    "create_users",
+            SQL: `CREATE TABLE IF NOT EXISTS users (
+    id          BIGSERIAL PRIMARY KEY,
+    name        TEXT        NOT NULL,
+    email       TEXT        NOT NULL,
+    age         INTEGER,
+    status      TEXT        NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL,
+    preferences JSONB       NOT NULL DEFAULT '{}'
+)`,
+        },
+        {
+            Version: 2,
+            Name:    "index_users_email",
+            SQL:     `CREATE INDEX IF NOT EXISTS users_email_idx ON users (email)`,
+        },
+        {
+            Version: 3,
+            Name:    "add_users_deleted_at",
+            SQL:     `ALTER TABLE users ADD COLUMN deleted_at TIMESTAMPTZ`,
+        },
+        {
+            Version: 4,
+            Name:    "unique_live_users_email",
+            SQL:     `CREATE UNIQUE INDEX IF NOT EXISTS users_email_live_key ON users (email) WHERE deleted_at IS NULL`,
+        },
+        {
+            Version: 5,
+            Name:    "add_users_status_changed_at",
+            SQL:     `ALTER TABLE users ADD COLUMN status_changed_at TIMESTAMPTZ`,
+        },
+        {
+            Version: 6,
+            Name:    "add_users_role",
+            SQL:     `ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'member'`,
+        },
+        {
+            Version: 7,
+            Name:    "add_users_tags",
+            SQL:     `ALTER TABLE users ADD COLUMN tags TEXT NOT NULL DEFAULT ''`,
+        },
+        {
+            Version: 8,
+            Name:    "add_users_avatar_url",
+            SQL:     `ALTER TABLE users ADD COLUMN avatar_url TEXT NOT NULL DEFAULT ''`,
+        },
+        {
+            Version: 9,
+            Name:    "add_users_phone",
+            SQL:     `ALTER TABLE users ADD COLUMN phone JSONB`,
+        },
+        {
+            Version: 10,
+            Name:    "add_users_address",
+            SQL:     `ALTER TABLE users ADD COLUMN address JSONB`,
+        },
+        {
+            Version: 11,
+            Name:    "add_users_metadata",
+            SQL:     `ALTER TABLE users ADD COLUMN metadata TEXT NOT NULL DEFAULT '{}'`,
+        },
+        {
+            Version: 12,
+            Name:    "add_users_tenant_id",
+            SQL:     `ALTER TABLE users ADD COLUMN tenant_id TEXT NOT NULL DEFAULT ''`,
+        },
+        {
+            Version: 13,
+            Name:    "drop_global_email_key",
+            SQL:     `DROP INDEX IF EXISTS users_email_live_key`,
+        },
+        {
+            Version: 14,
+            Name:    "unique_live_users_tenant_email",
+            SQL:     `CREATE UNIQUE INDEX IF NOT EXISTS users_tenant_email_live_key ON users (tenant_id, email) WHERE deleted_at IS NULL`,
+        },
+        {
+            Version: 15,
+            Name:    "create_jobs",
+            SQL: `CREATE TABLE IF NOT EXISTS jobs (
+    id           BIGSERIAL PRIMARY KEY,
+    type         TEXT        NOT NULL,
+    payload      TEXT        NOT NULL,
+    status       TEXT        NOT NULL,
+    attempts     INTEGER     NOT NULL DEFAULT 0,
+    max_attempts INTEGER     NOT NULL,
+    run_at       TIMESTAMPTZ NOT NULL,
+    last_error   TEXT        NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL,
+    updated_at   TIMESTAMPTZ NOT NULL
+)`,
+        },
+        {
+            Version: 16,
+            Name:    "index_jobs_due",
+            SQL:     `CREATE INDEX IF NOT EXISTS jobs_status_run_at_idx ON jobs (status, run_at)`,
+        },
+        {
+            Version: 17,
+            Name:    "add_users_anonymized_at",
+            SQL:     `ALTER TABLE users ADD COLUMN anonymized_at TIMESTAMPTZ`,
+        },
+        {
+            Version: 18,
+            Name:    "backfill_users_anonymized_at",
+            SQL:     `UPDATE users SET anonymized_at = CURRENT_TIMESTAMP WHERE email LIKE '%@anonymized.invalid'`,
+        },
+    },
+}
+
+// advanceSequence makes sure table's id sequence won't hand out id, after
+// a row was written with it explicitly, as restores and imports do: a
+// BIGSERIAL sequence ignores explicit IDs. The sequence is looked up by
+// pg_get_serial_sequence, so renamed sequences, schema-qualified tables
+// and identity columns work too, and it is never moved backwards.
+func (d sqlDialect) advanceSequence(ctx context.Context, conn sqlConn, table string, id int64) error {
+    if d.advance == "" {
+        return nil
+    }
+    _, err := conn.ExecContext(ctx, d.rebind(fmt.Sprintf(d.advance, table)), id, id)
+    return err
+}
+
+// rebind rewrites ? placeholders for dialects that number them.
+func (d sqlDialect) rebind(query string) string {
+    if !d.numbered {
+        return query
+    }
+    var b strings.Builder
+    n := 0
+    for _, c := range query {
+        if c == '?' {
+            n++
+            b.WriteString("$" + strconv.Itoa(n))
+            continue
+        }
+        b.WriteRune(c)
+    }
+    return b.String()
+}
+
+// userDataColumns lists every users column except id, in the order
+// userArgs produces values and scanUser reads them after id.
+var userDataColumns = []string{"name", "email", "age", "status", "created_at", "preferences", "deleted_at", "status_changed_at", "anonymized_at", "role", "tags", "avatar_url", "phone", "address", "metadata", "tenant_id"}
+
+var userColumns = "id, " + strings.Join(userDataColumns, ", ")
+
+// placeholders returns n comma-separated ? markers.
+func placeholders(n int) string {
+    return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// encodeTags stores tags as ",a,b," so one tag can be matched with a plain
+// LIKE '%,tag,%'; normalized tags never contain commas.
+func encodeTags(tags []string) string {
+    if len(tags) == 0 {
+        return ""
+    }
+    return "," + strings.Join(tags, ",") + ","
+}
+
+// encodeMetadata stores metadata as canonical JSON text (keys sorted, no
+// spaces), so one pair can be matched with a substring test on its
+// metadataPair fragment.
+func encodeMetadata(md map[string]string) (string, error) {
+    if len(md) == 0 {
+        return "{}", nil
+    }
+    b, err := json.Marshal(md)
+    return string(b), err
+}
+
+// metadataPair renders `"key":"value"` as it appears in encodeMetadata's
+// output. Quotes inside keys and values are escaped there, so the
+// fragment can't match across pairs.
+func metadataPair(key, value string) string {
+    k, _ := json.Marshal(key)
+    v, _ := json.Marshal(value)
+    return string(k) + ":" + string(v)
+}
+
+func decodeTags(s string) []string {
+    s = strings.Trim(s, ",")
+    if s == "" {
+        return nil
+    }
+    return strings.Split(s, ",")
+}
+
+// nullableJSON encodes v for a nullable JSON column, storing NULL for nil.
+func nullableJSON[T any](v *T) (any, error) {
+    if v == nil {
+        return nil, nil
+    }
+    return json.Marshal(v)
+}
+
+// userArgs returns the values for userDataColumns.
+func userArgs(user *User, createdAt time.Time) ([]any, error) {
+    prefs, err := json.Marshal(user.Preferences)
+    if err != nil {
+        return nil, err
+    }
+    phone, err := nullableJSON(user.Phone)
+    if err != nil {
+        return nil, err
+    }
+    address, err := nullableJSON(user.Address)
+    if err != nil {
+        return nil, err
+    }
+    metadata, err := encodeMetadata(user.Metadata)
+    if err != nil {
+        return nil, err
+    }
+    return []any{user.Name, user.Email, user.Age, user.Status, createdAt, prefs, user.DeletedAt, user.StatusChangedAt, user.AnonymizedAt, user.Role, encodeTags(user.Tags), user.AvatarURL, phone, address, metadata, user.TenantID}, nil
+}
+
+// liveUsers is the base predicate for reads that hide soft-deleted users.
+const liveUsers = ` WHERE deleted_at IS NULL`
+
+func NewPostgresRepository(db *sql.DB, pool PoolConfig, opts ...RepoOption) (*PostgresRepository, error) {
+    r, err := newSQLRepository(db, postgresDialect, pool, opts)
+    if err != nil {
+        return nil, err
+    }
+    return &PostgresRepository{r}, nil
+}
+
+type sqlRepository struct {
+    db       *sql.DB
+    dialect  sqlDialect
+    insert   *sql.Stmt
+    insertID *sql.Stmt
+    upsert   *sql.Stmt
+    findByID *sql.Stmt
+    delete   *sql.Stmt
+    // tx is set on the repository handed to a WithinTx callback.
+    tx   *sql.Tx
+    opts repoOptions
+    // seqPast is the highest explicit ID the users sequence is known to
+    // be past, to skip advanceSequence on ordinary updates.
+    seqPast *atomic.Int64
+}
+
+// sqlConn is the query surface shared by *sql.DB and *sql.Tx.
+type sqlConn interface {
+    ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+    QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+    QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (r *sqlRepository) conn() sqlConn {
+    if r.tx != nil {
+        return r.tx
+    }
+    return r.db
+}
+
+// stmt binds a prepared statement to the current transaction, if any.
+func (r *sqlRepository) stmt(ctx context.Context, stmt *sql.Stmt) *sql.Stmt {
+    if r.tx != nil {
+        return r.tx.StmtContext(ctx, stmt)
+    }
+    return stmt
+}
+
+// WithinTx runs fn against a repository bound to one database transaction,
+// committing if fn returns nil and rolling back otherwise. Nested calls join
+// the outer transaction.
+func (r *sqlRepository) WithinTx(ctx context.Context, fn func(UserRepository) error) error {
+    if r.tx != nil {
+        return fn(r)
+    }
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    txRepo := *r
+    txRepo.tx = tx
+    if err := fn(&txRepo); err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit()
+}
+
+func newSQLRepository(db *sql.DB, dialect sqlDialect, pool PoolConfig, opts []RepoOption) (*sqlRepository, error) {
+    pool.apply(db)
+
+    if err := migrate(db, dialect.migrations); err != nil {
+        return nil, fmt.Errorf("%s: %w", dialect.name, err)
+    }
+
+    r := &sqlRepository{db: db, dialect: dialect, opts: newRepoOptions(opts), seqPast: new(atomic.Int64)}
+    var updates []string
+    for _, c := range userDataColumns {
+        if c != "created_at" {
+            updates = append(updates, c+" = excluded."+c)
+        }
+    }
+    stmts := []struct {
+        dst   **sql.Stmt
+        query string
+    }{
+        {&r.insert, `INSERT INTO users (` + strings.Join(userDataColumns, ", ") + `)
+VALUES (` + placeholders(len(userDataColumns)) + `) RETURNING id`},
+        {&r.insertID, `INSERT INTO users (` + userColumns + `)
+VALUES (` + placeholders(len(userDataColumns)+1) + `)`},
+        {&r.upsert, `INSERT INTO users (` + userColumns + `)
+VALUES (` + placeholders(len(userDataColumns)+1) + `)
+ON CONFLICT (id) DO UPDATE SET ` + strings.Join(updates, ", ") + `
+WHERE users.tenant_id = excluded.tenant_id
+RETURNING created_at`},
+        {&r.findByID, `SELECT ` + userColumns + ` FROM users WHERE id = ? AND deleted_at IS NULL`},
+        {&r.delete, `UPDATE users SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL`},
+    }
+    for _, s := range stmts {
+        stmt, err := db.Prepare(dialect.rebind(s.query))
+        if err != nil {
+            r.Close()
+            return nil, fmt.Errorf("%s: prepare statement: %w", dialect.name, err)
+        }
+        *s.dst = stmt
+    }
+    return r, nil
+}
+
+// migrate applies every migration newer than the recorded schema version.
+func migrate(db *sql.DB, migrations []Migration) error {
+    if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+    version    INTEGER PRIMARY KEY,
+    name       TEXT NOT NULL,
+    applied_at TIMESTAMP NOT NULL
+)`); err != nil {
+        return fmt.Errorf("create schema_migrations: %w", err)
+    }
+
+    var current int
+    if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+        return fmt.Errorf("read schema version: %w", err)
+    }
+
+    pending := make([]Migration, 0, len(migrations))
+    for _, m := range migrations {
+        if m.Version > current {
+            pending = append(pending, m)
+        }
+    }
+    sort.Slice(pending, func(i, j int) bool { return pending[i].Version < pending[j].Version })
+
+    for _, m := range pending {
+        tx, err := db.Begin()
+        if err != nil {
+            return err
+        }
+        if _, err := tx.Exec(m.SQL); err != nil {
+            tx.Rollback()
+            return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+        }
+        // Literal rather than placeholders so the same statement works on every dialect.
+        record := fmt.Sprintf(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (%d, '%s', CURRENT_TIMESTAMP)`,
+            m.Version, strings.ReplaceAll(m.Name, "'", "''"))
+        if _, err := tx.Exec(record); err != nil {
+            tx.Rollback()
+            return fmt.Errorf("record migration %d: %w", m.Version, err)
+        }
+        if err := tx.Commit(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Close releases the prepared statements. The *sql.DB belongs to the caller.
+func (r *sqlRepository) Close() error {
+    for _, stmt := range []*sql.Stmt{r.insert, r.insertID, r.upsert, r.findByID, r.delete} {
+        if stmt != nil {
+            stmt.Close()
+        }
+    }
+    return nil
+}
+
+// Save checks email uniqueness up front for a clean ErrEmailTaken; the
+// partial unique index on email catches writers that race past the check.
+func (r *sqlRepository) Save(ctx context.Context, user *User) error {
+    return r.save(ctx, user, false)
+}
+
+func (r *sqlRepository) Insert(ctx context.Context, user *User) error {
+    return r.save(ctx, user, true)
+}
+
+func (r *sqlRepository) save(ctx context.Context, user *User, insertOnly bool) error {
+    if user.DeletedAt == nil {
+        if owner, err := r.findByEmail(ctx, user.TenantID, false, user.Email); err == nil && owner.ID != user.ID {
+            return fmt.Errorf("email %q %w", user.Email, ErrEmailTaken)
+        } else if err != nil && !errors.Is(err, ErrNotFound) {
+            return err
+        }
+    }
+
+    createdAt := user.CreatedAt
+    if createdAt.IsZero() {
+        createdAt = time.Now()
+    }
+    args, err := userArgs(user, createdAt)
+    if err != nil {
+        return err
+    }
+
+    explicit := user.ID != 0
+    switch {
+    case user.ID == 0 && r.opts.ids != nil:
+        id := r.opts.ids.NextID()
+        if _, err = r.stmt(ctx, r.insertID).ExecContext(ctx, append([]any{id}, args...)...); err == nil {
+            user.ID = id
+        }
+    case user.ID == 0:
+        var id int64
+        err = r.stmt(ctx, r.insert).QueryRowContext(ctx, args...).Scan(&id)
+        if err == nil {
+            user.ID = UserID(id)
+        }
+    case insertOnly:
+        _, err = r.stmt(ctx, r.insertID).ExecContext(ctx, append([]any{user.ID}, args...)...)
+    default:
+        // RETURNING hands back the stored created_at when the row existed,
+        // and nothing when the row belongs to another tenant.
+        err = r.stmt(ctx, r.upsert).QueryRowContext(ctx, append([]any{user.ID}, args...)...).Scan(&createdAt)
+        if errors.Is(err, sql.ErrNoRows) {
+            return fmt.Errorf("user with ID %d %w", user.ID, ErrNotFound)
+        }
+    }
+    if isUniqueViolation(err) {
+        if strings.Contains(err.Error(), "email") {
+            return fmt.Errorf("email %q %w", user.Email, ErrEmailTaken)
+        }
+        return fmt.Errorf("user with ID %d %w", user.ID, ErrAlreadyExists)
+    }
+    if err != nil {
+        return fmt.Errorf("save user %d: %w", user.ID, err)
+    }
+    if id := int64(user.ID); explicit && id > r.seqPast.Load() {
+        if err := r.dialect.advanceSequence(ctx, r.conn(), "users", id); err != nil {
+            return fmt.Errorf("save user %d: advance id sequence: %w", user.ID, err)
+        }
+        for {
+            past := r.seqPast.Load()
+            if id <= past || r.seqPast.CompareAndSwap(past, id) {
+                break
+            }
+        }
+    }
+    user.CreatedAt = createdAt
+    return nil
+}
+
+// isUniqueViolation recognizes unique-constraint errors from the Postgres
+// driver by message, since its error types aren't imported here.
+func isUniqueViolation(err error) bool {
+    return err != nil && strings.Contains(err.Error(), "duplicate key value")
+}
+
+// Ping checks that the database is reachable.
+func (r *sqlRepository) Ping(ctx context.Context) error {
+    return r.db.PingContext(ctx)
+}
+
+// Reindex rebuilds the users table's indexes. Postgres locks the table
+// against writes meanwhile.
+func (r *sqlRepository) Reindex(ctx context.Context) error {
+    query := "REINDEX users"
+    if r.dialect.name == "postgres" {
+        query = "REINDEX TABLE users"
+    }
+    _, err := r.conn().ExecContext(ctx, query)
+    return err
+}
+
+func (r *sqlRepository) FindByID(ctx context.Context, id UserID) (*User, error) {
+    user, err := scanUser(r.stmt(ctx, r.findByID).QueryRowContext(ctx, id))
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, fmt.Errorf("user with ID %d %w", id, ErrNotFound)
+    }
+    return user, err
+}
+
+func (r *sqlRepository) FindAll(ctx context.Context, order SortSpec) ([]*User, error) {
+    orderBy, err := order.sqlOrderBy()
+    if err != nil {
+        return nil, err
+    }
+    rows, err := r.conn().QueryContext(ctx, `SELECT `+userColumns+` FROM users`+liveUsers+orderBy)
+    if err != nil {
+        return nil, err
+    }
+    return scanUsers(rows)
+}
+
+func (r *sqlRepository) FindAllIter(ctx context.Context) iter.Seq2[*User, error] {
+    return func(yield func(*User, error) bool) {
+        rows, err := r.conn().QueryContext(ctx, `SELECT `+userColumns+` FROM users`+liveUsers+` ORDER BY id`)
+        if err != nil {
+            yield(nil, err)
+            return
+        }
+        defer rows.Close()
+
+        for rows.Next() {
+            user, err := scanUser(rows)
+            if err != nil {
+                yield(nil, err)
+                return
+            }
+            if !yield(user, nil) {
+                return
+            }
+        }
+        if err := rows.Err(); err != nil {
+            yield(nil, err)
+        }
+    }
+}
+
+func (r *sqlRepository) FindPage(ctx context.Context, page PageRequest) (*Page, error) {
+    page, err := page.normalize()
+    if err != nil {
+        return nil, err
+    }
+    orderBy, _ := page.Sort.sqlOrderBy()
+    where, args := liveUsers, []any{}
+    if page.TenantID != nil {
+        where += ` AND tenant_id = ?`
+        args = append(args, *page.TenantID)
+    }
+
+    var total int
+    if err := r.conn().QueryRowContext(ctx, r.dialect.rebind(`SELECT COUNT(*) FROM users`+where), args...).Scan(&total); err != nil {
+        return nil, err
+    }
+    query := `SELECT ` + userColumns + ` FROM users` + where + orderBy + ` LIMIT ? OFFSET ?`
+    rows, err := r.conn().QueryContext(ctx, r.dialect.rebind(query), append(args, page.Limit, page.Offset)...)
+    if err != nil {
+        return nil, err
+    }
+    users, err := scanUsers(rows)
+    if err != nil {
+        return nil, err
+    }
+    return &Page{Users: users, Total: total, Offset: page.Offset, Limit: page.Limit}, nil
+}
+
+// sqlOrderBy renders the spec as an ORDER BY clause. Field names come from
+// the SortField whitelist, never from callers, so they are safe to inline.
+func (s SortSpec) sqlOrderBy() (string, error) {
+    if err := s.validate(); err != nil {
+        return "", err
+    }
+    dir := " ASC"
+    if s.Desc {
+        dir = " DESC"
+    }
+    switch s.Field {
+    case "", SortByID:
+        return " ORDER BY id" + dir, nil
+    case SortByAge:
+        // Portable NULLS LAST: false sorts before true on every dialect.
+        return " ORDER BY (age IS NULL), age" + dir + ", id" + dir, nil
+    default:
+        return " ORDER BY " + string(s.Field) + dir + ", id" + dir, nil
+    }
+}
+
+// FindWhere translates the filter into a WHERE clause. It is not prepared
+// because the clause changes with the set of fields in use.
+func (r *sqlRepository) FindWhere(ctx context.Context, filter UserFilter) ([]*User, error) {
+    where, args := filter.sqlWhere(r.dialect)
+    query := `SELECT ` + userColumns + ` FROM users` + where + ` ORDER BY id`
+    rows, err := r.conn().QueryContext(ctx, r.dialect.rebind(query), args...)
+    if err != nil {
+        return nil, err
+    }
+    return scanUsers(rows)
+}
+
+// sqlWhere renders the filter as " WHERE ..." with ? placeholders, or "" when
+// the filter is empty.
+func (f UserFilter) sqlWhere(d sqlDialect) (string, []any) {
+    var (
+        conds []string
+        args  []any
+    )
+    add := func(cond string, arg any) {
+        conds = append(conds, cond)
+        args = append(args, arg)
+    }
+    if !f.IncludeDeleted {
+        conds = append(conds, "deleted_at IS NULL")
+    }
+    if f.Status != "" {
+        add("status = ?", f.Status)
+    }
+    if f.MinAge != nil {
+        add("age >= ?", *f.MinAge)
+    }
+    if f.MaxAge != nil {
+        add("age <= ?", *f.MaxAge)
+    }
+    if f.NamePrefix != "" {
+        add(`name LIKE ? ESCAPE '\'`, escapeLike(f.NamePrefix)+"%")
+    }
+    if f.EmailDomain != "" {
+        add(`LOWER(email) LIKE ? ESCAPE '\'`, "%@"+escapeLike(strings.ToLower(f.EmailDomain)))
+    }
+    if !f.CreatedAfter.IsZero() {
+        add("created_at >= ?", f.CreatedAfter)
+    }
+    if !f.CreatedBefore.IsZero() {
+        add("created_at < ?", f.CreatedBefore)
+    }
+    if f.Tag != "" {
+        add(`tags LIKE ? ESCAPE '\'`, "%,"+escapeLike(f.Tag)+",%")
+    }
+    for _, k := range slices.Sorted(maps.Keys(f.Metadata)) {
+        add(fmt.Sprintf(d.contains, "metadata"), metadataPair(k, f.Metadata[k]))
+    }
+    if f.TenantID != nil {
+        add("tenant_id = ?", *f.TenantID)
+    }
+    if len(f.IDs) > 0 {
+        conds = append(conds, "id IN ("+placeholders(len(f.IDs))+")")
+        for _, id := range f.IDs {
+            args = append(args, id)
+        }
+    }
+    if len(conds) == 0 {
+        return "", nil
+    }
+    return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func escapeLike(s string) string {
+    return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func scanUsers(rows *sql.Rows) ([]*User, error) {
+    defer rows.Close()
+
+    users := []*User{}
+    for rows.Next() {
+        user, err := scanUser(rows)
+        if err != nil {
+            return nil, err
+        }
+        users = append(users, user)
+    }
+    return users, rows.Err()
+}
+
+func (r *sqlRepository) Delete(ctx context.Context, id UserID) error {
+    res, err := r.stmt(ctx, r.delete).ExecContext(ctx, time.Now(), id)
+    if err != nil {
+        return err
+    }
+    return requireRow(res, id)
+}
+
+// FindByEmail looks in the tenant from ctx (see TenantScope).
+func (r *sqlRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+    tenant, all := TenantScope(ctx)
+    return r.findByEmail(ctx, tenant, all, email)
+}
+
+func (r *sqlRepository) findByEmail(ctx context.Context, tenant TenantID, allTenants bool, email string) (*User, error) {
+    match := `email = ?`
+    if r.opts.caseInsensitiveEmails {
+        match = `LOWER(email) = LOWER(?)`
+    }
+    args := []any{email}
+    if !allTenants {
+        match += ` AND tenant_id = ?`
+        args = append(args, tenant)
+    }
+    query := `SELECT ` + userColumns + ` FROM users WHERE ` + match + ` AND deleted_at IS NULL ORDER BY id LIMIT 1`
+    user, err := scanUser(r.conn().QueryRowContext(ctx, r.dialect.rebind(query), args...))
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, fmt.Errorf("user with email %q %w", email, ErrNotFound)
+    }
+    return user, err
+}
+
+// Restore fails with ErrEmailTaken if the address was reused while the user
+// was deleted (the partial unique index would reject it anyway).
+func (r *sqlRepository) Restore(ctx context.Context, id UserID) error {
+    var (
+        email  string
+        tenant TenantID
+    )
+    err := r.conn().QueryRowContext(ctx, r.dialect.rebind(`SELECT email, tenant_id FROM users WHERE id = ? AND deleted_at IS NOT NULL`), id).Scan(&email, &tenant)
+    switch {
+    case err == nil:
+        if _, err := r.findByEmail(ctx, tenant, false, email); err == nil {
+            return fmt.Errorf("email %q %w", email, ErrEmailTaken)
+        }
+    case !errors.Is(err, sql.ErrNoRows):
+        return err
+    }
+
+    res, err := r.conn().ExecContext(ctx, r.dialect.rebind(`UPDATE users SET deleted_at = NULL WHERE id = ?`), id)
+    if err != nil {
+        return err
+    }
+    return requireRow(res, id)
+}
+
+func (r *sqlRepository) PurgeDeleted(ctx context.Context, olderThan time.Duration) (int, error) {
+    res, err := r.conn().ExecContext(ctx,
+        r.dialect.rebind(`DELETE FROM users WHERE deleted_at IS NOT NULL AND deleted_at <= ?`),
+        time.Now().Add(-olderThan))
+    if err != nil {
+        return 0, err
+    }
+    n, err := res.RowsAffected()
+    return int(n), err
+}
+
+// requireRow turns "no rows affected" into ErrNotFound.
+func requireRow(res sql.Result, id UserID) error {
+    n, err := res.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return fmt.Errorf("user with ID %d %w", id, ErrNotFound)
+    }
+    return nil
+}
+
+// SaveAll and DeleteAll run in one transaction for speed, with a savepoint
+// around each item so one bad row is rolled back and reported without
+// aborting the rest (Postgres otherwise poisons the whole transaction).
+func (r *sqlRepository) SaveAll(ctx context.Context, users []*User) error {
+    return r.bulk(ctx, len(users), func(tx *sqlRepository, i int) (UserID, error) {
+        err := tx.Save(ctx, users[i])
+        return users[i].ID, err
+    })
+}
+
+func (r *sqlRepository) DeleteAll(ctx context.Context, ids []UserID) error {
+    return r.bulk(ctx, len(ids), func(tx *sqlRepository, i int) (UserID, error) {
+        return ids[i], tx.Delete(ctx, ids[i])
+    })
+}
+
+// bulk runs op for each item against a transaction-bound repository,
+// joining the caller's transaction if there is one.
+func (r *sqlRepository) bulk(ctx context.Context, n int, op func(tx *sqlRepository, i int) (UserID, error)) error {
+    txRepo := r
+    if r.tx == nil {
+        tx, err := r.db.BeginTx(ctx, nil)
+        if err != nil {
+            return err
+        }
+        defer tx.Rollback() // no-op after Commit
+        bound := *r
+        bound.tx = tx
+        txRepo = &bound
+    }
+    tx := txRepo.tx
+
+    var failures []BulkFailure
+    for i := 0; i < n; i++ {
+        if _, err := tx.ExecContext(ctx, "SAVEPOINT bulk_item"); err != nil {
+            return err
+        }
+        if id, err := op(txRepo, i); err != nil {
+            failures = append(failures, BulkFailure{Index: i, ID: id, Err: err})
+            if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT bulk_item"); err != nil {
+                return err
+            }
+            continue
+        }
+        if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT bulk_item"); err != nil {
+            return err
+        }
+    }
+    if r.tx == nil {
+        if err := tx.Commit(); err != nil {
+            return err
+        }
+    }
+    return bulkError(n, failures)
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+    Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (*User, error) {
+    var (
+        user      User
+        age       sql.NullInt64
+        prefs     []byte
+        deletedAt sql.NullTime
+        changedAt sql.NullTime
+        anonAt    sql.NullTime
+        tags      string
+        phone     []byte
+        address   []byte
+        metadata  string
+    )
+    if err := row.Scan(&user.ID, &user.Name, &user.Email, &age, &user.Status, &user.CreatedAt, &prefs, &deletedAt, &changedAt, &anonAt, &user.Role, &tags, &user.AvatarURL, &phone, &address, &metadata, &user.TenantID); err != nil {
+        return nil, err
+    }
+    if age.Valid {
+        user.Age = intPtr(int(age.Int64))
+    }
+    if deletedAt.Valid {
+        user.DeletedAt = &deletedAt.Time
+    }
+    if changedAt.Valid {
+        user.StatusChangedAt = &changedAt.Time
+    }
+    if anonAt.Valid {
+        user.AnonymizedAt = &anonAt.Time
+    }
+    user.Tags = decodeTags(tags)
+    if len(prefs) > 0 {
+        if err := json.Unmarshal(prefs, &user.Preferences); err != nil {
+            return nil, fmt.Errorf("decode preferences for user %d: %w", user.ID, err)
+        }
+    }
+    if len(phone) > 0 {
+        if err := json.Unmarshal(phone, &user.Phone); err != nil {
+            return nil, fmt.Errorf("decode phone for user %d: %w", user.ID, err)
+        }
+    }
+    if len(address) > 0 {
+        if err := json.Unmarshal(address, &user.Address); err != nil {
+            return nil, fmt.Errorf("decode address for user %d: %w", user.ID, err)
+        }
+    }
+    if metadata != "" && metadata != "{}" {
+        if err := json.Unmarshal([]byte(metadata), &user.Metadata); err != nil {
+            return nil, fmt.Errorf("decode metadata for user %d: %w", user.ID, err)
+        }
+    }
+    return &user, nil
+}
+
+// Logging decorator
+//
+// LoggingRepository wraps any UserRepository and logs every call with its
+// duration and outcome: failures of the backend at Error, other calls,
+// including expected results such as ErrNotFound, at Debug, and with
+// WithSlowRepoThreshold, calls that take too long at Warn along with the
+// caller's stack. WithSlowCallsOnly keeps just the last. Decorators wrap each other, so
+// NewLoggingRepository(NewCachingRepository(...)) works.
+var _ UserRepository = (*LoggingRepository)(nil)
+
+type LoggingRepository struct {
+    next     UserRepository
+    logger   Logger
+    slow     time.Duration
+    slowOnly bool
+}
+
+type LoggingOption func(*LoggingRepository)
+
+// WithSlowRepoThreshold logs calls taking d or longer at Warn.
+func WithSlowRepoThreshold(d time.Duration) LoggingOption {
+    return func(r *LoggingRepository) { r.slow = d }
+}
+
+// WithSlowCallsOnly logs nothing but slow calls, for wrapping a chain
+// whose errors are already reported elsewhere.
+func WithSlowCallsOnly() LoggingOption {
+    return func(r *LoggingRepository) { r.slowOnly = true }
+}
+
+func NewLoggingRepository(next UserRepository, logger Logger, opts ...LoggingOption) *LoggingRepository {
+    r := &LoggingRepository{next: next, logger: logger}
+    for _, opt := range opts {
+        opt(r)
+    }
+    return r
+}
+
+// Unwrap returns the decorated repository; see findRepository.
+func (r *LoggingRepository) Unwrap() UserRepository {
+    return r.next
+}
+
+// log is deferred by every method: defer r.log(ctx, "Op", time.Now(), &err).
+func (r *LoggingRepository) log(ctx context.Context, call string, start time.Time, err *error) {
+    elapsed := time.Since(start)
+    logger := loggerFor(ctx, r.logger)
+    if r.slow > 0 && elapsed >= r.slow {
+        logger.Warn("Slow repository call", "call", call, "duration", elapsed,
+            "threshold", r.slow, "stack", callerStack(1))
+    }
+    switch {
+    case r.slowOnly:
+    case isBackendFailure(*err):
+        logger.Error("Repository call failed", "call", call, "duration", elapsed, "error", *err)
+    case *err != nil:
+        logger.Debug("Repository call", "call", call, "duration", elapsed, "error", *err)
+    default:
+        logger.Debug("Repository call", "call", call, "duration", elapsed)
+    }
+}
+
+// callerStack formats the stack from skip frames above its caller, one
+// "function (file:line)" per line, leaving out the runtime's own frames.
+func callerStack(skip int) string {
+    pcs := make([]uintptr, 32)
+    n := runtime.Callers(skip+2, pcs)
+    frames := runtime.CallersFrames(pcs[:n])
+    var b strings.Builder
+    for {
+        frame, more := frames.Next()
+        if !strings.HasPrefix(frame.Function, "runtime.") {
+            fmt.Fprintf(&b, "%s (%s:%d)\n", frame.Function, filepath.Base(frame.File), frame.Line)
+        }
+        if !more {
+            break
+        }
+    }
+    return strings.TrimSuffix(b.String(), "\n")
+}
+
+func (r *LoggingRepository) Save(ctx context.Context, user *User) (err error) {
+    defer r.log(ctx, fmt.Sprintf("Save(%d)", user.ID), time.Now(), &err)
+    return r.next.Save(ctx, user)
+}
+
+func (r *LoggingRepository) Insert(ctx context.Context, user *User) (err error) {
+    defer r.log(ctx, "Insert", time.Now(), &err)
+    return r.next.Insert(ctx, user)
+}
+
+func (r *LoggingRepository) FindByID(ctx context.Context, id UserID) (_ *User, err error) {
+    defer r.log(ctx, fmt.Sprintf("FindByID(%d)", id), time.Now(), &err)
+    return r.next.FindByID(ctx, id)
+}
+
+func (r *LoggingRepository) FindAll(ctx context.Context, order SortSpec) (_ []*User, err error) {
+    defer r.log(ctx, "FindAll", time.Now(), &err)
+    return r.next.FindAll(ctx, order)
+}
+
+// FindAllIter logs once the stream has been fully consumed or abandoned.
+func (r *LoggingRepository) FindAllIter(ctx context.Context) iter.Seq2[*User, error] {
+    return func(yield func(*User, error) bool) {
+        var err error
+        defer r.log(ctx, "FindAllIter", time.Now(), &err)
+        for user, iterErr := range r.next.FindAllIter(ctx) {
+            err = iterErr
+            if !yield(user, iterErr) {
+                return
+            }
+        }
+    }
+}
+
+func (r *LoggingRepository) FindPage(ctx context.Context, page PageRequest) (_ *Page, err error) {
+    defer r.log(ctx, fmt.Sprintf("FindPage(offset=%d, limit=%d)", page.Offset, page.Limit), time.Now(), &err)
+    return r.next.FindPage(ctx, page)
+}
+
+func (r *LoggingRepository) Delete(ctx context.Context, id UserID) (err error) {
+    defer r.log(ctx, fmt.Sprintf("Delete(%d)", id), time.Now(), &err)
+    return r.next.Delete(ctx, id)
+}
+
+func (r *LoggingRepository) FindByEmail(ctx context.Context, email string) (_ *User, err error) {
+    defer r.log(ctx, "FindByEmail", time.Now(), &err)
+    return r.next.FindByEmail(ctx, email)
+}
+
+func (r *LoggingRepository) Restore(ctx context.Context, id UserID) (err error) {
+    defer r.log(ctx, fmt.Sprintf("Restore(%d)", id), time.Now(), &err)
+    return r.next.Restore(ctx, id)
+}
+
+func (r *LoggingRepository) PurgeDeleted(ctx context.Context, olderThan time.Duration) (_ int, err error) {
+    defer r.log(ctx, fmt.Sprintf("PurgeDeleted(%s)", olderThan), time.Now(), &err)
+    return r.next.PurgeDeleted(ctx, olderThan)
+}
+
+func (r *LoggingRepository) SaveAll(ctx context.Context, users []*User) (err error) {
+    defer r.log(ctx, fmt.Sprintf("SaveAll(%d users)", len(users)), time.Now(), &err)
+    return r.next.SaveAll(ctx, users)
+}
+
+func (r *LoggingRepository) DeleteAll(ctx context.Context, ids []UserID) (err error) {
+    defer r.log(ctx, fmt.Sprintf("DeleteAll(%d ids)", len(ids)), time.Now(), &err)
+    return r.next.DeleteAll(ctx, ids)
+}
+
+func (r *LoggingRepository) FindWhere(ctx context.Context, filter UserFilter) (_ []*User, err error) {
+    defer r.log(ctx, "FindWhere", time.Now(), &err)
+    return r.next.FindWhere(ctx, filter)
+}
+
+// WithinTx keeps logging inside the transaction by wrapping the
+// transaction-scoped repository too.
+func (r *LoggingRepository) WithinTx(ctx context.Context, fn func(UserRepository) error) (err error) {
+    defer r.log(ctx, "WithinTx", time.Now(), &err)
+    return WithinTx(ctx, r.next, func(tx UserRepository) error {
+        return fn(NewLoggingRepository(tx, r.logger, WithSlowRepoThreshold(r.slow)))
+    })
+}
+
+// Retries
+//
+// Retry re-runs an operation that failed with a transient error, waiting
+// between attempts with capped exponential backoff and full jitter.
+
+type RetryPolicy struct {
+    MaxRetries     int // attempts after the first
+    InitialBackoff time.Duration
+    MaxBackoff     time.Duration
+    // Retryable reports whether err is worth another attempt; IsTransient
+    // when nil.
+    Retryable func(error) bool
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+    MaxRetries:     MaxRetries,
+    InitialBackoff: 50 * time.Millisecond,
+    MaxBackoff:     2 * time.Second,
+}
+
+// Retry calls op until it succeeds, fails with a non-retryable error, the
+// retries run out, or ctx ends. It returns op's last result.
+func Retry[T any](ctx context.Context, p RetryPolicy, op func(context.Context) (T, error)) (T, error) {
+    retryable := p.Retryable
+    if retryable == nil {
+        retryable = IsTransient
+    }
+    backoff := p.InitialBackoff
+    for attempt := 0; ; attempt++ {
+        v, err := op(ctx)
+        if err == nil || attempt >= p.MaxRetries || !retryable(err) {
+            return v, err
+        }
+        wait := time.Duration(0)
+        if backoff > 0 {
+            wait = time.Duration(mrand.Int64N(int64(backoff)) + 1)
+            backoff = min(backoff*2, p.MaxBackoff)
+        }
+        select {
+        case <-time.After(wait):
+        case <-ctx.Done():
+            return v, err
+        }
+    }
+}
+
+// RetryDo is Retry for operations without a result.
+func RetryDo(ctx context.Context, p RetryPolicy, op func(context.Context) error) error {
+    _, err := Retry(ctx, p, func(ctx context.Context) (struct{}, error) {
+        return struct{}{}, op(ctx)
+    })
+    return err
+}
+
+// IsTransient recognizes errors a retry may fix: broken connections,
+// network timeouts, and deadlocks or serialization conflicts from
+// Postgres. Domain errors like ErrNotFound and context errors never are.
+func IsTransient(err error) bool {
+    if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+        return false
+    }
+    if errors.Is(err, driver.ErrBadConn) {
+        return true
+    }
+    var netErr net.Error
+    if errors.As(err, &netErr) && netErr.Timeout() {
+        return true
+    }
+    msg := err.Error()
+    for _, s := range []string{
+        "deadlock detected",          // Postgres 40P01
+        "could not serialize access", // Postgres 40001
+        "connection reset by peer",
+        "connection refused",
+    } {
+        if strings.Contains(msg, s) {
+            return true
+        }
+    }
+    return false
+}
+
+// RetryingRepository retries calls to next that fail with a transient
+// error, but only calls that are safe to repeat: reads, and Save or
+// SaveAll of users that already have IDs, which just write the same row
+// again. A transient error can arrive after the database applied a write,
+// so creating users (Insert, or Save without an ID), deletes, restores,
+// purges and transactions go through once: repeating them could create a
+// duplicate, or report ErrNotFound for a delete that succeeded.
+// FindAllIter is only retried if it fails before yielding any user.
+type RetryingRepository struct {
+    next   UserRepository
+    policy RetryPolicy
+}
+
+func NewRetryingRepository(next UserRepository, policy RetryPolicy) *RetryingRepository {
+    return &RetryingRepository{next: next, policy: policy}
+}
+
+// Unwrap returns the decorated repository; see findRepository.
+func (r *RetryingRepository) Unwrap() UserRepository {
+    return r.next
+}
+
+func (r *RetryingRepository) do(ctx context.Context, op func(context.Context) error) error {
+    return RetryDo(ctx, r.policy, op)
+}
+
+func (r *RetryingRepository) Save(ctx context.Context, user *User) error {
+    if user.ID == 0 {
+        return r.next.Save(ctx, user)
+    }
+    return r.do(ctx, func(ctx context.Context) error { return r.next.Save(ctx, user) })
+}
+
+func (r *RetryingRepository) Insert(ctx context.Context, user *User) error {
+    return r.next.Insert(ctx, user)
+}
+
+func (r *RetryingRepository) FindByID(ctx context.Context, id UserID) (*User, error) {
+    return Retry(ctx, r.policy, func(ctx context.Context) (*User, error) { return r.next.FindByID(ctx, id) })
+}
+
+func (r *RetryingRepository) FindAll(ctx context.Context, order SortSpec) ([]*User, error) {
+    return Retry(ctx, r.policy, func(ctx context.Context) ([]*User, error) { return r.next.FindAll(ctx, order) })
+}
+
+func (r *RetryingRepository) FindAllIter(ctx context.Context) iter.Seq2[*User, error] {
+    return func(yield func(*User, error) bool) {
+        var lastErr error
+        err := r.do(ctx, func(ctx context.Context) error {
+            yielded := false
+            for user, err := range r.next.FindAllIter(ctx) {
+                if err != nil {
+                    if yielded {
+                        // Can't rewind the caller; surface the error as is.
+                        lastErr = err
+                        return nil
+                    }
+                    return err
+                }
+                yielded = true
+                if !yield(user, nil) {
+                    return nil
+                }
+            }
+            return nil
+        })
+        if err == nil {
+            err = lastErr
+        }
+        if err != nil {
+            yield(nil, err)
+        }
+    }
+}
+
+func (r *RetryingRepository) FindPage(ctx context.Context, page PageRequest) (*Page, error) {
+    return Retry(ctx, r.policy, func(ctx context.Context) (*Page, error) { return r.next.FindPage(ctx, page) })
+}
+
+func (r *RetryingRepository) Delete(ctx context.Context, id UserID) error {
+    return r.next.Delete(ctx, id)
+}
+
+func (r *RetryingRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+    return Retry(ctx, r.policy, func(ctx context.Context) (*User, error) { return r.next.FindByEmail(ctx, email) })
+}
+
+func (r *RetryingRepository) Restore(ctx context.Context, id UserID) error {
+    return r.next.Restore(ctx, id)
+}
+
+func (r *RetryingRepository) PurgeDeleted(ctx context.Context, olderThan time.Duration) (int, error) {
+    return r.next.PurgeDeleted(ctx, olderThan)
+}
+
+func (r *RetryingRepository) SaveAll(ctx context.Context, users []*User) error {
+    if slices.ContainsFunc(users, func(u *User) bool { return u.ID == 0 }) {
+        return r.next.SaveAll(ctx, users)
+    }
+    return r.do(ctx, func(ctx context.Context) error { return r.next.SaveAll(ctx, users) })
+}
+
+func (r *RetryingRepository) DeleteAll(ctx context.Context, ids []UserID) error {
+    return r.next.DeleteAll(ctx, ids)
+}
+
+func (r *RetryingRepository) FindWhere(ctx context.Context, filter UserFilter) ([]*User, error) {
+    return Retry(ctx, r.policy, func(ctx context.Context) ([]*User, error) { return r.next.FindWhere(ctx, filter) })
+}
+
+func (r *RetryingRepository) WithinTx(ctx context.Context, fn func(UserRepository) error) error {
+    return WithinTx(ctx, r.next, fn)
+}
+
+// Locking decorator
+//
+// LockedRepository makes a repository that isn't safe for concurrent use
+// safe to share between requests, event subscribers and background jobs.
+// Reads share a read lock; writes and transactions take the write lock.
+// Methods reached through Unwrap are not locked. InMemoryRepository
+// locks itself and doesn't need it.
+
+var _ UserRepository = (*LockedRepository)(nil)
+
+type LockedRepository struct {
+    mu   sync.RWMutex
+    next UserRepository
+}
+
+func NewLockedRepository(next UserRepository) *LockedRepository {
+    return &LockedRepository{next: next}
+}
+
+// Unwrap returns the decorated repository; see findRepository.
+func (r *LockedRepository) Unwrap() UserRepository {
+    return r.next
+}
+
+func (r *LockedRepository) Save(ctx context.Context, user *User) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.next.Save(ctx, user)
+}
+
+func (r *LockedRepository) Insert(ctx context.Context, user *User) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.next.Insert(ctx, user)
+}
+
+func (r *LockedRepository) FindByID(ctx context.Context, id UserID) (*User, error) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.next.FindByID(ctx, id)
+}
+
+func (r *LockedRepository) FindAll(ctx context.Context, order SortSpec) ([]*User, error) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.next.FindAll(ctx, order)
+}
+
+// FindAllIter reads every user under the lock before yielding any, so a
+// caller that writes while iterating doesn't deadlock.
+func (r *LockedRepository) FindAllIter(ctx context.Context) iter.Seq2[*User, error] {
+    return func(yield func(*User, error) bool) {
+        var users []*User
+        var iterErr error
+        r.mu.RLock()
+        for user, err := range r.next.FindAllIter(ctx) {
+            if err != nil {
+                iterErr = err
+                break
+            }
+            users = append(users, user)
+        }
+        r.mu.RUnlock()
+        for _, user := range users {
+            if !yield(user, nil) {
+                return
+            }
+        }
+        if iterErr != nil {
+            yield(nil, iterErr)
+        }
+    }
+}
+
+func (r *LockedRepository) FindPage(ctx context.Context, page PageRequest) (*Page, error) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.next.FindPage(ctx, page)
+}
+
+func (r *LockedRepository) Delete(ctx context.Context, id UserID) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.next.Delete(ctx, id)
+}
+
+func (r *LockedRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.next.FindByEmail(ctx, email)
+}
+
+func (r *LockedRepository) Restore(ctx context.Context, id UserID) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.next.Restore(ctx, id)
+}
+
+func (r *LockedRepository) PurgeDeleted(ctx context.Context, olderThan time.Duration) (int, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.next.PurgeDeleted(ctx, olderThan)
+}
+
+func (r *LockedRepository) SaveAll(ctx context.Context, users []*User) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.next.SaveAll(ctx, users)
+}
+
+func (r *LockedRepository) DeleteAll(ctx context.Context, ids []UserID) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.next.DeleteAll(ctx, ids)
+}
+
+func (r *LockedRepository) FindWhere(ctx context.Context, filter UserFilter) ([]*User, error) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.next.FindWhere(ctx, filter)
+}
+
+// WithinTx holds the write lock for all of fn, which must use the
+// repository it is given rather than r.
+func (r *LockedRepository) WithinTx(ctx context.Context, fn func(UserRepository) error) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return WithinTx(ctx, r.next, fn)
+}
+
+// Circuit breaker
+//
+// CircuitBreaker stops calling a backend that keeps failing, so requests
+// fail fast while a database is down instead of each waiting out its own
+// timeout. It starts closed and opens after Threshold consecutive
+// failures. While open, calls fail at once with ErrCircuitOpen. Once
+// Cooldown has passed it is half-open and lets a single probe call
+// through: success closes it, failure opens it for another Cooldown.
+// CircuitBreakerRepository applies one breaker to every call of a
+// UserRepository.
+
+// ErrCircuitOpen is returned instead of calling the backend while the
+// breaker is open. It is not transient, so RetryingRepository gives up
+// at once rather than retrying into it.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+type BreakerState int
+
+const (
+    BreakerClosed BreakerState = iota
+    BreakerHalfOpen
+    BreakerOpen
+)
+
+func (s BreakerState) String() string {
+    switch s {
+    case BreakerClosed:
+        return "closed"
+    case BreakerHalfOpen:
+        return "half-open"
+    case BreakerOpen:
+        return "open"
+    }
+    return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+type BreakerConfig struct {
+    Threshold int           // consecutive failures that open the breaker; DefaultBreakerThreshold if zero
+    Cooldown  time.Duration // how long to stay open before probing; DefaultBreakerCooldown if zero
+    // IsFailure reports whether err counts against the backend. When nil,
+    // only errors the HTTP API would answer with a 5xx count, so results
+    // like ErrNotFound, and callers cancelling, never trip the breaker.
+    IsFailure func(error) bool
+}
+
+const (
+    DefaultBreakerThreshold = 5
+    DefaultBreakerCooldown  = 10 * time.Second
+)
+
+type CircuitBreaker struct {
+    cfg BreakerConfig
+
+    mu       sync.Mutex
+    state    BreakerState
+    failures int       // consecutive, while closed
+    openedAt time.Time // while open
+    probing  bool      // a half-open probe is in flight
+    onChange []func(from, to BreakerState)
+}
+
+func NewCircuitBreaker(cfg BreakerConfig) *CircuitBreaker {
+    if cfg.Threshold <= 0 {
+        cfg.Threshold = DefaultBreakerThreshold
+    }
+    if cfg.Cooldown <= 0 {
+        cfg.Cooldown = DefaultBreakerCooldown
+    }
+    if cfg.IsFailure == nil {
+        cfg.IsFailure = isBackendFailure
+    }
+    return &CircuitBreaker{cfg: cfg}
+}
+
+// isBackendFailure is the default BreakerConfig.IsFailure. Domain errors
+// answer the caller, so they don't count against the backend; timeouts,
+// transient errors and anything unrecognized do.
+func isBackendFailure(err error) bool {
+    if err == nil {
+        return false
+    }
+    for _, target := range []error{
+        context.Canceled, ErrCircuitOpen,
+        ErrNotFound, ErrEmailTaken, ErrAlreadyExists, ErrInvalidTransition,
+        ErrForbidden, ErrInvalidCredentials, ErrInvalidToken, ErrIdempotencyConflict,
+        ErrRateLimited, ErrAccountLocked, ErrNotSupported, ErrInvalidInput,
+    } {
+        if errors.Is(err, target) {
+            return false
+        }
+    }
+    return true
+}
+
+// OnStateChange registers fn to be called after every transition. It is
+// called synchronously by the call that caused the transition, without
+// holding the breaker's lock.
+func (b *CircuitBreaker) OnStateChange(fn func(from, to BreakerState)) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.onChange = append(b.onChange, fn)
+}
+
+// State reports the current state. An open breaker whose cooldown has
+// passed reports half-open, as the next call will probe.
+func (b *CircuitBreaker) State() BreakerState {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cfg.Cooldown {
+        return BreakerHalfOpen
+    }
+    return b.state
+}
+
+// Protect calls op unless b is open, and records how it went. A panic in
+// op counts as a failure and is passed on.
+func Protect[T any](ctx context.Context, b *CircuitBreaker, op func(context.Context) (T, error)) (v T, err error) {
+    probe, err := b.allow()
+    if err != nil {
+        return v, err
+    }
+    defer func() {
+        if r := recover(); r != nil {
+            b.record(probe, fmt.Errorf("panic: %v", r), true)
+            panic(r)
+        }
+        b.record(probe, err, false)
+    }()
+    return op(ctx)
+}
+
+// ProtectDo is Protect for operations without a result.
+func ProtectDo(ctx context.Context, b *CircuitBreaker, op func(context.Context) error) error {
+    _, err := Protect(ctx, b, func(ctx context.Context) (struct{}, error) {
+        return struct{}{}, op(ctx)
+    })
+    return err
+}
+
+// allow reports whether a call may go ahead, and whether it is the
+// half-open probe.
+func (b *CircuitBreaker) allow() (probe bool, err error) {
+    b.mu.Lock()
+    var from BreakerState
+    changed := false
+    switch b.state {
+    case BreakerOpen:
+        if wait := b.cfg.Cooldown - time.Since(b.openedAt); wait > 0 {
+            b.mu.Unlock()
+            return false, fmt.Errorf("%w; next probe in %s", ErrCircuitOpen, wait.Round(time.Millisecond))
+        }
+        from, changed = b.state, true
+        b.state = BreakerHalfOpen
+        fallthrough
+    case BreakerHalfOpen:
+        if b.probing {
+            b.mu.Unlock()
+            return false, fmt.Errorf("%w; probe in progress", ErrCircuitOpen)
+        }
+        b.probing = true
+        probe = true
+    }
+    b.mu.Unlock()
+    if changed {
+        b.notify(from, BreakerHalfOpen)
+    }
+    return probe, nil
+}
+
+// record applies a call's outcome. Calls that began before the breaker
+// left the closed state don't count; only the probe decides a half-open
+// breaker's fate.
+func (b *CircuitBreaker) record(probe bool, err error, panicked bool) {
+    failed := panicked || b.cfg.IsFailure(err)
+    b.mu.Lock()
+    from := b.state
+    switch {
+    case probe:
+        b.probing = false
+        if failed {
+            b.open()
+        } else if !errors.Is(err, context.Canceled) { // a cancelled probe proves nothing
+            b.state, b.failures = BreakerClosed, 0
+        }
+    case b.state != BreakerClosed:
+    case failed:
+        if b.failures++; b.failures >= b.cfg.Threshold {
+            b.open()
+        }
+    default:
+        b.failures = 0
+    }
+    to := b.state
+    b.mu.Unlock()
+    if to != from {
+        b.notify(from, to)
+    }
+}
+
+func (b *CircuitBreaker) open() {
+    b.state, b.openedAt, b.failures = BreakerOpen, time.Now(), 0
+}
+
+func (b *CircuitBreaker) notify(from, to BreakerState) {
+    b.mu.Lock()
+    fns := slices.Clone(b.onChange)
+    b.mu.Unlock()
+    for _, fn := range fns {
+        fn(from, to)
+    }
+}
+
+// CircuitBreakerRepository passes calls to next through a CircuitBreaker.
+// A transaction counts as one call. FindAllIter counts as one call that
+// failed if the stream did.
+var _ UserRepository = (*CircuitBreakerRepository)(nil)
+
+type CircuitBreakerRepository struct {
+    next    UserRepository
+    breaker *CircuitBreaker
+}
+
+func NewCircuitBreakerRepository(next UserRepository, breaker *CircuitBreaker) *CircuitBreakerRepository {
+    return &CircuitBreakerRepository{next: next, breaker: breaker}
+}
+
+// Unwrap returns the decorated repository; see findRepository.
+func (r *CircuitBreakerRepository) Unwrap() UserRepository {
+    return r.next
+}
+
+func (r *CircuitBreakerRepository) do(ctx context.Context, op func(context.Context) error) error {
+    return ProtectDo(ctx, r.breaker, op)
+}
+
+func (r *CircuitBreakerRepository) Save(ctx context.Context, user *User) error {
+    return r.do(ctx, func(ctx context.Context) error { return r.next.Save(ctx, user) })
+}
+
+func (r *CircuitBreakerRepository) Insert(ctx context.Context, user *User) error {
+    return r.do(ctx, func(ctx context.Context) error { return r.next.Insert(ctx, user) })
+}
+
+func (r *CircuitBreakerRepository) FindByID(ctx context.Context, id UserID) (*User, error) {
+    return Protect(ctx, r.breaker, func(ctx context.Context) (*User, error) { return r.next.FindByID(ctx, id) })
+}
+
+func (r *CircuitBreakerRepository) FindAll(ctx context.Context, order SortSpec) ([]*User, error) {
+    return Protect(ctx, r.breaker, func(ctx context.Context) ([]*User, error) { return r.next.FindAll(ctx, order) })
+}
+
+func (r *CircuitBreakerRepository) FindAllIter(ctx context.Context) iter.Seq2[*User, error] {
+    return func(yield func(*User, error) bool) {
+        err := r.do(ctx, func(ctx context.Context) error {
+            for user, err := range r.next.FindAllIter(ctx) {
+                if err != nil {
+                    return err
+                }
+                if !yield(user, nil) {
+                    return nil
+                }
+            }
+            return nil
+        })
+        if err != nil {
+            yield(nil, err)
+        }
+    }
+}
+
+func (r *CircuitBreakerRepository) FindPage(ctx context.Context, page PageRequest) (*Page, error) {
+    return Protect(ctx, r.breaker, func(ctx context.Context) (*Page, error) { return r.next.FindPage(ctx, page) })
+}
+
+func (r *CircuitBreakerRepository) Delete(ctx context.Context, id UserID) error {
+    return r.do(ctx, func(ctx context.Context) error { return r.next.Delete(ctx, id) })
+}
+
+func (r *CircuitBreakerRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+    return Protect(ctx, r.breaker, func(ctx context.Context) (*User, error) { return r.next.FindByEmail(ctx, email) })
+}
+
+func (r *CircuitBreakerRepository) Restore(ctx context.Context, id UserID) error {
+    return r.do(ctx, func(ctx context.Context) error { return r.next.Restore(ctx, id) })
+}
+
+func (r *CircuitBreakerRepository) PurgeDeleted(ctx context.Context, olderThan time.Duration) (int, error) {
+    return Protect(ctx, r.breaker, func(ctx context.Context) (int, error) { return r.next.PurgeDeleted(ctx, olderThan) })
+}
+
+func (r *CircuitBreakerRepository) SaveAll(ctx context.Context, users []*User) error {
+    return r.do(ctx, func(ctx context.Context) error { return r.next.SaveAll(ctx, users) })
+}
+
+func (r *CircuitBreakerRepository) DeleteAll(ctx context.Context, ids []UserID) error {
+    return r.do(ctx, func(ctx context.Context) error { return r.next.DeleteAll(ctx, ids) })
+}
+
+func (r *CircuitBreakerRepository) FindWhere(ctx context.Context, filter UserFilter) ([]*User, error) {
+    return Protect(ctx, r.breaker, func(ctx context.Context) ([]*User, error) { return r.next.FindWhere(ctx, filter) })
+}
+
+func (r *CircuitBreakerRepository) WithinTx(ctx context.Context, fn func(UserRepository) error) error {
+    return r.do(ctx, func(ctx context.Context) error { return WithinTx(ctx, r.next, fn) })
+}
+
+// Rate limiting
+//
+// Limiter keeps a token bucket per key. It backs the HTTP RateLimit
+// middleware's MemoryRateLimitStore, password reset requests and webhook
+// delivery. A bucket holds up to Burst tokens and refills completely over
+// Per, so a key can burst up to Burst and then sustain Burst per Per. A
+// missing bucket counts as full. Buckets left unused for the TTL are
+// dropped, which bounds memory by the keys seen recently; the TTL is never
+// shorter than Per, since a bucket idle that long is full again anyway.
+
+// Limit is a bucket's size and how long an empty one takes to refill.
+type Limit struct {
+    Burst int
+    Per   time.Duration
+}
+
+// valid reports whether l describes a bucket that holds tokens and
+// refills; any other Limit would make the refill rate zero or undefined.
+func (l Limit) valid() bool { return l.Burst > 0 && l.Per > 0 }
+
+type RateDecision struct {
+    Allowed    bool
+    Remaining  int           // whole tokens left after this request
+    RetryAfter time.Duration // until the next token, when not Allowed
+}
+
+type Limiter struct {
+    limit Limit
+    ttl   time.Duration
+
+    mu      sync.Mutex
+    buckets map[string]*tokenBucket
+    swept   time.Time
+}
+
+type tokenBucket struct {
+    tokens  float64
+    updated time.Time
+    per     time.Duration // of the limit last applied
+}
+
+// NewLimiter applies limit to every key, unless TakeLimit is given
+// another. A bucket unused for ttl is dropped; zero means limit.Per. The
+// zero Limit sets no default, leaving every key to TakeLimit; NewLimiter
+// panics on any other Limit with a zero or negative Burst or Per.
+func NewLimiter(limit Limit, ttl time.Duration) *Limiter {
+    if limit != (Limit{}) && !limit.valid() {
+        panic(fmt.Sprintf("ratelimit: invalid limit %d per %s", limit.Burst, limit.Per))
+    }
+    return &Limiter{limit: limit, ttl: ttl, buckets: make(map[string]*tokenBucket), swept: time.Now()}
+}
+
+// Allow spends a token from key's bucket if it has one.
+func (l *Limiter) Allow(key string) bool {
+    return l.Take(key).Allowed
+}
+
+// Take spends a token from key's bucket if it has one, and says how many
+// are left or how long until the next.
+func (l *Limiter) Take(key string) RateDecision {
+    return l.TakeLimit(key, l.limit)
+}
+
+// TakeLimit is Take under limit rather than the Limiter's own, for limits
+// that change at run time (see WithRateLimitVar). A limit with a zero or
+// negative Burst or Per allows nothing.
+func (l *Limiter) TakeLimit(key string, limit Limit) RateDecision {
+    if !limit.valid() {
+        return RateDecision{}
+    }
+    now := time.Now()
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.sweep(now, limit)
+    b := l.refill(key, limit, now)
+    rate := float64(limit.Burst) / limit.Per.Seconds() // tokens per second
+    d := RateDecision{Allowed: b.tokens >= 1}
+    if d.Allowed {
+        b.tokens--
+    } else {
+        d.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+    }
+    d.Remaining = int(b.tokens)
+    return d
+}
+
+// Wait spends a token from key's bucket, first waiting for one if the
+// bucket is empty. It fails only if ctx ends before then.
+func (l *Limiter) Wait(ctx context.Context, key string) error {
+    for {
+        d := l.Take(key)
+        if d.Allowed {
+            return nil
+        }
+        t := time.NewTimer(d.RetryAfter)
+        select {
+        case <-t.C:
+        case <-ctx.Done():
+            t.Stop()
+            return context.Cause(ctx)
+        }
+    }
+}
+
+// Available returns the whole tokens in key's bucket, without spending any.
+func (l *Limiter) Available(key string) int {
+    if !l.limit.valid() {
+        return 0
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return int(l.refill(key, l.limit, time.Now()).tokens)
+}
+
+// Used returns how many tokens key's bucket is short of full, rounded
+// up: roughly, the takes of the last Per.
+func (l *Limiter) Used(key string) int {
+    if !l.limit.valid() {
+        return 0
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return int(math.Ceil(float64(l.limit.Burst) - l.refill(key, l.limit, time.Now()).tokens))
+}
+
+// Reset fills key's bucket.
+func (l *Limiter) Reset(key string) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    delete(l.buckets, key)
+}
+
+// refill brings key's bucket up to date, creating it full if needed.
+func (l *Limiter) refill(key string, limit Limit, now time.Time) *tokenBucket {
+    b, ok := l.buckets[key]
+    if !ok {
+        b = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+        l.buckets[key] = b
+    }
+    rate := float64(limit.Burst) / limit.Per.Seconds()
+    b.tokens = min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*rate)
+    b.updated, b.per = now, limit.Per
+    return b
+}
+
+// sweep drops idle buckets, at most once per TTL.
+func (l *Limiter) sweep(now time.Time, limit Limit) {
+    ttl := cmp.Or(l.ttl, limit.Per)
+    if now.Sub(l.swept) < ttl {
+        return
+    }
+    l.swept = now
+    for key, b := range l.buckets {
+        if now.Sub(b.updated) >= max(ttl, b.per) {
+            delete(l.buckets, key)
+        }
+    }
+}
+
+// Tenant isolation decorator
+//
+// One deployment serves many customers (tenants). Every user belongs to
+// exactly one tenant, and email addresses are unique per tenant rather than
+// globally. TenantRepository confines each call to the tenant carried by
+// the context; calls without one fail with ErrForbidden, and users of
+// other tenants look like they don't exist. Maintenance work that spans
+// tenants opts out explicitly with WithAllTenants.
+
+type TenantID string
+
+// WithTenant scopes ctx to tenant.
+func WithTenant(ctx context.Context, tenant TenantID) context.Context {
+    return context.WithValue(ctx, tenantKey, tenant)
+}
+
+func TenantFrom(ctx context.Context) (TenantID, bool) {
+    tenant, ok := ctx.Value(tenantKey).(TenantID)
+    return tenant, ok
+}
+
+// WithAllTenants lifts tenant isolation for ctx, for system jobs and
+// cross-tenant reports. Never derive it from request input.
+func WithAllTenants(ctx context.Context) context.Context {
+    return context.WithValue(ctx, allTenantsKey, true)
+}
+
+// TenantScope reports the tenant ctx is confined to ("" if none was set),
+// or all=true for a WithAllTenants context.
+func TenantScope(ctx context.Context) (tenant TenantID, all bool) {
+    if all, _ := ctx.Value(allTenantsKey).(bool); all {
+        return "", true
+    }
+    tenant, _ = TenantFrom(ctx)
+    return tenant, false
+}
+
+type TenantRepository struct {
+    next UserRepository
+}
+
+func NewTenantRepository(next UserRepository) *TenantRepository {
+    return &TenantRepository{next: next}
+}
+
+// Unwrap returns the decorated repository; see findRepository.
+func (r *TenantRepository) Unwrap() UserRepository {
+    return r.next
+}
+
+// scope returns the caller's tenant, or all=true for WithAllTenants.
+func (r *TenantRepository) scope(ctx context.Context) (tenant TenantID, all bool, err error) {
+    tenant, all = TenantScope(ctx)
+    if all {
+        return "", true, nil
+    }
+    if _, ok := TenantFrom(ctx); !ok {
+        return "", false, fmt.Errorf("no tenant in context: %w", ErrForbidden)
+    }
+    return tenant, false, nil
+}
+
+// stamp assigns new users to the caller's tenant and refuses to write a
+// user into any other.
+func (r *TenantRepository) stamp(ctx context.Context, user *User) error {
+    tenant, all, err := r.scope(ctx)
+    if err != nil || all {
+        return err
+    }
+    if user.ID == 0 && user.TenantID == "" {
+        user.TenantID = tenant
+    }
+    if user.TenantID != tenant {
+        return fmt.Errorf("user belongs to tenant %q: %w", user.TenantID, ErrForbidden)
+    }
+    return nil
+}
+
+// Save can't move a user between tenants: the backends refuse to
+// overwrite a stored user whose TenantID differs.
+func (r *TenantRepository) Save(ctx context.Context, user *User) error {
+    if err := r.stamp(ctx, user); err != nil {
+        return err
+    }
+    return r.next.Save(ctx, user)
+}
+
+func (r *TenantRepository) Insert(ctx context.Context, user *User) error {
+    if err := r.stamp(ctx, user); err != nil {
+        return err
+    }
+    return r.next.Insert(ctx, user)
+}
+
+func (r *TenantRepository) FindByID(ctx context.Context, id UserID) (*User, error) {
+    tenant, all, err := r.scope(ctx)
+    if err != nil {
+        return nil, err
+    }
+    user, err := r.next.FindByID(ctx, id)
+    if err != nil {
+        return nil, err
+    }
+    if !all && user.TenantID != tenant {
+        return nil, fmt.Errorf("user with ID %d %w", id, ErrNotFound)
+    }
+    return user, nil
+}
+
+// filter adds the caller's tenant to f.
+func (r *TenantRepository) filter(ctx context.Context, f UserFilter) (UserFilter, error) {
+    tenant, all, err := r.scope(ctx)
+    if err != nil {
+        return f, err
+    }
+    if !all {
+        f.TenantID = &tenant
+    }
+    return f, nil
+}
+
+func (r *TenantRepository) FindWhere(ctx context.Context, filter UserFilter) ([]*User, error) {
+    filter, err := r.filter(ctx, filter)
+    if err != nil {
+        return nil, err
+    }
+    return r.next.FindWhere(ctx, filter)
+}
+
+func (r *TenantRepository) FindAll(ctx context.Context, order SortSpec) ([]*User, error) {
+    if err := order.validate(); err != nil {
+        return nil, err
+    }
+    users, err := r.FindWhere(ctx, UserFilter{})
+    if err != nil {
+        return nil, err
+    }
+    sortUsers(users, order)
+    return users, nil
+}
+
+func (r *TenantRepository) FindAllIter(ctx context.Context) iter.Seq2[*User, error] {
+    return func(yield func(*User, error) bool) {
+        tenant, all, err := r.scope(ctx)
+        if err != nil {
+            yield(nil, err)
+            return
+        }
+        for user, err := range r.next.FindAllIter(ctx) {
+            if err == nil && !all && user.TenantID != tenant {
+                continue
+            }
+            if !yield(user, err) || err != nil {
+                return
+            }
+        }
+    }
+}
+
+// FindPage has the backend page through the tenant's users only.
+func (r *TenantRepository) FindPage(ctx context.Context, page PageRequest) (*Page, error) {
+    tenant, all, err := r.scope(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if !all {
+        page.TenantID = &tenant
+    }
+    return r.next.FindPage(ctx, page)
+}
+
+func (r *TenantRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+    if _, _, err := r.scope(ctx); err != nil {
+        return nil, err
+    }
+    // The backends already look in the context's tenant.
+    return r.next.FindByEmail(ctx, email)
+}
+
+func (r *TenantRepository) Delete(ctx context.Context, id UserID) error {
+    if _, err := r.FindByID(ctx, id); err != nil {
+        return err
+    }
+    return r.next.Delete(ctx, id)
+}
+
+// Restore finds deleted users through FindWhere, since FindByID hides them.
+func (r *TenantRepository) Restore(ctx context.Context, id UserID) error {
+    filter, err := r.filter(ctx, UserFilter{IDs: []UserID{id}, IncludeDeleted: true})
+    if err != nil {
+        return err
+    }
+    owned, err := r.next.FindWhere(ctx, filter)
+    if err != nil {
+        return err
+    }
+    if len(owned) == 0 {
+        return fmt.Errorf("user with ID %d %w", id, ErrNotFound)
+    }
+    return r.next.Restore(ctx, id)
+}
+
+// PurgeDeleted is maintenance across every tenant and needs WithAllTenants.
+func (r *TenantRepository) PurgeDeleted(ctx context.Context, olderThan time.Duration) (int, error) {
+    _, all, err := r.scope(ctx)
+    if err != nil {
+        return 0, err
+    }
+    if !all {
+        return 0, fmt.Errorf("purge spans tenants: %w", ErrForbidden)
+    }
+    return r.next.PurgeDeleted(ctx, olderThan)
+}
+
+func (r *TenantRepository) SaveAll(ctx context.Context, users []*User) error {
+    for _, user := range users {
+        if err := r.stamp(ctx, user); err != nil {
+            return err
+        }
+    }
+    return r.next.SaveAll(ctx, users)
+}
+
+// DeleteAll reports IDs outside the caller's tenant as not found, at their
+// positions in ids.
+func (r *TenantRepository) DeleteAll(ctx context.Context, ids []UserID) error {
+    filter, err := r.filter(ctx, UserFilter{IDs: ids})
+    if err != nil {
+        return err
+    }
+    owned, err := r.next.FindWhere(ctx, filter)
+    if err != nil {
+        return err
+    }
+    isOwned := make(map[UserID]bool, len(owned))
+    for _, u := range owned {
+        isOwned[u.ID] = true
+    }
+
+    var (
+        allowed  []UserID
+        index    []int // position in ids of each allowed ID
+        failures []BulkFailure
+    )
+    for i, id := range ids {
+        if !isOwned[id] {
+            failures = append(failures, BulkFailure{Index: i, ID: id, Err: fmt.Errorf("user with ID %d %w", id, ErrNotFound)})
+            continue
+        }
+        allowed = append(allowed, id)
+        index = append(index, i)
+    }
+    if len(allowed) > 0 {
+        err := r.next.DeleteAll(ctx, allowed)
+        var bulk *BulkError
+        if errors.As(err, &bulk) {
+            for _, f := range bulk.Failures {
+                f.Index = index[f.Index]
+                failures = append(failures, f)
+            }
+        } else if err != nil {
+            return err
+        }
+    }
+    if len(failures) == 0 {
+        return nil
+    }
+    sort.Slice(failures, func(i, j int) bool { return failures[i].Index < failures[j].Index })
+    return &BulkError{Total: len(ids), Failures: failures}
+}
+
+func (r *TenantRepository) WithinTx(ctx context.Context, fn func(UserRepository) error) error {
+    return WithinTx(ctx, r.next, func(tx UserRepository) error {
+        return fn(&TenantRepository{next: tx})
+    })
+}
+
+// Caching decorator
+//
+// CachedRepository serves FindByID from an in-memory LRU in front of any
+// Repository[ID, T]. Every write through it invalidates the affected ID.
+// CachingRepository applies it to users and passes every other query
+// straight through to the wrapped UserRepository.
+var (
+    _ Repository[UserID, *User] = (*CachedRepository[UserID, *User])(nil)
+    _ UserRepository            = (*CachingRepository)(nil)
+)
+
+// CacheConfig sizes the cache. TTL of zero means entries only leave by
+// eviction or invalidation.
+type CacheConfig struct {
+    Size int
+    TTL  time.Duration
+}
+
+const DefaultCacheSize = 1024
+
+type CachedRepository[ID comparable, T Entity[ID]] struct {
+    next  Repository[ID, T]
+    cache *lruCache[ID, T]
+}
+
+func NewCachedRepository[ID comparable, T Entity[ID]](next Repository[ID, T], cfg CacheConfig) *CachedRepository[ID, T] {
+    if cfg.Size <= 0 {
+        cfg.Size = DefaultCacheSize
+    }
+    return &CachedRepository[ID, T]{next: next, cache: newLRUCache[ID, T](cfg.Size, cfg.TTL)}
+}
+
+func (r *CachedRepository[ID, T]) FindByID(ctx context.Context, id ID) (T, error) {
+    if entity, ok := r.cache.get(id); ok {
+        return entity, nil
+    }
+    entity, err := r.next.FindByID(ctx, id)
+    if err != nil {
+        return entity, err
+    }
+    r.cache.put(id, entity)
+    return entity, nil
+}
+
+func (r *CachedRepository[ID, T]) Save(ctx context.Context, entity T) error {
+    err := r.next.Save(ctx, entity)
+    r.cache.remove(entity.EntityID())
+    return err
+}
+
+func (r *CachedRepository[ID, T]) Insert(ctx context.Context, entity T) error {
+    err := r.next.Insert(ctx, entity)
+    r.cache.remove(entity.EntityID())
+    return err
+}
+
+func (r *CachedRepository[ID, T]) Delete(ctx context.Context, id ID) error {
+    err := r.next.Delete(ctx, id)
+    r.cache.remove(id)
+    return err
+}
+
+// Invalidate drops ids written by a path that bypassed this cache.
+func (r *CachedRepository[ID, T]) Invalidate(ids ...ID) {
+    for _, id := range ids {
+        r.cache.remove(id)
+    }
+}
+
+// InvalidateAll empties the cache.
+func (r *CachedRepository[ID, T]) InvalidateAll() {
+    r.cache.clear()
+}
+
+type CachingRepository struct {
+    UserRepository
+    cached *CachedRepository[UserID, *User]
+}
+
+func NewCachingRepository(next UserRepository, cfg CacheConfig) *CachingRepository {
+    return &CachingRepository{UserRepository: next, cached: NewCachedRepository[UserID, *User](next, cfg)}
+}
+
+func (r *CachingRepository) FindByID(ctx context.Context, id UserID) (*User, error) {
+    return r.cached.FindByID(ctx, id)
+}
+
+func (r *CachingRepository) Save(ctx context.Context, user *User) error {
+    return r.cached.Save(ctx, user)
+}
+
+func (r *CachingRepository) Insert(ctx context.Context, user *User) error {
+    return r.cached.Insert(ctx, user)
+}
+
+func (r *CachingRepository) Delete(ctx context.Context, id UserID) error {
+    return r.cached.Delete(ctx, id)
+}
+
+func (r *CachingRepository) Restore(ctx context.Context, id UserID) error {
+    err := r.UserRepository.Restore(ctx, id)
+    r.cached.Invalidate(id)
+    return err
+}
+
+func (r *CachingRepository) SaveAll(ctx context.Context, users []*User) error {
+    err := r.UserRepository.SaveAll(ctx, users)
+    for _, user := range users {
+        r.cached.Invalidate(user.ID)
+    }
+    return err
+}
+
+func (r *CachingRepository) DeleteAll(ctx context.Context, ids []UserID) error {
+    err := r.UserRepository.DeleteAll(ctx, ids)
+    r.cached.Invalidate(ids...)
+    return err
+}
+
+// WithinTx runs against the uncached backend and drops the whole cache
+// afterwards, since the transaction may have written any ID.
+func (r *CachingRepository) WithinTx(ctx context.Context, fn func(UserRepository) error) error {
+    defer r.cached.InvalidateAll()
+    return WithinTx(ctx, r.UserRepository, fn)
+}
+
+// Unwrap returns the decorated repository; see findRepository.
+func (r *CachingRepository) Unwrap() UserRepository {
+    return r.UserRepository
+}
+
+// lruCache is a fixed-size, optionally expiring LRU safe for concurrent use.
+type lruCache[K comparable, V any] struct {
+    mu      sync.Mutex
+    size    int
+    ttl     time.Duration
+    order   *list.List // front = most recently used
+    entries map[K]*list.Element
+}
+
+type lruEntry[K comparable, V any] struct {
+    key     K
+    value   V
+    expires time.Time
+}
+
+func newLRUCache[K comparable, V any](size int, ttl time.Duration) *lruCache[K, V] {
+    return &lruCache[K, V]{size: size, ttl: ttl, order: list.New(), entries: make(map[K]*list.Element)}
+}
+
+func (c *lruCache[K, V]) get(key K) (V, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    var zero V
+    el, ok := c.entries[key]
+    if !ok {
+        return zero, false
+    }
+    entry := el.Value.(*lruEntry[K, V])
+    if c.ttl > 0 && time.Now().After(entry.expires) {
+        c.order.Remove(el)
+        delete(c.entries, key)
+        return zero, false
+    }
+    c.order.MoveToFront(el)
+    return entry.value, true
+}
+
+func (c *lruCache[K, V]) put(key K, value V) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    entry := &lruEntry[K, V]{key: key, value: value, expires: time.Now().Add(c.ttl)}
+    if el, ok := c.entries[key]; ok {
+        el.Value = entry
+        c.order.MoveToFront(el)
+        return
+    }
+    c.entries[key] = c.order.PushFront(entry)
+    if c.order.Len() > c.size {
+        oldest := c.order.Back()
+        c.order.Remove(oldest)
+        delete(c.entries, oldest.Value.(*lruEntry[K, V]).key)
+    }
+}
+
+func (c *lruCache[K, V]) remove(key K) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if el, ok := c.entries[key]; ok {
+        c.order.Remove(el)
+        delete(c.entries, key)
+    }
+}
+
+func (c *lruCache[K, V]) clear() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.order.Init()
+    clear(c.entries)
+}
+
+// Read/write split
+//
+// CompositeRepository sends writes (and transactions) to a primary and
+// spreads reads across replicas using a ReplicaSelector. A read that fails on
+// a replica for any reason other than ErrNotFound is retried on the primary,
+// so a lagging or broken replica degrades to extra primary load rather than
+// errors.
+var _ UserRepository = (*CompositeRepository)(nil)
+
+type CompositeRepository struct {
+    primary  UserRepository
+    replicas []UserRepository
+    selector ReplicaSelector
+}
+
+// ReplicaSelector picks which of n replicas serves the next read and learns
+// from how each read went.
+type ReplicaSelector interface {
+    Pick(n int) int
+    Observe(replica int, elapsed time.Duration, err error)
+}
+
+// NewCompositeRepository uses round-robin selection when selector is nil.
+func NewCompositeRepository(primary UserRepository, replicas []UserRepository, selector ReplicaSelector) *CompositeRepository {
+    if selector == nil {
+        selector = &RoundRobinSelector{}
+    }
+    return &CompositeRepository{primary: primary, replicas: replicas, selector: selector}
+}
+
+// RoundRobinSelector cycles through replicas in order.
+type RoundRobinSelector struct {
+    next atomic.Uint64
+}
+
+func (s *RoundRobinSelector) Pick(n int) int {
+    return int((s.next.Add(1) - 1) % uint64(n))
+}
+
+func (s *RoundRobinSelector) Observe(int, time.Duration, error) {}
+
+// FastestSelector picks the replica with the lowest moving-average latency.
+// Failures count as FailurePenalty so a broken replica drops out of favour,
+// and replicas with no samples yet are tried first.
+type FastestSelector struct {
+    mu      sync.Mutex
+    latency map[int]time.Duration
+}
+
+const FailurePenalty = 5 * time.Second
+
+func (s *FastestSelector) Pick(n int) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    best := 0
+    for i := 0; i < n; i++ {
+        l, seen := s.latency[i]
+        if !seen {
+            return i
+        }
+        if l < s.latency[best] {
+            best = i
+        }
+    }
+    return best
+}
+
+func (s *FastestSelector) Observe(replica int, elapsed time.Duration, err error) {
+    if err != nil && !errors.Is(err, ErrNotFound) {
+        elapsed = FailurePenalty
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.latency == nil {
+        s.latency = make(map[int]time.Duration)
+    }
+    prev, seen := s.latency[replica]
+    if !seen {
+        s.latency[replica] = elapsed
+        return
+    }
+    // Exponentially weighted: new samples count for a fifth.
+    s.latency[replica] = (prev*4 + elapsed) / 5
+}
+
+// read runs fn on a replica, falling back to the primary as described above.
+func read[R any](r *CompositeRepository, fn func(UserRepository) (R, error)) (R, error) {
+    if len(r.replicas) == 0 {
+        return fn(r.primary)
+    }
+    i := r.selector.Pick(len(r.replicas))
+    start := time.Now()
+    result, err := fn(r.replicas[i])
+    r.selector.Observe(i, time.Since(start), err)
+    if err == nil || errors.Is(err, ErrNotFound) {
+        return result, err
+    }
+    return fn(r.primary)
+}
+
+func (r *CompositeRepository) FindByID(ctx context.Context, id UserID) (*User, error) {
+    return read(r, func(repo UserRepository) (*User, error) { return repo.FindByID(ctx, id) })
+}
+
+func (r *CompositeRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+    return read(r, func(repo UserRepository) (*User, error) { return repo.FindByEmail(ctx, email) })
+}
+
+func (r *CompositeRepository) FindAll(ctx context.Context, order SortSpec) ([]*User, error) {
+    return read(r, func(repo UserRepository) ([]*User, error) { return repo.FindAll(ctx, order) })
+}
+
+func (r *CompositeRepository) FindPage(ctx context.Context, page PageRequest) (*Page, error) {
+    return read(r, func(repo UserRepository) (*Page, error) { return repo.FindPage(ctx, page) })
+}
+
+func (r *CompositeRepository) FindWhere(ctx context.Context, filter UserFilter) ([]*User, error) {
+    return read(r, func(repo UserRepository) ([]*User, error) { return repo.FindWhere(ctx, filter) })
+}
+
+// FindAllIter streams from one replica with no fallback, since part of the
+// stream may already have been consumed when an error surfaces.
+func (r *CompositeRepository) FindAllIter(ctx context.Context) iter.Seq2[*User, error] {
+    if len(r.replicas) == 0 {
+        return r.primary.FindAllIter(ctx)
+    }
+    return r.replicas[r.selector.Pick(len(r.replicas))].FindAllIter(ctx)
+}
+
+func (r *CompositeRepository) Save(ctx context.Context, user *User) error {
+    return r.primary.Save(ctx, user)
+}
+
+func (r *CompositeRepository) Insert(ctx context.Context, user *User) error {
+    return r.primary.Insert(ctx, user)
+}
+
+func (r *CompositeRepository) Delete(ctx context.Context, id UserID) error {
+    return r.primary.Delete(ctx, id)
+}
+
+func (r *CompositeRepository) Restore(ctx context.Context, id UserID) error {
+    return r.primary.Restore(ctx, id)
+}
+
+func (r *CompositeRepository) PurgeDeleted(ctx context.Context, olderThan time.Duration) (int, error) {
+    return r.primary.PurgeDeleted(ctx, olderThan)
+}
+
+func (r *CompositeRepository) SaveAll(ctx context.Context, users []*User) error {
+    return r.primary.SaveAll(ctx, users)
+}
+
+func (r *CompositeRepository) DeleteAll(ctx context.Context, ids []UserID) error {
+    return r.primary.DeleteAll(ctx, ids)
+}
+
+// WithinTx runs entirely on the primary so reads see the transaction's writes.
+func (r *CompositeRepository) WithinTx(ctx context.Context, fn func(UserRepository) error) error {
+    return WithinTx(ctx, r.primary, fn)
+}
+
+// Lifecycle hooks
+//
+// HookedRepository wraps any UserRepository and runs registered hooks around
+// writes, so features like audit records or denormalized indexes can
+// subscribe without touching the backends. A Before hook returning an error
+// vetoes the write. An After hook error is returned to the caller even though
+// the write already happened.
+var _ UserRepository = (*HookedRepository)(nil)
+
+type (
+    SaveHook   func(ctx context.Context, user *User) error
+    DeleteHook func(ctx context.Context, id UserID) error
+)
+
+type HookedRepository struct {
+    UserRepository
+    mu           sync.RWMutex
+    beforeSave   []SaveHook
+    afterSave    []SaveHook
+    beforeDelete []DeleteHook
+    afterDelete  []DeleteHook
+}
+
+func NewHookedRepository(next UserRepository) *HookedRepository {
+    return &HookedRepository{UserRepository: next}
+}
+
+// Unwrap returns the decorated repository; see findRepository.
+func (r *HookedRepository) Unwrap() UserRepository {
+    return r.UserRepository
+}
+
+func (r *HookedRepository) BeforeSave(h SaveHook) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.beforeSave = append(r.beforeSave, h)
+}
+
+func (r *HookedRepository) AfterSave(h SaveHook) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.afterSave = append(r.afterSave, h)
+}
+
+func (r *HookedRepository) BeforeDelete(h DeleteHook) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.beforeDelete = append(r.beforeDelete, h)
+}
+
+func (r *HookedRepository) AfterDelete(h DeleteHook) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.afterDelete = append(r.afterDelete, h)
+}
+
+func (r *HookedRepository) runSave(ctx context.Context, hooks func() []SaveHook, user *User, stage string) error {
+    r.mu.RLock()
+    list := hooks()
+    r.mu.RUnlock()
+    for _, h := range list {
+        if err := h(ctx, user); err != nil {
+            return fmt.Errorf("%s hook: %w", stage, err)
+        }
+    }
+    return nil
+}
+
+func (r *HookedRepository) runDelete(ctx context.Context, hooks func() []DeleteHook, id UserID, stage string) error {
+    r.mu.RLock()
+    list := hooks()
+    r.mu.RUnlock()
+    for _, h := range list {
+        if err := h(ctx, id); err != nil {
+            return fmt.Errorf("%s hook: %w", stage, err)
+        }
+    }
+    return nil
+}
+
+func (r *HookedRepository) before(ctx context.Context, user *User) error {
+    return r.runSave(ctx, func() []SaveHook { return r.beforeSave }, user, "before-save")
+}
+
+func (r *HookedRepository) after(ctx context.Context, user *User) error {
+    return r.runSave(ctx, func() []SaveHook { return r.afterSave }, user, "after-save")
+}
+
+func (r *HookedRepository) Save(ctx context.Context, user *User) error {
+    if err := r.before(ctx, user); err != nil {
+        return err
+    }
+    if err := r.UserRepository.Save(ctx, user); err != nil {
+        return err
+    }
+    return r.after(ctx, user)
+}
+
+func (r *HookedRepository) Insert(ctx context.Context, user *User) error {
+    if err := r.before(ctx, user); err != nil {
+        return err
+    }
+    if err := r.UserRepository.Insert(ctx, user); err != nil {
+        return err
+    }
+    return r.after(ctx, user)
+}
+
+func (r *HookedRepository) Delete(ctx context.Context, id UserID) error {
+    if err := r.runDelete(ctx, func() []DeleteHook { return r.beforeDelete }, id, "before-delete"); err != nil {
+        return err
+    }
+    if err := r.UserRepository.Delete(ctx, id); err != nil {
+        return err
+    }
+    return r.runDelete(ctx, func() []DeleteHook { return r.afterDelete }, id, "after-delete")
+}
+
+// SaveAll and DeleteAll run the hooks per item; vetoed items and failed
+// after-hooks are reported in the *BulkError alongside backend failures.
+func (r *HookedRepository) SaveAll(ctx context.Context, users []*User) error {
+    var failures []BulkFailure
+    var passed []*User
+    var index []int // position in users of each passed entry
+    for i, user := range users {
+        if err := r.before(ctx, user); err != nil {
+            failures = append(failures, BulkFailure{Index: i, ID: user.ID, Err: err})
+            continue
+        }
+        passed = append(passed, user)
+        index = append(index, i)
+    }
+
+    failed, err := remapBulk(r.UserRepository.SaveAll(ctx, passed), index, &failures)
+    if err != nil {
+        return err
+    }
+    for j, user := range passed {
+        if failed[index[j]] {
+            continue
+        }
+        if err := r.after(ctx, user); err != nil {
+            failures = append(failures, BulkFailure{Index: index[j], ID: user.ID, Err: err})
+        }
+    }
+    sort.Slice(failures, func(i, j int) bool { return failures[i].Index < failures[j].Index })
+    return bulkError(len(users), failures)
+}
+
+func (r *HookedRepository) DeleteAll(ctx context.Context, ids []UserID) error {
+    var failures []BulkFailure
+    var passed []UserID
+    var index []int
+    for i, id := range ids {
+        if err := r.runDelete(ctx, func() []DeleteHook { return r.beforeDelete }, id, "before-delete"); err != nil {
+            failures = append(failures, BulkFailure{Index: i, ID: id, Err: err})
+            continue
+        }
+        passed = append(passed, id)
+        index = append(index, i)
+    }
+
+    failed, err := remapBulk(r.UserRepository.DeleteAll(ctx, passed), index, &failures)
+    if err != nil {
+        return err
+    }
+    for j, id := range passed {
+        if failed[index[j]] {
+            continue
+        }
+        if err := r.runDelete(ctx, func() []DeleteHook { return r.afterDelete }, id, "after-delete"); err != nil {
+            failures = append(failures, BulkFailure{Index: index[j], ID: id, Err: err})
+        }
+    }
+    sort.Slice(failures, func(i, j int) bool { return failures[i].Index < failures[j].Index })
+    return bulkError(len(ids), failures)
+}
+
+// remapBulk translates a *BulkError over a filtered subset back to indexes in
+// the original input, appending to failures. Other errors are returned as-is.
+func remapBulk(err error, index []int, failures *[]BulkFailure) (map[int]bool, error) {
+    failed := map[int]bool{}
+    var bulk *BulkError
+    if errors.As(err, &bulk) {
+        for _, f := range bulk.Failures {
+            f.Index = index[f.Index]
+            failed[f.Index] = true
+            *failures = append(*failures, f)
+        }
+        return failed, nil
+    }
+    return failed, err
+}
+
+// WithinTx fires the same hooks for writes made inside the transaction.
+func (r *HookedRepository) WithinTx(ctx context.Context, fn func(UserRepository) error) error {
+    return WithinTx(ctx, r.UserRepository, func(tx UserRepository) error {
+        r.mu.RLock()
+        hooked := &HookedRepository{
+            UserRepository: tx,
+            beforeSave:     r.beforeSave,
+            afterSave:      r.afterSave,
+            beforeDelete:   r.beforeDelete,
+            afterDelete:    r.afterDelete,
+        }
+        r.mu.RUnlock()
+        return fn(hooked)
+    })
+}
+
+// Backups
+//
+// BackupScheduler snapshots a repository on a fixed interval into a
+// BackupStore, writing a SHA-256 checksum next to each backup and pruning old
+// ones. Start it with the app and Stop it on shutdown. LocalBackupStore keeps
+// backups in a directory and S3BackupStore in an S3 bucket; ParseBackupStore
+// picks one from a -backup flag.
+// Snapshot is called from the scheduler's goroutine, so the source must be
+// safe for concurrent use with the app's writers.
+type Snapshotter interface {
+    Snapshot() ([]byte, error)
+}
+
+type BackupStore interface {
+    Put(ctx context.Context, name string, data []byte) error
+    Get(ctx context.Context, name string) ([]byte, error)
+    List(ctx context.Context) ([]string, error)
+    Delete(ctx context.Context, name string) error
+}
+
+// BackupConfig controls scheduling and retention. Keep and MaxAge both
+// prune; zero disables that rule. The newest backup is never pruned.
+type BackupConfig struct {
+    Interval time.Duration
+    Keep     int
+    MaxAge   time.Duration
+}
+
+const (
+    DefaultBackupInterval = time.Hour
+    DefaultBackupKeep     = 24
+    backupPrefix          = "users-"
+    backupSuffix          = ".json"
+    checksumSuffix        = ".sha256"
+    backupTimeFormat      = "20060102T150405.000000000Z"
+)
+
+type BackupScheduler struct {
+    source Snapshotter
+    store  BackupStore
+    cfg    BackupConfig
+    logger Logger
+
+    mu     sync.Mutex
+    cancel context.CancelFunc
+    done   chan struct{}
+}
+
+func NewBackupScheduler(source Snapshotter, store BackupStore, cfg BackupConfig, logger Logger) *BackupScheduler {
+    if cfg.Interval <= 0 {
+        cfg.Interval = DefaultBackupInterval
+    }
+    return &BackupScheduler{source: source, store: store, cfg: cfg, logger: logger}
+}
+
+// Start runs backups in the background until Stop is called or ctx ends.
+// Calling Start on a running scheduler does nothing.
+func (b *BackupScheduler) Start(ctx context.Context) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.cancel != nil {
+        return
+    }
+    ctx, b.cancel = context.WithCancel(ctx)
+    b.done = make(chan struct{})
+
+    go func() {
+        defer close(b.done)
+        ticker := time.NewTicker(b.cfg.Interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+                if _, err := b.RunOnce(ctx); err != nil {
+                    b.logger.Error("Backup failed", "error", err)
+                }
+            }
+        }
+    }()
+}
+
+// Stop halts the schedule and waits for an in-flight backup to finish.
+func (b *BackupScheduler) Stop() {
+    b.mu.Lock()
+    cancel, done := b.cancel, b.done
+    b.cancel, b.done = nil, nil
+    b.mu.Unlock()
+    if cancel != nil {
+        cancel()
+        <-done
+    }
+}
+
+// RunOnce takes one backup immediately, applies retention, and returns the
+// backup's name.
+func (b *BackupScheduler) RunOnce(ctx context.Context) (string, error) {
+    data, err := b.source.Snapshot()
+    if err != nil {
+        return "", fmt.Errorf("snapshot: %w", err)
+    }
+    name := backupPrefix + time.Now().UTC().Format(backupTimeFormat) + backupSuffix
+    sum := sha256.Sum256(data)
+    if err := b.store.Put(ctx, name, data); err != nil {
+        return "", err
+    }
+    if err := b.store.Put(ctx, name+checksumSuffix, []byte(hex.EncodeToString(sum[:]))); err != nil {
+        return "", err
+    }
+    b.logger.Info("Backup written", "backup", name, "bytes", len(data))
+    return name, b.prune(ctx)
+}
+
+func (b *BackupScheduler) prune(ctx context.Context) error {
+    names, err := listBackups(ctx, b.store)
+    if err != nil {
+        return err
+    }
+    cutoff := time.Now().Add(-b.cfg.MaxAge)
+    for i, name := range names[:max(len(names)-1, 0)] { // oldest first; keep the newest
+        tooMany := b.cfg.Keep > 0 && len(names)-i > b.cfg.Keep
+        tooOld := false
+        if taken, err := backupTime(name); b.cfg.MaxAge > 0 && err == nil {
+            tooOld = taken.Before(cutoff)
+        }
+        if !tooMany && !tooOld {
+            continue
+        }
+        if err := b.store.Delete(ctx, name); err != nil {
+            return err
+        }
+        if err := b.store.Delete(ctx, name+checksumSuffix); err != nil && !errors.Is(err, ErrNotFound) {
+            return err
+        }
+    }
+    return nil
+}
+
+// listBackups returns backup names (not checksum files), oldest first.
+func listBackups(ctx context.Context, store BackupStore) ([]string, error) {
+    all, err := store.List(ctx)
+    if err != nil {
+        return nil, err
+    }
+    var names []string
+    for _, name := range all {
+        if strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names) // timestamped names sort chronologically
+    return names, nil
+}
+
+func backupTime(name string) (time.Time, error) {
+    stamp := strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix)
+    return time.Parse(backupTimeFormat, stamp)
+}
+
+// LoadBackup fetches a backup and verifies it against its checksum, so a
+// corrupted file is never restored.
+func LoadBackup(ctx context.Context, store BackupStore, name string) ([]byte, error) {
+    data, err := store.Get(ctx, name)
+    if err != nil {
+        return nil, err
+    }
+    want, err := store.Get(ctx, name+checksumSuffix)
+    if err != nil {
+        return nil, fmt.Errorf("checksum for %s: %w", name, err)
+    }
+    sum := sha256.Sum256(data)
+    if hex.EncodeToString(sum[:]) != strings.TrimSpace(string(want)) {
+        return nil, fmt.Errorf("backup %s fails checksum verification", name)
+    }
+    return data, nil
+}
+
+// LocalBackupStore keeps backups as files in one directory.
+type LocalBackupStore struct {
+    Dir string
+}
+
+func (s LocalBackupStore) Put(ctx context.Context, name string, data []byte) error {
+    if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+        return err
+    }
+    return os.WriteFile(filepath.Join(s.Dir, name), data, 0o600)
+}
+
+func (s LocalBackupStore) Get(ctx context.Context, name string) ([]byte, error) {
+    data, err := os.ReadFile(filepath.Join(s.Dir, name))
+    if errors.Is(err, os.ErrNotExist) {
+        return nil, fmt.Errorf("backup %s %w", name, ErrNotFound)
+    }
+    return data, err
+}
+
+func (s LocalBackupStore) List(ctx context.Context) ([]string, error) {
+    entries, err := os.ReadDir(s.Dir)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    names := make([]string, 0, len(entries))
+    for _, e := range entries {
+        if !e.IsDir() {
+            names = append(names, e.Name())
+        }
+    }
+    return names, nil
+}
+
+func (s LocalBackupStore) Delete(ctx context.Context, name string) error {
+    err := os.Remove(filepath.Join(s.Dir, name))
+    if errors.Is(err, os.ErrNotExist) {
+        return fmt.Errorf("backup %s %w", name, ErrNotFound)
+    }
+    return err
+}
+
+// S3BackupStore keeps backups as objects named Prefix+name in an S3
+// bucket, signing requests with AWS Signature Version 4. With Endpoint
+// set, as for MinIO or another S3-compatible service, the bucket is
+// addressed path-style under it; otherwise requests go to the bucket's
+// virtual-hosted AWS endpoint in Region. Deleting a missing object isn't
+// an error, as S3 doesn't report it.
+type S3BackupStore struct {
+    Bucket          string
+    Prefix          string
+    Region          string // defaults to us-east-1
+    Endpoint        string
+    AccessKeyID     string
+    SecretAccessKey Secret
+    SessionToken    Secret // for temporary credentials
+    Client          *http.Client
+}
+
+// NewS3BackupStore returns a store for bucket, with credentials and
+// region from the standard AWS environment variables.
+func NewS3BackupStore(bucket, prefix string) *S3BackupStore {
+    return &S3BackupStore{
+        Bucket:          bucket,
+        Prefix:          prefix,
+        Region:          cmp.Or(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")),
+        AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+        SecretAccessKey: NewSecret(os.Getenv("AWS_SECRET_ACCESS_KEY")),
+        SessionToken:    NewSecret(os.Getenv("AWS_SESSION_TOKEN")),
+    }
+}
+
+func (s *S3BackupStore) Put(ctx context.Context, name string, data []byte) error {
+    resp, err := s.do(ctx, http.MethodPut, s.Prefix+name, nil, data)
+    if err != nil {
+        return err
+    }
+    return resp.Body.Close()
+}
+
+func (s *S3BackupStore) Get(ctx context.Context, name string) ([]byte, error) {
+    resp, err := s.do(ctx, http.MethodGet, s.Prefix+name, nil, nil)
+    if errors.Is(err, ErrNotFound) {
+        return nil, fmt.Errorf("backup %s %w", name, ErrNotFound)
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    return io.ReadAll(resp.Body)
+}
+
+// List pages through ListObjectsV2, returning names without the prefix.
+func (s *S3BackupStore) List(ctx context.Context) ([]string, error) {
+    var names []string
+    query := url.Values{"list-type": {"2"}, "prefix": {s.Prefix}}
+    for {
+        resp, err := s.do(ctx, http.MethodGet, "", query, nil)
+        if err != nil {
+            return nil, err
+        }
+        var page struct {
+            Contents []struct {
+                Key string
+            }
+            IsTruncated           bool
+            NextContinuationToken string
+        }
+        err = xml.NewDecoder(resp.Body).Decode(&page)
+        resp.Body.Close()
+        if err != nil {
+            return nil, fmt.Errorf("list s3://%s/%s: %w", s.Bucket, s.Prefix, err)
+        }
+        for _, obj := range page.Contents {
+            names = append(names, strings.TrimPrefix(obj.Key, s.Prefix))
+        }
+        if !page.IsTruncated || page.NextContinuationToken == "" {
+            return names, nil
+        }
+        query.Set("continuation-token", page.NextContinuationToken)
+    }
+}
+
+func (s *S3BackupStore) Delete(ctx context.Context, name string) error {
+    resp, err := s.do(ctx, http.MethodDelete, s.Prefix+name, nil, nil)
+    if err != nil {
+        return err
+    }
+    return resp.Body.Close()
+}
+
+// do sends a signed request for key, or for the bucket when key is empty,
+// and returns the response if it succeeded. A missing key is an error
+// wrapping ErrNotFound.
+func (s *S3BackupStore) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+    u := &url.URL{Scheme: "https", Host: s.Bucket + ".s3." + s.region() + ".amazonaws.com", Path: "/" + key}
+    if s.Endpoint != "" {
+        base, err := url.Parse(s.Endpoint)
+        if err != nil {
+            return nil, fmt.Errorf("s3 endpoint: %w", err)
+        }
+        u.Scheme, u.Host = base.Scheme, base.Host
+        u.Path = strings.TrimRight(base.Path, "/") + "/" + s.Bucket + "/" + key
+    }
+    u.RawPath = s3Escape(u.Path, true)
+    u.RawQuery = s3CanonicalQuery(query)
+    req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+    if err != nil {
+        return nil, err
+    }
+    signSigV4(req, body, time.Now(), s.credentials())
+    client := s.Client
+    if client == nil {
+        client = &http.Client{Timeout: time.Minute}
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode/100 == 2 {
+        return resp, nil
+    }
+    defer resp.Body.Close()
+    var s3err struct {
+        Code    string
+        Message string
+    }
+    xml.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&s3err)
+    target := "s3://" + s.Bucket + "/" + key
+    if resp.StatusCode == http.StatusNotFound && key != "" {
+        return nil, fmt.Errorf("%s %s: %w", method, target, ErrNotFound)
+    }
+    if s3err.Code != "" {
+        return nil, fmt.Errorf("%s %s: %s: %s: %s", method, target, resp.Status, s3err.Code, s3err.Message)
+    }
+    return nil, fmt.Errorf("%s %s: %s", method, target, resp.Status)
+}
+
+func (s *S3BackupStore) region() string {
+    return cmp.Or(s.Region, "us-east-1")
+}
+
+func (s *S3BackupStore) credentials() sigV4Credentials {
+    return sigV4Credentials{
+        Region:          s.region(),
+        AccessKeyID:     s.AccessKeyID,
+        SecretAccessKey: s.SecretAccessKey,
+        SessionToken:    s.SessionToken,
+    }
+}
+
+// sigV4Credentials are what signSigV4 signs an S3 request with.
+type sigV4Credentials struct {
+    Region          string
+    AccessKeyID     string
+    SecretAccessKey Secret
+    SessionToken    Secret // for temporary credentials
+}
+
+// signSigV4 adds AWS Signature Version 4 headers for S3 to req, covering
+// the host and every header already set. Headers set afterwards go
+// unsigned.
+func signSigV4(req *http.Request, body []byte, now time.Time, creds sigV4Credentials) {
+    stamp := now.UTC().Format("20060102T150405Z")
+    scope := stamp[:8] + "/" + creds.Region + "/s3/aws4_request"
+    sum := sha256.Sum256(body)
+    req.Header.Set("X-Amz-Date", stamp)
+    req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+    if !creds.SessionToken.IsZero() {
+        req.Header.Set("X-Amz-Security-Token", creds.SessionToken.Reveal())
+    }
+
+    headers := map[string]string{"host": req.URL.Host}
+    for name, values := range req.Header {
+        headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+    }
+    names := slices.Sorted(maps.Keys(headers))
+    var canonical strings.Builder
+    fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, req.URL.EscapedPath(), req.URL.RawQuery)
+    for _, name := range names {
+        fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+    }
+    signed := strings.Join(names, ";")
+    fmt.Fprintf(&canonical, "\n%s\n%s", signed, hex.EncodeToString(sum[:]))
+
+    hashed := sha256.Sum256([]byte(canonical.String()))
+    toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+    key := []byte("AWS4" + creds.SecretAccessKey.Reveal())
+    for _, part := range strings.Split(scope, "/") {
+        key = hmacSHA256(key, part)
+    }
+    req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%x",
+        creds.AccessKeyID, scope, signed, hmacSHA256(key, toSign)))
+}
+
+// s3CanonicalQuery encodes query sorted by key, as SigV4 signs it.
+func s3CanonicalQuery(query url.Values) string {
+    pairs := make([]string, 0, len(query))
+    for _, key := range slices.Sorted(maps.Keys(query)) {
+        for _, value := range query[key] {
+            pairs = append(pairs, s3Escape(key, false)+"="+s3Escape(value, false))
+        }
+    }
+    return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes all but RFC 3986 unreserved characters, and
+// slashes if keepSlash.
+func s3Escape(s string, keepSlash bool) string {
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+            c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && keepSlash {
+            b.WriteByte(c)
+        } else {
+            fmt.Fprintf(&b, "%%%02X", c)
+        }
+    }
+    return b.String()
+}
+
+// ParseBackupStore builds a BackupStore from a directory, or from
+// "s3://BUCKET/PREFIX" with optional region and endpoint query parameters,
+// as in s3://backups/zaai/?endpoint=http://localhost:9000. S3 credentials
+// come from the environment; see NewS3BackupStore.
+func ParseBackupStore(spec string) (BackupStore, error) {
+    if !strings.HasPrefix(spec, "s3://") {
+        return LocalBackupStore{Dir: spec}, nil
+    }
+    u, err := url.Parse(spec)
+    if err != nil {
+        return nil, fmt.Errorf("backup destination: %w", err)
+    }
+    if u.Host == "" {
+        return nil, fmt.Errorf("backup destination %q names no bucket", spec)
+    }
+    store := NewS3BackupStore(u.Host, strings.TrimPrefix(u.Path, "/"))
+    q := u.Query()
+    store.Region = cmp.Or(q.Get("region"), store.Region)
+    store.Endpoint = q.Get("endpoint")
+    return store, nil
+}
+
+// Worker pool
+//
+// WorkerPool runs a function over tasks with at most a fixed number of
+// workers at once. Submit queues a task, waiting while the workers are
+// busy and the queue is full. Close stops taking tasks, waits for those
+// queued to finish, and returns a PoolResult for each in submission
+// order, so one failing task doesn't stop the rest. Once the pool's
+// context ends, tasks not yet started fail with its cause rather than
+// run. RunPool is the one-shot form over a slice.
+
+var ErrPoolClosed = errors.New("worker pool closed")
+
+// PoolResult is the outcome of the task submitted Index-th, from 0.
+type PoolResult[R any] struct {
+    Index int
+    Value R
+    Err   error
+}
+
+type WorkerPool[T, R any] struct {
+    ctx   context.Context
+    fn    func(context.Context, T) (R, error)
+    tasks chan poolTask[T]
+    wg    sync.WaitGroup
+
+    mu        sync.RWMutex // held to send on tasks, locked to close it
+    closed    bool
+    submitted atomic.Int64
+
+    resultsMu sync.Mutex
+    results   []PoolResult[R]
+}
+
+type poolTask[T any] struct {
+    index int
+    task  T
+}
+
+// NewWorkerPool starts workers goroutines, GOMAXPROCS if zero, running
+// fn with ctx.
+func NewWorkerPool[T, R any](ctx context.Context, workers int, fn func(context.Context, T) (R, error)) *WorkerPool[T, R] {
+    if workers <= 0 {
+        workers = runtime.GOMAXPROCS(0)
+    }
+    p := &WorkerPool[T, R]{ctx: ctx, fn: fn, tasks: make(chan poolTask[T], workers)}
+    p.wg.Add(workers)
+    for range workers {
+        go p.work()
+    }
+    return p
+}
+
+func (p *WorkerPool[T, R]) work() {
+    defer p.wg.Done()
+    for t := range p.tasks {
+        r := PoolResult[R]{Index: t.index}
+        if err := context.Cause(p.ctx); err != nil {
+            r.Err = err
+        } else {
+            r.Value, r.Err = p.fn(p.ctx, t.task)
+        }
+        p.record(r)
+    }
+}
+
+func (p *WorkerPool[T, R]) record(r PoolResult[R]) {
+    p.resultsMu.Lock()
+    defer p.resultsMu.Unlock()
+    p.results = append(p.results, r)
+}
+
+// Submit queues task. It fails with ErrPoolClosed after Close, and with
+// the context's cause if that ends first, in which case the task's
+// result records the same error.
+func (p *WorkerPool[T, R]) Submit(task T) error {
+    p.mu.RLock()
+    defer p.mu.RUnlock()
+    if p.closed {
+        return ErrPoolClosed
+    }
+    index := int(p.submitted.Add(1) - 1)
+    select {
+    case p.tasks <- poolTask[T]{index: index, task: task}:
+        return nil
+    case <-p.ctx.Done():
+        err := context.Cause(p.ctx)
+        p.record(PoolResult[R]{Index: index, Err: err})
+        return err
+    }
+}
+
+// Close stops taking tasks, waits for the queued ones, and returns every
+// result in submission order. Later calls return the same results.
+func (p *WorkerPool[T, R]) Close() []PoolResult[R] {
+    p.mu.Lock()
+    if !p.closed {
+        p.closed = true
+        close(p.tasks)
+    }
+    p.mu.Unlock()
+    p.wg.Wait()
+
+    p.resultsMu.Lock()
+    defer p.resultsMu.Unlock()
+    slices.SortFunc(p.results, func(a, b PoolResult[R]) int { return cmp.Compare(a.Index, b.Index) })
+    return slices.Clone(p.results)
+}
+
+// RunPool runs fn over tasks with at most workers at once and returns
+// the results in task order.
+func RunPool[T, R any](ctx context.Context, workers int, tasks []T, fn func(context.Context, T) (R, error)) []PoolResult[R] {
+    if len(tasks) == 0 {
+        return nil
+    }
+    if workers <= 0 {
+        workers = runtime.GOMAXPROCS(0)
+    }
+    workers = min(workers, len(tasks))
+    p := NewWorkerPool(ctx, workers, fn)
+    for _, task := range tasks {
+        p.Submit(task) // a refused task's result carries the error
+    }
+    return p.Close()
+}
+
+// PoolErrors joins the errors among results, in order; nil if none failed.
+func PoolErrors[R any](results []PoolResult[R]) error {
+    var errs []error
+    for _, r := range results {
+        if r.Err != nil {
+            errs = append(errs, r.Err)
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// CSV import
+//
+// ImportUsersCSV streams users from CSV with a header row naming the columns
+// name, email, age, status (any order; age and status optional). Rows are
+// validated one by one and saved in batches through SaveAll, so memory use is
+// bounded by the batch size rather than the file size. ImportUsersCSVWith
+// can save several batches at once on a WorkerPool.
+type ImportReport struct {
+    Imported   int         `json:"imported"`
+    Duplicates []ImportRow `json:"duplicates,omitempty"`
+    Invalid    []ImportRow `json:"invalid,omitempty"`
+    Failed     []ImportRow `json:"failed,omitempty"`
+}
+
+// ImportRow points at a CSV line (1-based, header is line 1) that was not
+// imported.
+type ImportRow struct {
+    Line   int    `json:"line"`
+    Email  string `json:"email,omitempty"`
+    Reason string `json:"reason"`
+}
+
+const (
+    DefaultImportBatchSize = 500
+    DefaultImportWorkers   = 4
+    MaxUserAge             = 150
+    // MaxImportSeen bounds the emails an import remembers to name the
+    // earlier line a duplicate repeats. Past it, duplicates are still
+    // caught when the repository refuses them, as ErrEmailTaken.
+    MaxImportSeen = 100_000
+)
+
+// ImportOptions tunes ImportUsersCSVWith.
+type ImportOptions struct {
+    BatchSize int // DefaultImportBatchSize if zero
+    // Workers is how many batches may be saved at once; 1 if zero. More
+    // need a repository safe for concurrent use, like the SQL ones, and
+    // batches may then land out of file order.
+    Workers int
+}
+
+// ImportUsersCSV imports batches one at a time.
+func ImportUsersCSV(ctx context.Context, repo UserRepository, in io.Reader, batchSize int) (*ImportReport, error) {
+    return ImportUsersCSVWith(ctx, repo, in, ImportOptions{BatchSize: batchSize})
+}
+
+// importBatch is a batch of users and the CSV lines they came from.
+type importBatch struct {
+    users []*User
+    lines []int
+}
+
+// ImportUsersCSVWith imports as ImportUsersCSV does. A batch failing
+// other than user by user stops the import: batches not yet saved are
+// skipped, and the error is returned with the report of those that were.
+func ImportUsersCSVWith(ctx context.Context, repo UserRepository, in io.Reader, opts ImportOptions) (*ImportReport, error) {
+    batchSize := cmp.Or(opts.BatchSize, DefaultImportBatchSize)
+    r := csv.NewReader(in)
+    r.TrimLeadingSpace = true
+    r.FieldsPerRecord = -1 // trailing optional columns may be omitted
+
+    header, err := r.Read()
+    if err != nil {
+        return nil, fmt.Errorf("read CSV header: %w", err)
+    }
+    cols := map[string]int{}
+    for i, name := range header {
+        cols[strings.ToLower(strings.TrimSpace(name))] = i
+    }
+    for _, required := range []string{"name", "email"} {
+        if _, ok := cols[required]; !ok {
+            return nil, fmt.Errorf("CSV header is missing the %q column", required)
+        }
+    }
+    field := func(record []string, name string) string {
+        if i, ok := cols[name]; ok && i < len(record) {
+            return strings.TrimSpace(record[i])
+        }
+        return ""
+    }
+
+    report := &ImportReport{}
+    seen := map[string]int{} // lowercased email -> first line
+    var batch importBatch
+
+    ctx, stop := context.WithCancelCause(ctx)
+    defer stop(nil)
+    pool := NewWorkerPool(ctx, cmp.Or(opts.Workers, 1), func(ctx context.Context, b importBatch) (*ImportReport, error) {
+        saved := &ImportReport{}
+        err := repo.SaveAll(ctx, b.users)
+        var bulk *BulkError
+        if errors.As(err, &bulk) {
+            for _, f := range bulk.Failures {
+                row := ImportRow{Line: b.lines[f.Index], Email: b.users[f.Index].Email, Reason: f.Err.Error()}
+                if errors.Is(f.Err, ErrEmailTaken) {
+                    saved.Duplicates = append(saved.Duplicates, row)
+                } else {
+                    saved.Failed = append(saved.Failed, row)
+                }
+            }
+        } else if err != nil {
+            stop(err)
+            return nil, err
+        }
+        saved.Imported = len(b.users) - len(saved.Duplicates) - len(saved.Failed)
+        return saved, nil
+    })
+    // finish waits for the batches submitted and merges their reports.
+    finish := func() (*ImportReport, error) {
+        var err error
+        for _, res := range pool.Close() {
+            if res.Err != nil {
+                err = cmp.Or(err, res.Err)
+                continue
+            }
+            report.Imported += res.Value.Imported
+            report.Duplicates = append(report.Duplicates, res.Value.Duplicates...)
+            report.Failed = append(report.Failed, res.Value.Failed...)
+        }
+        byLine := func(a, b ImportRow) int { return cmp.Compare(a.Line, b.Line) }
+        slices.SortStableFunc(report.Duplicates, byLine)
+        slices.SortStableFunc(report.Failed, byLine)
+        return report, err
+    }
+
+    line := 1
+    for {
+        record, err := r.Read()
+        if err == io.EOF {
+            break
+        }
+        line++
+        if err != nil {
+            report.Invalid = append(report.Invalid, ImportRow{Line: line, Reason: err.Error()})
+            continue
+        }
+
+        user, err := parseImportRow(field(record, "name"), field(record, "email"), field(record, "age"), field(record, "status"))
+        if err != nil {
+            report.Invalid = append(report.Invalid, ImportRow{Line: line, Email: field(record, "email"), Reason: err.Error()})
+            continue
+        }
+        key := strings.ToLower(user.Email)
+        if first, dup := seen[key]; dup {
+            report.Duplicates = append(report.Duplicates, ImportRow{Line: line, Email: user.Email, Reason: fmt.Sprintf("same email as line %d", first)})
+            continue
+        }
+        if len(seen) < MaxImportSeen {
+            seen[key] = line
+        }
+
+        batch.users = append(batch.users, user)
+        batch.lines = append(batch.lines, line)
+        if len(batch.users) >= batchSize {
+            if err := pool.Submit(batch); err != nil {
+                return finish()
+            }
+            batch = importBatch{}
+        }
+    }
+    if len(batch.users) > 0 {
+        pool.Submit(batch) // a refused batch's result carries the error
+    }
+    return finish()
+}
+
+func parseImportRow(name, email, age, status string) (*User, error) {
+    if name == "" {
+        return nil, errors.New("name is required")
+    }
+    email, err := NormalizeEmail(email)
+    if err != nil {
+        return nil, err
+    }
+    user := &User{Name: name, Email: email, Status: StatusActive, Role: RoleMember, Preferences: DefaultPrefs}
+    if age != "" {
+        n, err := strconv.Atoi(age)
+        if err != nil || n < 0 || n > MaxUserAge {
+            return nil, fmt.Errorf("invalid age %q", age)
+        }
+        user.Age = intPtr(n)
+    }
+    switch Status(strings.ToLower(status)) {
+    case "":
+    case StatusActive, StatusInactive, StatusPending:
+        user.Status = Status(strings.ToLower(status))
+    default:
+        return nil, fmt.Errorf("unknown status %q", status)
+    }
+    return user, nil
+}
+
+// JSON export
+//
+// ExportUsersJSON writes every live user as NDJSON: one JSON object per
+// line, in the order FindAllIter yields them. Users are encoded as they
+// are read rather than collected first, so memory use stays the same
+// however many users there are.
+
+// ExportUsersJSON returns how many users it wrote. If it fails part way,
+// w holds the users before the failure, each on a complete line.
+func ExportUsersJSON(ctx context.Context, repo UserRepository, w io.Writer) (int, error) {
+    bw := bufio.NewWriter(w)
+    enc := json.NewEncoder(bw)
+    exported := 0
+    for user, err := range repo.FindAllIter(ctx) {
+        if err == nil {
+            err = enc.Encode(user)
+        }
+        if err != nil {
+            bw.Flush()
+            return exported, err
+        }
+        exported++
+    }
+    return exported, bw.Flush()
+}
+
+// Contact details
+
+type Phone struct {
+    // Number is in E.164 form: "+", country code, subscriber number, at
+    // most 15 digits in all.
+    Number    string `json:"number"`
+    Extension string `json:"extension,omitempty"`
+}
+
+// NormalizePhone strips common separators (spaces, dashes, dots and
+// parentheses) and checks the result is an E.164 number. A leading "00"
+// international prefix is accepted in place of "+".
+func NormalizePhone(number string) (string, error) {
+    cleaned := strings.Map(func(r rune) rune {
+        if strings.ContainsRune(" -.()", r) {
+            return -1
+        }
+        return r
+    }, strings.TrimSpace(number))
+    if rest, ok := strings.CutPrefix(cleaned, "00"); ok {
+        cleaned = "+" + rest
+    }
+    digits, ok := strings.CutPrefix(cleaned, "+")
+    if !ok || len(digits) < 2 || len(digits) > 15 || digits[0] == '0' || strings.Trim(digits, "0123456789") != "" {
+        return "", fmt.Errorf("invalid phone number %q: want E.164, e.g. +14155550123", number)
+    }
+    return "+" + digits, nil
+}
+
+func (p Phone) normalized() (*Phone, error) {
+    number, err := NormalizePhone(p.Number)
+    if err != nil {
+        return nil, err
+    }
+    if strings.Trim(p.Extension, "0123456789") != "" || len(p.Extension) > 10 {
+        return nil, fmt.Errorf("invalid phone extension %q", p.Extension)
+    }
+    return &Phone{Number: number, Extension: p.Extension}, nil
+}
+
+type Address struct {
+    Line1      string `json:"line1"`
+    Line2      string `json:"line2,omitempty"`
+    City       string `json:"city"`
+    Region     string `json:"region,omitempty"` // state, province, county...
+    PostalCode string `json:"postal_code,omitempty"`
+    Country    string `json:"country"` // ISO 3166-1 alpha-2
+}
+
+// AddressValidator checks the country-specific parts of an address, which
+// arrives trimmed, with an upper-case Country and the common fields
+// already present.
+type AddressValidator func(Address) error
+
+// DefaultAddressValidators cover a few common countries; addresses
+// elsewhere only get the common checks unless WithAddressValidator adds
+// one.
+var DefaultAddressValidators = map[string]AddressValidator{
+    "US": func(a Address) error {
+        if len(a.Region) != 2 {
+            return errors.New("US addresses need a two-letter state")
+        }
+        return checkPostalCode(a, "#####", "#####-####")
+    },
+    "CA": func(a Address) error {
+        if a.Region == "" {
+            return errors.New("Canadian addresses need a province")
+        }
+        return checkPostalCode(a, "A#A #A#", "A#A#A#")
+    },
+    "GB": func(a Address) error {
+        // UK postcodes vary too much for a pattern; check the shape.
+        if n := len(strings.ReplaceAll(a.PostalCode, " ", "")); n < 5 || n > 7 {
+            return fmt.Errorf("invalid UK postcode %q", a.PostalCode)
+        }
+        return nil
+    },
+    "DE": func(a Address) error { return checkPostalCode(a, "#####") },
+    "FR": func(a Address) error { return checkPostalCode(a, "#####") },
+}
+
+// checkPostalCode matches a's postal code against patterns where # is a
+// digit, A a letter and any other character itself.
+func checkPostalCode(a Address, patterns ...string) error {
+    code := strings.ToUpper(a.PostalCode)
+    for _, pattern := range patterns {
+        if len(code) != len(pattern) {
+            continue
+        }
+        ok := true
+        for i := range len(pattern) {
+            c := code[i]
+            switch pattern[i] {
+            case '#':
+                ok = c >= '0' && c <= '9'
+            case 'A':
+                ok = c >= 'A' && c <= 'Z'
+            default:
+                ok = c == pattern[i]
+            }
+            if !ok {
+                break
+            }
+        }
+        if ok {
+            return nil
+        }
+    }
+    return fmt.Errorf("invalid postal code %q for %s", a.PostalCode, a.Country)
+}
+
+// validateAddress trims addr, checks the fields every address needs and
+// then runs the validator registered for its country.
+func (s *UserService) validateAddress(addr Address) (*Address, error) {
+    for _, f := range []*string{&addr.Line1, &addr.Line2, &addr.City, &addr.Region, &addr.PostalCode, &addr.Country} {
+        *f = strings.TrimSpace(*f)
+    }
+    addr.Country = strings.ToUpper(addr.Country)
+    addr.PostalCode = strings.ToUpper(addr.PostalCode)
+    switch {
+    case addr.Line1 == "":
+        return nil, errors.New("address line1 is required")
+    case addr.City == "":
+        return nil, errors.New("address city is required")
+    case len(addr.Country) != 2 || strings.Trim(addr.Country, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "":
+        return nil, fmt.Errorf("invalid country %q: want an ISO 3166-1 alpha-2 code", addr.Country)
+    }
+    if validate, ok := s.addresses[addr.Country]; ok {
+        if err := validate(addr); err != nil {
+            return nil, err
+        }
+    }
+    return &addr, nil
+}
+
+// Avatars
+//
+// SetAvatar validates an uploaded image, center-crops it to a square and
+// stores a PNG rendition for each of AvatarSizes in an AvatarStore. The
+// user's AvatarURL points at the largest one; GetAvatar serves any size.
+
+const (
+    MaxAvatarBytes = 5 << 20
+    // MaxAvatarPixels bounds decoded dimensions, since a small compressed
+    // file can expand to gigabytes of pixels.
+    MaxAvatarPixels = 4096 * 4096
+)
+
+// AvatarSizes are the square edge lengths stored for every avatar, largest
+// first.
+var AvatarSizes = []int{256, 128, 64}
+
+var allowedAvatarTypes = []string{"image/png", "image/jpeg", "image/gif"}
+
+// AvatarStore keeps avatar images by key and returns the URL they are
+// served from.
+type AvatarStore interface {
+    Put(ctx context.Context, key, contentType string, data []byte) (string, error)
+    Get(ctx context.Context, key string) ([]byte, error)
+    Delete(ctx context.Context, key string) error
+}
+
+func avatarKey(id UserID, size int) string {
+    return fmt.Sprintf("avatars/%d/%d.png", id, size)
+}
+
+// SetAvatar replaces user id's avatar with the image read from r, which
+// must be a PNG, JPEG or GIF of at most MaxAvatarBytes. Users may set
+// their own; others need ActionUpdateUser.
+func (s *UserService) SetAvatar(ctx context.Context, id UserID, r io.Reader) (*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if err := s.authorize(ctx, ActionUpdateUser, id); err != nil {
+        return nil, err
+    }
+    if s.avatars == nil {
+        return nil, errors.New("no avatar store configured")
+    }
+    if _, err := s.repo.FindByID(ctx, id); err != nil {
+        return nil, err
+    }
+    data, err := io.ReadAll(io.LimitReader(r, MaxAvatarBytes+1))
+    if err != nil {
+        return nil, err
+    }
+    img, err := decodeAvatar(data)
+    if err != nil {
+        return nil, err
+    }
+
+    var url string
+    for _, size := range AvatarSizes {
+        var buf bytes.Buffer
+        if err := png.Encode(&buf, resizeSquare(img, size)); err != nil {
+            return nil, err
+        }
+        u, err := s.avatars.Put(ctx, avatarKey(id, size), "image/png", buf.Bytes())
+        if err != nil {
+            s.log(ctx).Error("Failed to store avatar", "target", id, "error", err)
+            return nil, err
+        }
+        if url == "" {
+            url = u
+        }
+    }
+
+    var updated User
+    err = WithinTx(ctx, s.repo, func(repo UserRepository) error {
+        current, err := repo.FindByID(ctx, id)
+        if err != nil {
+            return err
+        }
+        updated = *current
+        updated.AvatarURL = url
+        return repo.Save(ctx, &updated)
+    })
+    if err != nil {
+        return nil, err
+    }
+    s.log(ctx).Info("Avatar updated", "target", id)
+    s.emit(ctx, EventUserUpdated, id, &updated)
+    return &updated, nil
+}
+
+// GetAvatar returns the PNG rendition of user id's avatar at size, one of
+// AvatarSizes.
+func (s *UserService) GetAvatar(ctx context.Context, id UserID, size int) ([]byte, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if s.avatars == nil {
+        return nil, errors.New("no avatar store configured")
+    }
+    if !slices.Contains(AvatarSizes, size) {
+        return nil, fmt.Errorf("avatar size %d not in %v", size, AvatarSizes)
+    }
+    user, err := s.repo.FindByID(ctx, id)
+    if err != nil {
+        return nil, err
+    }
+    if user.AvatarURL == "" {
+        return nil, fmt.Errorf("avatar for user %d %w", id, ErrNotFound)
+    }
+    return s.avatars.Get(ctx, avatarKey(id, size))
+}
+
+// deleteAvatars removes every stored rendition, logging failures; the
+// user record no longer points at them either way. Erasing, anonymizing
+// and purging a user call it.
+func (s *UserService) deleteAvatars(ctx context.Context, id UserID) {
+    if s.avatars == nil {
+        return
+    }
+    for _, size := range AvatarSizes {
+        if err := s.avatars.Delete(ctx, avatarKey(id, size)); err != nil && !errors.Is(err, ErrNotFound) {
+            s.log(ctx).Error("Failed to delete avatar", "key", avatarKey(id, size), "error", err)
+        }
+    }
+}
+
+func decodeAvatar(data []byte) (image.Image, error) {
+    if len(data) > MaxAvatarBytes {
+        return nil, fmt.Errorf("avatar exceeds %d bytes", MaxAvatarBytes)
+    }
+    if ct := http.DetectContentType(data); !slices.Contains(allowedAvatarTypes, ct) {
+        return nil, fmt.Errorf("unsupported avatar type %s", ct)
+    }
+    cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        return nil, fmt.Errorf("invalid avatar image: %w", err)
+    }
+    if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > MaxAvatarPixels {
+        return nil, fmt.Errorf("avatar dimensions %dx%d not allowed", cfg.Width, cfg.Height)
+    }
+    img, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        return nil, fmt.Errorf("invalid avatar image: %w", err)
+    }
+    return img, nil
+}
+
+// resizeSquare center-crops src to a square and scales it to size×size,
+// averaging the source pixels under each destination pixel (a box filter),
+// which is enough for downscaling photos to thumbnails.
+func resizeSquare(src image.Image, size int) *image.RGBA {
+    b := src.Bounds()
+    side := min(b.Dx(), b.Dy())
+    x0 := b.Min.X + (b.Dx()-side)/2
+    y0 := b.Min.Y + (b.Dy()-side)/2
+
+    dst := image.NewRGBA(image.Rect(0, 0, size, size))
+    for dy := 0; dy < size; dy++ {
+        sy0 := y0 + dy*side/size
+        sy1 := max(y0+(dy+1)*side/size, sy0+1)
+        for dx := 0; dx < size; dx++ {
+            sx0 := x0 + dx*side/size
+            sx1 := max(x0+(dx+1)*side/size, sx0+1)
+            var r, g, bl, a, n uint64
+            for sy := sy0; sy < sy1; sy++ {
+                for sx := sx0; sx < sx1; sx++ {
+                    cr, cg, cb, ca := src.At(sx, sy).RGBA()
+                    r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+                    n++
+                }
+            }
+            dst.Set(dx, dy, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+        }
+    }
+    return dst
+}
+
+// LocalAvatarStore writes avatars under Dir, to be served at BaseURL by
+// any static file server.
+type LocalAvatarStore struct {
+    Dir     string
+    BaseURL string
+}
+
+func (l LocalAvatarStore) Put(ctx context.Context, key, contentType string, data []byte) (string, error) {
+    path := filepath.Join(l.Dir, filepath.FromSlash(key))
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+        return "", err
+    }
+    // Write then rename so readers never see a partial image.
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0o644); err != nil {
+        return "", err
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        return "", err
+    }
+    return strings.TrimSuffix(l.BaseURL, "/") + "/" + key, nil
+}
+
+func (l LocalAvatarStore) Get(ctx context.Context, key string) ([]byte, error) {
+    data, err := os.ReadFile(filepath.Join(l.Dir, filepath.FromSlash(key)))
+    if errors.Is(err, os.ErrNotExist) {
+        return nil, fmt.Errorf("avatar %s %w", key, ErrNotFound)
+    }
+    return data, err
+}
+
+func (l LocalAvatarStore) Delete(ctx context.Context, key string) error {
+    err := os.Remove(filepath.Join(l.Dir, filepath.FromSlash(key)))
+    if errors.Is(err, os.ErrNotExist) {
+        return nil
+    }
+    return err
+}
+
+// S3AvatarStore keeps avatars in an S3 (or S3-compatible) bucket using
+// path-style requests signed with AWS Signature Version 4. PublicURL, if
+// set, replaces Endpoint/Bucket in returned URLs, e.g. for a CDN.
+type S3AvatarStore struct {
+    Endpoint        string // e.g. https://s3.us-east-1.amazonaws.com
+    Region          string
+    Bucket          string
+    AccessKeyID     string
+    SecretAccessKey Secret
+    SessionToken    Secret // for temporary credentials
+    PublicURL       string
+    Client          *http.Client // http.DefaultClient if nil
+}
+
+func (s3 S3AvatarStore) credentials() sigV4Credentials {
+    return sigV4Credentials{
+        Region:          s3.Region,
+        AccessKeyID:     s3.AccessKeyID,
+        SecretAccessKey: s3.SecretAccessKey,
+        SessionToken:    s3.SessionToken,
+    }
+}
+
+func (s3 S3AvatarStore) objectURL(key string) string {
+    return strings.TrimSuffix(s3.Endpoint, "/") + "/" + s3.Bucket + "/" + key
+}
+
+func (s3 S3AvatarStore) Put(ctx context.Context, key, contentType string, data []byte) (string, error) {
+    resp, err := s3.do(ctx, http.MethodPut, key, data, contentType)
+    if err != nil {
+        return "", err
+    }
+    resp.Body.Close()
+    if s3.PublicURL != "" {
+        return strings.TrimSuffix(s3.PublicURL, "/") + "/" + key, nil
+    }
+    return s3.objectURL(key), nil
+}
+
+func (s3 S3AvatarStore) Get(ctx context.Context, key string) ([]byte, error) {
+    resp, err := s3.do(ctx, http.MethodGet, key, nil, "")
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    return io.ReadAll(resp.Body)
+}
+
+func (s3 S3AvatarStore) Delete(ctx context.Context, key string) error {
+    resp, err := s3.do(ctx, http.MethodDelete, key, nil, "")
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    return nil
+}
+
+func (s3 S3AvatarStore) do(ctx context.Context, method, key string, body []byte, contentType string) (*http.Response, error) {
+    req, err := http.NewRequestWithContext(ctx, method, s3.objectURL(key), bytes.NewReader(body))
+    if err != nil {
+        return nil, err
+    }
+    if contentType != "" {
+        req.Header.Set("Content-Type", contentType)
+    }
+    signSigV4(req, body, time.Now(), s3.credentials())
+    propagateContext(ctx, req) // unsigned, so it can't break the signature
+    client := s3.Client
+    if client == nil {
+        client = http.DefaultClient
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    switch {
+    case resp.StatusCode == http.StatusNotFound:
+        resp.Body.Close()
+        return nil, fmt.Errorf("avatar %s %w", key, ErrNotFound)
+    case resp.StatusCode >= 300:
+        resp.Body.Close()
+        return nil, fmt.Errorf("s3 %s %s: %s", method, key, resp.Status)
+    }
+    return resp, nil
+}
+
+// Job scheduler
+//
+// Scheduler runs registered jobs on cron-like schedules. Each job has its
+// own goroutine and runs at most once at a time: a run that overlaps the
+// next slot makes the job skip it rather than pile up.
+
+// Schedule yields the next run time strictly after a given time.
+type Schedule interface {
+    Next(after time.Time) time.Time
+}
+
+type everySchedule time.Duration
+
+func (e everySchedule) Next(after time.Time) time.Time {
+    return after.Add(time.Duration(e))
+}
+
+// cronSchedule matches the five standard cron fields, each kept as a
+// bitset of allowed values.
+type cronSchedule struct {
+    minute, hour, dom, month, dow uint64
+    // Per cron convention, when both day fields are restricted a day
+    // matches if either does.
+    domAny, dowAny bool
+}
+
+var cronAliases = map[string]string{
+    "@hourly":  "0 * * * *",
+    "@daily":   "0 0 * * *",
+    "@weekly":  "0 0 * * 0",
+    "@monthly": "0 0 1 * *",
+}
+
+// ParseSchedule accepts "@every <duration>", @hourly, @daily, @weekly,
+// @monthly, or a five-field cron expression ("minute hour day-of-month
+// month day-of-week") with *, lists, ranges and /steps. Cron times are in
+// the location of the time passed to Next.
+func ParseSchedule(expr string) (Schedule, error) {
+    expr = strings.TrimSpace(expr)
+    if rest, ok := strings.CutPrefix(expr, "@every "); ok {
+        d, err := time.ParseDuration(strings.TrimSpace(rest))
+        if err != nil || d <= 0 {
+            return nil, fmt.Errorf("invalid schedule %q: want a positive duration", expr)
+        }
+        return everySchedule(d), nil
+    }
+    if alias, ok := cronAliases[expr]; ok {
+        expr = alias
+    }
+    fields := strings.Fields(expr)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("invalid schedule %q: want 5 cron fields", expr)
+    }
+    var c cronSchedule
+    bounds := []struct {
+        dst      *uint64
+        min, max int
+    }{{&c.minute, 0, 59}, {&c.hour, 0, 23}, {&c.dom, 1, 31}, {&c.month, 1, 12}, {&c.dow, 0, 6}}
+    for i, f := range fields {
+        bits, err := parseCronField(f, bounds[i].min, bounds[i].max)
+        if err != nil {
+            return nil, fmt.Errorf("invalid schedule %q: %w", expr, err)
+        }
+        *bounds[i].dst = bits
+    }
+    c.domAny, c.dowAny = fields[2] == "*", fields[4] == "*"
+    return c, nil
+}
+
+func parseCronField(field string, lo, hi int) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(field, ",") {
+        rng, stepStr, hasStep := strings.Cut(part, "/")
+        step := 1
+        if hasStep {
+            n, err := strconv.Atoi(stepStr)
+            if err != nil || n <= 0 {
+                return 0, fmt.Errorf("bad step in %q", part)
+            }
+            step = n
+        }
+        start, end := lo, hi
+        if rng != "*" {
+            a, b, isRange := strings.Cut(rng, "-")
+            var err error
+            if start, err = strconv.Atoi(a); err != nil {
+                return 0, fmt.Errorf("bad value in %q", part)
+            }
+            end = start
+            if isRange {
+                if end, err = strconv.Atoi(b); err != nil {
+                    return 0, fmt.Errorf("bad range in %q", part)
+                }
+            } else if hasStep {
+                end = hi
+            }
+        }
+        if start < lo || end > hi || start > end {
+            return 0, fmt.Errorf("%q out of range %d-%d", part, lo, hi)
+        }
+        for v := start; v <= end; v += step {
+            bits |= 1 << v
+        }
+    }
+    return bits, nil
+}
+
+func (c cronSchedule) Next(after time.Time) time.Time {
+    // Truncate works in absolute time, which is off by the zone's offset
+    // in zones like UTC+5:30, so the jumps below go through time.Date in
+    // the schedule's own location. Rebuilding after itself with time.Date
+    // could land on the earlier of a repeated hour, before after.
+    t := after.Add(time.Minute - time.Duration(after.Second())*time.Second - time.Duration(after.Nanosecond()))
+    // Every valid expression matches within a few years; the bound only
+    // guards against ones like "0 0 31 2 *" that never do.
+    limit := t.AddDate(5, 0, 0)
+    for t.Before(limit) {
+        switch {
+        case c.month&(1<<uint(t.Month())) == 0:
+            t = forward(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location()))
+        case !c.dayMatches(t):
+            t = forward(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()))
+        case c.hour&(1<<uint(t.Hour())) == 0:
+            t = forward(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location()))
+        case c.minute&(1<<uint(t.Minute())) == 0:
+            t = t.Add(time.Minute)
+        default:
+            return t
+        }
+    }
+    return time.Time{}
+}
+
+// forward returns next, a wall time after t, as an instant after t. A
+// wall time that a daylight saving gap skips, such as 02:00 on the day
+// clocks go from 02:00 to 03:00, is normalized by time.Date to the hour
+// before; moving on by the gap gives the first instant after it.
+func forward(t, next time.Time) time.Time {
+    for !next.After(t) {
+        next = next.Add(time.Hour)
+    }
+    return next
+}
+
+func (c cronSchedule) dayMatches(t time.Time) bool {
+    dom := c.dom&(1<<uint(t.Day())) != 0
+    dow := c.dow&(1<<uint(t.Weekday())) != 0
+    if c.domAny || c.dowAny {
+        return dom && dow
+    }
+    return dom || dow
+}
+
+type JobFunc func(ctx context.Context) error
+
+var ErrJobRunning = errors.New("job is already running")
+
+type scheduledJob struct {
+    name     string
+    schedule Schedule
+    run      JobFunc
+    running  sync.Mutex
+}
+
+type Scheduler struct {
+    logger Logger
+
+    mu     sync.Mutex
+    jobs   map[string]*scheduledJob
+    ctx    context.Context
+    cancel context.CancelFunc
+    wg     sync.WaitGroup
+}
+
+func NewScheduler(logger Logger) *Scheduler {
+    return &Scheduler{logger: logger, jobs: make(map[string]*scheduledJob)}
+}
+
+// Register adds a job under a unique name. Jobs registered while the
+// scheduler is running start right away.
+func (s *Scheduler) Register(name, expr string, run JobFunc) error {
+    schedule, err := ParseSchedule(expr)
+    if err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, exists := s.jobs[name]; exists {
+        return fmt.Errorf("job %q %w", name, ErrAlreadyExists)
+    }
+    job := &scheduledJob{name: name, schedule: schedule, run: run}
+    s.jobs[name] = job
+    if s.ctx != nil {
+        s.startLocked(job)
+    }
+    return nil
+}
+
+// Start runs every job on its schedule until Stop is called or ctx ends.
+// Calling Start on a running scheduler does nothing.
+func (s *Scheduler) Start(ctx context.Context) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.ctx != nil {
+        return
+    }
+    s.ctx, s.cancel = context.WithCancel(ctx)
+    for _, job := range s.jobs {
+        s.startLocked(job)
+    }
+}
+
+// Stop cancels the context of running jobs and waits for them to return.
+func (s *Scheduler) Stop() {
+    s.mu.Lock()
+    cancel := s.cancel
+    s.ctx, s.cancel = nil, nil
+    s.mu.Unlock()
+    if cancel != nil {
+        cancel()
+        s.wg.Wait()
+    }
+}
+
+// RunNow runs the named job immediately, or fails with ErrJobRunning if it
+// is in progress.
+func (s *Scheduler) RunNow(ctx context.Context, name string) error {
+    s.mu.Lock()
+    job, ok := s.jobs[name]
+    s.mu.Unlock()
+    if !ok {
+        return fmt.Errorf("job %q %w", name, ErrNotFound)
+    }
+    return s.execute(ctx, job)
+}
+
+func (s *Scheduler) startLocked(job *scheduledJob) {
+    ctx := s.ctx
+    s.wg.Add(1)
+    go func() {
+        defer s.wg.Done()
+        for {
+            next := job.schedule.Next(time.Now())
+            if next.IsZero() {
+                s.logger.Warn("Schedule never fires again", "job", job.name)
+                return
+            }
+            timer := time.NewTimer(time.Until(next))
+            select {
+            case <-ctx.Done():
+                timer.Stop()
+                return
+            case <-timer.C:
+            }
+            if err := s.execute(ctx, job); errors.Is(err, ErrJobRunning) {
+                s.logger.Info("Previous run still in progress, skipping", "job", job.name)
+            }
+        }
+    }()
+}
+
+func (s *Scheduler) execute(ctx context.Context, job *scheduledJob) error {
+    if !job.running.TryLock() {
+        return ErrJobRunning
+    }
+    defer job.running.Unlock()
+
+    s.logger.Info("Job started", "job", job.name)
+    start := time.Now()
+    err := job.run(ctx)
+    if err != nil {
+        s.logger.Error("Job failed", "job", job.name, "duration", time.Since(start), "error", err)
+        return err
+    }
+    s.logger.Info("Job finished", "job", job.name, "duration", time.Since(start))
+    return nil
+}
+
+// ExpirePendingUsersJob deactivates users left pending for olderThan, in
+// every tenant.
+func ExpirePendingUsersJob(svc *UserService, olderThan time.Duration) JobFunc {
+    return func(ctx context.Context) error {
+        _, err := svc.ExpirePendingUsers(WithAllTenants(ctx), olderThan)
+        return err
+    }
+}
+
+// PurgeDeletedJob permanently removes users soft-deleted over olderThan ago.
+func PurgeDeletedJob(repo UserRepository, olderThan time.Duration) JobFunc {
+    return func(ctx context.Context) error {
+        _, err := repo.PurgeDeleted(WithAllTenants(ctx), olderThan)
+        return err
+    }
+}
+
+// SimpleLogger logs through log/slog. The zero value writes to
+// slog.Default(), which drops Debug; NewSimpleLogger chooses the handler,
+// such as slog.NewJSONHandler for log shippers.
+type SimpleLogger struct {
+    l *slog.Logger
+}
+
+func NewSimpleLogger(h slog.Handler) *SimpleLogger {
+    return &SimpleLogger{l: slog.New(h)}
+}
+
+// NewLogHandler returns a slog handler writing format, "text", "json" or
+// "dev" (see NewDevHandler), to w, at level and above. Pass a
+// *slog.LevelVar to change the level while the handler is in use.
+func NewLogHandler(w io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+    opts := &slog.HandlerOptions{Level: level}
+    switch format {
+    case "text":
+        return slog.NewTextHandler(w, opts), nil
+    case "json":
+        return slog.NewJSONHandler(w, opts), nil
+    case "dev":
+        return NewDevHandler(w, level), nil
+    }
+    return nil, fmt.Errorf("unknown log format %q; want text, json or dev", format)
+}
+
+// Slog returns the underlying slog.Logger, for code written against
+// log/slog directly.
+func (l *SimpleLogger) Slog() *slog.Logger {
+    if l.l == nil {
+        return slog.Default()
+    }
+    return l.l
+}
+
+func (l *SimpleLogger) Info(msg string, attrs ...any) {
+    l.Slog().Info(msg, attrs...)
+}
+
+func (l *SimpleLogger) Warn(msg string, attrs ...any) {
+    l.Slog().Warn(msg, attrs...)
+}
+
+func (l *SimpleLogger) Error(msg string, attrs ...any) {
+    l.Slog().Error(msg, attrs...)
+}
+
+func (l *SimpleLogger) Debug(msg string, attrs ...any) {
+    l.Slog().Debug(msg, attrs...)
+}
+
+// WithContext adds the attributes ctx carries; see contextAttrs.
+func (l *SimpleLogger) WithContext(ctx context.Context) Logger {
+    attrs := contextAttrs(ctx)
+    if len(attrs) == 0 {
+        return l
+    }
+    return &SimpleLogger{l: l.Slog().With(attrs...)}
+}
+
+// AdaptPlainLogger lets a PlainLogger serve as a Logger. Attributes are
+// appended to the message as key=value pairs. Warnings go to the
+// PlainLogger's own Warn(string) method if it has one, and to Error
+// otherwise so they are not lost.
+func AdaptPlainLogger(p PlainLogger) Logger {
+    return plainLogger{p: p}
+}
+
+type plainLogger struct {
+    p     PlainLogger
+    attrs []any // from WithContext, logged before each call's own
+}
+
+func (l plainLogger) Info(msg string, attrs ...any)  { l.p.Info(l.format(msg, attrs)) }
+func (l plainLogger) Error(msg string, attrs ...any) { l.p.Error(l.format(msg, attrs)) }
+func (l plainLogger) Warn(msg string, attrs ...any) {
+    if w, ok := l.p.(interface{ Warn(string) }); ok {
+        w.Warn(l.format(msg, attrs))
+        return
+    }
+    l.p.Error(l.format(msg, attrs))
+}
+func (l plainLogger) Debug(msg string, attrs ...any) { l.p.Debug(l.format(msg, attrs)) }
+
+func (l plainLogger) WithContext(ctx context.Context) Logger {
+    attrs := contextAttrs(ctx)
+    if len(attrs) == 0 {
+        return l
+    }
+    return plainLogger{p: l.p, attrs: append(slices.Clip(l.attrs), attrs...)}
+}
+
+func (l plainLogger) format(msg string, attrs []any) string {
+    if len(l.attrs) > 0 {
+        attrs = append(slices.Clip(l.attrs), attrs...)
+    }
+    return appendAttrs(msg, attrs)
+}
+
+// appendAttrs formats attrs the way slog's text handler would, after msg.
+func appendAttrs(msg string, attrs []any) string {
+    if len(attrs) == 0 {
+        return msg
+    }
+    var r slog.Record
+    r.Add(attrs...)
+    var b strings.Builder
+    b.WriteString(msg)
+    r.Attrs(func(a slog.Attr) bool {
+        fmt.Fprintf(&b, " %s=%s", a.Key, quoteLogValue(a.Value.String()))
+        return true
+    })
+    return b.String()
+}
+
+// quoteLogValue quotes v if it would be ambiguous in key=value output.
+func quoteLogValue(v string) string {
+    if v == "" || strings.ContainsAny(v, " \"=\n") {
+        return strconv.Quote(v)
+    }
+    return v
+}
+
+// ParseLogLevel reads a level name, debug, info, warn or error in any
+// case, optionally with an offset such as "info+2".
+func ParseLogLevel(s string) (slog.Level, error) {
+    var level slog.Level
+    if err := level.UnmarshalText([]byte(s)); err != nil {
+        return 0, invalidInput(fmt.Errorf("unknown log level %q; want debug, info, warn or error", s))
+    }
+    return level, nil
+}
+
+// RotateConfig configures a RotatingFile. Zero limits are off: with no
+// MaxSize or MaxAge the file is never rotated, and with no MaxBackups or
+// Retain rotated files are kept forever.
+type RotateConfig struct {
+    // Path is the live log file; rotated files sit beside it as
+    // name-20060102T150405.000.ext, with .gz added when compressed and a
+    // -1, -2, ... before the extension when that name is taken.
+    Path string
+    // MaxSize rotates before a write would take the file past this many
+    // bytes.
+    MaxSize int64
+    // MaxAge rotates once the file has been open this long, counted from
+    // when the process opened it.
+    MaxAge     time.Duration
+    MaxBackups int
+    // Retain removes rotated files older than this.
+    Retain   time.Duration
+    Compress bool
+    // OnError receives the errors Write can't return because logging
+    // carried on past them: a failed rotation, and failures compressing
+    // or pruning rotated files, which happen in the background. They are
+    // dropped if it is nil.
+    OnError func(error)
+}
+
+// RotatingFile is an io.WriteCloser for log handlers that rotates its
+// file by size and age. Compressing and pruning rotated files happens in
+// the background so a rotation never stalls logging for long; Close waits
+// for it.
+type RotatingFile struct {
+    cfg RotateConfig
+
+    mu     sync.Mutex
+    f      *os.File
+    size   int64
+    opened time.Time
+    // retry holds off rotating again after a failed rename until then.
+    retry time.Time
+
+    cleaning sync.Mutex // serializes compress and prune
+    wg       sync.WaitGroup
+}
+
+// OpenRotatingFile opens cfg.Path for appending, creating it and its
+// directory if needed.
+func OpenRotatingFile(cfg RotateConfig) (*RotatingFile, error) {
+    if cfg.Path == "" {
+        return nil, errors.New("rotating file: no path")
+    }
+    if err := os.MkdirAll(filepath.Dir(cfg.Path), 0o755); err != nil {
+        return nil, fmt.Errorf("rotating file: %w", err)
+    }
+    r := &RotatingFile{cfg: cfg}
+    if err := r.open(); err != nil {
+        return nil, err
+    }
+    return r, nil
+}
+
+func (r *RotatingFile) open() error {
+    f, err := os.OpenFile(r.cfg.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+    if err != nil {
+        return fmt.Errorf("rotating file: %w", err)
+    }
+    info, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return fmt.Errorf("rotating file: %w", err)
+    }
+    r.f, r.size, r.opened = f, info.Size(), time.Now()
+    return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.f == nil {
+        return 0, os.ErrClosed
+    }
+    tooBig := r.cfg.MaxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.cfg.MaxSize
+    tooOld := r.cfg.MaxAge > 0 && time.Since(r.opened) >= r.cfg.MaxAge
+    if (tooBig || tooOld) && !time.Now().Before(r.retry) {
+        if err := r.rotate(); err != nil {
+            if r.f == nil {
+                return 0, err
+            }
+            r.report(err)
+        }
+    }
+    n, err := r.f.Write(p)
+    r.size += int64(n)
+    return n, err
+}
+
+// Rotate starts a new file now, for example on SIGHUP.
+func (r *RotatingFile) Rotate() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.f == nil {
+        return os.ErrClosed
+    }
+    return r.rotate()
+}
+
+// rotateRetryDelay spaces out attempts to rotate after a rename fails, so
+// a stuck rotation doesn't reopen the file and report on every write.
+const rotateRetryDelay = 10 * time.Second
+
+func (r *RotatingFile) rotate() error {
+    if err := r.f.Close(); err != nil {
+        return fmt.Errorf("rotating file: %w", err)
+    }
+    r.f = nil
+    backup := r.backupName(time.Now())
+    renameErr := os.Rename(r.cfg.Path, backup)
+    // Reopen even if the rename failed, so logging carries on in the
+    // old file rather than stopping; a later write tries again, with the
+    // file's age still counted from before.
+    opened := r.opened
+    if err := r.open(); err != nil {
+        return err
+    }
+    if renameErr != nil {
+        r.opened, r.retry = opened, time.Now().Add(rotateRetryDelay)
+        return fmt.Errorf("rotating file: %w", renameErr)
+    }
+    r.wg.Add(1)
+    go func() {
+        defer r.wg.Done()
+        r.cleanUp(backup)
+    }()
+    return nil
+}
+
+// backupName names the file rotated out at t, numbering it if an earlier
+// rotation in the same millisecond, say a SIGHUP right after a size
+// rotation, already took the name.
+func (r *RotatingFile) backupName(t time.Time) string {
+    ext := filepath.Ext(r.cfg.Path)
+    base := strings.TrimSuffix(r.cfg.Path, ext) + "-" + t.Format(rotateTimeFormat)
+    name := base + ext
+    for seq := 1; pathExists(name) || pathExists(name+".gz"); seq++ {
+        name = base + "-" + strconv.Itoa(seq) + ext
+    }
+    return name
+}
+
+func pathExists(path string) bool {
+    _, err := os.Lstat(path)
+    return err == nil
+}
+
+const rotateTimeFormat = "20060102T150405.000"
+
+// cleanUp compresses the file just rotated out, then enforces MaxBackups
+// and Retain. Errors go to OnError, since the log itself is the thing
+// being maintained.
+func (r *RotatingFile) cleanUp(backup string) {
+    r.cleaning.Lock()
+    defer r.cleaning.Unlock()
+    if r.cfg.Compress {
+        if err := gzipFile(backup); err != nil {
+            r.report(fmt.Errorf("rotating file: compressing %s: %w", backup, err))
+        }
+    }
+    backups, err := r.backups()
+    if err != nil {
+        r.report(fmt.Errorf("rotating file: %w", err))
+        return
+    }
+    for i, b := range backups {
+        expired := r.cfg.Retain > 0 && time.Since(b.at) > r.cfg.Retain
+        if (r.cfg.MaxBackups > 0 && i >= r.cfg.MaxBackups) || expired {
+            if err := os.Remove(b.path); err != nil {
+                r.report(fmt.Errorf("rotating file: %w", err))
+            }
+        }
+    }
+}
+
+func (r *RotatingFile) report(err error) {
+    if r.cfg.OnError != nil {
+        r.cfg.OnError(err)
+    }
+}
+
+type rotatedFile struct {
+    path string
+    at   time.Time
+    seq  int
+}
+
+// backups lists the rotated files, newest first.
+func (r *RotatingFile) backups() ([]rotatedFile, error) {
+    dir := filepath.Dir(r.cfg.Path)
+    ext := filepath.Ext(r.cfg.Path)
+    prefix := strings.TrimSuffix(filepath.Base(r.cfg.Path), ext) + "-"
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    var files []rotatedFile
+    for _, e := range entries {
+        stamp, ok := strings.CutPrefix(e.Name(), prefix)
+        if !ok || e.IsDir() {
+            continue
+        }
+        stamp = strings.TrimSuffix(strings.TrimSuffix(stamp, ".gz"), ext)
+        stamp, num, numbered := strings.Cut(stamp, "-")
+        at, err := time.ParseInLocation(rotateTimeFormat, stamp, time.Local)
+        if err != nil {
+            continue
+        }
+        seq := 0
+        if numbered {
+            if seq, err = strconv.Atoi(num); err != nil {
+                continue
+            }
+        }
+        files = append(files, rotatedFile{path: filepath.Join(dir, e.Name()), at: at, seq: seq})
+    }
+    slices.SortFunc(files, func(a, b rotatedFile) int {
+        return cmp.Or(b.at.Compare(a.at), cmp.Compare(b.seq, a.seq))
+    })
+    return files, nil
+}
+
+// gzipFile replaces path with path.gz.
+func gzipFile(path string) error {
+    src, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer src.Close()
+    tmp := path + ".gz.tmp"
+    dst, err := os.Create(tmp)
+    if err != nil {
+        return err
+    }
+    zw := gzip.NewWriter(dst)
+    _, err = io.Copy(zw, src)
+    if cerr := zw.Close(); err == nil {
+        err = cerr
+    }
+    if cerr := dst.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = os.Rename(tmp, path+".gz")
+    }
+    if err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    return os.Remove(path)
+}
+
+// Close closes the file and waits for background compression and pruning.
+func (r *RotatingFile) Close() error {
+    r.mu.Lock()
+    var err error
+    if r.f != nil {
+        err = r.f.Close()
+        r.f = nil
+    }
+    r.mu.Unlock()
+    r.wg.Wait()
+    return err
+}
+
+// DefaultRedactFields are the attribute keys a Redactor masks when given
+// none: personal data and credentials.
+var DefaultRedactFields = []string{
+    "email", "name", "first_name", "last_name", "phone", "address",
+    "password", "token", "access_token", "refresh_token", "api_key",
+    "secret", "authorization", "cookie",
+}
+
+var (
+    redactEmail = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+    // Bearer credentials, JWTs and API keys (see apiKeyPrefix) in free text.
+    redactToken = regexp.MustCompile(`(?i:bearer)\s+\S+|eyJ[\w-]+\.[\w-]+\.[\w-]*|` + apiKeyPrefix + `\d+_[\w-]+`)
+)
+
+const redacted = "[REDACTED]"
+
+// Redactor masks personal data in log lines. Attributes whose key is one
+// of its fields are masked whatever their value; elsewhere, in messages,
+// string values and errors, email addresses and tokens are found by
+// pattern. Emails keep their first letter and domain, a***@example.com,
+// so lines stay useful for debugging; everything else becomes
+// [REDACTED]. Names in free text can't be told apart from other words,
+// so log them as attributes.
+type Redactor struct {
+    fields map[string]bool
+}
+
+// NewRedactor masks the attributes named fields, matched case-
+// insensitively at any group depth, or DefaultRedactFields if none.
+func NewRedactor(fields ...string) *Redactor {
+    if len(fields) == 0 {
+        fields = DefaultRedactFields
+    }
+    r := &Redactor{fields: make(map[string]bool, len(fields))}
+    for _, f := range fields {
+        r.fields[strings.ToLower(strings.TrimSpace(f))] = true
+    }
+    return r
+}
+
+// Handler returns h with every record redacted before it is handled.
+func (r *Redactor) Handler(h slog.Handler) slog.Handler {
+    return &redactingHandler{h: h, r: r}
+}
+
+// String masks the emails and tokens in s.
+func (r *Redactor) String(s string) string {
+    s = redactEmail.ReplaceAllStringFunc(s, maskEmail)
+    return redactToken.ReplaceAllString(s, redacted)
+}
+
+func maskEmail(email string) string {
+    at := strings.LastIndexByte(email, '@')
+    if at <= 0 {
+        return redacted
+    }
+    _, size := utf8.DecodeRuneInString(email)
+    return email[:size] + "***" + email[at:]
+}
+
+func (r *Redactor) attr(a slog.Attr) slog.Attr {
+    v := a.Value.Resolve()
+    if r.fields[strings.ToLower(a.Key)] && v.Kind() != slog.KindGroup {
+        if s := v.String(); redactEmail.FindString(s) == s {
+            return slog.String(a.Key, maskEmail(s))
+        }
+        return slog.String(a.Key, redacted)
+    }
+    switch v.Kind() {
+    case slog.KindGroup:
+        group := v.Group()
+        attrs := make([]slog.Attr, len(group))
+        for i, ga := range group {
+            attrs[i] = r.attr(ga)
+        }
+        return slog.Attr{Key: a.Key, Value: slog.GroupValue(attrs...)}
+    case slog.KindString:
+        return slog.String(a.Key, r.String(v.String()))
+    case slog.KindAny:
+        // Errors and other values can carry addresses in their text.
+        s := fmt.Sprint(v.Any())
+        if masked := r.String(s); masked != s {
+            return slog.String(a.Key, masked)
+        }
+    }
+    return slog.Attr{Key: a.Key, Value: v}
+}
+
+type redactingHandler struct {
+    h slog.Handler
+    r *Redactor
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+    return h.h.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, rec slog.Record) error {
+    out := slog.NewRecord(rec.Time, rec.Level, h.r.String(rec.Message), rec.PC)
+    rec.Attrs(func(a slog.Attr) bool {
+        out.AddAttrs(h.r.attr(a))
+        return true
+    })
+    return h.h.Handle(ctx, out)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    masked := make([]slog.Attr, len(attrs))
+    for i, a := range attrs {
+        masked[i] = h.r.attr(a)
+    }
+    return &redactingHandler{h: h.h.WithAttrs(masked), r: h.r}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+    return &redactingHandler{h: h.h.WithGroup(name), r: h.r}
+}
+
+// LogSinkConfig declares one destination of a TeeLogger, typically read
+// from a JSON file:
+//
+//     [
+//       {"type": "console", "format": "text"},
+//       {"type": "file", "path": "/var/log/zaai/zaai.log", "level": "debug", "max_size_mb": 100},
+//       {"type": "http", "url": "https://logs.example.com/ingest", "level": "warn"}
+//     ]
+//
+// console writes to stderr, file to a RotatingFile, http POSTs batches
+// of JSON lines to a collector, syslog sends RFC 5424 messages (see
+// SyslogConfig for network, address and facility), and journald writes
+// to the local journal, or the socket at path. Format defaults to json except
+// for console. An empty Level follows the TeeLogger's shared level, so
+// PUT /admin/log-level still applies to that sink. Raw exempts a sink
+// from redaction, for an access-controlled audit trail.
+type LogSinkConfig struct {
+    Type   string `json:"type"`
+    Name   string `json:"name,omitempty"`
+    Level  string `json:"level,omitempty"`
+    Format string `json:"format,omitempty"`
+    // Buffer is how many records may wait for the sink before the oldest
+    // are dropped; 1024 if zero.
+    Buffer int  `json:"buffer,omitempty"`
+    Raw    bool `json:"raw,omitempty"`
+
+    Path       string        `json:"path,omitempty"`
+    MaxSizeMB  int64         `json:"max_size_mb,omitempty"`
+    MaxAge     string        `json:"max_age,omitempty"` // e.g. "24h"
+    MaxBackups int           `json:"max_backups,omitempty"`
+    Compress   bool          `json:"compress,omitempty"`
+
+    URL string `json:"url,omitempty"`
+
+    Network  string `json:"network,omitempty"`
+    Address  string `json:"address,omitempty"`
+    Facility string `json:"facility,omitempty"`
+}
+
+// LogSink is one destination of a TeeLogger. Closer, if set, is closed
+// with the TeeLogger after the sink's buffer has drained.
+type LogSink struct {
+    Name    string
+    Handler slog.Handler
+    Level   slog.Leveler
+    Buffer  int
+    Closer  io.Closer
+}
+
+// TeeLogger fans each line out to several sinks, each with its own level.
+// Delivery never blocks the caller: every sink has a ring buffer served
+// by its own goroutine, and a sink that falls behind loses its oldest
+// lines (see Dropped) rather than slowing the others down.
+type TeeLogger struct {
+    *SimpleLogger
+    sinks []*teeSink
+}
+
+type teeSink struct {
+    LogSink
+    ring *logRing
+}
+
+// NewTeeLogger starts delivering to sinks.
+func NewTeeLogger(sinks ...LogSink) *TeeLogger {
+    t := &TeeLogger{}
+    h := &teeHandler{}
+    for _, sink := range sinks {
+        if sink.Buffer <= 0 {
+            sink.Buffer = 1024
+        }
+        if sink.Level == nil {
+            sink.Level = slog.LevelInfo
+        }
+        s := &teeSink{LogSink: sink, ring: newLogRing(sink.Buffer)}
+        t.sinks = append(t.sinks, s)
+        h.sinks = append(h.sinks, s)
+        h.handlers = append(h.handlers, sink.Handler)
+    }
+    t.SimpleLogger = NewSimpleLogger(h)
+    return t
+}
+
+// OpenTeeLogger builds the sinks cfgs declare. Sinks without a level of
+// their own filter on level. redactor, if not nil, masks lines for every
+// sink not marked Raw.
+func OpenTeeLogger(cfgs []LogSinkConfig, level slog.Leveler, redactor *Redactor) (*TeeLogger, error) {
+    var sinks []LogSink
+    fail := func(err error) (*TeeLogger, error) {
+        for _, s := range sinks {
+            if s.Closer != nil {
+                s.Closer.Close()
+            }
+        }
+        return nil, err
+    }
+    for i, cfg := range cfgs {
+        sink := LogSink{Name: cmp.Or(cfg.Name, cfg.Type), Level: level, Buffer: cfg.Buffer}
+        if cfg.Level != "" {
+            l, err := ParseLogLevel(cfg.Level)
+            if err != nil {
+                return fail(fmt.Errorf("log sink %d: %w", i, err))
+            }
+            sink.Level = l
+        }
+        var w io.Writer
+        var h slog.Handler
+        format := cfg.Format
+        switch cfg.Type {
+        case "console":
+            w, format = os.Stderr, cmp.Or(format, "text")
+        case "file":
+            var maxAge time.Duration
+            if cfg.MaxAge != "" {
+                var err error
+                if maxAge, err = time.ParseDuration(cfg.MaxAge); err != nil {
+                    return fail(fmt.Errorf("log sink %d: invalid max_age: %w", i, err))
+                }
+            }
+            f, err := OpenRotatingFile(RotateConfig{
+                Path: cfg.Path, MaxSize: cfg.MaxSizeMB << 20, MaxAge: maxAge,
+                MaxBackups: cfg.MaxBackups, Compress: cfg.Compress,
+                // Like the collector sink, report where the log can't go.
+                OnError: func(err error) { fmt.Fprintln(os.Stderr, err) },
+            })
+            if err != nil {
+                return fail(fmt.Errorf("log sink %d: %w", i, err))
+            }
+            w, sink.Closer = f, f
+        case "http":
+            if cfg.URL == "" {
+                return fail(fmt.Errorf("log sink %d: http sink needs a url", i))
+            }
+            c := newCollectorWriter(cfg.URL, nil)
+            w, sink.Closer = c, c
+        case "syslog":
+            sw, err := DialSyslog(SyslogConfig{Network: cfg.Network, Addr: cfg.Address, Facility: cfg.Facility})
+            if err != nil {
+                return fail(fmt.Errorf("log sink %d: %w", i, err))
+            }
+            h, sink.Closer = sw.Handler(slog.LevelDebug), sw
+        case "journald":
+            jw, err := DialJournald(cfg.Path)
+            if err != nil {
+                return fail(fmt.Errorf("log sink %d: %w", i, err))
+            }
+            h, sink.Closer = jw.Handler(slog.LevelDebug), jw
+        default:
+            return fail(fmt.Errorf("log sink %d: unknown type %q", i, cfg.Type))
+        }
+        if h == nil {
+            var err error
+            if h, err = NewLogHandler(w, cmp.Or(format, "json"), slog.LevelDebug); err != nil {
+                if sink.Closer != nil {
+                    sink.Closer.Close()
+                }
+                return fail(fmt.Errorf("log sink %d: %w", i, err))
+            }
+        }
+        if redactor != nil && !cfg.Raw {
+            h = redactor.Handler(h)
+        }
+        sink.Handler = h
+        sinks = append(sinks, sink)
+    }
+    return NewTeeLogger(sinks...), nil
+}
+
+// ReadLogSinks reads a JSON array of LogSinkConfig from path.
+func ReadLogSinks(path string) ([]LogSinkConfig, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var cfgs []LogSinkConfig
+    if err := json.Unmarshal(data, &cfgs); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    return cfgs, nil
+}
+
+// Dropped reports, per sink name, how many lines were dropped because
+// the sink's buffer was full.
+func (t *TeeLogger) Dropped() map[string]int64 {
+    dropped := make(map[string]int64, len(t.sinks))
+    for _, s := range t.sinks {
+        dropped[s.Name] += s.ring.dropped.Load()
+    }
+    return dropped
+}
+
+// Flush waits until every line logged so far has reached its sinks.
+func (t *TeeLogger) Flush() error {
+    for _, s := range t.sinks {
+        s.ring.flush()
+    }
+    return nil
+}
+
+// Close delivers what is buffered, then closes the sinks. Lines logged
+// after Close are dropped.
+func (t *TeeLogger) Close() error {
+    var errs []error
+    for _, s := range t.sinks {
+        s.ring.close()
+        if s.Closer != nil {
+            errs = append(errs, s.Closer.Close())
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// teeHandler is the slog.Handler behind a TeeLogger. handlers[i] is
+// sinks[i].Handler with the attributes and groups added through With.
+type teeHandler struct {
+    sinks    []*teeSink
+    handlers []slog.Handler
+}
+
+func (h *teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+    for _, s := range h.sinks {
+        if level >= s.Level.Level() {
+            return true
+        }
+    }
+    return false
+}
+
+func (h *teeHandler) Handle(ctx context.Context, r slog.Record) error {
+    ctx = context.WithoutCancel(ctx)
+    for i, s := range h.sinks {
+        if r.Level < s.Level.Level() {
+            continue
+        }
+        s.ring.push(queuedRecord{ctx: ctx, handler: h.handlers[i], record: r.Clone()})
+    }
+    return nil
+}
+
+func (h *teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return h.with(func(sh slog.Handler) slog.Handler { return sh.WithAttrs(attrs) })
+}
+
+func (h *teeHandler) WithGroup(name string) slog.Handler {
+    return h.with(func(sh slog.Handler) slog.Handler { return sh.WithGroup(name) })
+}
+
+func (h *teeHandler) with(f func(slog.Handler) slog.Handler) slog.Handler {
+    handlers := make([]slog.Handler, len(h.handlers))
+    for i, sh := range h.handlers {
+        handlers[i] = f(sh)
+    }
+    return &teeHandler{sinks: h.sinks, handlers: handlers}
+}
+
+// AsyncLogger hands lines to a background goroutine through a ring
+// buffer, so callers such as Save never wait on log I/O. When the buffer
+// is full the oldest waiting line is dropped and counted; see Dropped.
+// Flush waits for the buffer to drain, and Server.Run calls it on
+// shutdown (see LogFlusher).
+type AsyncLogger struct {
+    *SimpleLogger
+    ring *logRing
+}
+
+// NewAsyncLogger logs to h through a buffer of size lines, 1024 if size
+// is not positive.
+func NewAsyncLogger(h slog.Handler, size int) *AsyncLogger {
+    if size <= 0 {
+        size = 1024
+    }
+    ring := newLogRing(size)
+    return &AsyncLogger{SimpleLogger: NewSimpleLogger(&asyncHandler{h: h, ring: ring}), ring: ring}
+}
+
+// Dropped reports how many lines were lost to a full buffer.
+func (l *AsyncLogger) Dropped() int64 {
+    return l.ring.dropped.Load()
+}
+
+// Flush waits until every line logged so far has been handled.
+func (l *AsyncLogger) Flush() error {
+    l.ring.flush()
+    return nil
+}
+
+// Close handles what is buffered and stops the background goroutine.
+// Lines logged after Close are dropped. It does not close h's writer.
+func (l *AsyncLogger) Close() error {
+    l.ring.close()
+    return nil
+}
+
+type asyncHandler struct {
+    h    slog.Handler
+    ring *logRing
+}
+
+func (a *asyncHandler) Enabled(ctx context.Context, level slog.Level) bool {
+    return a.h.Enabled(ctx, level)
+}
+
+func (a *asyncHandler) Handle(ctx context.Context, r slog.Record) error {
+    a.ring.push(queuedRecord{ctx: context.WithoutCancel(ctx), handler: a.h, record: r.Clone()})
+    return nil
+}
+
+func (a *asyncHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return &asyncHandler{h: a.h.WithAttrs(attrs), ring: a.ring}
+}
+
+func (a *asyncHandler) WithGroup(name string) slog.Handler {
+    return &asyncHandler{h: a.h.WithGroup(name), ring: a.ring}
+}
+
+type queuedRecord struct {
+    ctx     context.Context
+    handler slog.Handler // with the logger's attributes and groups
+    record  slog.Record
+}
+
+// logRing is a fixed-size FIFO of records handled by one goroutine. A
+// push to a full ring overwrites the oldest record.
+type logRing struct {
+    mu      sync.Mutex
+    cond    *sync.Cond // signalled on push, on handling and on close
+    items   []queuedRecord
+    head, n int
+    busy    bool // the goroutine is handling a record it has taken
+    closed  bool
+    dropped atomic.Int64
+    done    chan struct{}
+}
+
+func newLogRing(size int) *logRing {
+    r := &logRing{items: make([]queuedRecord, size), done: make(chan struct{})}
+    r.cond = sync.NewCond(&r.mu)
+    go r.run()
+    return r
+}
+
+func (r *logRing) push(rec queuedRecord) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.closed {
+        r.dropped.Add(1)
+        return
+    }
+    if r.n == len(r.items) {
+        r.items[r.head] = queuedRecord{}
+        r.head = (r.head + 1) % len(r.items)
+        r.n--
+        r.dropped.Add(1)
+    }
+    r.items[(r.head+r.n)%len(r.items)] = rec
+    r.n++
+    r.cond.Broadcast()
+}
+
+func (r *logRing) run() {
+    defer close(r.done)
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for {
+        for r.n == 0 && !r.closed {
+            r.cond.Wait()
+        }
+        if r.n == 0 {
+            return
+        }
+        rec := r.items[r.head]
+        r.items[r.head] = queuedRecord{}
+        r.head = (r.head + 1) % len(r.items)
+        r.n--
+        r.busy = true
+        r.mu.Unlock()
+        rec.handler.Handle(rec.ctx, rec.record)
+        r.mu.Lock()
+        r.busy = false
+        r.cond.Broadcast()
+    }
+}
+
+// flush waits until the ring is empty and nothing is being handled.
+func (r *logRing) flush() {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for r.n > 0 || r.busy {
+        r.cond.Wait()
+    }
+}
+
+// close drains the ring and stops its goroutine.
+func (r *logRing) close() {
+    r.mu.Lock()
+    r.closed = true
+    r.cond.Broadcast()
+    r.mu.Unlock()
+    <-r.done
+}
+
+// collectorWriter batches log lines and POSTs them to a collector as
+// application/x-ndjson, once a second or when 64KB are waiting. Failed
+// batches are reported on stderr and discarded.
+type collectorWriter struct {
+    url    string
+    client *http.Client
+
+    mu   sync.Mutex
+    buf  bytes.Buffer
+    stop chan struct{}
+    done chan struct{}
+}
+
+const collectorBatchSize = 64 << 10
+
+func newCollectorWriter(url string, client *http.Client) *collectorWriter {
+    if client == nil {
+        client = &http.Client{Timeout: 10 * time.Second}
+    }
+    c := &collectorWriter{url: url, client: client, stop: make(chan struct{}), done: make(chan struct{})}
+    go c.loop()
+    return c
+}
+
+func (c *collectorWriter) Write(p []byte) (int, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.buf.Write(p)
+    if c.buf.Len() >= collectorBatchSize {
+        c.flushLocked()
+    }
+    return len(p), nil
+}
+
+func (c *collectorWriter) loop() {
+    defer close(c.done)
+    tick := time.NewTicker(time.Second)
+    defer tick.Stop()
+    for {
+        select {
+        case <-tick.C:
+            c.mu.Lock()
+            c.flushLocked()
+            c.mu.Unlock()
+        case <-c.stop:
+            return
+        }
+    }
+}
+
+func (c *collectorWriter) flushLocked() {
+    if c.buf.Len() == 0 {
+        return
+    }
+    body := bytes.Clone(c.buf.Bytes())
+    c.buf.Reset()
+    resp, err := c.client.Post(c.url, "application/x-ndjson", bytes.NewReader(body))
+    if err == nil {
+        resp.Body.Close()
+        if resp.StatusCode >= 300 {
+            err = fmt.Errorf("%s", resp.Status)
+        }
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "log collector %s: dropped %d bytes: %v\n", c.url, len(body), err)
+    }
+}
+
+// Close sends what is buffered and stops the flush timer.
+func (c *collectorWriter) Close() error {
+    close(c.stop)
+    <-c.done
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.flushLocked()
+    return nil
+}
+
+// NewDevHandler returns a slog handler for reading logs in a terminal
+// during development: abbreviated timestamps, a three-letter level,
+// messages padded to a column so attributes line up, and colors when w
+// is a terminal and NO_COLOR is unset.
+//
+//     15:04:05.000 INF Creating user                  email=a***@example.com
+func NewDevHandler(w io.Writer, level slog.Leveler) slog.Handler {
+    d := &devWriter{w: w, color: isTerminal(w) && os.Getenv("NO_COLOR") == ""}
+    return &fieldHandler{level: level, emit: d.emit}
+}
+
+// devMessageWidth is the column attributes start at, after the message.
+const devMessageWidth = 30
+
+const (
+    ansiReset  = "\x1b[0m"
+    ansiDim    = "\x1b[2m"
+    ansiRed    = "\x1b[31m"
+    ansiGreen  = "\x1b[32m"
+    ansiYellow = "\x1b[33m"
+    ansiGray   = "\x1b[90m"
+)
+
+type devWriter struct {
+    mu    sync.Mutex
+    w     io.Writer
+    color bool
+}
+
+func (d *devWriter) emit(r slog.Record, fields []logField) error {
+    var b bytes.Buffer
+    paint := func(color, s string) {
+        if d.color {
+            b.WriteString(color + s + ansiReset)
+        } else {
+            b.WriteString(s)
+        }
+    }
+    paint(ansiDim, r.Time.Format("15:04:05.000"))
+    b.WriteByte(' ')
+    switch {
+    case r.Level < slog.LevelInfo:
+        paint(ansiGray, "DBG")
+    case r.Level < slog.LevelWarn:
+        paint(ansiGreen, "INF")
+    case r.Level < slog.LevelError:
+        paint(ansiYellow, "WRN")
+    default:
+        paint(ansiRed, "ERR")
+    }
+    b.WriteByte(' ')
+    b.WriteString(r.Message)
+    if len(fields) > 0 {
+        if pad := devMessageWidth - utf8.RuneCountInString(r.Message); pad > 0 {
+            b.WriteString(strings.Repeat(" ", pad))
+        }
+        for _, f := range fields {
+            b.WriteByte(' ')
+            paint(ansiDim, f.key+"=")
+            b.WriteString(quoteLogValue(f.value))
+        }
+    }
+    b.WriteByte('\n')
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    _, err := d.w.Write(b.Bytes())
+    return err
+}
+
+// isTerminal reports whether w is a character device such as a terminal.
+func isTerminal(w io.Writer) bool {
+    f, ok := w.(*os.File)
+    if !ok {
+        return false
+    }
+    info, err := f.Stat()
+    return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Syslog and journald
+//
+// SyslogWriter sends RFC 5424 messages to a syslog daemon or relay, and
+// JournaldWriter sends entries to systemd-journald's native socket. Both
+// serve slog through Handler, flatten attributes (groups become dotted
+// keys) into structured data or journal fields, and map slog levels to
+// syslog severities:
+//
+//     below INFO    7 debug
+//     INFO          6 informational
+//     WARN          4 warning
+//     ERROR         3 error
+//     ERROR+4 up    2 critical
+
+// syslogSeverity maps a slog level to a syslog severity.
+func syslogSeverity(level slog.Level) int {
+    switch {
+    case level < slog.LevelInfo:
+        return 7
+    case level < slog.LevelWarn:
+        return 6
+    case level < slog.LevelError:
+        return 4
+    case level < slog.LevelError+4:
+        return 3
+    }
+    return 2
+}
+
+var syslogFacilities = map[string]int{
+    "kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+    "lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+    "local0": 16, "local1": 17, "local2": 18, "local3": 19,
+    "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SyslogConfig says where and as what to send syslog messages.
+type SyslogConfig struct {
+    // Network is "udp", "tcp", "unix" or "unixgram"; with Addr empty,
+    // the local daemon's /dev/log is used.
+    Network, Addr string
+    // Facility is a name such as "daemon" or "local0"; "user" if empty.
+    Facility string
+    AppName  string // AppName if empty
+    Hostname string // os.Hostname() if empty
+}
+
+// SyslogWriter is a connection to a syslog daemon. TCP messages are
+// framed by octet counting (RFC 6587). A failed write redials once.
+type SyslogWriter struct {
+    cfg      SyslogConfig
+    facility int
+
+    mu   sync.Mutex
+    conn net.Conn
+}
+
+func DialSyslog(cfg SyslogConfig) (*SyslogWriter, error) {
+    if cfg.Addr == "" {
+        cfg.Network, cfg.Addr = "unixgram", "/dev/log"
+    }
+    facility, ok := syslogFacilities[cmp.Or(cfg.Facility, "user")]
+    if !ok {
+        return nil, fmt.Errorf("syslog: unknown facility %q", cfg.Facility)
+    }
+    if cfg.AppName == "" {
+        cfg.AppName = AppName
+    }
+    if cfg.Hostname == "" {
+        cfg.Hostname, _ = os.Hostname()
+    }
+    w := &SyslogWriter{cfg: cfg, facility: facility}
+    if err := w.dial(); err != nil {
+        return nil, err
+    }
+    return w, nil
+}
+
+func (w *SyslogWriter) dial() error {
+    conn, err := net.DialTimeout(w.cfg.Network, w.cfg.Addr, 5*time.Second)
+    if err != nil {
+        return fmt.Errorf("syslog: %w", err)
+    }
+    w.conn = conn
+    return nil
+}
+
+// Handler logs to w at level and above; nil means INFO.
+func (w *SyslogWriter) Handler(level slog.Leveler) slog.Handler {
+    return &fieldHandler{level: level, emit: w.emit}
+}
+
+func (w *SyslogWriter) emit(r slog.Record, fields []logField) error {
+    var b bytes.Buffer
+    fmt.Fprintf(&b, "<%d>1 %s %s %s %d - ",
+        w.facility*8+syslogSeverity(r.Level), r.Time.Format(time.RFC3339Nano),
+        syslogHeaderField(w.cfg.Hostname), syslogHeaderField(w.cfg.AppName), os.Getpid())
+    if len(fields) == 0 {
+        b.WriteByte('-')
+    } else {
+        // 32473 is the private enterprise number reserved for examples.
+        b.WriteString("[zaai@32473")
+        for _, f := range fields {
+            fmt.Fprintf(&b, " %s=\"%s\"", syslogParamName(f.key), syslogParamValue.Replace(f.value))
+        }
+        b.WriteByte(']')
+    }
+    b.WriteByte(' ')
+    b.WriteString(r.Message)
+
+    msg := b.Bytes()
+    if w.cfg.Network == "tcp" || w.cfg.Network == "tcp4" || w.cfg.Network == "tcp6" {
+        msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+    }
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if w.conn != nil {
+        if _, err := w.conn.Write(msg); err == nil {
+            return nil
+        }
+        w.conn.Close()
+        w.conn = nil
+    }
+    if err := w.dial(); err != nil {
+        return err
+    }
+    _, err := w.conn.Write(msg)
+    return err
+}
+
+func (w *SyslogWriter) Close() error {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if w.conn == nil {
+        return nil
+    }
+    err := w.conn.Close()
+    w.conn = nil
+    return err
+}
+
+var syslogParamValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslogHeaderField makes s a valid header field: printable ASCII, no
+// spaces, or "-" when empty.
+func syslogHeaderField(s string) string {
+    s = strings.Map(func(r rune) rune {
+        if r <= ' ' || r > '~' {
+            return -1
+        }
+        return r
+    }, s)
+    return cmp.Or(s, "-")
+}
+
+// syslogParamName makes key a valid SD-NAME: at most 32 printable ASCII
+// characters other than '=', ' ', ']' and '"'.
+func syslogParamName(key string) string {
+    key = strings.Map(func(r rune) rune {
+        if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+            return '_'
+        }
+        return r
+    }, key)
+    if len(key) > 32 {
+        key = key[:32]
+    }
+    return cmp.Or(key, "_")
+}
+
+// JournaldSocket is where systemd-journald listens for native entries.
+const JournaldSocket = "/run/systemd/journal/socket"
+
+// JournaldWriter sends entries to journald with MESSAGE, PRIORITY and
+// SYSLOG_IDENTIFIER set and each attribute as an upper-case field, so
+// `journalctl USER_ID=7` finds them. Entries must fit in one datagram;
+// journald's larger-entry protocol is not implemented.
+type JournaldWriter struct {
+    identifier string
+    conn       *net.UnixConn
+}
+
+// DialJournald connects to journald at path, JournaldSocket if empty.
+func DialJournald(path string) (*JournaldWriter, error) {
+    addr := &net.UnixAddr{Name: cmp.Or(path, JournaldSocket), Net: "unixgram"}
+    conn, err := net.DialUnix("unixgram", nil, addr)
+    if err != nil {
+        return nil, fmt.Errorf("journald: %w", err)
+    }
+    return &JournaldWriter{identifier: AppName, conn: conn}, nil
+}
+
+// Handler logs to w at level and above; nil means INFO.
+func (w *JournaldWriter) Handler(level slog.Leveler) slog.Handler {
+    return &fieldHandler{level: level, emit: w.emit}
+}
+
+func (w *JournaldWriter) emit(r slog.Record, fields []logField) error {
+    var b bytes.Buffer
+    journalField(&b, "MESSAGE", r.Message)
+    journalField(&b, "PRIORITY", strconv.Itoa(syslogSeverity(r.Level)))
+    journalField(&b, "SYSLOG_IDENTIFIER", w.identifier)
+    for _, f := range fields {
+        journalField(&b, journalFieldName(f.key), f.value)
+    }
+    _, err := w.conn.Write(b.Bytes())
+    return err
+}
+
+func (w *JournaldWriter) Close() error {
+    return w.conn.Close()
+}
+
+// journalField appends one field in journald's native format: KEY=value
+// on a line, or, for values with newlines, the key, a newline, the
+// value's length as a little-endian uint64, the value and a newline.
+func journalField(b *bytes.Buffer, key, value string) {
+    b.WriteString(key)
+    if strings.ContainsRune(value, '\n') {
+        b.WriteByte('\n')
+        binary.Write(b, binary.LittleEndian, uint64(len(value)))
+    } else {
+        b.WriteByte('=')
+    }
+    b.WriteString(value)
+    b.WriteByte('\n')
+}
+
+// journalFieldName makes key a valid journal field name: upper-case
+// letters, digits and underscores, not starting with an underscore
+// (reserved for trusted fields) or a digit, at most 64 bytes.
+func journalFieldName(key string) string {
+    key = strings.Map(func(r rune) rune {
+        switch {
+        case r >= 'a' && r <= 'z':
+            return r - 'a' + 'A'
+        case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+            return r
+        }
+        return '_'
+    }, key)
+    key = strings.TrimLeft(key, "_")
+    if key == "" || key[0] >= '0' && key[0] <= '9' {
+        key = "F_" + key
+    }
+    if len(key) > 64 {
+        key = key[:64]
+    }
+    return key
+}
+
+type logField struct {
+    key, value string
+}
+
+// fieldHandler is a slog.Handler for outputs that take flat key/value
+// fields. Groups become dotted key prefixes.
+type fieldHandler struct {
+    level  slog.Leveler
+    fields []logField // from WithAttrs
+    group  string     // prefix from WithGroup, ending in "."
+    emit   func(r slog.Record, fields []logField) error
+}
+
+func (h *fieldHandler) Enabled(_ context.Context, level slog.Level) bool {
+    threshold := slog.LevelInfo
+    if h.level != nil {
+        threshold = h.level.Level()
+    }
+    return level >= threshold
+}
+
+func (h *fieldHandler) Handle(_ context.Context, r slog.Record) error {
+    fields := slices.Clone(h.fields)
+    r.Attrs(func(a slog.Attr) bool {
+        fields = appendLogField(fields, h.group, a)
+        return true
+    })
+    return h.emit(r, fields)
+}
+
+func (h *fieldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    fields := slices.Clone(h.fields)
+    for _, a := range attrs {
+        fields = appendLogField(fields, h.group, a)
+    }
+    return &fieldHandler{level: h.level, fields: fields, group: h.group, emit: h.emit}
+}
+
+func (h *fieldHandler) WithGroup(name string) slog.Handler {
+    if name == "" {
+        return h
+    }
+    return &fieldHandler{level: h.level, fields: h.fields, group: h.group + name + ".", emit: h.emit}
+}
+
+func appendLogField(fields []logField, prefix string, a slog.Attr) []logField {
+    v := a.Value.Resolve()
+    if a.Key == "" && v.Kind() != slog.KindGroup {
+        return fields
+    }
+    if v.Kind() == slog.KindGroup {
+        if a.Key != "" {
+            prefix += a.Key + "."
+        }
+        for _, ga := range v.Group() {
+            fields = appendLogField(fields, prefix, ga)
+        }
+        return fields
+    }
+    return append(fields, logField{key: prefix + a.Key, value: v.String()})
+}
+
+// Service layer
+type UserService struct {
+    repo       UserRepository
+    logger     Logger
+    authorizer Authorizer
+    prefs      *PrefSchema
+    checkMX    bool
+    retry      *RetryPolicy
+    idem       IdempotencyStore
+    idemLocks  keyedMutex
+    timeout    time.Duration
+    receiptKey []byte
+    anonymize  AnonymizeConfig
+    avatars    AvatarStore
+    addresses  map[string]AddressValidator
+    onEvent    EventHandler
+    audit      AuditLog
+    mergeHooks []MergeHook
+    tracer     *Tracer
+    slow       time.Duration
+    // statsWorkers, if positive, aggregates GetUserStats in parallel.
+    statsWorkers int
+}
+
+// ServiceOption configures optional UserService collaborators.
+type ServiceOption func(*UserService)
+
+// WithAuthorizer makes the service ask a before every guarded action.
+func WithAuthorizer(a Authorizer) ServiceOption {
+    return func(s *UserService) { s.authorizer = a }
+}
+
+// WithPrefSchema replaces the default schema (built-in keys only) with one
+// that has custom preferences registered.
+func WithPrefSchema(schema *PrefSchema) ServiceOption {
+    return func(s *UserService) { s.prefs = schema }
+}
+
+// WithRetryPolicy replaces DefaultRetryPolicy for the repository calls
+// RetryingRepository considers safe to repeat. Use RetryPolicy{} to
+// disable retries.
+func WithRetryPolicy(p RetryPolicy) ServiceOption {
+    return func(s *UserService) { s.retry = &p }
+}
+
+// DefaultOperationTimeout bounds each UserService call, including its
+// retries, unless the caller's context has an earlier deadline.
+const DefaultOperationTimeout = 30 * time.Second
+
+// WithOperationTimeout replaces DefaultOperationTimeout; zero leaves calls
+// bounded only by the caller's context.
+func WithOperationTimeout(d time.Duration) ServiceOption {
+    return func(s *UserService) { s.timeout = d }
+}
+
+// WithReceiptKey sets the HMAC key EraseUser signs erasure receipts with.
+func WithReceiptKey(key []byte) ServiceOption {
+    return func(s *UserService) { s.receiptKey = key }
+}
+
+// WithAnonymizeConfig replaces DefaultAnonymizeConfig.
+func WithAnonymizeConfig(cfg AnonymizeConfig) ServiceOption {
+    return func(s *UserService) { s.anonymize = cfg }
+}
+
+// WithAddressValidator adds or replaces the check for addresses in country
+// (an ISO 3166-1 alpha-2 code), on top of DefaultAddressValidators.
+func WithAddressValidator(country string, v AddressValidator) ServiceOption {
+    return func(s *UserService) { s.addresses[strings.ToUpper(country)] = v }
+}
+
+// WithAvatarStore enables SetAvatar and GetAvatar.
+func WithAvatarStore(store AvatarStore) ServiceOption {
+    return func(s *UserService) { s.avatars = store }
+}
+
+// WithIdempotencyStore replaces the default in-memory store of CreateUser
+// idempotency keys, e.g. with one shared by every instance.
+func WithIdempotencyStore(store IdempotencyStore) ServiceOption {
+    return func(s *UserService) { s.idem = store }
+}
+
+// WithMXCheck makes the service reject emails whose domain has no mail
+// server in DNS. It adds a lookup to every create and email change.
+func WithMXCheck() ServiceOption {
+    return func(s *UserService) { s.checkMX = true }
+}
+
+// WithEventHandler makes the service report completed actions to h.
+func WithEventHandler(h EventHandler) ServiceOption {
+    return func(s *UserService) { s.onEvent = h }
+}
+
+// DefaultStatsShardSize is how many users each WithParallelStats worker
+// aggregates at a time. Fewer users than that are counted without
+// starting any goroutines.
+const DefaultStatsShardSize = 4096
+
+// WithParallelStats makes GetUserStats aggregate shards of users on up
+// to workers goroutines, GOMAXPROCS if zero, and merge the results. With
+// a single worker it counts serially, as sharding only adds overhead.
+func WithParallelStats(workers int) ServiceOption {
+    return func(s *UserService) {
+        if workers <= 0 {
+            workers = runtime.GOMAXPROCS(0)
+        }
+        s.statsWorkers = workers
+    }
+}
+
+// WithSlowCallThreshold logs service calls taking d or longer at Warn,
+// naming the method and giving the caller's stack. For the arguments,
+// see the repository calls WithSlowRepoThreshold reports.
+func WithSlowCallThreshold(d time.Duration) ServiceOption {
+    return func(s *UserService) { s.slow = d }
+}
+
+// WithTracer makes every service method record a span, named like
+// "UserService.CreateUser".
+func WithTracer(t *Tracer) ServiceOption {
+    return func(s *UserService) { s.tracer = t }
+}
+
+// WithAuditLog makes the service record administrative actions in log.
+func WithAuditLog(log AuditLog) ServiceOption {
+    return func(s *UserService) { s.audit = log }
+}
+
+// WithMergeHook registers a hook MergeUsers calls to re-point records that
+// reference the duplicate user.
+func WithMergeHook(h MergeHook) ServiceOption {
+    return func(s *UserService) { s.mergeHooks = append(s.mergeHooks, h) }
+}
+
+func NewUserService(repo UserRepository, logger Logger, opts ...ServiceOption) *UserService {
+    s := &UserService{
+        repo:      repo,
+        logger:    logger,
+        prefs:     NewPrefSchema(),
+        idem:      NewMemoryIdempotencyStore(DefaultIdempotencyTTL),
+        timeout:   DefaultOperationTimeout,
+        anonymize: DefaultAnonymizeConfig,
+        addresses: maps.Clone(DefaultAddressValidators),
+    }
+    for _, opt := range opts {
+        opt(s)
+    }
+    policy := DefaultRetryPolicy
+    if s.retry != nil {
+        policy = *s.retry
+    }
+    if policy.MaxRetries > 0 {
+        s.repo = NewRetryingRepository(s.repo, policy)
+    }
+    return s
+}
+
+// Action names a guarded service operation.
+type Action string
+
+const (
+    ActionUpdateUser     Action = "user.update"
+    ActionDeleteUser     Action = "user.delete"
+    ActionDeactivateUser Action = "user.deactivate"
+    ActionSetRole        Action = "user.set_role"
+    ActionViewStats      Action = "stats.view"
+    ActionMergeUsers     Action = "user.merge"
+    ActionExportUserData Action = "user.export"
+    ActionEraseUser      Action = "user.erase"
+    ActionAnonymizeUsers Action = "user.anonymize"
+    ActionViewDeleted    Action = "user.view_deleted"
+    ActionRestoreUser    Action = "user.restore"
+    ActionPurgeUsers     Action = "user.purge"
+    ActionViewLockout    Action = "user.view_lockout"
+    ActionUnlockUser     Action = "user.unlock"
+    ActionViewAudit      Action = "audit.view"
+    ActionViewWebhooks   Action = "webhook.view"
+    ActionReindex        Action = "maintenance.reindex"
+    ActionSetLogLevel    Action = "maintenance.log_level"
+    ActionViewSLOs       Action = "slo.view"
+    ActionViewJobs       Action = "job.view"
+    ActionRetryJobs      Action = "job.retry"
+    // ActionReloadConfig is only audited: ConfigWatcher acts for no caller.
+    ActionReloadConfig Action = "maintenance.reload_config"
+)
+
+// Authorizer decides whether the caller carried in ctx may perform action
+// on target. A non-nil error (conventionally wrapping ErrForbidden) stops
+// the action before anything is read or written.
+type Authorizer interface {
+    Authorize(ctx context.Context, action Action, target UserID) error
+}
+
+// AuthorizerFunc adapts a plain function to Authorizer.
+type AuthorizerFunc func(ctx context.Context, action Action, target UserID) error
+
+func (f AuthorizerFunc) Authorize(ctx context.Context, action Action, target UserID) error {
+    return f(ctx, action, target)
+}
+
+type EventType string
+
+const (
+    EventUserCreated     EventType = "user.created"
+    EventUserUpdated     EventType = "user.updated"
+    EventUserDeleted     EventType = "user.deleted"
+    EventUserDeactivated EventType = "user.deactivated"
+    EventUserMerged      EventType = "user.merged"
+    EventUserRestored    EventType = "user.restored"
+
+    EventPasswordResetRequested EventType = "user.password_reset_requested"
+    EventPasswordReset          EventType = "user.password_reset"
+    EventAccountLocked          EventType = "user.account_locked"
+)
+
+// UserEvent describes a change the service has committed. User is the
+// state after the change; it is nil for EventUserDeleted.
+type UserEvent struct {
+    Type   EventType `json:"type"`
+    UserID UserID    `json:"user_id"`
+    User   *User     `json:"user,omitempty"`
+    At     time.Time `json:"at"`
+    // Token carries a secret meant only for the user, such as a password
+    // reset token, for notifiers to deliver. It is never serialized, so it
+    // doesn't leak to webhooks or logs.
+    Token string `json:"-"`
+    // RequestID is the request that caused the event, if any.
+    RequestID string `json:"request_id,omitempty"`
+}
+
+// EventHandler receives events after the change is stored, on the caller's
+// goroutine. The change can't be undone by then, so an error is only
+// logged. EventBus.Publish is an EventHandler.
+type EventHandler func(ctx context.Context, event UserEvent) error
+
+// Event bus
+
+type DispatchMode int
+
+const (
+    // DispatchSync runs subscribers on the publisher's goroutine, in
+    // subscription order, and Publish returns their joined errors.
+    DispatchSync DispatchMode = iota
+    // DispatchAsync queues events for a background worker; Publish only
+    // fails if the bus is closed or ctx ends while the queue is full.
+    // Subscriber errors are logged.
+    DispatchAsync
+)
+
+// DefaultEventQueueSize is the async buffer of NewEventBus.
+const DefaultEventQueueSize = 256
+
+var ErrBusClosed = errors.New("event bus closed")
+
+type Subscriber func(ctx context.Context, event UserEvent) error
+
+// EventBus fans UserEvents out to in-process subscribers such as
+// notifiers and cache invalidation. Subscribers see events in publish
+// order; a panicking subscriber is reported as an error and doesn't stop
+// the others.
+type EventBus struct {
+    mode   DispatchMode
+    logger Logger
+
+    mu     sync.RWMutex
+    subs   map[int]Subscriber
+    order  []int
+    nextID int
+
+    // closeMu is held for reading while publishing so Close can't close
+    // the queue under a sender. It is separate from mu so a sender blocked
+    // on a full queue doesn't stall the worker's reads of subs.
+    closeMu sync.RWMutex
+    closed  bool
+    queue   chan queuedEvent
+    done    chan struct{}
+}
+
+type queuedEvent struct {
+    ctx   context.Context
+    event UserEvent
+}
+
+func NewEventBus(mode DispatchMode, logger Logger) *EventBus {
+    b := &EventBus{mode: mode, logger: logger, subs: make(map[int]Subscriber)}
+    if mode == DispatchAsync {
+        b.queue = make(chan queuedEvent, DefaultEventQueueSize)
+        b.done = make(chan struct{})
+        go b.run()
+    }
+    return b
+}
+
+// Subscribe registers h for every event and returns a function that
+// removes it again.
+func (b *EventBus) Subscribe(h Subscriber) (unsubscribe func()) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    id := b.nextID
+    b.nextID++
+    b.subs[id] = h
+    b.order = append(b.order, id)
+    return func() {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+        delete(b.subs, id)
+        b.order = slices.DeleteFunc(b.order, func(i int) bool { return i == id })
+    }
+}
+
+func (b *EventBus) Publish(ctx context.Context, event UserEvent) error {
+    b.closeMu.RLock()
+    defer b.closeMu.RUnlock()
+    if b.closed {
+        return ErrBusClosed
+    }
+    if b.mode == DispatchSync {
+        return b.dispatch(ctx, event)
+    }
+    select {
+    // Async subscribers outlive the request, so they must not inherit its
+    // cancellation.
+    case b.queue <- queuedEvent{ctx: context.WithoutCancel(ctx), event: event}:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// QueueDepth is how many events wait for async delivery; always 0 in
+// sync mode.
+func (b *EventBus) QueueDepth() int {
+    return len(b.queue)
+}
+
+// Close stops accepting events and, in async mode, waits until queued
+// events have been delivered.
+func (b *EventBus) Close() {
+    b.closeMu.Lock()
+    if b.closed {
+        b.closeMu.Unlock()
+        return
+    }
+    b.closed = true
+    b.closeMu.Unlock()
+    if b.queue != nil {
+        close(b.queue)
+        <-b.done
+    }
+}
+
+func (b *EventBus) run() {
+    defer close(b.done)
+    for q := range b.queue {
+        if err := b.dispatch(q.ctx, q.event); err != nil {
+            b.logger.Error("Event handler failed", "event", q.event.Type, "target", q.event.UserID, "error", err)
+        }
+    }
+}
+
+func (b *EventBus) dispatch(ctx context.Context, event UserEvent) error {
+    b.mu.RLock()
+    subs := make([]Subscriber, 0, len(b.order))
+    for _, id := range b.order {
+        subs = append(subs, b.subs[id])
+    }
+    b.mu.RUnlock()
+
+    var errs []error
+    for _, h := range subs {
+        if err := deliver(ctx, h, event); err != nil {
+            errs = append(errs, err)
+        }
+    }
+    return errors.Join(errs...)
+}
+
+func deliver(ctx context.Context, h Subscriber, event UserEvent) (err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            err = fmt.Errorf("subscriber panicked: %v", r)
+        }
+    }()
+    return h(ctx, event)
+}
+
+// Policy decides whether actor may perform action on target; target is
+// zero for actions that aren't about one user, like ActionViewStats.
+type Policy interface {
+    Allow(actor *User, action Action, target UserID) bool
+}
+
+// RolePolicy grants each role a fixed set of actions.
+type RolePolicy map[Role][]Action
+
+func (p RolePolicy) Allow(actor *User, action Action, target UserID) bool {
+    for _, a := range p[actor.Role] {
+        if a == action {
+            return true
+        }
+    }
+    return false
+}
+
+// DefaultRolePolicy reserves every guarded action for admins.
+var DefaultRolePolicy = RolePolicy{
+    RoleAdmin: {
+        ActionUpdateUser, ActionDeleteUser, ActionDeactivateUser, ActionSetRole, ActionViewStats,
+        ActionMergeUsers, ActionExportUserData, ActionEraseUser, ActionAnonymizeUsers,
+        ActionViewDeleted, ActionRestoreUser, ActionPurgeUsers, ActionViewLockout, ActionUnlockUser,
+        ActionViewAudit, ActionViewWebhooks, ActionReindex, ActionSetLogLevel, ActionViewSLOs,
+        ActionViewJobs, ActionRetryJobs,
+    },
+}
+
+// SelfServiceActions are the actions RBACAuthorizer lets every user take
+// on their own account, whatever their role.
+var SelfServiceActions = []Action{ActionUpdateUser}
+
+// RBACAuthorizer authorizes the user in the context (see WithCurrentUser)
+// against Policy, or DefaultRolePolicy when Policy is nil. Users may
+// always take SelfServiceActions on themselves.
+type RBACAuthorizer struct {
+    Policy Policy
+}
+
+func (a RBACAuthorizer) Authorize(ctx context.Context, action Action, target UserID) error {
+    actor, ok := CurrentUser(ctx)
+    if !ok {
+        return fmt.Errorf("%s: no authenticated user: %w", action, ErrForbidden)
+    }
+    if target != 0 && target == actor.ID && slices.Contains(SelfServiceActions, action) {
+        return nil
+    }
+    policy := a.Policy
+    if policy == nil {
+        policy = DefaultRolePolicy
+    }
+    if !policy.Allow(actor, action, target) {
+        return fmt.Errorf("%s by %s user %d: %w", action, actor.Role, actor.ID, ErrForbidden)
+    }
+    return nil
+}
+
+// bound applies the operation timeout to ctx. With a tracer it starts a
+// span for the calling method, and with a slow-call threshold it times
+// the method; cancel ends both.
+func (s *UserService) bound(ctx context.Context) (context.Context, context.CancelFunc) {
+    if s.tracer == nil && s.slow <= 0 {
+        if s.timeout <= 0 {
+            return context.WithCancel(ctx)
+        }
+        return context.WithTimeout(ctx, s.timeout)
+    }
+    start := time.Now()
+    method := serviceMethodName(2)
+    ctx, span := s.tracer.Start(ctx, method, SpanKindInternal)
+    var cancel context.CancelFunc
+    if s.timeout <= 0 {
+        ctx, cancel = context.WithCancel(ctx)
+    } else {
+        ctx, cancel = context.WithTimeout(ctx, s.timeout)
+    }
+    return ctx, func() {
+        if elapsed := time.Since(start); s.slow > 0 && elapsed >= s.slow {
+            s.log(ctx).Warn("Slow service call", "call", method, "duration", elapsed,
+                "threshold", s.slow, "stack", callerStack(1))
+        }
+        span.RecordError(context.Cause(ctx)) // if cut short by timeout or cancellation
+        cancel()
+        span.End()
+    }
+}
+
+// serviceMethodName names the function skip frames up, such as
+// "UserService.CreateUser" for main.(*UserService).CreateUser.
+func serviceMethodName(skip int) string {
+    pc, _, _, ok := runtime.Caller(skip)
+    fn := runtime.FuncForPC(pc)
+    if !ok || fn == nil {
+        return "UserService"
+    }
+    name := fn.Name()
+    name = name[strings.LastIndexByte(name, '/')+1:]
+    _, name, _ = strings.Cut(name, ".")
+    return strings.NewReplacer("(*", "", ")", "").Replace(name)
+}
+
+// ContextLogger is implemented by loggers that can enrich messages with
+// request-scoped values carried in ctx, such as a request ID.
+type ContextLogger interface {
+    Logger
+    WithContext(ctx context.Context) Logger
+}
+
+// log returns the service logger bound to ctx when it supports that.
+func (s *UserService) log(ctx context.Context) Logger {
+    return loggerFor(ctx, s.logger)
+}
+
+// loggerFor binds l to ctx when l is a ContextLogger, so its lines carry
+// the request ID, user, tenant and WithFields attributes.
+func loggerFor(ctx context.Context, l Logger) Logger {
+    if cl, ok := l.(ContextLogger); ok {
+        return cl.WithContext(ctx)
+    }
+    return l
+}
+
+// WithLogger makes l the logger LoggerFromContext returns for ctx.
+// RequestLogging does this for every request.
+func WithLogger(ctx context.Context, l Logger) context.Context {
+    return context.WithValue(ctx, loggerKey, l)
+}
+
+// LoggerFromContext returns the logger set by WithLogger, or a
+// SimpleLogger on slog.Default() if there is none, bound to ctx.
+func LoggerFromContext(ctx context.Context) Logger {
+    l, ok := ctx.Value(loggerKey).(Logger)
+    if !ok {
+        l = &SimpleLogger{}
+    }
+    return loggerFor(ctx, l)
+}
+
+// WithFields adds attributes, as alternating keys and values or
+// slog.Attr, to every line logged through a logger bound to ctx.
+func WithFields(ctx context.Context, attrs ...any) context.Context {
+    fields, _ := ctx.Value(logFieldsKey).([]any)
+    return context.WithValue(ctx, logFieldsKey, append(slices.Clip(fields), attrs...))
+}
+
+// contextAttrs is what a ContextLogger adds for ctx: its request ID, the
+// authenticated user's ID, its tenant, the current trace span and any
+// WithFields attributes.
+func contextAttrs(ctx context.Context) []any {
+    var attrs []any
+    if id, ok := RequestIDFrom(ctx); ok {
+        attrs = append(attrs, "request_id", id)
+    }
+    if user, ok := CurrentUser(ctx); ok && user != nil {
+        attrs = append(attrs, "user_id", user.ID)
+    }
+    if tenant, ok := TenantFrom(ctx); ok && tenant != "" {
+        attrs = append(attrs, "tenant", string(tenant))
+    }
+    if span := SpanFromContext(ctx); span != nil {
+        attrs = append(attrs, "trace_id", span.TraceID(), "span_id", span.SpanID())
+    }
+    fields, _ := ctx.Value(logFieldsKey).([]any)
+    return append(attrs, fields...)
+}
+
+func (s *UserService) authorize(ctx context.Context, action Action, target UserID) error {
+    if s.authorizer == nil {
+        return nil
+    }
+    if err := s.authorizer.Authorize(ctx, action, target); err != nil {
+        s.log(ctx).Warn("Denied", "action", action, "target", target, "error", err)
+        return err
+    }
+    return nil
+}
+
+func (s *UserService) emit(ctx context.Context, typ EventType, id UserID, user *User) {
+    if s.onEvent == nil {
+        return
+    }
+    event := UserEvent{Type: typ, UserID: id, User: user, At: time.Now()}
+    event.RequestID, _ = RequestIDFrom(ctx)
+    if err := s.onEvent(ctx, event); err != nil {
+        s.log(ctx).Error("Event handler failed", "event", typ, "target", id, "error", err)
+    }
+}
+
+// CreateUser creates an active user. If ctx carries an idempotency key
+// (see WithIdempotencyKey), repeating the call with the same key and
+// arguments returns the user created the first time instead of a new one.
+func (s *UserService) CreateUser(ctx context.Context, name, email string, age *int) (*User, error) {
+    return s.CreateUserWith(ctx, CreateUserRequest{Name: name, Email: email, Age: age})
+}
+
+// CreateUserWith is CreateUser for requests that also carry contact
+// details.
+func (s *UserService) CreateUserWith(ctx context.Context, req CreateUserRequest) (*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    key, ok := IdempotencyKeyFrom(ctx)
+    if !ok {
+        return s.createUser(ctx, req)
+    }
+
+    defer s.idemLocks.Lock(key)()
+    fingerprint := req.fingerprint()
+    rec, found, err := s.idem.Lookup(ctx, key)
+    if err != nil {
+        return nil, err
+    }
+    if found {
+        if rec.Fingerprint != fingerprint {
+            return nil, fmt.Errorf("key %q: %w", key, ErrIdempotencyConflict)
+        }
+        s.log(ctx).Info("Replaying create", "idempotency_key", key, "target", rec.UserID)
+        return s.repo.FindByID(ctx, rec.UserID)
+    }
+    user, err := s.createUser(ctx, req)
+    if err != nil {
+        return nil, err
+    }
+    if err := s.idem.Store(ctx, key, IdempotencyRecord{UserID: user.ID, Fingerprint: fingerprint}); err != nil {
+        // The user exists; a retry will see ErrEmailTaken rather than a
+        // duplicate, so report success.
+        s.log(ctx).Error("Failed to store idempotency key", "idempotency_key", key, "error", err)
+    }
+    return user, nil
+}
+
+func (s *UserService) createUser(ctx context.Context, req CreateUserRequest) (*User, error) {
+    s.log(ctx).Info("Creating user", "email", req.Email)
+    
+    user, err := s.newUser(ctx, req)
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := s.repo.Save(ctx, user); err != nil {
+        s.log(ctx).Error("Failed to save user", "email", req.Email, "error", err)
+        return nil, err
+    }
+    
+    s.log(ctx).Info("User created", "target", user.ID)
+    s.emit(ctx, EventUserCreated, user.ID, user)
+    return user, nil
+}
+
+// UserStats summarizes the live users. The age figures only count users
+// with an age set (WithAge of them) and are zero when there are none.
+// Percentiles interpolate linearly between the nearest ages.
+type UserStats struct {
+    Total        int            `json:"total"`
+    ByStatus     map[Status]int `json:"by_status"`
+    WithAge      int            `json:"with_age"`
+    WithoutAge   int            `json:"without_age"`
+    AverageAge   float64        `json:"average_age"`
+    MedianAge    float64        `json:"median_age"`
+    P90Age       float64        `json:"p90_age"`
+    P99Age       float64        `json:"p99_age"`
+    AgeStdDev    float64        `json:"age_stddev"`
+    AgeHistogram []AgeBucket    `json:"age_histogram"`
+    ByTag        map[string]int `json:"by_tag"`
+}
+
+// AgeBucketWidth is the span of each AgeHistogram bucket in years.
+const AgeBucketWidth = 10
+
+// AgeBucket counts users aged Min through Max inclusive.
+type AgeBucket struct {
+    Min   int `json:"min"`
+    Max   int `json:"max"`
+    Count int `json:"count"`
+}
+
+// newUser validates req and builds the user CreateUser would store.
+func (s *UserService) newUser(ctx context.Context, req CreateUserRequest) (*User, error) {
+    email, err := s.checkEmail(ctx, req.Email)
+    if err != nil {
+        return nil, invalidInput(err)
+    }
+    user := &User{
+        Name:        req.Name,
+        Email:       email,
+        Age:         req.Age,
+        Status:      StatusActive,
+        Role:        RoleMember,
+        Preferences: DefaultPrefs,
+    }
+    if req.Phone != nil {
+        if user.Phone, err = req.Phone.normalized(); err != nil {
+            return nil, invalidInput(err)
+        }
+    }
+    if req.Address != nil {
+        if user.Address, err = s.validateAddress(*req.Address); err != nil {
+            return nil, invalidInput(err)
+        }
+    }
+    return user, nil
+}
+
+type CreateUserRequest struct {
+    Name    string   `json:"name"`
+    Email   string   `json:"email"`
+    Age     *int     `json:"age,omitempty"`
+    Phone   *Phone   `json:"phone,omitempty"`
+    Address *Address `json:"address,omitempty"`
+}
+
+// fingerprint identifies the request's content for idempotency checks.
+func (r CreateUserRequest) fingerprint() string {
+    b, _ := json.Marshal(r)
+    sum := sha256.Sum256(b)
+    return hex.EncodeToString(sum[:])
+}
+
+// Idempotency
+
+// DefaultIdempotencyTTL is how long CreateUser remembers a key.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// WithIdempotencyKey attaches a client-chosen key to ctx; the HTTP layer
+// typically takes it from an Idempotency-Key header.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+    return context.WithValue(ctx, idempotencyKeyKey, key)
+}
+
+func IdempotencyKeyFrom(ctx context.Context) (string, bool) {
+    key, ok := ctx.Value(idempotencyKeyKey).(string)
+    return key, ok && key != ""
+}
+
+// IdempotencyRecord is what a key resolves to: the user it created and a
+// fingerprint of the request that created it.
+type IdempotencyRecord struct {
+    UserID      UserID `json:"user_id"`
+    Fingerprint string `json:"fingerprint"`
+}
+
+// IdempotencyStore remembers idempotency keys. UserService serializes calls
+// per key within one process; a store shared between instances needs its
+// own protection against two instances racing on the same key.
+type IdempotencyStore interface {
+    Lookup(ctx context.Context, key string) (IdempotencyRecord, bool, error)
+    Store(ctx context.Context, key string, rec IdempotencyRecord) error
+}
+
+// MemoryIdempotencyStore keeps keys in memory for ttl. It is safe for
+// concurrent use. Expired keys are dropped when looked up, and the rest
+// by a sweep at most once per ttl.
+type MemoryIdempotencyStore struct {
+    ttl     time.Duration
+    mu      sync.Mutex
+    records map[string]idempotencyEntry
+    swept   time.Time
+}
+
+type idempotencyEntry struct {
+    rec     IdempotencyRecord
+    expires time.Time
+}
+
+func NewMemoryIdempotencyStore(ttl time.Duration) *MemoryIdempotencyStore {
+    return &MemoryIdempotencyStore{ttl: ttl, records: make(map[string]idempotencyEntry), swept: time.Now()}
+}
+
+func (m *MemoryIdempotencyStore) Lookup(ctx context.Context, key string) (IdempotencyRecord, bool, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    e, ok := m.records[key]
+    if !ok {
+        return IdempotencyRecord{}, false, nil
+    }
+    if time.Now().After(e.expires) {
+        delete(m.records, key)
+        return IdempotencyRecord{}, false, nil
+    }
+    return e.rec, true, nil
+}
+
+func (m *MemoryIdempotencyStore) Store(ctx context.Context, key string, rec IdempotencyRecord) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    now := time.Now()
+    m.sweep(now)
+    m.records[key] = idempotencyEntry{rec: rec, expires: now.Add(m.ttl)}
+    return nil
+}
+
+// sweep drops expired keys, at most once per ttl.
+func (m *MemoryIdempotencyStore) sweep(now time.Time) {
+    if now.Sub(m.swept) < m.ttl {
+        return
+    }
+    m.swept = now
+    for k, e := range m.records {
+        if now.After(e.expires) {
+            delete(m.records, k)
+        }
+    }
+}
+
+// keyedMutex hands out one lock per key and forgets keys nobody holds.
+type keyedMutex struct {
+    mu    sync.Mutex
+    locks map[string]*refMutex
+}
+
+type refMutex struct {
+    sync.Mutex
+    refs int
+}
+
+// Lock blocks until key is free and returns the function that frees it.
+func (k *keyedMutex) Lock(key string) (unlock func()) {
+    k.mu.Lock()
+    if k.locks == nil {
+        k.locks = make(map[string]*refMutex)
+    }
+    m, ok := k.locks[key]
+    if !ok {
+        m = &refMutex{}
+        k.locks[key] = m
+    }
+    m.refs++
+    k.mu.Unlock()
+
+    m.Lock()
+    return func() {
+        m.Unlock()
+        k.mu.Lock()
+        if m.refs--; m.refs == 0 {
+            delete(k.locks, key)
+        }
+        k.mu.Unlock()
+    }
+}
+
+// CreateUserResult is the outcome for the request at the same index:
+// exactly one of User and Err is set.
+type CreateUserResult struct {
+    User *User `json:"user,omitempty"`
+    Err  error `json:"-"`
+}
+
+// CreateUsers validates every request, then stores the valid ones in one
+// SaveAll call, which is a single transaction on SQL backends. A request
+// that fails validation or repeats an email earlier in the batch doesn't
+// stop the others. The error is only set if the batch as a whole failed.
+func (s *UserService) CreateUsers(ctx context.Context, reqs []CreateUserRequest) ([]CreateUserResult, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    s.log(ctx).Info("Creating users", "count", len(reqs))
+
+    results := make([]CreateUserResult, len(reqs))
+    var (
+        users   []*User
+        indexes []int // position in reqs of each entry in users
+        seen    = make(map[string]int)
+    )
+    for i, req := range reqs {
+        user, err := s.newUser(ctx, req)
+        if err != nil {
+            results[i].Err = err
+            continue
+        }
+        if first, dup := seen[user.Email]; dup {
+            results[i].Err = fmt.Errorf("email %q repeats request %d: %w", user.Email, first, ErrEmailTaken)
+            continue
+        }
+        seen[user.Email] = i
+        users = append(users, user)
+        indexes = append(indexes, i)
+    }
+
+    if len(users) > 0 {
+        err := s.repo.SaveAll(ctx, users)
+        var bulk *BulkError
+        switch {
+        case errors.As(err, &bulk):
+            for _, f := range bulk.Failures {
+                results[indexes[f.Index]].Err = f.Err
+                users[f.Index] = nil
+            }
+        case err != nil:
+            s.log(ctx).Error("Failed to create users", "error", err)
+            return nil, err
+        }
+        for j, user := range users {
+            if user != nil {
+                results[indexes[j]].User = user
+            }
+        }
+    }
+
+    created := 0
+    for _, r := range results {
+        if r.User != nil {
+            created++
+            s.emit(ctx, EventUserCreated, r.User.ID, r.User)
+        }
+    }
+    s.log(ctx).Info("Users created", "created", created, "requested", len(reqs))
+    return results, nil
+}
+
+func (s *UserService) GetUserStats(ctx context.Context) (*UserStats, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if err := s.authorize(ctx, ActionViewStats, 0); err != nil {
+        return nil, err
+    }
+    if s.statsWorkers > 1 {
+        return collectStatsParallel(ctx, s.repo.FindAllIter(ctx), s.statsWorkers, DefaultStatsShardSize)
+    }
+    return collectStats(s.repo.FindAllIter(ctx))
+}
+
+// GetTenantStats computes UserStats for each tenant. It reads across
+// tenants, so ctx must come from WithAllTenants.
+func (s *UserService) GetTenantStats(ctx context.Context) (map[TenantID]*UserStats, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if err := s.authorize(ctx, ActionViewStats, 0); err != nil {
+        return nil, err
+    }
+    if _, all := TenantScope(ctx); !all {
+        return nil, fmt.Errorf("tenant stats span tenants: %w", ErrForbidden)
+    }
+    byTenant := make(map[TenantID][]*User)
+    for user, err := range s.repo.FindAllIter(ctx) {
+        if err != nil {
+            return nil, err
+        }
+        byTenant[user.TenantID] = append(byTenant[user.TenantID], user)
+    }
+    stats := make(map[TenantID]*UserStats, len(byTenant))
+    for tenant, users := range byTenant {
+        st, err := collectStats(func(yield func(*User, error) bool) {
+            for _, u := range users {
+                if !yield(u, nil) {
+                    return
+                }
+            }
+        })
+        if err != nil {
+            return nil, err
+        }
+        stats[tenant] = st
+    }
+    return stats, nil
+}
+
+// collectStats computes UserStats over users, stopping at the first error.
+func collectStats(users iter.Seq2[*User, error]) (*UserStats, error) {
+    stats := &UserStats{ByStatus: make(map[Status]int), ByTag: make(map[string]int)}
+    var ages []int
+    
+    for user, err := range users {
+        if err != nil {
+            return nil, err
+        }
+        stats.Total++
+        stats.ByStatus[user.Status]++
+        for _, tag := range user.Tags {
+            stats.ByTag[tag]++
+        }
+        if user.Age != nil {
+            ages = append(ages, *user.Age)
+        }
+    }
+    
+    stats.WithAge = len(ages)
+    stats.WithoutAge = stats.Total - len(ages)
+    stats.addAgeDistribution(ages)
+    return stats, nil
+}
+
+func (s *UserStats) addAgeDistribution(ages []int) {
+    if len(ages) == 0 {
+        return
+    }
+    sort.Ints(ages)
+
+    sum := 0
+    for _, a := range ages {
+        sum += a
+    }
+    mean := float64(sum) / float64(len(ages))
+    variance := 0.0
+    for _, a := range ages {
+        d := float64(a) - mean
+        variance += d * d
+    }
+    s.AverageAge = mean
+    s.AgeStdDev = math.Sqrt(variance / float64(len(ages)))
+    s.MedianAge = percentile(ages, 50)
+    s.P90Age = percentile(ages, 90)
+    s.P99Age = percentile(ages, 99)
+
+    // Buckets run contiguously from the youngest to the oldest user so gaps
+    // show up as zero counts.
+    first, last := ages[0]/AgeBucketWidth, ages[len(ages)-1]/AgeBucketWidth
+    s.AgeHistogram = make([]AgeBucket, last-first+1)
+    for i := range s.AgeHistogram {
+        lo := (first + i) * AgeBucketWidth
+        s.AgeHistogram[i] = AgeBucket{Min: lo, Max: lo + AgeBucketWidth - 1}
+    }
+    for _, a := range ages {
+        s.AgeHistogram[a/AgeBucketWidth-first].Count++
+    }
+}
+
+// percentile returns the p-th percentile of sorted, which must not be empty.
+func percentile(sorted []int, p float64) float64 {
+    rank := p / 100 * float64(len(sorted)-1)
+    lo := int(rank)
+    if lo+1 >= len(sorted) {
+        return float64(sorted[lo])
+    }
+    frac := rank - float64(lo)
+    return float64(sorted[lo]) + frac*float64(sorted[lo+1]-sorted[lo])
+}
+
+// statsShard is the part of UserStats one shard of users contributes.
+// Ages are counted by value, so shards merge by adding. A map rather than
+// a slice indexed by age keeps a corrupt age of a billion from costing
+// gigabytes, and takes negative ages as collectStats does.
+type statsShard struct {
+    total    int
+    byStatus map[Status]int
+    byTag    map[string]int
+    ages     map[int]int // users by age
+}
+
+func newStatsShard() *statsShard {
+    return &statsShard{byStatus: make(map[Status]int), byTag: make(map[string]int), ages: make(map[int]int)}
+}
+
+func (p *statsShard) add(user *User) {
+    p.total++
+    p.byStatus[user.Status]++
+    for _, tag := range user.Tags {
+        p.byTag[tag]++
+    }
+    if user.Age != nil {
+        p.ages[*user.Age]++
+    }
+}
+
+func (p *statsShard) merge(q *statsShard) {
+    p.total += q.total
+    for status, n := range q.byStatus {
+        p.byStatus[status] += n
+    }
+    for tag, n := range q.byTag {
+        p.byTag[tag] += n
+    }
+    for a, n := range q.ages {
+        p.ages[a] += n
+    }
+}
+
+func (p *statsShard) stats() *UserStats {
+    stats := &UserStats{Total: p.total, ByStatus: p.byStatus, ByTag: p.byTag}
+    var ages []int // sorted
+    for _, a := range slices.Sorted(maps.Keys(p.ages)) {
+        for range p.ages[a] {
+            ages = append(ages, a)
+        }
+    }
+    stats.WithAge = len(ages)
+    stats.WithoutAge = stats.Total - len(ages)
+    stats.addAgeDistribution(ages)
+    return stats
+}
+
+// collectStatsParallel computes what collectStats does, aggregating
+// shards of shardSize users on up to workers goroutines and merging
+// their partial results. Reading users stays serial, so it only pays
+// when there are enough of them; with one shard's worth or fewer it
+// doesn't start any goroutines.
+//
+// Counting shards is about three quarters of the work, and reading and
+// summarizing ages the rest, so W workers can at best cut the time to
+// roughly 1/4 + 3/(4W) of collectStats's. On one CPU it took 1.15 times
+// as long as collectStats for 1K users, 1.10 for 8K and 0.98 to 1.05 from
+// 16K to 1M: the pool's overhead, with no second CPU to win it back.
+// That is why a single worker counts serially.
+func collectStatsParallel(ctx context.Context, users iter.Seq2[*User, error], workers, shardSize int) (*UserStats, error) {
+    aggregate := func(ctx context.Context, shard []*User) (*statsShard, error) {
+        p := newStatsShard()
+        for _, user := range shard {
+            p.add(user)
+        }
+        return p, nil
+    }
+    var pool *WorkerPool[[]*User, *statsShard]
+    shard := make([]*User, 0, shardSize)
+    for user, err := range users {
+        if err != nil {
+            if pool != nil {
+                pool.Close()
+            }
+            return nil, err
+        }
+        if shard = append(shard, user); len(shard) < shardSize {
+            continue
+        }
+        if pool == nil {
+            pool = NewWorkerPool(ctx, workers, aggregate)
+        }
+        if err := pool.Submit(shard); err != nil {
+            pool.Close()
+            return nil, err
+        }
+        shard = make([]*User, 0, shardSize)
+    }
+    total, _ := aggregate(ctx, shard)
+    if pool == nil {
+        return total.stats(), nil
+    }
+    results := pool.Close()
+    if err := PoolErrors(results); err != nil {
+        return nil, err
+    }
+    for _, r := range results {
+        total.merge(r.Value)
+    }
+    return total.stats(), nil
+}
+
+// Interval is the bucket size of a signup time series.
+type Interval string
+
+const (
+    IntervalDay   Interval = "day"
+    IntervalWeek  Interval = "week" // weeks start on Monday
+    IntervalMonth Interval = "month"
+)
+
+// MaxSeriesBuckets bounds how many buckets one time series may span.
+const MaxSeriesBuckets = 10000
+
+// start returns the beginning of the bucket containing t, in t's location.
+func (i Interval) start(t time.Time) time.Time {
+    y, m, d := t.Date()
+    switch i {
+    case IntervalWeek:
+        offset := (int(t.Weekday()) + 6) % 7 // days since Monday
+        return time.Date(y, m, d-offset, 0, 0, 0, 0, t.Location())
+    case IntervalMonth:
+        return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+    default:
+        return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+    }
+}
+
+func (i Interval) next(t time.Time) time.Time {
+    switch i {
+    case IntervalWeek:
+        return t.AddDate(0, 0, 7)
+    case IntervalMonth:
+        return t.AddDate(0, 1, 0)
+    default:
+        return t.AddDate(0, 0, 1)
+    }
+}
+
+type SignupBucket struct {
+    Start time.Time `json:"start"`
+    Count int       `json:"count"`
+}
+
+// GetSignupTimeSeries counts live users created in [from, to) per interval.
+// Buckets are aligned to calendar boundaries in from's location and run
+// contiguously, so periods without signups appear with a zero count.
+func (s *UserService) GetSignupTimeSeries(ctx context.Context, interval Interval, from, to time.Time) ([]SignupBucket, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    switch interval {
+    case IntervalDay, IntervalWeek, IntervalMonth:
+    default:
+        return nil, fmt.Errorf("unknown interval %q", interval)
+    }
+    if !from.Before(to) {
+        return nil, fmt.Errorf("empty range %s to %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+    }
+    if err := s.authorize(ctx, ActionViewStats, 0); err != nil {
+        return nil, err
+    }
+
+    var buckets []SignupBucket
+    index := make(map[time.Time]int)
+    for t := interval.start(from); t.Before(to); t = interval.next(t) {
+        if len(buckets) == MaxSeriesBuckets {
+            return nil, fmt.Errorf("range spans more than %d %s buckets", MaxSeriesBuckets, interval)
+        }
+        index[t] = len(buckets)
+        buckets = append(buckets, SignupBucket{Start: t})
+    }
+
+    users, err := s.repo.FindWhere(ctx, UserFilter{CreatedAfter: from, CreatedBefore: to})
+    if err != nil {
+        return nil, err
+    }
+    for _, u := range users {
+        if i, ok := index[interval.start(u.CreatedAt.In(from.Location()))]; ok {
+            buckets[i].Count++
+        }
+    }
+    return buckets, nil
+}
+
+// GetUserStatsMap returns GetUserStats in the old untyped shape.
+//
+// Deprecated: use GetUserStats. This adapter will be removed in the next
+// release.
+func (s *UserService) GetUserStatsMap(ctx context.Context) (map[string]interface{}, error) {
+    stats, err := s.GetUserStats(ctx)
+    if err != nil {
+        return nil, err
+    }
+    return map[string]interface{}{
+        "total":       stats.Total,
+        "by_status":   stats.ByStatus,
+        "average_age": stats.AverageAge,
+    }, nil
+}
+
+// GetUser returns a live user.
+func (s *UserService) GetUser(ctx context.Context, id UserID) (*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    return s.repo.FindByID(ctx, id)
+}
+
+// ListUsers returns one page of live users.
+func (s *UserService) ListUsers(ctx context.Context, req PageRequest) (*Page, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if _, err := req.normalize(); err != nil {
+        return nil, invalidInput(err)
+    }
+    return s.repo.FindPage(ctx, req)
+}
+
+// FindUsers returns one page of the users matching filter: live ones,
+// unless IncludeDeleted asks for deleted ones too, which needs
+// ActionViewDeleted as ListDeletedUsers does.
+func (s *UserService) FindUsers(ctx context.Context, filter UserFilter, req PageRequest) (*Page, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if filter.IncludeDeleted {
+        if err := s.authorize(ctx, ActionViewDeleted, 0); err != nil {
+            return nil, err
+        }
+    }
+    req, err := req.normalize()
+    if err != nil {
+        return nil, invalidInput(err)
+    }
+    users, err := s.repo.FindWhere(ctx, filter)
+    if err != nil {
+        return nil, err
+    }
+    sortUsers(users, req.Sort)
+    start := min(req.Offset, len(users))
+    end := min(start+req.Limit, len(users))
+    return &Page{Users: users[start:end], Total: len(users), Offset: req.Offset, Limit: req.Limit}, nil
+}
+
+// GetUsers looks up several live users with one query. IDs that don't
+// resolve are absent from the result.
+func (s *UserService) GetUsers(ctx context.Context, ids []UserID) (map[UserID]*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    found := make(map[UserID]*User, len(ids))
+    if len(ids) == 0 {
+        return found, nil
+    }
+    users, err := s.repo.FindWhere(ctx, UserFilter{IDs: ids})
+    if err != nil {
+        return nil, err
+    }
+    for _, user := range users {
+        found[user.ID] = user
+    }
+    return found, nil
+}
+
+// UserPatch lists the fields PatchUser should change; nil fields are left
+// alone, so callers never overwrite data they didn't mean to touch. Set
+// ClearAge to remove the age entirely, and likewise ClearPhone and
+// ClearAddress.
+type UserPatch struct {
+    Name         *string     `json:"name,omitempty"`
+    Email        *string     `json:"email,omitempty"`
+    Age          *int        `json:"age,omitempty"`
+    ClearAge     bool        `json:"clear_age,omitempty"`
+    Status       *Status     `json:"status,omitempty"`
+    Preferences  *PrefsPatch `json:"preferences,omitempty"`
+    Phone        *Phone      `json:"phone,omitempty"`
+    ClearPhone   bool        `json:"clear_phone,omitempty"`
+    Address      *Address    `json:"address,omitempty"`
+    ClearAddress bool        `json:"clear_address,omitempty"`
+}
+
+type PrefsPatch struct {
+    Theme         *string `json:"theme,omitempty"`
+    Notifications *bool   `json:"notifications,omitempty"`
+    Language      *string `json:"language,omitempty"`
+    // Custom sets registered custom preferences, keyed like PrefSchema.
+    Custom map[string]string `json:"custom,omitempty"`
+}
+
+// PatchUser applies patch to the stored user inside a transaction (where
+// the backend supports one) and returns the updated user. Users may patch
+// themselves, but changing a status needs ActionDeactivateUser too.
+func (s *UserService) PatchUser(ctx context.Context, id UserID, patch UserPatch) (*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if err := s.authorize(ctx, ActionUpdateUser, id); err != nil {
+        return nil, err
+    }
+    if patch.Status != nil {
+        if err := s.authorize(ctx, ActionDeactivateUser, id); err != nil {
+            return nil, err
+        }
+    }
+
+    s.log(ctx).Info("Patching user", "target", id)
+
+    if patch.Email != nil && s.checkMX {
+        if _, err := s.checkEmail(ctx, *patch.Email); err != nil {
+            return nil, invalidInput(err)
+        }
+    }
+    if prefs := patch.Preferences; prefs != nil && len(prefs.Custom) > 0 {
+        custom := make(map[string]string, len(prefs.Custom))
+        for key, raw := range prefs.Custom {
+            if isBuiltinPref(key) {
+                return nil, invalidInput(fmt.Errorf("%q is not a custom preference", key))
+            }
+            canonical, err := s.prefs.Parse(key, raw)
+            if err != nil {
+                return nil, invalidInput(err)
+            }
+            custom[key] = canonical
+        }
+        prefsCopy := *prefs
+        prefsCopy.Custom = custom
+        patch.Preferences = &prefsCopy
+    }
+    if patch.Address != nil && !patch.ClearAddress {
+        addr, err := s.validateAddress(*patch.Address)
+        if err != nil {
+            return nil, invalidInput(err)
+        }
+        patch.Address = addr
+    }
+
+    var updated User
+    err := WithinTx(ctx, s.repo, func(repo UserRepository) error {
+        current, err := repo.FindByID(ctx, id)
+        if err != nil {
+            return err
+        }
+        updated = *current // never mutate the stored copy before validation passes
+        if err := patch.apply(&updated, time.Now()); err != nil {
+            return invalidInput(err)
+        }
+        return repo.Save(ctx, &updated)
+    })
+    if err != nil {
+        s.log(ctx).Error("Failed to patch user", "target", id, "error", err)
+        return nil, err
+    }
+    s.emit(ctx, EventUserUpdated, id, &updated)
+    return &updated, nil
+}
+
+// apply validates and copies the patch onto user; a Status change goes
+// through the lifecycle and is stamped with now.
+func (p UserPatch) apply(user *User, now time.Time) error {
+    if p.Name != nil {
+        user.Name = *p.Name
+    }
+    if p.Email != nil {
+        email, err := NormalizeEmail(*p.Email)
+        if err != nil {
+            return err
+        }
+        user.Email = email
+    }
+    if p.ClearAge {
+        user.Age = nil
+    } else if p.Age != nil {
+        if *p.Age < 0 || *p.Age > MaxUserAge {
+            return fmt.Errorf("invalid age %d", *p.Age)
+        }
+        user.Age = intPtr(*p.Age)
+    }
+    if p.ClearPhone {
+        user.Phone = nil
+    } else if p.Phone != nil {
+        phone, err := p.Phone.normalized()
+        if err != nil {
+            return err
+        }
+        user.Phone = phone
+    }
+    // Addresses need the service's per-country validators, so PatchUser
+    // checks them before calling apply.
+    if p.ClearAddress {
+        user.Address = nil
+    } else if p.Address != nil {
+        addr := *p.Address
+        user.Address = &addr
+    }
+    if p.Status != nil && *p.Status != user.Status {
+        if err := user.transition(*p.Status, now); err != nil {
+            return err
+        }
+    }
+    if prefs := p.Preferences; prefs != nil {
+        if prefs.Theme != nil {
+            if err := validateChoice(PrefTheme, *prefs.Theme, AllowedThemes); err != nil {
+                return err
+            }
+            user.Preferences.Theme = *prefs.Theme
+        }
+        if prefs.Notifications != nil {
+            user.Preferences.Notifications = *prefs.Notifications
+        }
+        if prefs.Language != nil {
+            if err := validateChoice(PrefLanguage, *prefs.Language, AllowedLanguages); err != nil {
+                return err
+            }
+            user.Preferences.Language = *prefs.Language
+        }
+        if len(prefs.Custom) > 0 {
+            // Clone so the stored user's map isn't modified through the copy.
+            custom := maps.Clone(user.Preferences.Custom)
+            if custom == nil {
+                custom = make(map[string]string, len(prefs.Custom))
+            }
+            maps.Copy(custom, prefs.Custom)
+            user.Preferences.Custom = custom
+        }
+    }
+    return nil
+}
+
+// DeleteUser soft-deletes a user after the authorizer allows it.
+func (s *UserService) DeleteUser(ctx context.Context, id UserID) error {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if err := s.authorize(ctx, ActionDeleteUser, id); err != nil {
+        return err
+    }
+    s.log(ctx).Info("Deleting user", "target", id)
+
+    if err := s.repo.Delete(ctx, id); err != nil {
+        s.log(ctx).Error("Failed to delete user", "target", id, "error", err)
+        return err
+    }
+    s.emit(ctx, EventUserDeleted, id, nil)
+    return nil
+}
+
+// ListDeletedUsers returns one page of soft-deleted users, most recently
+// deleted first; req.Sort is ignored.
+func (s *UserService) ListDeletedUsers(ctx context.Context, req PageRequest) (*Page, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if err := s.authorize(ctx, ActionViewDeleted, 0); err != nil {
+        return nil, err
+    }
+    req, err := req.normalize()
+    if err != nil {
+        return nil, invalidInput(err)
+    }
+    users, err := s.repo.FindWhere(ctx, UserFilter{IncludeDeleted: true})
+    if err != nil {
+        return nil, err
+    }
+    users = slices.DeleteFunc(users, func(u *User) bool { return u.DeletedAt == nil })
+    sort.SliceStable(users, func(i, j int) bool { return users[i].DeletedAt.After(*users[j].DeletedAt) })
+    start := min(req.Offset, len(users))
+    end := min(start+req.Limit, len(users))
+    return &Page{Users: users[start:end], Total: len(users), Offset: req.Offset, Limit: req.Limit}, nil
+}
+
+// RestoreUser undoes DeleteUser, failing with ErrEmailTaken if another
+// live user has taken the email since.
+func (s *UserService) RestoreUser(ctx context.Context, id UserID) (*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if err := s.authorize(ctx, ActionRestoreUser, id); err != nil {
+        return nil, err
+    }
+    s.log(ctx).Info("Restoring user", "target", id)
+
+    if err := s.repo.Restore(ctx, id); err != nil {
+        s.log(ctx).Error("Failed to restore user", "target", id, "error", err)
+        return nil, err
+    }
+    user, err := s.repo.FindByID(ctx, id)
+    if err != nil {
+        return nil, err
+    }
+    s.record(ctx, ActionRestoreUser, id, "")
+    s.emit(ctx, EventUserRestored, id, user)
+    return user, nil
+}
+
+// PurgeDeletedUsers permanently removes users soft-deleted over olderThan
+// ago and returns how many went.
+func (s *UserService) PurgeDeletedUsers(ctx context.Context, olderThan time.Duration) (int, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if err := s.authorize(ctx, ActionPurgeUsers, 0); err != nil {
+        return 0, err
+    }
+    if olderThan < 0 {
+        return 0, invalidInput(fmt.Errorf("negative purge age %s", olderThan))
+    }
+    // Note whose avatars go with them; the repository only counts.
+    var avatars []UserID
+    if s.avatars != nil {
+        deleted, err := s.repo.FindWhere(ctx, UserFilter{IncludeDeleted: true})
+        if err != nil {
+            return 0, err
+        }
+        cutoff := time.Now().Add(-olderThan)
+        for _, u := range deleted {
+            if u.DeletedAt != nil && !u.DeletedAt.After(cutoff) && u.AvatarURL != "" {
+                avatars = append(avatars, u.ID)
+            }
+        }
+    }
+    purged, err := s.repo.PurgeDeleted(ctx, olderThan)
+    if err != nil {
+        s.log(ctx).Error("Failed to purge deleted users", "error", err)
+        return 0, err
+    }
+    for _, id := range avatars {
+        s.deleteAvatars(ctx, id)
+    }
+    s.log(ctx).Info("Purged deleted users", "count", purged, "older_than", olderThan)
+    s.record(ctx, ActionPurgeUsers, 0, fmt.Sprintf("purged %d users deleted over %s ago", purged, olderThan))
+    return purged, nil
+}
+
+// Reindex rebuilds the repository's indexes, if it or a repository it
+// decorates is a Reindexer. Indexes span every tenant.
+func (s *UserService) Reindex(ctx context.Context) error {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if err := s.authorize(ctx, ActionReindex, 0); err != nil {
+        return err
+    }
+    r, ok := findRepository[Reindexer](s.repo)
+    if !ok {
+        return fmt.Errorf("reindex: %T %w", s.repo, ErrNotSupported)
+    }
+    start := time.Now()
+    if err := r.Reindex(ctx); err != nil {
+        s.log(ctx).Error("Reindex failed", "error", err)
+        return err
+    }
+    s.log(ctx).Info("Reindexed", "duration", time.Since(start).Round(time.Millisecond))
+    s.record(ctx, ActionReindex, 0, "")
+    return nil
+}
+
+// Data subject requests (GDPR)
+
+// UserDataExport is everything the service holds about one user, in the
+// form handed to the user on an access request.
+type UserDataExport struct {
+    ExportedAt   time.Time      `json:"exported_at"`
+    User         *User          `json:"user"`
+    Preferences  map[string]any `json:"preferences"`
+    AuditEntries []AuditEntry   `json:"audit_entries"`
+}
+
+// ExportUserData collects a live user's profile, every preference in the
+// schema (defaults included, so the export shows what is in effect), and
+// their audit entries when an audit log is configured.
+func (s *UserService) ExportUserData(ctx context.Context, id UserID) (*UserDataExport, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if err := s.authorize(ctx, ActionExportUserData, id); err != nil {
+        return nil, err
+    }
+    user, err := s.repo.FindByID(ctx, id)
+    if err != nil {
+        return nil, err
+    }
+    export := &UserDataExport{
+        ExportedAt:   time.Now().UTC(),
+        User:         user,
+        Preferences:  s.prefs.Values(user.Preferences),
+        AuditEntries: []AuditEntry{},
+    }
+    if s.audit != nil {
+        entries, err := s.audit.ForUser(ctx, id)
+        if err != nil {
+            return nil, err
+        }
+        export.AuditEntries = append(export.AuditEntries, entries...)
+    }
+    s.record(ctx, ActionExportUserData, id, "")
+    return export, nil
+}
+
+// ErasureReceipt proves that a user's personal data was erased. EmailHash
+// lets the data subject check the receipt is theirs without the receipt
+// containing the address itself.
+type ErasureReceipt struct {
+    UserID    UserID    `json:"user_id"`
+    EmailHash string    `json:"email_hash"`
+    ErasedAt  time.Time `json:"erased_at"`
+    Fields    []string  `json:"fields"`
+    Signature string    `json:"signature"`
+}
+
+func (r ErasureReceipt) payload() []byte {
+    unsigned := r
+    unsigned.Signature = ""
+    b, _ := json.Marshal(unsigned)
+    return b
+}
+
+// VerifyErasureReceipt reports whether r was signed with key.
+func VerifyErasureReceipt(key []byte, r ErasureReceipt) bool {
+    sig, err := hex.DecodeString(r.Signature)
+    return err == nil && hmac.Equal(sig, hmacSHA256(key, string(r.payload())))
+}
+
+// erasedFields are the User fields EraseUser overwrites.
+var erasedFields = []string{"name", "email", "age", "preferences", "tags", "avatar_url", "phone", "address", "metadata"}
+
+// EraseUser overwrites a user's personal data and then soft-deletes the
+// record, so the ID stays valid for audit entries but nothing identifies
+// the person. Already soft-deleted users are restored first so they can be
+// erased too. The returned receipt is signed with the WithReceiptKey key.
+func (s *UserService) EraseUser(ctx context.Context, id UserID) (*ErasureReceipt, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if len(s.receiptKey) == 0 {
+        return nil, errors.New("no erasure receipt key configured")
+    }
+    if err := s.authorize(ctx, ActionEraseUser, id); err != nil {
+        return nil, err
+    }
+    s.log(ctx).Info("Erasing user", "target", id)
+
+    var emailHash string
+    err := WithinTx(ctx, s.repo, func(repo UserRepository) error {
+        user, err := repo.FindByID(ctx, id)
+        if errors.Is(err, ErrNotFound) {
+            if err := repo.Restore(ctx, id); err != nil {
+                return err
+            }
+            user, err = repo.FindByID(ctx, id)
+        }
+        if err != nil {
+            return err
+        }
+        sum := sha256.Sum256([]byte(strings.ToLower(user.Email)))
+        emailHash = hex.EncodeToString(sum[:])
+
+        erased := *user
+        erased.Name = ""
+        erased.Email = fmt.Sprintf("erased-%d@erased.invalid", id)
+        erased.Age = nil
+        erased.Preferences = UserPrefs{}
+        erased.Tags = nil
+        erased.AvatarURL = ""
+        erased.Phone = nil
+        erased.Address = nil
+        erased.Metadata = nil
+        if err := repo.Save(ctx, &erased); err != nil {
+            return err
+        }
+        return repo.Delete(ctx, id)
+    })
+    if err != nil {
+        s.log(ctx).Error("Failed to erase user", "target", id, "error", err)
+        return nil, err
+    }
+
+    s.deleteAvatars(ctx, id)
+
+    receipt := &ErasureReceipt{UserID: id, EmailHash: emailHash, ErasedAt: time.Now().UTC(), Fields: erasedFields}
+    receipt.Signature = hex.EncodeToString(hmacSHA256(s.receiptKey, string(receipt.payload())))
+    s.record(ctx, ActionEraseUser, id, "")
+    s.emit(ctx, EventUserDeleted, id, nil)
+    return receipt, nil
+}
+
+// Anonymization
+
+// PIIField names a User field that can identify a person.
+type PIIField string
+
+const (
+    PIIName        PIIField = "name"
+    PIIEmail       PIIField = "email"
+    PIIAge         PIIField = "age"
+    PIIPreferences PIIField = "preferences"
+    PIITags        PIIField = "tags"
+    PIIAvatar      PIIField = "avatar"
+    PIIPhone       PIIField = "phone"
+    PIIAddress     PIIField = "address"
+    PIIMetadata    PIIField = "metadata"
+)
+
+// AnonymizedEmailDomain is the domain of addresses replaced by Anonymize.
+const AnonymizedEmailDomain = "anonymized.invalid"
+
+// AnonymizeConfig chooses which fields Anonymize treats as PII. Salt is
+// mixed into email hashes so they can't be reversed by hashing a list of
+// known addresses; keep it secret and stable so the same address always
+// maps to the same hash.
+type AnonymizeConfig struct {
+    Fields []PIIField
+    Salt   []byte
+}
+
+var DefaultAnonymizeConfig = AnonymizeConfig{Fields: []PIIField{PIIName, PIIEmail, PIIAge, PIIAvatar, PIIPhone, PIIAddress, PIIMetadata}}
+
+// Anonymize returns a copy of user with the configured PII fields replaced:
+// the email by a salted hash at AnonymizedEmailDomain (still unique, so the
+// user can be counted and deduplicated), the name by "[redacted]", and
+// the other fields dropped. It always sets AnonymizedAt, so anonymized
+// users are recognized whichever fields were configured.
+func Anonymize(user *User, cfg AnonymizeConfig) *User {
+    anon := *user
+    now := time.Now()
+    anon.AnonymizedAt = &now
+    for _, f := range cfg.Fields {
+        switch f {
+        case PIIName:
+            anon.Name = "[redacted]"
+        case PIIEmail:
+            mac := hmac.New(sha256.New, cfg.Salt)
+            mac.Write([]byte(strings.ToLower(user.Email)))
+            anon.Email = hex.EncodeToString(mac.Sum(nil))[:32] + "@" + AnonymizedEmailDomain
+        case PIIAge:
+            anon.Age = nil
+        case PIIPreferences:
+            anon.Preferences = UserPrefs{}
+        case PIITags:
+            anon.Tags = nil
+        case PIIAvatar:
+            anon.AvatarURL = ""
+        case PIIPhone:
+            anon.Phone = nil
+        case PIIAddress:
+            anon.Address = nil
+        case PIIMetadata:
+            anon.Metadata = nil
+        }
+    }
+    return &anon
+}
+
+func isAnonymized(user *User) bool {
+    return user.AnonymizedAt != nil
+}
+
+// AnonymizeInactiveUsers anonymizes every inactive user whose status last
+// changed (or who was created, if it never changed) more than olderThan
+// ago, for retention policies. Users anonymized earlier are skipped, so
+// it is safe to run on a schedule. It returns how many users it changed.
+func (s *UserService) AnonymizeInactiveUsers(ctx context.Context, olderThan time.Duration) (int, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if err := s.authorize(ctx, ActionAnonymizeUsers, 0); err != nil {
+        return 0, err
+    }
+    inactive, err := s.repo.FindWhere(ctx, UserFilter{Status: StatusInactive})
+    if err != nil {
+        return 0, err
+    }
+    cutoff := time.Now().Add(-olderThan)
+    var batch []*User
+    var hadAvatar []bool
+    for _, u := range inactive {
+        since := u.CreatedAt
+        if u.StatusChangedAt != nil {
+            since = *u.StatusChangedAt
+        }
+        if since.Before(cutoff) && !isAnonymized(u) {
+            batch = append(batch, Anonymize(u, s.anonymize))
+            hadAvatar = append(hadAvatar, u.AvatarURL != "")
+        }
+    }
+    if len(batch) == 0 {
+        return 0, nil
+    }
+    s.log(ctx).Info("Anonymizing inactive users", "count", len(batch))
+
+    err = s.repo.SaveAll(ctx, batch)
+    failed := make(map[int]bool)
+    var bulk *BulkError
+    if errors.As(err, &bulk) {
+        for _, f := range bulk.Failures {
+            failed[f.Index] = true
+        }
+    } else if err != nil {
+        s.log(ctx).Error("Failed to anonymize users", "error", err)
+        return 0, err
+    }
+    for i, u := range batch {
+        if failed[i] {
+            continue
+        }
+        if hadAvatar[i] && u.AvatarURL == "" {
+            s.deleteAvatars(ctx, u.ID)
+        }
+        s.emit(ctx, EventUserUpdated, u.ID, u)
+    }
+    changed := len(batch) - len(failed)
+    s.record(ctx, ActionAnonymizeUsers, 0, fmt.Sprintf("anonymized %d users inactive since %s", changed, cutoff.Format(time.RFC3339)))
+    return changed, err
+}
+
+// AnonymizeUser anonymizes one user, whatever their status, like
+// AnonymizeInactiveUsers. A user anonymized earlier is returned unchanged.
+func (s *UserService) AnonymizeUser(ctx context.Context, id UserID) (*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if err := s.authorize(ctx, ActionAnonymizeUsers, id); err != nil {
+        return nil, err
+    }
+    user, err := s.repo.FindByID(ctx, id)
+    if err != nil {
+        return nil, err
+    }
+    if isAnonymized(user) {
+        return user, nil
+    }
+    anon := Anonymize(user, s.anonymize)
+    if err := s.repo.Save(ctx, anon); err != nil {
+        s.log(ctx).Error("Failed to anonymize user", "target", id, "error", err)
+        return nil, err
+    }
+    if user.AvatarURL != "" && anon.AvatarURL == "" {
+        s.deleteAvatars(ctx, id)
+    }
+    s.emit(ctx, EventUserUpdated, id, anon)
+    s.record(ctx, ActionAnonymizeUsers, id, "anonymized")
+    return anon, nil
+}
+
+// ExpirePendingUsers moves users that have been pending since more than
+// olderThan ago to inactive, and returns how many it moved. Failures on
+// individual users are joined into the error without stopping the rest.
+func (s *UserService) ExpirePendingUsers(ctx context.Context, olderThan time.Duration) (int, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    pending, err := s.repo.FindWhere(ctx, UserFilter{Status: StatusPending, CreatedBefore: time.Now().Add(-olderThan)})
+    if err != nil {
+        return 0, err
+    }
+    var errs []error
+    expired := 0
+    for _, u := range pending {
+        if _, err := s.transitionStatus(ctx, u.ID, StatusInactive); err != nil {
+            errs = append(errs, err)
+            continue
+        }
+        expired++
+    }
+    return expired, errors.Join(errs...)
+}
+
+// Search
+//
+// SearchUsers scores every live user against the query by name and email:
+// exact, prefix and substring matches rank highest, then typo-tolerant
+// matches by trigram similarity or edit distance to a single word. It scans
+// through FindAllIter so it works on every backend; large deployments
+// should put a real search index behind it.
+
+// MinSearchScore is the relevance below which users are left out.
+const MinSearchScore = 0.3
+
+type SearchResult struct {
+    User  *User   `json:"user"`
+    Score float64 `json:"score"`
+}
+
+type SearchPage struct {
+    Results []SearchResult `json:"results"`
+    Total   int            `json:"total"`
+    Offset  int            `json:"offset"`
+    Limit   int            `json:"limit"`
+}
+
+// SearchUsers returns one page of users matching query, best first. The
+// Sort field of req is ignored; results are ordered by score, then ID.
+func (s *UserService) SearchUsers(ctx context.Context, query string, req PageRequest) (*SearchPage, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    q := strings.ToLower(strings.TrimSpace(query))
+    if q == "" {
+        return nil, errors.New("empty search query")
+    }
+    req.Sort = SortSpec{}
+    req, err := req.normalize()
+    if err != nil {
+        return nil, err
+    }
+
+    var results []SearchResult
+    for user, err := range s.repo.FindAllIter(ctx) {
+        if err != nil {
+            return nil, err
+        }
+        if score := searchScore(q, user); score >= MinSearchScore {
+            results = append(results, SearchResult{User: user, Score: score})
+        }
+    }
+    sort.Slice(results, func(i, j int) bool {
+        if results[i].Score != results[j].Score {
+            return results[i].Score > results[j].Score
+        }
+        return results[i].User.ID < results[j].User.ID
+    })
+
+    page := &SearchPage{Total: len(results), Offset: req.Offset, Limit: req.Limit}
+    if req.Offset < len(results) {
+        page.Results = results[req.Offset:min(req.Offset+req.Limit, len(results))]
+    }
+    return page, nil
+}
+
+// searchScore rates how well the lowercased query q matches user, from 0
+// (no resemblance) to 1 (exact match).
+func searchScore(q string, user *User) float64 {
+    best := 0.0
+    for _, field := range []string{strings.ToLower(user.Name), strings.ToLower(user.Email)} {
+        switch {
+        case field == q:
+            return 1
+        case strings.HasPrefix(field, q):
+            best = max(best, 0.9)
+        case strings.Contains(field, q):
+            best = max(best, 0.75)
+        }
+        // Fuzzy matches are capped below substring matches.
+        best = max(best, 0.7*trigramSimilarity(q, field))
+        for _, word := range strings.FieldsFunc(field, func(r rune) bool {
+            return r == ' ' || r == '@' || r == '.' || r == '-' || r == '_'
+        }) {
+            best = max(best, 0.7*editSimilarity(q, word))
+        }
+    }
+    return best
+}
+
+// trigramSimilarity is the Jaccard index of the padded trigram sets of a
+// and b.
+func trigramSimilarity(a, b string) float64 {
+    ta, tb := trigrams(a), trigrams(b)
+    shared := 0
+    for t := range ta {
+        if tb[t] {
+            shared++
+        }
+    }
+    union := len(ta) + len(tb) - shared
+    if union == 0 {
+        return 0
+    }
+    return float64(shared) / float64(union)
+}
+
+func trigrams(s string) map[string]bool {
+    r := []rune("  " + s + " ")
+    set := make(map[string]bool, len(r))
+    for i := 0; i+3 <= len(r); i++ {
+        set[string(r[i:i+3])] = true
+    }
+    return set
+}
+
+// editSimilarity turns the Levenshtein distance between a and b into a
+// 0..1 score relative to the longer string.
+func editSimilarity(a, b string) float64 {
+    ra, rb := []rune(a), []rune(b)
+    longest := max(len(ra), len(rb))
+    if longest == 0 {
+        return 1
+    }
+    return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+func levenshtein(a, b []rune) int {
+    prev := make([]int, len(b)+1)
+    cur := make([]int, len(b)+1)
+    for j := range prev {
+        prev[j] = j
+    }
+    for i := 1; i <= len(a); i++ {
+        cur[0] = i
+        for j := 1; j <= len(b); j++ {
+            cost := 1
+            if a[i-1] == b[j-1] {
+                cost = 0
+            }
+            cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+        }
+        prev, cur = cur, prev
+    }
+    return prev[len(b)]
+}
+
+// Duplicates and merging
+
+// DuplicateNameSimilarity is the editSimilarity at or above which two
+// names are flagged as likely duplicates.
+const DuplicateNameSimilarity = 0.85
+
+type DuplicateReason string
+
+const (
+    DuplicateEmail DuplicateReason = "email"
+    DuplicateName  DuplicateReason = "name"
+)
+
+// DuplicatePair is two live users that probably belong to one person;
+// A always has the lower ID.
+type DuplicatePair struct {
+    A      *User           `json:"a"`
+    B      *User           `json:"b"`
+    Reason DuplicateReason `json:"reason"`
+}
+
+// FindDuplicates flags pairs of live users whose emails are equal once
+// normalized (case and "+tag" suffixes ignored) or whose names are nearly
+// identical. Name comparison is pairwise, so this is meant for periodic
+// cleanup jobs rather than request paths.
+func (s *UserService) FindDuplicates(ctx context.Context) ([]DuplicatePair, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    users, err := s.repo.FindAll(ctx, SortSpec{})
+    if err != nil {
+        return nil, err
+    }
+    var pairs []DuplicatePair
+    byEmail := make(map[string][]*User)
+    for _, u := range users {
+        key := duplicateEmailKey(u.Email)
+        for _, other := range byEmail[key] {
+            pairs = append(pairs, DuplicatePair{A: other, B: u, Reason: DuplicateEmail})
+        }
+        byEmail[key] = append(byEmail[key], u)
+    }
+    for i, a := range users {
+        name := normalizeName(a.Name)
+        if name == "" {
+            continue
+        }
+        for _, b := range users[i+1:] {
+            if duplicateEmailKey(a.Email) == duplicateEmailKey(b.Email) {
+                continue // already reported by email
+            }
+            if editSimilarity(name, normalizeName(b.Name)) >= DuplicateNameSimilarity {
+                pairs = append(pairs, DuplicatePair{A: a, B: b, Reason: DuplicateName})
+            }
+        }
+    }
+    return pairs, nil
+}
+
+// duplicateEmailKey goes further than NormalizeEmail and drops "+tag"
+// suffixes, which deliver to the same mailbox at most providers.
+func duplicateEmailKey(email string) string {
+    email = strings.ToLower(strings.TrimSpace(email))
+    local, domain, ok := strings.Cut(email, "@")
+    if !ok {
+        return email
+    }
+    local, _, _ = strings.Cut(local, "+")
+    return local + "@" + domain
+}
+
+func normalizeName(name string) string {
+    return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+// MergeHook moves whatever references duplicate over to primary. Hooks run
+// inside MergeUsers' transaction, and an error aborts the merge.
+type MergeHook func(ctx context.Context, primary, duplicate UserID) error
+
+// MergeUsers folds duplicateID into primaryID: fields missing on the primary
+// are filled from the duplicate, merge hooks re-point references, and the
+// duplicate is soft-deleted. The merge is recorded in the audit log.
+func (s *UserService) MergeUsers(ctx context.Context, primaryID, duplicateID UserID) (*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if primaryID == duplicateID {
+        return nil, fmt.Errorf("cannot merge user %d into itself", primaryID)
+    }
+    if err := s.authorize(ctx, ActionMergeUsers, duplicateID); err != nil {
+        return nil, err
+    }
+    s.log(ctx).Info("Merging users", "duplicate", duplicateID, "primary", primaryID)
+
+    var (
+        merged User
+        filled []string
+    )
+    err := WithinTx(ctx, s.repo, func(repo UserRepository) error {
+        primary, err := repo.FindByID(ctx, primaryID)
+        if err != nil {
+            return err
+        }
+        dup, err := repo.FindByID(ctx, duplicateID)
+        if err != nil {
+            return err
+        }
+        merged = *primary
+        filled = fillMissing(&merged, dup)
+        if err := repo.Save(ctx, &merged); err != nil {
+            return err
+        }
+        if err := repo.Delete(ctx, duplicateID); err != nil {
+            return err
+        }
+        for _, hook := range s.mergeHooks {
+            if err := hook(ctx, primaryID, duplicateID); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        s.log(ctx).Error("Failed to merge users", "duplicate", duplicateID, "primary", primaryID, "error", err)
+        return nil, err
+    }
+
+    s.record(ctx, ActionMergeUsers, primaryID, fmt.Sprintf("merged user %d; filled %v", duplicateID, filled))
+    s.emit(ctx, EventUserDeleted, duplicateID, nil)
+    s.emit(ctx, EventUserMerged, primaryID, &merged)
+    return &merged, nil
+}
+
+// fillMissing copies fields that are unset on dst from src and returns
+// their names.
+func fillMissing(dst, src *User) []string {
+    var filled []string
+    if dst.Name == "" && src.Name != "" {
+        dst.Name = src.Name
+        filled = append(filled, "name")
+    }
+    if dst.Age == nil && src.Age != nil {
+        dst.Age = intPtr(*src.Age)
+        filled = append(filled, "age")
+    }
+    if dst.Preferences.Theme == "" && src.Preferences.Theme != "" {
+        dst.Preferences.Theme = src.Preferences.Theme
+        filled = append(filled, "preferences.theme")
+    }
+    if dst.Preferences.Language == "" && src.Preferences.Language != "" {
+        dst.Preferences.Language = src.Preferences.Language
+        filled = append(filled, "preferences.language")
+    }
+    return filled
+}
+
+// Audit trail
+
+// AuditEntry records who did what to whom. Actor is zero when the context
+// carries no authenticated user.
+type AuditEntry struct {
+    At        time.Time `json:"at"`
+    Actor     UserID    `json:"actor,omitempty"`
+    Action    Action    `json:"action"`
+    Target    UserID    `json:"target"`
+    Detail    string    `json:"detail,omitempty"`
+    RequestID string    `json:"request_id,omitempty"`
+}
+
+type AuditLog interface {
+    Record(ctx context.Context, entry AuditEntry) error
+    // ForUser returns the entries where id is the actor or the target,
+    // oldest first.
+    ForUser(ctx context.Context, id UserID) ([]AuditEntry, error)
+}
+
+// MemoryAuditLog keeps entries in memory; it is safe for concurrent use.
+type MemoryAuditLog struct {
+    mu      sync.Mutex
+    entries []AuditEntry
+}
+
+func (l *MemoryAuditLog) Record(ctx context.Context, entry AuditEntry) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.entries = append(l.entries, entry)
+    return nil
+}
+
+func (l *MemoryAuditLog) ForUser(ctx context.Context, id UserID) ([]AuditEntry, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    var entries []AuditEntry
+    for _, e := range l.entries {
+        if e.Actor == id || e.Target == id {
+            entries = append(entries, e)
+        }
+    }
+    return entries, nil
+}
+
+func (l *MemoryAuditLog) Query(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    var entries []AuditEntry
+    for _, e := range l.entries {
+        if q.Matches(e) {
+            entries = append(entries, e)
+        }
+    }
+    if q.Limit > 0 && len(entries) > q.Limit {
+        entries = entries[len(entries)-q.Limit:]
+    }
+    return entries, nil
+}
+
+// AuditQuery selects audit entries; zero fields match every entry.
+type AuditQuery struct {
+    Actor  UserID
+    Target UserID
+    Action Action
+    Since  time.Time // inclusive
+    Until  time.Time // exclusive
+    // Limit keeps only the newest Limit matches.
+    Limit int
+}
+
+func (q AuditQuery) Matches(e AuditEntry) bool {
+    return (q.Actor == 0 || e.Actor == q.Actor) &&
+        (q.Target == 0 || e.Target == q.Target) &&
+        (q.Action == "" || e.Action == q.Action) &&
+        (q.Since.IsZero() || !e.At.Before(q.Since)) &&
+        (q.Until.IsZero() || e.At.Before(q.Until))
+}
+
+// AuditQuerier is implemented by audit logs that answer ad hoc queries,
+// oldest entry first.
+type AuditQuerier interface {
+    Query(ctx context.Context, q AuditQuery) ([]AuditEntry, error)
+}
+
+// Entries returns a copy of everything recorded so far, oldest first.
+func (l *MemoryAuditLog) Entries() []AuditEntry {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return append([]AuditEntry(nil), l.entries...)
+}
+
+// record writes an audit entry for an action that already happened, so a
+// failing audit log is reported but doesn't undo the action.
+func (s *UserService) record(ctx context.Context, action Action, target UserID, detail string) {
+    if s.audit == nil {
+        return
+    }
+    entry := AuditEntry{At: time.Now(), Action: action, Target: target, Detail: detail}
+    entry.RequestID, _ = RequestIDFrom(ctx)
+    if actor, ok := CurrentUser(ctx); ok {
+        entry.Actor = actor.ID
+    }
+    if err := s.audit.Record(ctx, entry); err != nil {
+        s.log(ctx).Error("Failed to audit", "action", action, "target", target, "error", err)
+    }
+}
+
+// SetRole changes a user's role after the authorizer allows it.
+func (s *UserService) SetRole(ctx context.Context, id UserID, role Role) (*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if !role.Valid() {
+        return nil, fmt.Errorf("unknown role %q", role)
+    }
+    if err := s.authorize(ctx, ActionSetRole, id); err != nil {
+        return nil, err
+    }
+    s.log(ctx).Info("Setting role", "target", id, "role", role)
+
+    var updated User
+    err := WithinTx(ctx, s.repo, func(repo UserRepository) error {
+        current, err := repo.FindByID(ctx, id)
+        if err != nil {
+            return err
+        }
+        updated = *current
+        updated.Role = role
+        return repo.Save(ctx, &updated)
+    })
+    if err != nil {
+        s.log(ctx).Error("Failed to set role", "target", id, "error", err)
+        return nil, err
+    }
+    s.emit(ctx, EventUserUpdated, id, &updated)
+    return &updated, nil
+}
+
+// DeactivateUser moves a user to StatusInactive after the authorizer allows
+// it; the lifecycle rules of TransitionStatus apply.
+func (s *UserService) DeactivateUser(ctx context.Context, id UserID) (*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if err := s.authorize(ctx, ActionDeactivateUser, id); err != nil {
+        return nil, err
+    }
+    return s.transitionStatus(ctx, id, StatusInactive)
+}
+
+func isBuiltinPref(key string) bool {
+    return key == PrefTheme || key == PrefNotifications || key == PrefLanguage
+}
+
+// MaxTagLength bounds a single tag in bytes.
+const MaxTagLength = 64
+
+// normalizeTag lowercases and trims tag so "VIP " and "vip" are one label.
+func normalizeTag(tag string) (string, error) {
+    tag = strings.ToLower(strings.TrimSpace(tag))
+    switch {
+    case tag == "":
+        return "", errors.New("tag is empty")
+    case len(tag) > MaxTagLength:
+        return "", fmt.Errorf("tag longer than %d bytes", MaxTagLength)
+    case strings.Contains(tag, ","):
+        return "", fmt.Errorf("tag %q contains a comma", tag)
+    }
+    return tag, nil
+}
+
+// AddTag labels a user; adding a tag the user already has is a no-op.
+func (s *UserService) AddTag(ctx context.Context, id UserID, tag string) (*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    tag, err := normalizeTag(tag)
+    if err != nil {
+        return nil, err
+    }
+    return s.updateTags(ctx, id, func(tags []string) []string {
+        if i, found := slices.BinarySearch(tags, tag); !found {
+            tags = slices.Insert(tags, i, tag)
+        }
+        return tags
+    })
+}
+
+// RemoveTag removes a label; removing one the user doesn't have is a no-op.
+func (s *UserService) RemoveTag(ctx context.Context, id UserID, tag string) (*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    tag, err := normalizeTag(tag)
+    if err != nil {
+        return nil, err
+    }
+    return s.updateTags(ctx, id, func(tags []string) []string {
+        return slices.DeleteFunc(tags, func(t string) bool { return t == tag })
+    })
+}
+
+func (s *UserService) updateTags(ctx context.Context, id UserID, change func([]string) []string) (*User, error) {
+    var updated User
+    err := WithinTx(ctx, s.repo, func(repo UserRepository) error {
+        current, err := repo.FindByID(ctx, id)
+        if err != nil {
+            return err
+        }
+        updated = *current
+        updated.Tags = change(slices.Clone(current.Tags))
+        return repo.Save(ctx, &updated)
+    })
+    if err != nil {
+        s.log(ctx).Error("Failed to update tags", "target", id, "error", err)
+        return nil, err
+    }
+    s.emit(ctx, EventUserUpdated, id, &updated)
+    return &updated, nil
+}
+
+// FindByTag returns the live users labeled tag, in ID order.
+func (s *UserService) FindByTag(ctx context.Context, tag string) ([]*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    tag, err := normalizeTag(tag)
+    if err != nil {
+        return nil, err
+    }
+    return s.repo.FindWhere(ctx, UserFilter{Tag: tag})
+}
+
+// Metadata limits. Keys are ASCII letters, digits, '_', '-' and '.'.
+const (
+    MaxMetadataKeys        = 50
+    MaxMetadataKeyLength   = 64
+    MaxMetadataValueLength = 512
+)
+
+// ReservedMetadataPrefixes mark keys kept for the service's own use;
+// SetMetadata and DeleteMetadata refuse them.
+var ReservedMetadataPrefixes = []string{"_", "zaai."}
+
+func validateMetadataKey(key string) error {
+    switch {
+    case key == "":
+        return errors.New("metadata key is empty")
+    case len(key) > MaxMetadataKeyLength:
+        return fmt.Errorf("metadata key longer than %d bytes", MaxMetadataKeyLength)
+    case strings.Trim(key, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-.") != "":
+        return fmt.Errorf("metadata key %q has invalid characters", key)
+    }
+    for _, prefix := range ReservedMetadataPrefixes {
+        if strings.HasPrefix(key, prefix) {
+            return fmt.Errorf("metadata key %q is reserved: %w", key, ErrForbidden)
+        }
+    }
+    return nil
+}
+
+// SetMetadata sets one metadata value, e.g. SetMetadata(ctx, id,
+// "crm_id", "0031x00000AbCdE").
+func (s *UserService) SetMetadata(ctx context.Context, id UserID, key, value string) (*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if err := validateMetadataKey(key); err != nil {
+        return nil, err
+    }
+    if len(value) > MaxMetadataValueLength {
+        return nil, fmt.Errorf("metadata value longer than %d bytes", MaxMetadataValueLength)
+    }
+    return s.updateMetadata(ctx, id, func(md map[string]string) error {
+        if _, exists := md[key]; !exists && len(md) >= MaxMetadataKeys {
+            return fmt.Errorf("user %d already has %d metadata keys", id, MaxMetadataKeys)
+        }
+        md[key] = value
+        return nil
+    })
+}
+
+// DeleteMetadata removes a key; removing one the user doesn't have is a
+// no-op.
+func (s *UserService) DeleteMetadata(ctx context.Context, id UserID, key string) (*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if err := validateMetadataKey(key); err != nil {
+        return nil, err
+    }
+    return s.updateMetadata(ctx, id, func(md map[string]string) error {
+        delete(md, key)
+        return nil
+    })
+}
+
+func (s *UserService) updateMetadata(ctx context.Context, id UserID, change func(map[string]string) error) (*User, error) {
+    var updated User
+    err := WithinTx(ctx, s.repo, func(repo UserRepository) error {
+        current, err := repo.FindByID(ctx, id)
+        if err != nil {
+            return err
+        }
+        updated = *current
+        updated.Metadata = maps.Clone(current.Metadata)
+        if updated.Metadata == nil {
+            updated.Metadata = make(map[string]string)
+        }
+        if err := change(updated.Metadata); err != nil {
+            return err
+        }
+        return repo.Save(ctx, &updated)
+    })
+    if err != nil {
+        s.log(ctx).Error("Failed to update metadata", "target", id, "error", err)
+        return nil, err
+    }
+    s.emit(ctx, EventUserUpdated, id, &updated)
+    return &updated, nil
+}
+
+// FindByMetadata returns the live users whose metadata has key set to
+// exactly value, in ID order.
+func (s *UserService) FindByMetadata(ctx context.Context, key, value string) ([]*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    return s.repo.FindWhere(ctx, UserFilter{Metadata: map[string]string{key: value}})
+}
+
+// GetPreferences returns a user's preferences with defaults filled in.
+func (s *UserService) GetPreferences(ctx context.Context, id UserID) (UserPrefs, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    user, err := s.repo.FindByID(ctx, id)
+    if err != nil {
+        return UserPrefs{}, err
+    }
+    return user.Preferences.withDefaults(), nil
+}
+
+// GetPreferenceValues returns every preference in the service's schema,
+// built-in and custom, as typed values with defaults filled in.
+func (s *UserService) GetPreferenceValues(ctx context.Context, id UserID) (map[string]any, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    user, err := s.repo.FindByID(ctx, id)
+    if err != nil {
+        return nil, err
+    }
+    return s.prefs.Values(user.Preferences), nil
+}
+
+// UpdatePreference sets one preference, built-in or custom, from its string
+// form (e.g. "dark" for PrefTheme, "false" for PrefNotifications) and
+// returns the resulting preferences.
+func (s *UserService) UpdatePreference(ctx context.Context, id UserID, key, value string) (UserPrefs, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    canonical, err := s.prefs.Parse(key, value)
+    if err != nil {
+        return UserPrefs{}, err
+    }
+    var patch PrefsPatch
+    switch key {
+    case PrefTheme:
+        patch.Theme = &canonical
+    case PrefLanguage:
+        patch.Language = &canonical
+    case PrefNotifications:
+        on := canonical == "true"
+        patch.Notifications = &on
+    default:
+        patch.Custom = map[string]string{key: canonical}
+    }
+    user, err := s.PatchUser(ctx, id, UserPatch{Preferences: &patch})
+    if err != nil {
+        return UserPrefs{}, err
+    }
+    return user.Preferences.withDefaults(), nil
+}
+
+// TransitionStatus moves a user to newStatus, rejecting jumps the lifecycle
+// doesn't allow (including "moving" to the current status) with
+// ErrInvalidTransition, and records when the change happened. Like
+// DeactivateUser it needs ActionDeactivateUser.
+func (s *UserService) TransitionStatus(ctx context.Context, id UserID, newStatus Status) (*User, error) {
+    ctx, cancel := s.bound(ctx)
+    defer cancel()
+
+    if err := s.authorize(ctx, ActionDeactivateUser, id); err != nil {
+        return nil, err
+    }
+    return s.transitionStatus(ctx, id, newStatus)
+}
+
+// transitionStatus is TransitionStatus for callers that have authorized
+// already, or act for the system rather than a caller. It publishes one
+// event for the change: EventUserDeactivated for a move to inactive,
+// EventUserUpdated otherwise.
+func (s *UserService) transitionStatus(ctx context.Context, id UserID, newStatus Status) (*User, error) {
+    s.log(ctx).Info("Transitioning user", "target", id, "status", newStatus)
+
+    var updated User
+    err := WithinTx(ctx, s.repo, func(repo UserRepository) error {
+        current, err := repo.FindByID(ctx, id)
+        if err != nil {
+            return err
+        }
+        updated = *current
+        if err := updated.transition(newStatus, time.Now()); err != nil {
+            return err
+        }
+        return repo.Save(ctx, &updated)
+    })
+    if err != nil {
+        s.log(ctx).Error("Failed to transition user", "target", id, "error", err)
+        return nil, err
+    }
+    event := EventUserUpdated
+    if newStatus == StatusInactive {
+        event = EventUserDeactivated
+    }
+    s.emit(ctx, event, id, &updated)
+    return &updated, nil
+}
+
+// Authentication
+//
+// Passwords are hashed with PBKDF2-HMAC-SHA256 and stored in a
+// self-describing "pbkdf2-sha256$iterations$salt$key" string, so hashes made
+// under older HashParams keep verifying and are upgraded on the next
+// successful login.
+
+const MinPasswordLength = 8
+
+// HashParams tunes password hashing cost. Raising Iterations (or changing
+// the salt or key size) makes AuthService rehash each password the next
+// time it is checked.
+type HashParams struct {
+    Iterations int
+    SaltLen    int
+    KeyLen     int
+}
+
+// DefaultHashParams follows the OWASP recommendation for PBKDF2-SHA256.
+var DefaultHashParams = HashParams{Iterations: 600_000, SaltLen: 16, KeyLen: 32}
+
+const passwordScheme = "pbkdf2-sha256"
+
+// Credentials holds a user's password hash; it is stored apart from User so
+// the hash never travels with ordinary user reads.
+type Credentials struct {
+    UserID    UserID    `json:"user_id"`
+    Hash      string    `json:"hash"`
+    UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (c *Credentials) EntityID() UserID      { return c.UserID }
+func (c *Credentials) SetEntityID(id UserID) { c.UserID = id }
+
+type CredentialStore = Repository[UserID, *Credentials]
+
+// AuthService sets and checks user passwords.
+type AuthService struct {
+    users   UserRepository
+    creds   CredentialStore
+    params  HashParams
+    logger  Logger
+    resets  ResetTokenStore
+    limiter *Limiter
+    onEvent EventHandler
+    lockout *lockout
+}
+
+// AuthOption configures optional AuthService collaborators.
+type AuthOption func(*AuthService)
+
+// WithResetTokenStore replaces the default in-memory store of password
+// reset tokens, e.g. with one shared by every instance.
+func WithResetTokenStore(store ResetTokenStore) AuthOption {
+    return func(a *AuthService) { a.resets = store }
+}
+
+// WithLockoutPolicy replaces DefaultLockoutPolicy.
+func WithLockoutPolicy(p LockoutPolicy) AuthOption {
+    return func(a *AuthService) { a.lockout = newLockout(p) }
+}
+
+// WithAuthEventHandler receives password reset events, typically
+// EventBus.Publish so a NotificationService can email the token.
+func WithAuthEventHandler(h EventHandler) AuthOption {
+    return func(a *AuthService) { a.onEvent = h }
+}
+
+func NewAuthService(users UserRepository, creds CredentialStore, params HashParams, logger Logger, opts ...AuthOption) *AuthService {
+    a := &AuthService{
+        users:   users,
+        creds:   creds,
+        params:  params,
+        logger:  logger,
+        resets:  NewMemoryRepository[UserID, *ResetToken](nil),
+        limiter: NewLimiter(Limit{Burst: MaxResetRequests, Per: ResetRequestWindow}, 0),
+        lockout: newLockout(DefaultLockoutPolicy),
+    }
+    for _, opt := range opts {
+        opt(a)
+    }
+    return a
+}
+
+// SetPassword hashes password under the current params and stores it for
+// an existing, live user.
+func (a *AuthService) SetPassword(ctx context.Context, id UserID, password string) error {
+    if len(password) < MinPasswordLength {
+        return fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+    }
+    if _, err := a.users.FindByID(ctx, id); err != nil {
+        return err
+    }
+    if err := a.storeHash(ctx, id, password); err != nil {
+        loggerFor(ctx, a.logger).Error("Failed to set password", "target", id, "error", err)
+        return err
+    }
+    loggerFor(ctx, a.logger).Info("Password set", "target", id)
+    return nil
+}
+
+// CheckPassword returns nil if password matches the stored hash and
+// ErrInvalidCredentials otherwise, including when the user has no password.
+// A match against a hash made with outdated params is rehashed in place.
+// Failures count towards the user's lockout; while locked, every attempt
+// fails with ErrAccountLocked without checking the password.
+func (a *AuthService) CheckPassword(ctx context.Context, id UserID, password string) error {
+    now := time.Now()
+    if status := a.lockout.status(id, now); status.Locked {
+        return fmt.Errorf("user %d until %s: %w", id, status.Until.Format(time.RFC3339), ErrAccountLocked)
+    }
+    err := a.checkPassword(ctx, id, password)
+    switch {
+    case err == nil:
+        a.lockout.succeeded(id)
+    case errors.Is(err, ErrInvalidCredentials):
+        if a.lockout.failed(id, now) {
+            loggerFor(ctx, a.logger).Info("Account locked after repeated failed logins", "target", id)
+            a.emit(ctx, UserEvent{Type: EventAccountLocked, UserID: id, User: a.findUser(ctx, id), At: now})
+        }
+    }
+    return err
+}
+
+// findUser returns the user for an event, or nil if it can't be read.
+func (a *AuthService) findUser(ctx context.Context, id UserID) *User {
+    user, err := a.users.FindByID(ctx, id)
+    if err != nil {
+        return nil
+    }
+    return user
+}
+
+// Login checks an email and password from remoteIP and returns the user.
+// Besides the per-user lockout, an IP with too many recent failures is
+// refused with ErrRateLimited. Unknown emails fail like wrong passwords.
+func (a *AuthService) Login(ctx context.Context, email, password, remoteIP string) (*User, error) {
+    if a.lockout.ipThrottled(remoteIP) {
+        return nil, fmt.Errorf("login from %s: %w", remoteIP, ErrRateLimited)
+    }
+    email, err := NormalizeEmail(email)
+    if err != nil {
+        a.lockout.ipFailed(remoteIP)
+        return nil, ErrInvalidCredentials
+    }
+    user, err := a.users.FindByEmail(ctx, email)
+    if errors.Is(err, ErrNotFound) {
+        a.hashDummy(password)
+        a.lockout.ipFailed(remoteIP)
+        return nil, ErrInvalidCredentials
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := a.CheckPassword(ctx, user.ID, password); err != nil {
+        if errors.Is(err, ErrInvalidCredentials) {
+            a.lockout.ipFailed(remoteIP)
+        }
+        return nil, err
+    }
+    return user, nil
+}
+
+// LockStatus reports whether user id is locked out, for the admin API.
+func (a *AuthService) LockStatus(id UserID) LockStatus {
+    return a.lockout.status(id, time.Now())
+}
+
+// Unlock lifts a lockout early and forgets the user's failed attempts.
+func (a *AuthService) Unlock(id UserID) {
+    a.lockout.succeeded(id)
+    a.logger.Info("Account unlocked", "target", id)
+}
+
+func (a *AuthService) checkPassword(ctx context.Context, id UserID, password string) error {
+    creds, err := a.creds.FindByID(ctx, id)
+    if errors.Is(err, ErrNotFound) {
+        a.hashDummy(password)
+        return ErrInvalidCredentials
+    }
+    if err != nil {
+        return err
+    }
+    stored, salt, key, err := parsePasswordHash(creds.Hash)
+    if err != nil {
+        return fmt.Errorf("credentials for user %d: %w", id, err)
+    }
+    got, err := pbkdf2.Key(sha256.New, password, salt, stored.Iterations, len(key))
+    if err != nil {
+        return err
+    }
+    if subtle.ConstantTimeCompare(got, key) != 1 {
+        return ErrInvalidCredentials
+    }
+    if stored != a.params {
+        // The password is known good, so this is the only chance to move it
+        // to the new params without asking the user.
+        if err := a.storeHash(ctx, id, password); err != nil {
+            loggerFor(ctx, a.logger).Error("Failed to rehash password", "target", id, "error", err)
+        } else {
+            loggerFor(ctx, a.logger).Info("Rehashed password", "target", id)
+        }
+    }
+    return nil
+}
+
+func (a *AuthService) storeHash(ctx context.Context, id UserID, password string) error {
+    hash, err := hashPassword(password, a.params)
+    if err != nil {
+        return err
+    }
+    return a.creds.Save(ctx, &Credentials{UserID: id, Hash: hash, UpdatedAt: time.Now()})
+}
+
+// Password reset
+//
+// A reset token is "<user id>.<random secret>". Only a hash of the secret
+// is stored, one per user, so requesting a new token invalidates the last
+// one, and using a token deletes it.
+
+const (
+    PasswordResetTTL = time.Hour
+    // MaxResetRequests bounds reset requests per email address in each
+    // ResetRequestWindow, so the address can't be flooded with emails.
+    MaxResetRequests   = 3
+    ResetRequestWindow = time.Hour
+)
+
+type ResetToken struct {
+    UserID    UserID    `json:"user_id"`
+    Hash      string    `json:"hash"`
+    ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (t *ResetToken) EntityID() UserID      { return t.UserID }
+func (t *ResetToken) SetEntityID(id UserID) { t.UserID = id }
+
+type ResetTokenStore = Repository[UserID, *ResetToken]
+
+// RequestPasswordReset issues a reset token for the user with email and
+// emits EventPasswordResetRequested carrying it. To avoid revealing which
+// addresses have accounts it returns nil when there is no such user; it
+// fails with ErrRateLimited after MaxResetRequests for one address.
+func (a *AuthService) RequestPasswordReset(ctx context.Context, email string) error {
+    email, err := NormalizeEmail(email)
+    if err != nil {
+        return err
+    }
+    if !a.limiter.Allow(email) {
+        return fmt.Errorf("password reset for %s: %w", email, ErrRateLimited)
+    }
+    user, err := a.users.FindByEmail(ctx, email)
+    if errors.Is(err, ErrNotFound) {
+        loggerFor(ctx, a.logger).Info("Password reset requested for unknown email")
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    secret := make([]byte, 32)
+    if _, err := rand.Read(secret); err != nil {
+        return err
+    }
+    token := fmt.Sprintf("%d.%s", user.ID, base64.RawURLEncoding.EncodeToString(secret))
+    sum := sha256.Sum256(secret)
+    reset := &ResetToken{UserID: user.ID, Hash: hex.EncodeToString(sum[:]), ExpiresAt: time.Now().Add(PasswordResetTTL)}
+    if err := a.resets.Save(ctx, reset); err != nil {
+        return err
+    }
+    loggerFor(ctx, a.logger).Info("Password reset requested", "target", user.ID)
+    a.emit(ctx, UserEvent{Type: EventPasswordResetRequested, UserID: user.ID, User: user, At: time.Now(), Token: token})
+    return nil
+}
+
+// ResetPassword sets a new password using a token from
+// RequestPasswordReset. Bad, used and expired tokens fail with
+// ErrInvalidToken; a password that is too short fails without using up the
+// token.
+func (a *AuthService) ResetPassword(ctx context.Context, token, newPassword string) error {
+    if len(newPassword) < MinPasswordLength {
+        return fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+    }
+    idPart, secretPart, ok := strings.Cut(token, ".")
+    id, idErr := strconv.Atoi(idPart)
+    secret, secretErr := base64.RawURLEncoding.DecodeString(secretPart)
+    if !ok || idErr != nil || secretErr != nil {
+        return ErrInvalidToken
+    }
+    reset, err := a.resets.FindByID(ctx, UserID(id))
+    if errors.Is(err, ErrNotFound) {
+        return ErrInvalidToken
+    }
+    if err != nil {
+        return err
+    }
+    sum := sha256.Sum256(secret)
+    if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(reset.Hash)) != 1 {
+        return ErrInvalidToken
+    }
+    // Consume the token before anything else can fail, so it is single-use
+    // even if the reset is retried.
+    if err := a.resets.Delete(ctx, reset.UserID); err != nil {
+        if errors.Is(err, ErrNotFound) {
+            return ErrInvalidToken // raced with another use
+        }
+        return err
+    }
+    if time.Now().After(reset.ExpiresAt) {
+        return fmt.Errorf("reset token expired: %w", ErrInvalidToken)
+    }
+    if err := a.SetPassword(ctx, reset.UserID, newPassword); err != nil {
+        return err
+    }
+    // Proving control of the email is enough to lift a lockout.
+    a.lockout.succeeded(reset.UserID)
+    a.emit(ctx, UserEvent{Type: EventPasswordReset, UserID: reset.UserID, At: time.Now()})
+    return nil
+}
+
+func (a *AuthService) emit(ctx context.Context, event UserEvent) {
+    if a.onEvent == nil {
+        return
+    }
+    if err := a.onEvent(ctx, event); err != nil {
+        loggerFor(ctx, a.logger).Error("Event handler failed", "event", event.Type, "target", event.UserID, "error", err)
+    }
+}
+
+// Login throttling
+//
+// Failed password checks are counted per user and, through Login, per
+// client IP, over a sliding window. MaxFailures for one user locks the
+// account for LockDuration, after which it unlocks by itself; MaxIPFailures
+// from one IP refuses further logins from it until old failures age out.
+// These are counts rather than token buckets on purpose: a bucket refills
+// as it goes, so guesses paced just under its rate would never lock. The
+// counters live in memory, so each instance throttles on its own.
+
+type LockoutPolicy struct {
+    MaxFailures   int
+    MaxIPFailures int
+    Window        time.Duration
+    LockDuration  time.Duration
+}
+
+var DefaultLockoutPolicy = LockoutPolicy{
+    MaxFailures:   5,
+    MaxIPFailures: 20,
+    Window:        15 * time.Minute,
+    LockDuration:  15 * time.Minute,
+}
+
+type LockStatus struct {
+    Locked bool      `json:"locked"`
+    Until  time.Time `json:"until,omitzero"`
+    // Failures counts recent failed attempts towards the next lock.
+    Failures int `json:"failures"`
+}
+
+type lockout struct {
+    policy   LockoutPolicy
+    failures *windowCounter // keyed by user ID
+    ips      *windowCounter
+
+    mu     sync.Mutex
+    locked map[UserID]time.Time
+}
+
+func newLockout(p LockoutPolicy) *lockout {
+    return &lockout{
+        policy:   p,
+        failures: newWindowCounter(p.Window),
+        ips:      newWindowCounter(p.Window),
+        locked:   make(map[UserID]time.Time),
+    }
+}
+
+func (l *lockout) status(id UserID, now time.Time) LockStatus {
+    l.mu.Lock()
+    until, ok := l.locked[id]
+    if ok && !now.Before(until) {
+        delete(l.locked, id)
+        ok = false
+    }
+    l.mu.Unlock()
+    st := LockStatus{Failures: l.failures.count(userKey(id), now)}
+    if ok {
+        st.Locked, st.Until = true, until
+    }
+    return st
+}
+
+// failed records a failure and reports whether it locked the account.
+func (l *lockout) failed(id UserID, now time.Time) bool {
+    key := userKey(id)
+    if l.failures.add(key, now) < l.policy.MaxFailures {
+        return false
+    }
+    l.failures.reset(key)
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.locked[id] = now.Add(l.policy.LockDuration)
+    return true
+}
+
+func (l *lockout) succeeded(id UserID) {
+    l.failures.reset(userKey(id))
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    delete(l.locked, id)
+}
+
+func (l *lockout) ipThrottled(ip string) bool {
+    return ip != "" && l.ips.count(ip, time.Now()) >= l.policy.MaxIPFailures
+}
+
+func (l *lockout) ipFailed(ip string) {
+    if ip != "" {
+        l.ips.add(ip, time.Now())
+    }
+}
+
+func userKey(id UserID) string { return strconv.Itoa(int(id)) }
+
+// windowCounter counts events per key over a sliding window.
+type windowCounter struct {
+    window time.Duration
+
+    mu    sync.Mutex
+    hits  map[string][]time.Time
+    swept time.Time
+}
+
+func newWindowCounter(window time.Duration) *windowCounter {
+    return &windowCounter{window: window, hits: make(map[string][]time.Time), swept: time.Now()}
+}
+
+// add records an event for key at now and returns how many key has had
+// within the window, this one included.
+func (c *windowCounter) add(key string, now time.Time) int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.sweep(now)
+    c.hits[key] = append(c.recent(key, now), now)
+    return len(c.hits[key])
+}
+
+// count returns how many events key had within the window before now.
+func (c *windowCounter) count(key string, now time.Time) int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return len(c.recent(key, now))
+}
+
+func (c *windowCounter) reset(key string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    delete(c.hits, key)
+}
+
+// recent drops key's events older than the window and returns the rest.
+func (c *windowCounter) recent(key string, now time.Time) []time.Time {
+    cutoff := now.Add(-c.window)
+    times := slices.DeleteFunc(c.hits[key], func(t time.Time) bool { return !t.After(cutoff) })
+    if len(times) == 0 {
+        delete(c.hits, key)
+        return nil
+    }
+    c.hits[key] = times
+    return times
+}
+
+// sweep drops keys with no recent events, at most once per window, so
+// the map doesn't grow without bound.
+func (c *windowCounter) sweep(now time.Time) {
+    if now.Sub(c.swept) < c.window {
+        return
+    }
+    c.swept = now
+    for key := range c.hits {
+        c.recent(key, now)
+    }
+}
+
+// hashDummy does the work of checking password against a hash with the
+// current params, and throws it away. Logins for unknown emails or users
+// without a password call it, so they take as long as a wrong password
+// and response times don't reveal which accounts exist.
+func (a *AuthService) hashDummy(password string) {
+    pbkdf2.Key(sha256.New, password, make([]byte, a.params.SaltLen), a.params.Iterations, a.params.KeyLen)
+}
+
+func hashPassword(password string, p HashParams) (string, error) {
+    salt := make([]byte, p.SaltLen)
+    if _, err := rand.Read(salt); err != nil {
+        return "", err
+    }
+    key, err := pbkdf2.Key(sha256.New, password, salt, p.Iterations, p.KeyLen)
+    if err != nil {
+        return "", err
+    }
+    enc := base64.RawStdEncoding
+    return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, p.Iterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+func parsePasswordHash(hash string) (HashParams, []byte, []byte, error) {
+    parts := strings.Split(hash, "$")
+    if len(parts) != 4 || parts[0] != passwordScheme {
+        return HashParams{}, nil, nil, errors.New("unrecognized password hash")
+    }
+    iterations, err := strconv.Atoi(parts[1])
+    if err != nil || iterations < 1 {
+        return HashParams{}, nil, nil, fmt.Errorf("bad iteration count %q", parts[1])
+    }
+    enc := base64.RawStdEncoding
+    salt, err := enc.DecodeString(parts[2])
+    if err != nil {
+        return HashParams{}, nil, nil, fmt.Errorf("bad salt: %w", err)
+    }
+    key, err := enc.DecodeString(parts[3])
+    if err != nil {
+        return HashParams{}, nil, nil, fmt.Errorf("bad key: %w", err)
+    }
+    return HashParams{Iterations: iterations, SaltLen: len(salt), KeyLen: len(key)}, salt, key, nil
+}
+
+// Tokens
+//
+// TokenService issues HS256-signed JWTs: short-lived access tokens that
+// identify the user on each request, and long-lived refresh tokens that can
+// only be traded for a new pair. Keys are looked up by the "kid" header, so
+// a new signing key can be rolled out while tokens signed with the old one
+// stay valid until they expire.
+
+const (
+    DefaultAccessTTL  = 15 * time.Minute
+    DefaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+type TokenType string
+
+const (
+    AccessToken  TokenType = "access"
+    RefreshToken TokenType = "refresh"
+)
+
+type TokenConfig struct {
+    Issuer       string
+    Keys         map[string][]byte // verification keys by key ID
+    SigningKeyID string            // key in Keys used for new tokens
+    AccessTTL    time.Duration     // DefaultAccessTTL if zero
+    RefreshTTL   time.Duration     // DefaultRefreshTTL if zero
+}
+
+// Claims is the JWT payload TokenService reads and writes.
+type Claims struct {
+    Subject   string    `json:"sub"`
+    Issuer    string    `json:"iss,omitempty"`
+    IssuedAt  int64     `json:"iat"`
+    ExpiresAt int64     `json:"exp"`
+    Type      TokenType `json:"typ"`
+}
+
+// UserID parses the subject back into the user it was issued for.
+func (c *Claims) UserID() (UserID, error) {
+    id, err := strconv.Atoi(c.Subject)
+    if err != nil {
+        return 0, fmt.Errorf("subject %q: %w", c.Subject, ErrInvalidToken)
+    }
+    return UserID(id), nil
+}
+
+type TokenPair struct {
+    AccessToken      string    `json:"access_token"`
+    RefreshToken     string    `json:"refresh_token"`
+    AccessExpiresAt  time.Time `json:"access_expires_at"`
+    RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+type jwtHeader struct {
+    Alg string `json:"alg"`
+    Typ string `json:"typ"`
+    Kid string `json:"kid"`
+}
+
+type TokenService struct {
+    users UserRepository
+    cfg   TokenConfig
+}
+
+func NewTokenService(users UserRepository, cfg TokenConfig) (*TokenService, error) {
+    if len(cfg.Keys[cfg.SigningKeyID]) == 0 {
+        return nil, fmt.Errorf("signing key %q is not configured", cfg.SigningKeyID)
+    }
+    if cfg.AccessTTL <= 0 {
+        cfg.AccessTTL = DefaultAccessTTL
+    }
+    if cfg.RefreshTTL <= 0 {
+        cfg.RefreshTTL = DefaultRefreshTTL
+    }
+    return &TokenService{users: users, cfg: cfg}, nil
+}
+
+// Issue returns a fresh token pair for an active user. Callers establish who
+// the user is first, e.g. with AuthService.CheckPassword.
+func (t *TokenService) Issue(ctx context.Context, id UserID) (*TokenPair, error) {
+    if _, err := t.activeUser(ctx, id); err != nil {
+        return nil, err
+    }
+    now := time.Now()
+    pair := &TokenPair{
+        AccessExpiresAt:  now.Add(t.cfg.AccessTTL),
+        RefreshExpiresAt: now.Add(t.cfg.RefreshTTL),
+    }
+    var err error
+    if pair.AccessToken, err = t.sign(id, AccessToken, now, pair.AccessExpiresAt); err != nil {
+        return nil, err
+    }
+    if pair.RefreshToken, err = t.sign(id, RefreshToken, now, pair.RefreshExpiresAt); err != nil {
+        return nil, err
+    }
+    return pair, nil
+}
+
+// Refresh trades a valid refresh token for a new pair, re-checking that the
+// user is still active.
+func (t *TokenService) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+    claims, err := t.Validate(refreshToken, RefreshToken)
+    if err != nil {
+        return nil, err
+    }
+    id, err := claims.UserID()
+    if err != nil {
+        return nil, err
+    }
+    return t.Issue(ctx, id)
+}
+
+// Authenticate resolves the active user an access token was issued for.
+func (t *TokenService) Authenticate(ctx context.Context, accessToken string) (*User, error) {
+    claims, err := t.Validate(accessToken, AccessToken)
+    if err != nil {
+        return nil, err
+    }
+    id, err := claims.UserID()
+    if err != nil {
+        return nil, err
+    }
+    return t.activeUser(ctx, id)
+}
+
+// Validate checks the token's signature, expiry, issuer and type. Every
+// failure wraps ErrInvalidToken.
+func (t *TokenService) Validate(token string, want TokenType) (*Claims, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return nil, fmt.Errorf("malformed: %w", ErrInvalidToken)
+    }
+    var header jwtHeader
+    if err := decodeSegment(parts[0], &header); err != nil {
+        return nil, err
+    }
+    key := t.cfg.Keys[header.Kid]
+    if header.Alg != "HS256" || len(key) == 0 {
+        return nil, fmt.Errorf("unsupported alg %q or key %q: %w", header.Alg, header.Kid, ErrInvalidToken)
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil || !hmac.Equal(sig, hmacSHA256(key, parts[0]+"."+parts[1])) {
+        return nil, fmt.Errorf("bad signature: %w", ErrInvalidToken)
+    }
+    var claims Claims
+    if err := decodeSegment(parts[1], &claims); err != nil {
+        return nil, err
+    }
+    switch {
+    case time.Now().Unix() >= claims.ExpiresAt:
+        return nil, fmt.Errorf("expired: %w", ErrInvalidToken)
+    case claims.Issuer != t.cfg.Issuer:
+        return nil, fmt.Errorf("issuer %q: %w", claims.Issuer, ErrInvalidToken)
+    case claims.Type != want:
+        return nil, fmt.Errorf("%s token used as %s: %w", claims.Type, want, ErrInvalidToken)
+    }
+    return &claims, nil
+}
+
+func (t *TokenService) activeUser(ctx context.Context, id UserID) (*User, error) {
+    user, err := t.users.FindByID(ctx, id)
+    if err != nil {
+        return nil, err
+    }
+    if user.Status != StatusActive {
+        return nil, fmt.Errorf("user %d is %s: %w", id, user.Status, ErrForbidden)
+    }
+    return user, nil
+}
+
+func (t *TokenService) sign(id UserID, typ TokenType, now, expires time.Time) (string, error) {
+    header, err := json.Marshal(jwtHeader{Alg: "HS256", Typ: "JWT", Kid: t.cfg.SigningKeyID})
+    if err != nil {
+        return "", err
+    }
+    claims, err := json.Marshal(Claims{
+        Subject:   strconv.Itoa(int(id)),
+        Issuer:    t.cfg.Issuer,
+        IssuedAt:  now.Unix(),
+        ExpiresAt: expires.Unix(),
+        Type:      typ,
+    })
+    if err != nil {
+        return "", err
+    }
+    enc := base64.RawURLEncoding
+    signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+    return signed + "." + enc.EncodeToString(hmacSHA256(t.cfg.Keys[t.cfg.SigningKeyID], signed)), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
+
+func decodeSegment(seg string, v any) error {
+    raw, err := base64.RawURLEncoding.DecodeString(seg)
+    if err != nil {
+        return fmt.Errorf("bad encoding: %w", ErrInvalidToken)
+    }
+    if err := json.Unmarshal(raw, v); err != nil {
+        return fmt.Errorf("bad json: %w", ErrInvalidToken)
+    }
+    return nil
+}
+
+type ctxKey int
+
+const (
+    currentUserKey ctxKey = iota
+    idempotencyKeyKey
+    tenantKey
+    allTenantsKey
+    apiKeyKey
+    requestIDKey
+    loggerKey
+    logFieldsKey
+    routeKey
+    spanKey
+    remoteSpanKey
+)
+
+// WithCurrentUser returns a context carrying the authenticated user.
+func WithCurrentUser(ctx context.Context, user *User) context.Context {
+    return context.WithValue(ctx, currentUserKey, user)
+}
+
+// CurrentUser returns the user set by WithCurrentUser or Middleware.
+func CurrentUser(ctx context.Context) (*User, bool) {
+    user, ok := ctx.Value(currentUserKey).(*User)
+    return user, ok
+}
+
+// Middleware authenticates the "Authorization: Bearer" access token and
+// passes the user to next through the request context. Requests without a
+// valid token get 401 and never reach next.
+func (t *TokenService) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+        if !ok {
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            http.Error(w, "missing bearer token", http.StatusUnauthorized)
+            return
+        }
+        user, err := t.Authenticate(WithAllTenants(r.Context()), token)
+        if err != nil {
+            w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+            http.Error(w, "invalid token", http.StatusUnauthorized)
+            return
+        }
+        // The token's subject may be in any tenant; once known, the user's
+        // tenant scopes the rest of the request.
+        ctx := WithTenant(WithCurrentUser(r.Context(), user), user.TenantID)
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// API keys
+//
+// Machine clients authenticate with a long-lived key instead of a
+// password. A key reads "zk_<key id>_<secret>"; only a SHA-256 hash of the
+// secret is stored, so a leaked store can't be replayed, and the plaintext
+// is shown once, by Issue.
+
+type APIKeyID int
+
+type APIScope string
+
+const (
+    ScopeUsersRead  APIScope = "users:read"
+    ScopeUsersWrite APIScope = "users:write"
+    ScopeAdmin      APIScope = "admin"
+)
+
+var knownScopes = []APIScope{ScopeUsersRead, ScopeUsersWrite, ScopeAdmin}
+
+const apiKeyPrefix = "zk_"
+
+// lastUsedGranularity limits how often Resolve writes LastUsedAt, so busy
+// keys don't cost a write per request.
+const lastUsedGranularity = time.Minute
+
+type APIKey struct {
+    ID         APIKeyID   `json:"id"`
+    UserID     UserID     `json:"user_id"`
+    Name       string     `json:"name"`
+    SecretHash string     `json:"-"`
+    Scopes     []APIScope `json:"scopes"`
+    CreatedAt  time.Time  `json:"created_at"`
+    ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+    LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+    RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (k *APIKey) EntityID() APIKeyID      { return k.ID }
+func (k *APIKey) SetEntityID(id APIKeyID) { k.ID = id }
+
+// HasScope reports whether the key grants scope; ScopeAdmin grants all.
+func (k *APIKey) HasScope(scope APIScope) bool {
+    return slices.Contains(k.Scopes, scope) || slices.Contains(k.Scopes, ScopeAdmin)
+}
+
+// APIKeyStore is satisfied by *MemoryRepository[APIKeyID, *APIKey].
+type APIKeyStore interface {
+    Repository[APIKeyID, *APIKey]
+    FindAll(ctx context.Context) ([]*APIKey, error)
+}
+
+type APIKeyService struct {
+    keys   APIKeyStore
+    users  UserRepository
+    logger Logger
+}
+
+func NewAPIKeyService(keys APIKeyStore, users UserRepository, logger Logger) *APIKeyService {
+    return &APIKeyService{keys: keys, users: users, logger: logger}
+}
+
+// Issue creates a key for user id and returns its plaintext, which can't
+// be recovered later. A zero ttl means the key never expires.
+func (s *APIKeyService) Issue(ctx context.Context, id UserID, name string, ttl time.Duration, scopes ...APIScope) (string, *APIKey, error) {
+    if strings.TrimSpace(name) == "" {
+        return "", nil, errors.New("API key name is required")
+    }
+    if len(scopes) == 0 {
+        return "", nil, errors.New("API key needs at least one scope")
+    }
+    for _, scope := range scopes {
+        if !slices.Contains(knownScopes, scope) {
+            return "", nil, fmt.Errorf("unknown API scope %q", scope)
+        }
+    }
+    if _, err := s.users.FindByID(ctx, id); err != nil {
+        return "", nil, err
+    }
+
+    secret := make([]byte, 32)
+    if _, err := rand.Read(secret); err != nil {
+        return "", nil, err
+    }
+    sum := sha256.Sum256(secret)
+    key := &APIKey{
+        UserID:     id,
+        Name:       name,
+        SecretHash: hex.EncodeToString(sum[:]),
+        Scopes:     slices.Clone(scopes),
+        CreatedAt:  time.Now(),
+    }
+    if ttl > 0 {
+        expires := key.CreatedAt.Add(ttl)
+        key.ExpiresAt = &expires
+    }
+    if err := s.keys.Insert(ctx, key); err != nil {
+        loggerFor(ctx, s.logger).Error("Failed to issue API key", "target", id, "error", err)
+        return "", nil, err
+    }
+    loggerFor(ctx, s.logger).Info("API key issued", "key", key.ID, "target", id)
+    return fmt.Sprintf("%s%d_%s", apiKeyPrefix, key.ID, base64.RawURLEncoding.EncodeToString(secret)), key, nil
+}
+
+// Revoke disables one of user id's keys. Revoking a revoked key is a
+// no-op; another user's key is reported as not found.
+func (s *APIKeyService) Revoke(ctx context.Context, id UserID, keyID APIKeyID) error {
+    key, err := s.keys.FindByID(ctx, keyID)
+    if err != nil {
+        return err
+    }
+    if key.UserID != id {
+        return fmt.Errorf("API key %d %w", keyID, ErrNotFound)
+    }
+    if key.RevokedAt != nil {
+        return nil
+    }
+    revoked := *key
+    now := time.Now()
+    revoked.RevokedAt = &now
+    if err := s.keys.Save(ctx, &revoked); err != nil {
+        return err
+    }
+    loggerFor(ctx, s.logger).Info("API key revoked", "key", keyID, "target", id)
+    return nil
+}
+
+// List returns user id's keys, revoked ones included, oldest first.
+func (s *APIKeyService) List(ctx context.Context, id UserID) ([]*APIKey, error) {
+    all, err := s.keys.FindAll(ctx)
+    if err != nil {
+        return nil, err
+    }
+    keys := slices.DeleteFunc(all, func(k *APIKey) bool { return k.UserID != id })
+    sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+    return keys, nil
+}
+
+// Resolve maps a presented key to its user. Malformed, unknown, revoked
+// and expired keys, and keys of users who are gone or not active, all
+// fail with ErrInvalidToken.
+func (s *APIKeyService) Resolve(ctx context.Context, presented string) (*User, *APIKey, error) {
+    rest, ok := strings.CutPrefix(presented, apiKeyPrefix)
+    idPart, secretPart, ok2 := strings.Cut(rest, "_")
+    id, idErr := strconv.Atoi(idPart)
+    secret, secretErr := base64.RawURLEncoding.DecodeString(secretPart)
+    if !ok || !ok2 || idErr != nil || secretErr != nil {
+        return nil, nil, ErrInvalidToken
+    }
+    key, err := s.keys.FindByID(ctx, APIKeyID(id))
+    if errors.Is(err, ErrNotFound) {
+        return nil, nil, ErrInvalidToken
+    }
+    if err != nil {
+        return nil, nil, err
+    }
+    sum := sha256.Sum256(secret)
+    if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(key.SecretHash)) != 1 {
+        return nil, nil, ErrInvalidToken
+    }
+    now := time.Now()
+    if key.RevokedAt != nil || (key.ExpiresAt != nil && now.After(*key.ExpiresAt)) {
+        return nil, nil, ErrInvalidToken
+    }
+    // The key's user may be in any tenant; the key itself is the proof.
+    user, err := s.users.FindByID(WithAllTenants(ctx), key.UserID)
+    if errors.Is(err, ErrNotFound) {
+        return nil, nil, ErrInvalidToken
+    }
+    if err != nil {
+        return nil, nil, err
+    }
+    if user.Status != StatusActive {
+        return nil, nil, ErrInvalidToken
+    }
+
+    if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= lastUsedGranularity {
+        used := *key
+        used.LastUsedAt = &now
+        if err := s.keys.Save(ctx, &used); err != nil {
+            loggerFor(ctx, s.logger).Error("Failed to record API key use", "key", key.ID, "error", err)
+        } else {
+            key = &used
+        }
+    }
+    return user, key, nil
+}
+
+// APIKeyFrom returns the key set by APIKeyService.Middleware, for scope
+// checks in handlers.
+func APIKeyFrom(ctx context.Context) (*APIKey, bool) {
+    key, ok := ctx.Value(apiKeyKey).(*APIKey)
+    return key, ok
+}
+
+// RequiredScope is the scope an API key needs for r: ScopeAdmin under
+// /admin/, ScopeUsersRead for reads and ScopeUsersWrite otherwise, which
+// includes every POST to /graphql, queries too.
+func RequiredScope(r *http.Request) APIScope {
+    switch {
+    case r.URL.Path == "/admin" || strings.HasPrefix(r.URL.Path, "/admin/"):
+        return ScopeAdmin
+    case r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions:
+        return ScopeUsersRead
+    }
+    return ScopeUsersWrite
+}
+
+// Middleware authenticates the X-API-Key header like TokenService's
+// Middleware does bearer tokens, adding the key itself to the context.
+// A key without the RequiredScope for the request gets 403.
+func (s *APIKeyService) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        presented := r.Header.Get("X-API-Key")
+        if presented == "" {
+            http.Error(w, "missing API key", http.StatusUnauthorized)
+            return
+        }
+        user, key, err := s.Resolve(r.Context(), presented)
+        if err != nil {
+            http.Error(w, "invalid API key", http.StatusUnauthorized)
+            return
+        }
+        if scope := RequiredScope(r); !key.HasScope(scope) {
+            http.Error(w, fmt.Sprintf("API key lacks the %s scope", scope), http.StatusForbidden)
+            return
+        }
+        ctx := WithTenant(WithCurrentUser(r.Context(), user), user.TenantID)
+        next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, apiKeyKey, key)))
+    })
+}
+
+// Groups
+
+type GroupID int
+
+// Group organizes users, e.g. by team. Members is kept sorted.
+type Group struct {
+    ID          GroupID   `json:"id"`
+    Name        string    `json:"name"`
+    Description string    `json:"description,omitempty"`
+    CreatedAt   time.Time `json:"created_at"`
+    Members     []UserID  `json:"members"`
+}
+
+func (g *Group) EntityID() GroupID      { return g.ID }
+func (g *Group) SetEntityID(id GroupID) { g.ID = id }
+
+func (g *Group) hasMember(id UserID) bool {
+    _, found := slices.BinarySearch(g.Members, id)
+    return found
+}
+
+// GroupRepository is satisfied by *MemoryRepository[GroupID, *Group].
+type GroupRepository interface {
+    Repository[GroupID, *Group]
+    FindAll(ctx context.Context) ([]*Group, error)
+}
+
+// GroupService manages groups and their membership. Stored groups are
+// never edited in place; membership changes save an updated copy and are
+// serialized so concurrent adds and removes don't lose each other.
+type GroupService struct {
+    // Authorizer guards GetGroupStats as UserService guards
+    // GetUserStats, with ActionViewStats; nil allows everything.
+    Authorizer Authorizer
+
+    groups GroupRepository
+    users  UserRepository
+    logger Logger
+    mu     sync.Mutex
+}
+
+func NewGroupService(groups GroupRepository, users UserRepository, logger Logger) *GroupService {
+    return &GroupService{groups: groups, users: users, logger: logger}
+}
+
+func (s *GroupService) CreateGroup(ctx context.Context, name, description string) (*Group, error) {
+    if strings.TrimSpace(name) == "" {
+        return nil, errors.New("group name is required")
+    }
+    group := &Group{Name: name, Description: description, CreatedAt: time.Now(), Members: []UserID{}}
+    if err := s.groups.Insert(ctx, group); err != nil {
+        loggerFor(ctx, s.logger).Error("Failed to create group", "name", name, "error", err)
+        return nil, err
+    }
+    loggerFor(ctx, s.logger).Info("Group created", "group", group.ID)
+    return group, nil
+}
+
+// AddToGroup makes a live user a member, failing with ErrAlreadyExists if
+// they already are.
+func (s *GroupService) AddToGroup(ctx context.Context, groupID GroupID, userID UserID) error {
+    if _, err := s.users.FindByID(ctx, userID); err != nil {
+        return err
+    }
+    return s.updateMembers(ctx, groupID, func(g *Group) error {
+        if g.hasMember(userID) {
+            return fmt.Errorf("user %d in group %d %w", userID, groupID, ErrAlreadyExists)
+        }
+        g.Members = append(g.Members, userID)
+        slices.Sort(g.Members)
+        return nil
+    })
+}
+
+func (s *GroupService) RemoveFromGroup(ctx context.Context, groupID GroupID, userID UserID) error {
+    return s.updateMembers(ctx, groupID, func(g *Group) error {
+        if !g.hasMember(userID) {
+            return fmt.Errorf("user %d in group %d %w", userID, groupID, ErrNotFound)
+        }
+        g.Members = slices.DeleteFunc(g.Members, func(id UserID) bool { return id == userID })
+        return nil
+    })
+}
+
+func (s *GroupService) updateMembers(ctx context.Context, groupID GroupID, change func(*Group) error) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    current, err := s.groups.FindByID(ctx, groupID)
+    if err != nil {
+        return err
+    }
+    updated := *current
+    updated.Members = slices.Clone(current.Members)
+    if err := change(&updated); err != nil {
+        return err
+    }
+    if err := s.groups.Save(ctx, &updated); err != nil {
+        loggerFor(ctx, s.logger).Error("Failed to update group", "group", groupID, "error", err)
+        return err
+    }
+    return nil
+}
+
+// ListGroupMembers returns the group's live members in ID order; members
+// that have since been deleted are skipped.
+func (s *GroupService) ListGroupMembers(ctx context.Context, groupID GroupID) ([]*User, error) {
+    var users []*User
+    for user, err := range s.members(ctx, groupID) {
+        if err != nil {
+            return nil, err
+        }
+        users = append(users, user)
+    }
+    return users, nil
+}
+
+// ListUserGroups returns the groups userID belongs to, in ID order.
+func (s *GroupService) ListUserGroups(ctx context.Context, userID UserID) ([]*Group, error) {
+    all, err := s.groups.FindAll(ctx)
+    if err != nil {
+        return nil, err
+    }
+    var groups []*Group
+    for _, g := range all {
+        if g.hasMember(userID) {
+            groups = append(groups, g)
+        }
+    }
+    sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+    return groups, nil
+}
+
+// GetGroupStats computes UserStats over the group's live members.
+func (s *GroupService) GetGroupStats(ctx context.Context, groupID GroupID) (*UserStats, error) {
+    if s.Authorizer != nil {
+        if err := s.Authorizer.Authorize(ctx, ActionViewStats, 0); err != nil {
+            loggerFor(ctx, s.logger).Warn("Denied group stats", "group", groupID, "error", err)
+            return nil, err
+        }
+    }
+    return collectStats(s.members(ctx, groupID))
+}
+
+func (s *GroupService) members(ctx context.Context, groupID GroupID) iter.Seq2[*User, error] {
+    return func(yield func(*User, error) bool) {
+        group, err := s.groups.FindByID(ctx, groupID)
+        if err != nil {
+            yield(nil, err)
+            return
+        }
+        for _, id := range group.Members {
+            user, err := s.users.FindByID(ctx, id)
+            if errors.Is(err, ErrNotFound) {
+                continue
+            }
+            if !yield(user, err) || err != nil {
+                return
+            }
+        }
+    }
+}
+
+// MergeHook moves the duplicate's memberships to the primary user; pass it
+// to WithMergeHook.
+func (s *GroupService) MergeHook() MergeHook {
+    return func(ctx context.Context, primary, duplicate UserID) error {
+        groups, err := s.ListUserGroups(ctx, duplicate)
+        if err != nil {
+            return err
+        }
+        for _, g := range groups {
+            err := s.updateMembers(ctx, g.ID, func(g *Group) error {
+                g.Members = slices.DeleteFunc(g.Members, func(id UserID) bool { return id == duplicate })
+                if !g.hasMember(primary) {
+                    g.Members = append(g.Members, primary)
+                    slices.Sort(g.Members)
+                }
+                return nil
+            })
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+}
+
+// checkEmail normalizes email and, with WithMXCheck, verifies its domain.
+func (s *UserService) checkEmail(ctx context.Context, email string) (string, error) {
+    email, err := NormalizeEmail(email)
+    if err != nil {
+        return "", err
+    }
+    if s.checkMX {
+        if err := verifyMailDomain(ctx, email); err != nil {
+            return "", err
+        }
+    }
+    return email, nil
+}
+
+// Webhooks
+//
+// WebhookDispatcher delivers UserEvents to operator-registered URLs.
+// Subscribe its HandleEvent to an EventBus. Each delivery is a JSON POST of
+// the UserEvent, signed with the webhook's secret:
+//
+//     X-Webhook-Signature: sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+//
+// where timestamp is the X-Webhook-Timestamp header, so receivers can
+// reject replays. Failed deliveries are retried with exponential backoff.
+
+type (
+    WebhookID  int
+    DeliveryID int
+)
+
+type Webhook struct {
+    ID        WebhookID   `json:"id"`
+    URL       string      `json:"url"`
+    Secret    []byte      `json:"-"`
+    Events    []EventType `json:"events"` // empty means every event
+    CreatedAt time.Time   `json:"created_at"`
+}
+
+func (w *Webhook) EntityID() WebhookID      { return w.ID }
+func (w *Webhook) SetEntityID(id WebhookID) { w.ID = id }
+
+func (w *Webhook) wants(t EventType) bool {
+    return len(w.Events) == 0 || slices.Contains(w.Events, t)
+}
+
+type DeliveryStatus string
+
+const (
+    DeliveryPending   DeliveryStatus = "pending"
+    DeliverySucceeded DeliveryStatus = "succeeded"
+    DeliveryFailed    DeliveryStatus = "failed"
+)
+
+// Delivery tracks one event sent to one webhook.
+type Delivery struct {
+    ID             DeliveryID     `json:"id"`
+    WebhookID      WebhookID      `json:"webhook_id"`
+    Event          UserEvent      `json:"event"`
+    Status         DeliveryStatus `json:"status"`
+    Attempts       int            `json:"attempts"`
+    LastStatusCode int            `json:"last_status_code,omitempty"`
+    LastError      string         `json:"last_error,omitempty"`
+    UpdatedAt      time.Time      `json:"updated_at"`
+}
+
+func (d *Delivery) EntityID() DeliveryID      { return d.ID }
+func (d *Delivery) SetEntityID(id DeliveryID) { d.ID = id }
+
+type WebhookConfig struct {
+    MaxAttempts    int           // DefaultWebhookAttempts if zero
+    InitialBackoff time.Duration // doubled after each failure, with jitter
+    MaxBackoff     time.Duration
+    Timeout        time.Duration // per attempt
+    Client         *http.Client  // http.DefaultClient if nil
+    // RateLimit caps attempts per webhook, so a burst of events doesn't
+    // flood a receiver; attempts over it wait their turn. Unlimited if zero.
+    RateLimit Limit
+}
+
+const DefaultWebhookAttempts = 5
+
+var DefaultWebhookConfig = WebhookConfig{
+    MaxAttempts:    DefaultWebhookAttempts,
+    InitialBackoff: time.Second,
+    MaxBackoff:     5 * time.Minute,
+    Timeout:        10 * time.Second,
+}
+
+type WebhookDispatcher struct {
+    cfg        WebhookConfig
+    logger     Logger
+    hooks      *MemoryRepository[WebhookID, *Webhook]
+    deliveries *MemoryRepository[DeliveryID, *Delivery]
+    limiter    *Limiter // keyed by webhook ID; nil if unlimited
+
+    ctx    context.Context
+    cancel context.CancelFunc
+    wg     sync.WaitGroup
+}
+
+func NewWebhookDispatcher(cfg WebhookConfig, logger Logger) *WebhookDispatcher {
+    if cfg.MaxAttempts <= 0 {
+        cfg.MaxAttempts = DefaultWebhookAttempts
+    }
+    if cfg.InitialBackoff <= 0 {
+        cfg.InitialBackoff = DefaultWebhookConfig.InitialBackoff
+    }
+    if cfg.MaxBackoff <= 0 {
+        cfg.MaxBackoff = DefaultWebhookConfig.MaxBackoff
+    }
+    if cfg.Timeout <= 0 {
+        cfg.Timeout = DefaultWebhookConfig.Timeout
+    }
+    if cfg.Client == nil {
+        cfg.Client = http.DefaultClient
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    d := &WebhookDispatcher{
+        cfg:        cfg,
+        logger:     logger,
+        hooks:      NewMemoryRepository[WebhookID, *Webhook](Sequence[WebhookID]()),
+        deliveries: NewMemoryRepository[DeliveryID, *Delivery](Sequence[DeliveryID]()),
+        ctx:        ctx,
+        cancel:     cancel,
+    }
+    if cfg.RateLimit.Burst > 0 && cfg.RateLimit.Per > 0 {
+        d.limiter = NewLimiter(cfg.RateLimit, 0)
+    }
+    return d
+}
+
+// Register adds a webhook for the given event types, or all of them if
+// none are given.
+func (d *WebhookDispatcher) Register(ctx context.Context, rawURL string, secret []byte, events ...EventType) (*Webhook, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+        return nil, fmt.Errorf("invalid webhook URL %q", rawURL)
+    }
+    if len(secret) == 0 {
+        return nil, errors.New("webhook secret is required")
+    }
+    hook := &Webhook{URL: rawURL, Secret: secret, Events: events, CreatedAt: time.Now()}
+    if err := d.hooks.Insert(ctx, hook); err != nil {
+        return nil, err
+    }
+    loggerFor(ctx, d.logger).Info("Webhook registered", "webhook", hook.ID, "url", rawURL)
+    return hook, nil
+}
+
+func (d *WebhookDispatcher) Unregister(ctx context.Context, id WebhookID) error {
+    return d.hooks.Delete(ctx, id)
+}
+
+// HandleEvent starts a delivery to every webhook that wants event. It
+// returns once deliveries are queued; use Deliveries to follow them.
+func (d *WebhookDispatcher) HandleEvent(ctx context.Context, event UserEvent) error {
+    hooks, err := d.hooks.FindAll(ctx)
+    if err != nil {
+        return err
+    }
+    body, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    for _, hook := range hooks {
+        if !hook.wants(event.Type) {
+            continue
+        }
+        delivery := &Delivery{WebhookID: hook.ID, Event: event, Status: DeliveryPending, UpdatedAt: time.Now()}
+        if err := d.deliveries.Insert(ctx, delivery); err != nil {
+            return err
+        }
+        d.wg.Add(1)
+        go d.deliver(*hook, *delivery, body)
+    }
+    return nil
+}
+
+// Delivery returns the current state of one delivery.
+func (d *WebhookDispatcher) Delivery(ctx context.Context, id DeliveryID) (*Delivery, error) {
+    delivery, err := d.deliveries.FindByID(ctx, id)
+    if err != nil {
+        return nil, err
+    }
+    copied := *delivery
+    return &copied, nil
+}
+
+// Webhooks lists the registered webhooks in ID order.
+func (d *WebhookDispatcher) Webhooks(ctx context.Context) ([]Webhook, error) {
+    all, err := d.hooks.FindAll(ctx)
+    if err != nil {
+        return nil, err
+    }
+    out := make([]Webhook, len(all))
+    for i, hook := range all {
+        out[i] = *hook
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+    return out, nil
+}
+
+// Deliveries lists a webhook's deliveries, oldest first.
+func (d *WebhookDispatcher) Deliveries(ctx context.Context, id WebhookID) ([]Delivery, error) {
+    all, err := d.deliveries.FindAll(ctx)
+    if err != nil {
+        return nil, err
+    }
+    var out []Delivery
+    for _, delivery := range all {
+        if delivery.WebhookID == id {
+            out = append(out, *delivery)
+        }
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+    return out, nil
+}
+
+// Close abandons pending retries and waits for in-flight attempts.
+func (d *WebhookDispatcher) Close() {
+    d.cancel()
+    d.wg.Wait()
+}
+
+// deliver owns its copy of delivery and saves a fresh copy after every
+// attempt, so readers never see a half-updated record.
+func (d *WebhookDispatcher) deliver(hook Webhook, delivery Delivery, body []byte) {
+    defer d.wg.Done()
+    backoff := d.cfg.InitialBackoff
+    for {
+        retry := d.attemptOnce(d.ctx, hook, &delivery, body)
+        if delivery.Status == DeliveryPending && (!retry || delivery.Attempts >= d.cfg.MaxAttempts) {
+            delivery.Status = DeliveryFailed
+            d.logger.Error("Webhook delivery failed", "webhook", hook.ID, "delivery", delivery.ID, "attempts", delivery.Attempts, "error", delivery.LastError)
+        }
+        delivery.UpdatedAt = time.Now()
+        saved := delivery
+        d.deliveries.Save(d.ctx, &saved)
+        if delivery.Status != DeliveryPending {
+            return
+        }
+
+        // Full jitter keeps receivers from being hit by synchronized retries.
+        wait := time.Duration(mrand.Int64N(int64(backoff)) + 1)
+        backoff = min(backoff*2, d.cfg.MaxBackoff)
+        select {
+        case <-time.After(wait):
+        case <-d.ctx.Done():
+            return
+        }
+    }
+}
+
+// Deliver makes one attempt to send event to webhook id, records it as a
+// Delivery and returns that. The delivery is failed, not pending, if the
+// attempt failed; callers that retry, such as DeliverWebhookHandler, can
+// tell from retryableStatus whether another attempt may succeed.
+func (d *WebhookDispatcher) Deliver(ctx context.Context, id WebhookID, event UserEvent) (*Delivery, error) {
+    hook, err := d.hooks.FindByID(ctx, id)
+    if err != nil {
+        return nil, err
+    }
+    body, err := json.Marshal(event)
+    if err != nil {
+        return nil, err
+    }
+    delivery := &Delivery{WebhookID: id, Event: event, Status: DeliveryPending, UpdatedAt: time.Now()}
+    if err := d.deliveries.Insert(ctx, delivery); err != nil {
+        return nil, err
+    }
+    d.attemptOnce(ctx, *hook, delivery, body)
+    if delivery.Status == DeliveryPending {
+        delivery.Status = DeliveryFailed
+    }
+    delivery.UpdatedAt = time.Now()
+    saved := *delivery
+    if err := d.deliveries.Save(ctx, &saved); err != nil {
+        return nil, err
+    }
+    return delivery, nil
+}
+
+// attemptOnce makes the next attempt at delivery and records its outcome,
+// reporting whether a failure is worth retrying. Waiting on the rate
+// limit doesn't count as an attempt.
+func (d *WebhookDispatcher) attemptOnce(ctx context.Context, hook Webhook, delivery *Delivery, body []byte) (retry bool) {
+    if d.limiter != nil {
+        if err := d.limiter.Wait(ctx, strconv.Itoa(int(hook.ID))); err != nil {
+            delivery.LastError = err.Error()
+            return true
+        }
+    }
+    delivery.Attempts++
+    code, err := d.attempt(ctx, hook, delivery, body)
+    delivery.LastStatusCode = code
+    delivery.LastError = ""
+    switch {
+    case err != nil:
+        delivery.LastError = err.Error()
+        return true
+    case code >= 200 && code < 300:
+        delivery.Status = DeliverySucceeded
+        return false
+    default:
+        delivery.LastError = fmt.Sprintf("unexpected status %d", code)
+        return retryableStatus(code)
+    }
+}
+
+// retryableStatus reports whether a webhook receiver's failure status may
+// clear up. Other client errors mean the receiver rejected the payload;
+// sending it again won't help.
+func retryableStatus(code int) bool {
+    return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+}
+
+func (d *WebhookDispatcher) attempt(ctx context.Context, hook Webhook, delivery *Delivery, body []byte) (int, error) {
+    ctx, cancel := context.WithTimeout(ctx, d.cfg.Timeout)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+    if err != nil {
+        return 0, err
+    }
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Webhook-ID", strconv.Itoa(int(hook.ID)))
+    req.Header.Set("X-Webhook-Delivery", strconv.Itoa(int(delivery.ID)))
+    req.Header.Set("X-Webhook-Timestamp", timestamp)
+    req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(hmacSHA256(hook.Secret, timestamp+"."+string(body))))
+    if id := delivery.Event.RequestID; id != "" {
+        req.Header.Set("X-Request-ID", id)
+    }
+
+    resp, err := d.cfg.Client.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+    io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) // let the connection be reused
+    return resp.StatusCode, nil
+}
+
+// Notifications
+//
+// NotificationService turns UserEvents into notifications for the affected
+// user on each registered channel, rendering the channel's own subject and
+// body templates. Users whose Preferences.Notifications is false are
+// skipped, except for account security events such as password resets, as
+// are events that carry no user (EventUserDeleted). Subscribe HandleEvent
+// to an EventBus.
+
+// securityEvents are always delivered, whatever the user's preferences.
+var securityEvents = []EventType{EventPasswordResetRequested, EventPasswordReset, EventAccountLocked}
+
+type Notification struct {
+    Channel string    `json:"channel"`
+    Event   EventType `json:"event"`
+    UserID  UserID    `json:"user_id"`
+    To      string    `json:"to"`
+    Subject string    `json:"subject"`
+    Body    string    `json:"body"`
+}
+
+type Notifier interface {
+    Notify(ctx context.Context, n Notification) error
+}
+
+type NotifierFunc func(ctx context.Context, n Notification) error
+
+func (f NotifierFunc) Notify(ctx context.Context, n Notification) error { return f(ctx, n) }
+
+// NotificationTemplate holds text/template sources executed with the
+// triggering UserEvent, e.g. "Welcome, {{.User.Name}}" or, for password
+// resets, "https://example.com/reset?token={{.Token}}".
+type NotificationTemplate struct {
+    Subject string
+    Body    string
+}
+
+type compiledTemplate struct {
+    subject, body *template.Template
+}
+
+func compileTemplate(name string, t NotificationTemplate) (compiledTemplate, error) {
+    subject, err := template.New(name + ":subject").Parse(t.Subject)
+    if err != nil {
+        return compiledTemplate{}, err
+    }
+    body, err := template.New(name + ":body").Parse(t.Body)
+    if err != nil {
+        return compiledTemplate{}, err
+    }
+    return compiledTemplate{subject: subject, body: body}, nil
+}
+
+func (t compiledTemplate) render(data any) (subject, body string, err error) {
+    var sb, bb strings.Builder
+    if err := t.subject.Execute(&sb, data); err != nil {
+        return "", "", err
+    }
+    if err := t.body.Execute(&bb, data); err != nil {
+        return "", "", err
+    }
+    return sb.String(), bb.String(), nil
+}
+
+type notificationChannel struct {
+    name      string
+    notifier  Notifier
+    templates map[EventType]compiledTemplate
+}
+
+type NotificationService struct {
+    logger Logger
+
+    mu       sync.RWMutex
+    channels []*notificationChannel
+}
+
+func NewNotificationService(logger Logger) *NotificationService {
+    return &NotificationService{logger: logger}
+}
+
+// AddChannel registers notifier under name. Only events with a template
+// are sent on the channel.
+func (n *NotificationService) AddChannel(name string, notifier Notifier, templates map[EventType]NotificationTemplate) error {
+    ch := &notificationChannel{name: name, notifier: notifier, templates: make(map[EventType]compiledTemplate, len(templates))}
+    for event, tmpl := range templates {
+        compiled, err := compileTemplate(name+":"+string(event), tmpl)
+        if err != nil {
+            return fmt.Errorf("channel %s: %w", name, err)
+        }
+        ch.templates[event] = compiled
+    }
+
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    for _, existing := range n.channels {
+        if existing.name == name {
+            return fmt.Errorf("notification channel %q %w", name, ErrAlreadyExists)
+        }
+    }
+    n.channels = append(n.channels, ch)
+    return nil
+}
+
+// HandleEvent notifies event.User on every channel with a template for
+// the event, all at once. A failing channel does not stop the others;
+// their errors are joined.
+func (n *NotificationService) HandleEvent(ctx context.Context, event UserEvent) error {
+    user := event.User
+    if user == nil {
+        return nil
+    }
+    if !user.Preferences.Notifications && !slices.Contains(securityEvents, event.Type) {
+        loggerFor(ctx, n.logger).Info("Notification suppressed by preferences", "event", event.Type, "target", user.ID)
+        return nil
+    }
+
+    n.mu.RLock()
+    var channels []*notificationChannel
+    for _, ch := range n.channels {
+        if _, ok := ch.templates[event.Type]; ok {
+            channels = append(channels, ch)
+        }
+    }
+    n.mu.RUnlock()
+
+    results := RunPool(ctx, len(channels), channels, func(ctx context.Context, ch *notificationChannel) (struct{}, error) {
+        subject, body, err := ch.templates[event.Type].render(event)
+        if err != nil {
+            return struct{}{}, fmt.Errorf("channel %s: %w", ch.name, err)
+        }
+        note := Notification{
+            Channel: ch.name,
+            Event:   event.Type,
+            UserID:  user.ID,
+            To:      user.Email,
+            Subject: subject,
+            Body:    body,
+        }
+        if err := ch.notifier.Notify(ctx, note); err != nil {
+            loggerFor(ctx, n.logger).Error("Notification failed", "event", event.Type, "target", user.ID, "channel", ch.name, "error", err)
+            return struct{}{}, fmt.Errorf("channel %s: %w", ch.name, err)
+        }
+        return struct{}{}, nil
+    })
+    return PoolErrors(results)
+}
+
+// EmailSender delivers a plain-text message to a single address.
+type EmailSender interface {
+    SendEmail(ctx context.Context, to, subject, body string) error
+}
+
+type EmailNotifier struct {
+    Sender EmailSender
+}
+
+func (e EmailNotifier) Notify(ctx context.Context, n Notification) error {
+    return e.Sender.SendEmail(ctx, n.To, n.Subject, n.Body)
+}
+
+// WebhookNotifier POSTs each Notification as JSON to URL. Unlike
+// WebhookDispatcher it makes a single unsigned attempt, and is meant for
+// internal endpoints such as chat integrations.
+type WebhookNotifier struct {
+    URL    string
+    Client *http.Client // http.DefaultClient if nil
+}
+
+func (w WebhookNotifier) Notify(ctx context.Context, n Notification) error {
+    body, err := json.Marshal(n)
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    propagateContext(ctx, req)
+    client := w.Client
+    if client == nil {
+        client = http.DefaultClient
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    io.Copy(io.Discard, resp.Body)
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("notification webhook returned %s", resp.Status)
+    }
+    return nil
+}
+
+// LogNotifier writes notifications to a Logger, for development.
+type LogNotifier struct {
+    Logger Logger
+}
+
+func (l LogNotifier) Notify(ctx context.Context, n Notification) error {
+    l.Logger.Info("Notify", "to", n.To, "channel", n.Channel, "subject", n.Subject)
+    return nil
+}
+
+// Email
+//
+// Mailer renders transactional emails in the recipient's preferred
+// language and hands them to an EmailSender. SMTPSender delivers over SMTP
+// with STARTTLS or implicit TLS and retries temporary failures; in dry-run
+// mode it keeps messages in memory instead.
+
+type EmailKind string
+
+const (
+    EmailWelcome       EmailKind = "welcome"
+    EmailVerification  EmailKind = "verification"
+    EmailPasswordReset EmailKind = "password_reset"
+)
+
+// EmailData is what email templates are executed with. URL is the
+// verification or reset link and ExpiresAt its expiry; both are empty for
+// welcome emails.
+type EmailData struct {
+    User      *User
+    URL       string
+    ExpiresAt time.Time
+}
+
+// DefaultEmailTemplates covers every EmailKind in a subset of
+// AllowedLanguages; other languages fall back to DefaultPrefs.Language.
+var DefaultEmailTemplates = map[string]map[EmailKind]NotificationTemplate{
+    "en": {
+        EmailWelcome:       {Subject: "Welcome, {{.User.Name}}", Body: "Hi {{.User.Name}},\n\nYour account is ready.\n"},
+        EmailVerification:  {Subject: "Verify your email address", Body: "Hi {{.User.Name}},\n\nConfirm your address by visiting:\n{{.URL}}\n\nThis link expires {{.ExpiresAt.Format \"2006-01-02 15:04 MST\"}}.\n"},
+        EmailPasswordReset: {Subject: "Reset your password", Body: "Hi {{.User.Name}},\n\nReset your password here:\n{{.URL}}\n\nThis link expires {{.ExpiresAt.Format \"2006-01-02 15:04 MST\"}}. If you did not ask for a reset, ignore this email.\n"},
+    },
+    "es": {
+        EmailWelcome:       {Subject: "Bienvenido, {{.User.Name}}", Body: "Hola {{.User.Name}}:\n\nTu cuenta está lista.\n"},
+        EmailVerification:  {Subject: "Verifica tu correo electrónico", Body: "Hola {{.User.Name}}:\n\nConfirma tu dirección aquí:\n{{.URL}}\n\nEl enlace caduca el {{.ExpiresAt.Format \"2006-01-02 15:04 MST\"}}.\n"},
+        EmailPasswordReset: {Subject: "Restablece tu contraseña", Body: "Hola {{.User.Name}}:\n\nRestablece tu contraseña aquí:\n{{.URL}}\n\nEl enlace caduca el {{.ExpiresAt.Format \"2006-01-02 15:04 MST\"}}. Si no lo solicitaste, ignora este correo.\n"},
+    },
+    "fr": {
+        EmailWelcome:       {Subject: "Bienvenue, {{.User.Name}}", Body: "Bonjour {{.User.Name}},\n\nVotre compte est prêt.\n"},
+        EmailVerification:  {Subject: "Vérifiez votre adresse e-mail", Body: "Bonjour {{.User.Name}},\n\nConfirmez votre adresse ici :\n{{.URL}}\n\nCe lien expire le {{.ExpiresAt.Format \"2006-01-02 15:04 MST\"}}.\n"},
+        EmailPasswordReset: {Subject: "Réinitialisez votre mot de passe", Body: "Bonjour {{.User.Name}},\n\nRéinitialisez votre mot de passe ici :\n{{.URL}}\n\nCe lien expire le {{.ExpiresAt.Format \"2006-01-02 15:04 MST\"}}. Si vous n'êtes pas à l'origine de cette demande, ignorez cet e-mail.\n"},
+    },
+    "de": {
+        EmailWelcome:       {Subject: "Willkommen, {{.User.Name}}", Body: "Hallo {{.User.Name}},\n\nIhr Konto ist bereit.\n"},
+        EmailVerification:  {Subject: "Bestätigen Sie Ihre E-Mail-Adresse", Body: "Hallo {{.User.Name}},\n\nBestätigen Sie Ihre Adresse hier:\n{{.URL}}\n\nDer Link läuft am {{.ExpiresAt.Format \"2006-01-02 15:04 MST\"}} ab.\n"},
+        EmailPasswordReset: {Subject: "Passwort zurücksetzen", Body: "Hallo {{.User.Name}},\n\nSetzen Sie Ihr Passwort hier zurück:\n{{.URL}}\n\nDer Link läuft am {{.ExpiresAt.Format \"2006-01-02 15:04 MST\"}} ab. Falls Sie das nicht angefordert haben, ignorieren Sie diese E-Mail.\n"},
+    },
+}
+
+type Mailer struct {
+    sender    EmailSender
+    templates map[string]map[EmailKind]compiledTemplate
+}
+
+// NewMailer compiles templates, keyed by language then kind. Pass
+// DefaultEmailTemplates unless you ship your own copy.
+func NewMailer(sender EmailSender, templates map[string]map[EmailKind]NotificationTemplate) (*Mailer, error) {
+    m := &Mailer{sender: sender, templates: make(map[string]map[EmailKind]compiledTemplate, len(templates))}
+    for lang, kinds := range templates {
+        m.templates[lang] = make(map[EmailKind]compiledTemplate, len(kinds))
+        for kind, tmpl := range kinds {
+            compiled, err := compileTemplate(lang+":"+string(kind), tmpl)
+            if err != nil {
+                return nil, fmt.Errorf("email template %s/%s: %w", lang, kind, err)
+            }
+            m.templates[lang][kind] = compiled
+        }
+    }
+    return m, nil
+}
+
+// Send renders kind in data.User's language and sends it to their email.
+func (m *Mailer) Send(ctx context.Context, kind EmailKind, data EmailData) error {
+    tmpl, ok := m.templates[data.User.Preferences.Language][kind]
+    if !ok {
+        tmpl, ok = m.templates[DefaultPrefs.Language][kind]
+    }
+    if !ok {
+        return fmt.Errorf("email template %s %w", kind, ErrNotFound)
+    }
+    subject, body, err := tmpl.render(data)
+    if err != nil {
+        return err
+    }
+    return m.sender.SendEmail(ctx, data.User.Email, subject, body)
+}
+
+type SMTPSecurity int
+
+const (
+    SMTPStartTLS    SMTPSecurity = iota // upgrade a plain connection; refuse servers without STARTTLS
+    SMTPImplicitTLS                     // TLS from the first byte, usually port 465
+    SMTPPlaintext                       // local relays and test servers only
+)
+
+type SMTPConfig struct {
+    Host     string
+    Port     int // 587 if zero, or 465 with SMTPImplicitTLS
+    Username string
+    Password Secret
+    From     string
+    Security SMTPSecurity
+    // TLSConfig overrides the default, which verifies Host.
+    TLSConfig *tls.Config
+    // Retry applies to connection failures and 4xx replies.
+    Retry RetryPolicy
+    // DryRun renders and records messages without connecting anywhere.
+    DryRun bool
+}
+
+// SentEmail is a message captured by a dry-run SMTPSender.
+type SentEmail struct {
+    To      string
+    Subject string
+    Body    string
+    Raw     []byte
+}
+
+type SMTPSender struct {
+    cfg    SMTPConfig
+    logger Logger
+
+    mu     sync.Mutex
+    outbox []SentEmail
+}
+
+func NewSMTPSender(cfg SMTPConfig, logger Logger) *SMTPSender {
+    if cfg.Port == 0 {
+        cfg.Port = 587
+        if cfg.Security == SMTPImplicitTLS {
+            cfg.Port = 465
+        }
+    }
+    if cfg.TLSConfig == nil {
+        cfg.TLSConfig = &tls.Config{ServerName: cfg.Host, MinVersion: tls.VersionTLS12}
+    }
+    if cfg.Retry.Retryable == nil {
+        cfg.Retry.Retryable = isTemporarySMTPError
+    }
+    return &SMTPSender{cfg: cfg, logger: logger}
+}
+
+func (s *SMTPSender) SendEmail(ctx context.Context, to, subject, body string) error {
+    to, err := NormalizeEmail(to)
+    if err != nil {
+        return err
+    }
+    if strings.ContainsAny(subject, "\r\n") {
+        return errors.New("email subject must be a single line")
+    }
+    msg, err := s.buildMessage(to, subject, body)
+    if err != nil {
+        return err
+    }
+
+    if s.cfg.DryRun {
+        s.mu.Lock()
+        s.outbox = append(s.outbox, SentEmail{To: to, Subject: subject, Body: body, Raw: msg})
+        s.mu.Unlock()
+        loggerFor(ctx, s.logger).Info("Dry run: email not sent", "subject", subject, "to", to)
+        return nil
+    }
+    err = RetryDo(ctx, s.cfg.Retry, func(ctx context.Context) error {
+        return s.deliver(ctx, to, msg)
+    })
+    if err != nil {
+        loggerFor(ctx, s.logger).Error("Email failed", "subject", subject, "to", to, "error", err)
+        return err
+    }
+    loggerFor(ctx, s.logger).Info("Email sent", "subject", subject, "to", to)
+    return nil
+}
+
+// Outbox returns the messages captured in dry-run mode.
+func (s *SMTPSender) Outbox() []SentEmail {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return slices.Clone(s.outbox)
+}
+
+func (s *SMTPSender) buildMessage(to, subject, body string) ([]byte, error) {
+    var b strings.Builder
+    fmt.Fprintf(&b, "From: %s\r\n", s.cfg.From)
+    fmt.Fprintf(&b, "To: %s\r\n", to)
+    fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+    fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+    b.WriteString("MIME-Version: 1.0\r\n")
+    b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+    b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+    qp := quotedprintable.NewWriter(&b)
+    if _, err := qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n"))); err != nil {
+        return nil, err
+    }
+    if err := qp.Close(); err != nil {
+        return nil, err
+    }
+    return []byte(b.String()), nil
+}
+
+func (s *SMTPSender) deliver(ctx context.Context, to string, msg []byte) error {
+    addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+    var conn net.Conn
+    var err error
+    if s.cfg.Security == SMTPImplicitTLS {
+        conn, err = (&tls.Dialer{Config: s.cfg.TLSConfig}).DialContext(ctx, "tcp", addr)
+    } else {
+        conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+    }
+    if err != nil {
+        return err
+    }
+    // net/smtp has no context support, so bound the whole session instead.
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetDeadline(deadline)
+    }
+    c, err := smtp.NewClient(conn, s.cfg.Host)
+    if err != nil {
+        conn.Close()
+        return err
+    }
+    defer c.Close()
+
+    if s.cfg.Security == SMTPStartTLS {
+        if ok, _ := c.Extension("STARTTLS"); !ok {
+            return fmt.Errorf("SMTP server %s does not support STARTTLS", s.cfg.Host)
+        }
+        if err := c.StartTLS(s.cfg.TLSConfig); err != nil {
+            return err
+        }
+    }
+    if s.cfg.Username != "" {
+        if err := c.Auth(smtp.PlainAuth("", s.cfg.Username, s.cfg.Password.Reveal(), s.cfg.Host)); err != nil {
+            return err
+        }
+    }
+    if err := c.Mail(s.cfg.From); err != nil {
+        return err
+    }
+    if err := c.Rcpt(to); err != nil {
+        return err
+    }
+    w, err := c.Data()
+    if err != nil {
+        return err
+    }
+    if _, err := w.Write(msg); err != nil {
+        return err
+    }
+    if err := w.Close(); err != nil {
+        return err
+    }
+    return c.Quit()
+}
+
+// isTemporarySMTPError retries 4xx replies, which SMTP defines as
+// transient, along with whatever IsTransient accepts.
+func isTemporarySMTPError(err error) bool {
+    var protoErr *textproto.Error
+    if errors.As(err, &protoErr) {
+        return protoErr.Code >= 400 && protoErr.Code < 500
+    }
+    return IsTransient(err)
+}
+
+// Jobs
+//
+// JobQueue runs work that must outlive the request asking for it, such as
+// sending an email, delivering a webhook or anonymizing a user. Enqueue
+// stores the job in a JobStore before returning, so pending jobs survive a
+// restart. The queue polls the store and runs due jobs on a worker pool,
+// using the handler registered for each JobType with HandleJob. A failed
+// job is retried with exponential backoff until it has used MaxAttempts.
+// It then stays in the store as dead until an operator retries it.
+// Handlers may see a job more than once: a job whose process died while
+// running it is run again, so handlers should be idempotent.
+
+type JobID int
+
+type JobType string
+
+const (
+    JobSendEmail      JobType = "send_email"
+    JobDeliverWebhook JobType = "deliver_webhook"
+    JobAnonymizeUser  JobType = "anonymize_user"
+)
+
+// JobStatus is where a job stands. Jobs that succeed are deleted, so a
+// store only ever holds pending, running and dead jobs.
+type JobStatus string
+
+const (
+    JobPending JobStatus = "pending"
+    JobRunning JobStatus = "running"
+    JobDead    JobStatus = "dead"
+)
+
+// ErrJobPermanent marks handler errors that retrying won't fix, such as a
+// payload naming a user that no longer exists. Wrap it to send the job
+// straight to dead.
+var ErrJobPermanent = errors.New("permanent job failure")
+
+type Job struct {
+    ID          JobID           `json:"id"`
+    Type        JobType         `json:"type"`
+    Payload     json.RawMessage `json:"payload"`
+    Status      JobStatus       `json:"status"`
+    Attempts    int             `json:"attempts"`
+    MaxAttempts int             `json:"max_attempts"`
+    RunAt       time.Time       `json:"run_at"` // earliest time of the next attempt
+    LastError   string          `json:"last_error,omitempty"`
+    CreatedAt   time.Time       `json:"created_at"`
+    UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+func (j *Job) EntityID() JobID      { return j.ID }
+func (j *Job) SetEntityID(id JobID) { j.ID = id }
+
+// Redacted returns a copy of j fit to show an operator, without secrets
+// its payload carries: an email's body, which may hold a password reset
+// or verification link, is replaced.
+func (j *Job) Redacted() *Job {
+    c := *j
+    if j.Type == JobSendEmail {
+        var email SendEmailJob
+        if json.Unmarshal(j.Payload, &email) == nil {
+            email.Body = "[redacted]"
+            c.Payload, _ = json.Marshal(email)
+        } else {
+            c.Payload = json.RawMessage("null")
+        }
+    }
+    return &c
+}
+
+// JobPayload is implemented by the typed arguments of each kind of job.
+// JobType must work on the zero value.
+type JobPayload interface {
+    JobType() JobType
+}
+
+// SendEmailJob is one message for an EmailSender. The body is stored with
+// the job, including any links it carries, until the job succeeds, and
+// for good once it is dead; show jobs with Job.Redacted.
+type SendEmailJob struct {
+    To      string `json:"to"`
+    Subject string `json:"subject"`
+    Body    string `json:"body"`
+}
+
+// DeliverWebhookJob sends Event to one webhook.
+type DeliverWebhookJob struct {
+    WebhookID WebhookID `json:"webhook_id"`
+    Event     UserEvent `json:"event"`
+}
+
+// AnonymizeUserJob anonymizes one user in Tenant on behalf of RequestedBy.
+// The requester is authorized again when the job runs. Build one with
+// NewAnonymizeUserJob to capture both from the request.
+type AnonymizeUserJob struct {
+    UserID      UserID   `json:"user_id"`
+    RequestedBy UserID   `json:"requested_by,omitempty"`
+    Tenant      TenantID `json:"tenant,omitempty"`
+}
+
+func (SendEmailJob) JobType() JobType      { return JobSendEmail }
+func (DeliverWebhookJob) JobType() JobType { return JobDeliverWebhook }
+func (AnonymizeUserJob) JobType() JobType  { return JobAnonymizeUser }
+
+func NewAnonymizeUserJob(ctx context.Context, id UserID) AnonymizeUserJob {
+    job := AnonymizeUserJob{UserID: id}
+    if actor, ok := CurrentUser(ctx); ok {
+        job.RequestedBy = actor.ID
+    }
+    job.Tenant, _ = TenantScope(ctx)
+    return job
+}
+
+// JobStore persists jobs for a JobQueue. Jobs go in and come out as
+// copies that belong to the caller.
+type JobStore interface {
+    Repository[JobID, *Job]
+    // FindDue returns up to limit pending jobs of the given types whose
+    // RunAt is not after now, earliest first.
+    FindDue(ctx context.Context, now time.Time, types []JobType, limit int) ([]*Job, error)
+    // FindByStatus returns the jobs in status, in ID order.
+    FindByStatus(ctx context.Context, status JobStatus) ([]*Job, error)
+    // Claim marks job running and counts an attempt, in the store and in
+    // job. It reports false if the job was no longer pending, for
+    // instance because another server claimed it first.
+    Claim(ctx context.Context, job *Job) (bool, error)
+}
+
+// MemoryJobStore keeps jobs in memory and, through Persist and Load, in a
+// JSON file. It is safe for concurrent use.
+type MemoryJobStore struct {
+    mu    sync.Mutex // makes Claim atomic with respect to writes
+    jobs  *MemoryRepository[JobID, *Job]
+    maxID atomic.Int64
+}
+
+func NewMemoryJobStore() *MemoryJobStore {
+    s := &MemoryJobStore{}
+    s.jobs = NewMemoryRepository[JobID, *Job](func() JobID { return JobID(s.maxID.Add(1)) })
+    return s
+}
+
+func (s *MemoryJobStore) Save(ctx context.Context, job *Job) error {
+    return s.write(job, func(copied *Job) error { return s.jobs.Save(ctx, copied) })
+}
+
+func (s *MemoryJobStore) Insert(ctx context.Context, job *Job) error {
+    return s.write(job, func(copied *Job) error { return s.jobs.Insert(ctx, copied) })
+}
+
+// write stores a copy of job and hands back the ID it was given.
+func (s *MemoryJobStore) write(job *Job, store func(*Job) error) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    copied := *job
+    if err := store(&copied); err != nil {
+        return err
+    }
+    job.ID = copied.ID
+    return nil
+}
+
+func (s *MemoryJobStore) FindByID(ctx context.Context, id JobID) (*Job, error) {
+    job, err := s.jobs.FindByID(ctx, id)
+    if err != nil {
+        return nil, err
+    }
+    copied := *job
+    return &copied, nil
+}
+
+func (s *MemoryJobStore) Delete(ctx context.Context, id JobID) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.jobs.Delete(ctx, id)
+}
+
+func (s *MemoryJobStore) FindDue(ctx context.Context, now time.Time, types []JobType, limit int) ([]*Job, error) {
+    due, err := s.find(ctx, func(j *Job) bool {
+        return j.Status == JobPending && !j.RunAt.After(now) && slices.Contains(types, j.Type)
+    })
+    if err != nil {
+        return nil, err
+    }
+    slices.SortStableFunc(due, func(a, b *Job) int { return a.RunAt.Compare(b.RunAt) })
+    return due[:min(len(due), limit)], nil
+}
+
+func (s *MemoryJobStore) FindByStatus(ctx context.Context, status JobStatus) ([]*Job, error) {
+    return s.find(ctx, func(j *Job) bool { return j.Status == status })
+}
+
+// find returns copies of the jobs matching keep, in ID order.
+func (s *MemoryJobStore) find(ctx context.Context, keep func(*Job) bool) ([]*Job, error) {
+    all, err := s.jobs.FindAll(ctx)
+    if err != nil {
+        return nil, err
+    }
+    var out []*Job
+    for _, job := range all {
+        if keep(job) {
+            copied := *job
+            out = append(out, &copied)
+        }
+    }
+    slices.SortFunc(out, func(a, b *Job) int { return cmp.Compare(a.ID, b.ID) })
+    return out, nil
+}
+
+func (s *MemoryJobStore) Claim(ctx context.Context, job *Job) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    stored, err := s.jobs.FindByID(ctx, job.ID)
+    if errors.Is(err, ErrNotFound) {
+        return false, nil
+    }
+    if err != nil || stored.Status != JobPending {
+        return false, err
+    }
+    claimed := *stored
+    claimed.Status = JobRunning
+    claimed.Attempts++
+    claimed.UpdatedAt = time.Now()
+    if err := s.jobs.Save(ctx, &claimed); err != nil {
+        return false, err
+    }
+    *job = claimed
+    return true, nil
+}
+
+// Persist writes every job to path as JSON, atomically like
+// InMemoryRepository.Persist.
+func (s *MemoryJobStore) Persist(path string) error {
+    jobs, err := s.find(context.Background(), func(*Job) bool { return true })
+    if err != nil {
+        return err
+    }
+    data, err := json.Marshal(nonNil(jobs))
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(path, data)
+}
+
+// Load adds the jobs stored at path. A missing file is not an error.
+func (s *MemoryJobStore) Load(path string) error {
+    data, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    var jobs []*Job
+    if err := json.Unmarshal(data, &jobs); err != nil {
+        return fmt.Errorf("load %s: %w", path, err)
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, job := range jobs {
+        if job.ID <= 0 {
+            return fmt.Errorf("load %s: job without an ID", path)
+        }
+        if err := s.jobs.Save(context.Background(), job); err != nil {
+            return err
+        }
+        // New IDs carry on after the loaded ones. Every write holds mu,
+        // so nothing draws an ID meanwhile.
+        if int64(job.ID) > s.maxID.Load() {
+            s.maxID.Store(int64(job.ID))
+        }
+    }
+    return nil
+}
+
+// SQLJobStore keeps jobs in the jobs table next to the users of a
+// PostgresRepository; get one from its Jobs method.
+// Claim is a conditional update, so several servers can share the table.
+type SQLJobStore struct {
+    db      *sql.DB
+    dialect sqlDialect
+}
+
+// Jobs returns a JobStore in the repository's database. It works outside
+// any transaction the repository is bound to.
+func (r *sqlRepository) Jobs() *SQLJobStore {
+    return &SQLJobStore{db: r.db, dialect: r.dialect}
+}
+
+const (
+    jobDataColumns = `type, payload, status, attempts, max_attempts, run_at, last_error, created_at, updated_at`
+    jobColumns     = `id, ` + jobDataColumns
+)
+
+func jobArgs(job *Job) []any {
+    return []any{job.Type, string(job.Payload), job.Status, job.Attempts, job.MaxAttempts, job.RunAt, job.LastError, job.CreatedAt, job.UpdatedAt}
+}
+
+func (s *SQLJobStore) Save(ctx context.Context, job *Job) error {
+    if job.ID == 0 {
+        return s.Insert(ctx, job)
+    }
+    var updates []string
+    for _, c := range strings.Split(jobDataColumns, ", ") {
+        if c != "created_at" {
+            updates = append(updates, c+" = excluded."+c)
+        }
+    }
+    query := `INSERT INTO jobs (` + jobColumns + `) VALUES (` + placeholders(10) + `)
+ON CONFLICT (id) DO UPDATE SET ` + strings.Join(updates, ", ")
+    _, err := s.db.ExecContext(ctx, s.dialect.rebind(query), append([]any{job.ID}, jobArgs(job)...)...)
+    return err
+}
+
+func (s *SQLJobStore) Insert(ctx context.Context, job *Job) error {
+    if job.ID != 0 {
+        _, err := s.db.ExecContext(ctx, s.dialect.rebind(`INSERT INTO jobs (`+jobColumns+`) VALUES (`+placeholders(10)+`)`),
+            append([]any{job.ID}, jobArgs(job)...)...)
+        if isUniqueViolation(err) {
+            return fmt.Errorf("job with ID %d %w", job.ID, ErrAlreadyExists)
+        }
+        if err != nil {
+            return err
+        }
+        return s.dialect.advanceSequence(ctx, s.db, "jobs", int64(job.ID))
+    }
+    var id int64
+    err := s.db.QueryRowContext(ctx, s.dialect.rebind(`INSERT INTO jobs (`+jobDataColumns+`) VALUES (`+placeholders(9)+`) RETURNING id`),
+        jobArgs(job)...).Scan(&id)
+    if err == nil {
+        job.ID = JobID(id)
+    }
+    return err
+}
+
+func (s *SQLJobStore) FindByID(ctx context.Context, id JobID) (*Job, error) {
+    job, err := scanJob(s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT `+jobColumns+` FROM jobs WHERE id = ?`), id))
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, fmt.Errorf("job with ID %d %w", id, ErrNotFound)
+    }
+    return job, err
+}
+
+func (s *SQLJobStore) Delete(ctx context.Context, id JobID) error {
+    res, err := s.db.ExecContext(ctx, s.dialect.rebind(`DELETE FROM jobs WHERE id = ?`), id)
+    if err != nil {
+        return err
+    }
+    if n, err := res.RowsAffected(); err != nil {
+        return err
+    } else if n == 0 {
+        return fmt.Errorf("job with ID %d %w", id, ErrNotFound)
+    }
+    return nil
+}
+
+func (s *SQLJobStore) FindDue(ctx context.Context, now time.Time, types []JobType, limit int) ([]*Job, error) {
+    if len(types) == 0 {
+        return nil, nil
+    }
+    args := []any{JobPending, now}
+    for _, t := range types {
+        args = append(args, t)
+    }
+    query := `SELECT ` + jobColumns + ` FROM jobs WHERE status = ? AND run_at <= ? AND type IN (` + placeholders(len(types)) + `)
+ORDER BY run_at, id LIMIT ?`
+    rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query), append(args, limit)...)
+    if err != nil {
+        return nil, err
+    }
+    return scanJobs(rows)
+}
+
+func (s *SQLJobStore) FindByStatus(ctx context.Context, status JobStatus) ([]*Job, error) {
+    rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`SELECT `+jobColumns+` FROM jobs WHERE status = ? ORDER BY id`), status)
+    if err != nil {
+        return nil, err
+    }
+    return scanJobs(rows)
+}
+
+func (s *SQLJobStore) Claim(ctx context.Context, job *Job) (bool, error) {
+    now := time.Now()
+    res, err := s.db.ExecContext(ctx, s.dialect.rebind(`UPDATE jobs SET status = ?, attempts = attempts + 1, updated_at = ?
+WHERE id = ? AND status = ?`), JobRunning, now, job.ID, JobPending)
+    if err != nil {
+        return false, err
+    }
+    n, err := res.RowsAffected()
+    if err != nil || n == 0 {
+        return false, err
+    }
+    claimed, err := s.FindByID(ctx, job.ID)
+    if err != nil {
+        return false, err
+    }
+    *job = *claimed
+    return true, nil
+}
+
+func scanJob(row rowScanner) (*Job, error) {
+    var (
+        job     Job
+        payload []byte
+    )
+    if err := row.Scan(&job.ID, &job.Type, &payload, &job.Status, &job.Attempts, &job.MaxAttempts, &job.RunAt, &job.LastError, &job.CreatedAt, &job.UpdatedAt); err != nil {
+        return nil, err
+    }
+    job.Payload = json.RawMessage(payload)
+    return &job, nil
+}
+
+func scanJobs(rows *sql.Rows) ([]*Job, error) {
+    defer rows.Close()
+    var jobs []*Job
+    for rows.Next() {
+        job, err := scanJob(rows)
+        if err != nil {
+            return nil, err
+        }
+        jobs = append(jobs, job)
+    }
+    return jobs, rows.Err()
+}
+
+type JobConfig struct {
+    Workers        int           // jobs run at once; DefaultJobWorkers if zero
+    PollInterval   time.Duration // how often to look for due jobs
+    MaxAttempts    int           // per job; DefaultJobAttempts if zero
+    InitialBackoff time.Duration // doubled after each failure, with jitter
+    MaxBackoff     time.Duration
+    // Timeout bounds each attempt. A job still marked running after twice
+    // Timeout is presumed lost with its process and is run again.
+    Timeout time.Duration
+}
+
+const (
+    DefaultJobWorkers  = 4
+    DefaultJobAttempts = 5
+)
+
+var DefaultJobConfig = JobConfig{
+    Workers:        DefaultJobWorkers,
+    PollInterval:   time.Second,
+    MaxAttempts:    DefaultJobAttempts,
+    InitialBackoff: 10 * time.Second,
+    MaxBackoff:     time.Hour,
+    Timeout:        5 * time.Minute,
+}
+
+type JobQueue struct {
+    cfg    JobConfig
+    store  JobStore
+    logger Logger
+
+    handlersMu sync.RWMutex
+    handlers   map[JobType]func(context.Context, *Job) error
+
+    wake   chan struct{}
+    mu     sync.Mutex
+    cancel context.CancelFunc
+    done   chan struct{}
+}
+
+func NewJobQueue(store JobStore, cfg JobConfig, logger Logger) *JobQueue {
+    if cfg.Workers <= 0 {
+        cfg.Workers = DefaultJobWorkers
+    }
+    if cfg.PollInterval <= 0 {
+        cfg.PollInterval = DefaultJobConfig.PollInterval
+    }
+    if cfg.MaxAttempts <= 0 {
+        cfg.MaxAttempts = DefaultJobAttempts
+    }
+    if cfg.InitialBackoff <= 0 {
+        cfg.InitialBackoff = DefaultJobConfig.InitialBackoff
+    }
+    if cfg.MaxBackoff <= 0 {
+        cfg.MaxBackoff = DefaultJobConfig.MaxBackoff
+    }
+    if cfg.Timeout <= 0 {
+        cfg.Timeout = DefaultJobConfig.Timeout
+    }
+    return &JobQueue{
+        cfg:      cfg,
+        store:    store,
+        logger:   logger,
+        handlers: make(map[JobType]func(context.Context, *Job) error),
+        wake:     make(chan struct{}, 1),
+    }
+}
+
+// HandleJob registers fn to run the jobs of P's type, replacing any
+// earlier handler. Jobs of types without a handler stay pending.
+func HandleJob[P JobPayload](q *JobQueue, fn func(ctx context.Context, payload P) error) {
+    var zero P
+    q.handlersMu.Lock()
+    defer q.handlersMu.Unlock()
+    q.handlers[zero.JobType()] = func(ctx context.Context, job *Job) error {
+        var payload P
+        if err := json.Unmarshal(job.Payload, &payload); err != nil {
+            return fmt.Errorf("decode %s payload: %w: %w", job.Type, err, ErrJobPermanent)
+        }
+        return fn(ctx, payload)
+    }
+}
+
+// Enqueue stores a job for payload that runs as soon as a worker is free.
+func (q *JobQueue) Enqueue(ctx context.Context, payload JobPayload) (*Job, error) {
+    return q.EnqueueAt(ctx, payload, time.Time{})
+}
+
+// EnqueueAt stores a job for payload that runs no earlier than at.
+func (q *JobQueue) EnqueueAt(ctx context.Context, payload JobPayload, at time.Time) (*Job, error) {
+    data, err := json.Marshal(payload)
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now()
+    if at.IsZero() {
+        at = now
+    }
+    job := &Job{
+        Type:        payload.JobType(),
+        Payload:     data,
+        Status:      JobPending,
+        MaxAttempts: q.cfg.MaxAttempts,
+        RunAt:       at,
+        CreatedAt:   now,
+        UpdatedAt:   now,
+    }
+    if err := q.store.Insert(ctx, job); err != nil {
+        return nil, err
+    }
+    loggerFor(ctx, q.logger).Debug("Job enqueued", "job", job.ID, "type", job.Type, "run_at", job.RunAt)
+    if !at.After(now) {
+        q.notify()
+    }
+    return job, nil
+}
+
+// notify wakes the poller early, for jobs that are due now.
+func (q *JobQueue) notify() {
+    select {
+    case q.wake <- struct{}{}:
+    default: // a wake-up is already pending
+    }
+}
+
+// Job returns one job.
+func (q *JobQueue) Job(ctx context.Context, id JobID) (*Job, error) {
+    return q.store.FindByID(ctx, id)
+}
+
+// Jobs lists the jobs in status, in ID order.
+func (q *JobQueue) Jobs(ctx context.Context, status JobStatus) ([]*Job, error) {
+    return q.store.FindByStatus(ctx, status)
+}
+
+// Retry gives a dead job a fresh set of attempts, starting now. Its last
+// error is kept until the next attempt.
+func (q *JobQueue) Retry(ctx context.Context, id JobID) (*Job, error) {
+    job, err := q.store.FindByID(ctx, id)
+    if err != nil {
+        return nil, err
+    }
+    if job.Status != JobDead {
+        return nil, fmt.Errorf("job %d is %s, not dead: %w", id, job.Status, ErrInvalidTransition)
+    }
+    job.Status = JobPending
+    job.Attempts = 0
+    job.RunAt = time.Now()
+    job.UpdatedAt = job.RunAt
+    if err := q.store.Save(ctx, job); err != nil {
+        return nil, err
+    }
+    loggerFor(ctx, q.logger).Info("Dead job retried", "job", id, "type", job.Type)
+    q.notify()
+    return job, nil
+}
+
+// Start runs due jobs in the background until Stop is called or ctx ends.
+// Calling Start on a running queue does nothing.
+func (q *JobQueue) Start(ctx context.Context) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if q.cancel != nil {
+        return
+    }
+    ctx, q.cancel = context.WithCancel(ctx)
+    q.done = make(chan struct{})
+
+    go func() {
+        defer close(q.done)
+        ticker := time.NewTicker(q.cfg.PollInterval)
+        defer ticker.Stop()
+        for {
+            if _, err := q.RunDue(ctx); err != nil && ctx.Err() == nil {
+                q.logger.Error("Running jobs failed", "error", err)
+            }
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+            case <-q.wake:
+            }
+        }
+    }()
+}
+
+// Stop halts polling and waits for running jobs to finish.
+func (q *JobQueue) Stop() {
+    q.mu.Lock()
+    cancel, done := q.cancel, q.done
+    q.cancel, q.done = nil, nil
+    q.mu.Unlock()
+    if cancel != nil {
+        cancel()
+        <-done
+    }
+}
+
+// RunDue runs jobs that are due, Workers at a time, until none are left
+// or ctx ends, and returns how many it ran. Start calls it on every poll.
+func (q *JobQueue) RunDue(ctx context.Context) (int, error) {
+    q.handlersMu.RLock()
+    types := slices.Collect(maps.Keys(q.handlers))
+    q.handlersMu.RUnlock()
+    if len(types) == 0 {
+        return 0, nil
+    }
+    if err := q.requeueLost(ctx); err != nil {
+        return 0, err
+    }
+
+    ran := 0
+    for ctx.Err() == nil {
+        due, err := q.store.FindDue(ctx, time.Now(), types, q.cfg.Workers)
+        if err != nil {
+            return ran, err
+        }
+        var claimed []*Job
+        for _, job := range due {
+            ok, err := q.store.Claim(ctx, job)
+            if err != nil {
+                return ran, err
+            }
+            if ok {
+                claimed = append(claimed, job)
+            }
+        }
+        if len(claimed) == 0 {
+            return ran, nil
+        }
+        // Claimed jobs run to completion even if ctx ends meanwhile.
+        RunPool(context.WithoutCancel(ctx), q.cfg.Workers, claimed, func(ctx context.Context, job *Job) (struct{}, error) {
+            q.run(ctx, job)
+            return struct{}{}, nil
+        })
+        ran += len(claimed)
+    }
+    return ran, nil
+}
+
+// run makes one attempt at job and records the outcome.
+func (q *JobQueue) run(ctx context.Context, job *Job) {
+    logger := q.logger
+    start := time.Now()
+    err := q.call(ctx, job)
+    now := time.Now()
+    job.UpdatedAt = now
+    switch {
+    case err == nil:
+        logger.Debug("Job done", "job", job.ID, "type", job.Type, "attempt", job.Attempts, "duration", now.Sub(start))
+        if err := q.store.Delete(ctx, job.ID); err != nil && !errors.Is(err, ErrNotFound) {
+            logger.Error("Deleting finished job failed", "job", job.ID, "error", err)
+        }
+        return
+    case errors.Is(err, ErrJobPermanent) || job.Attempts >= job.MaxAttempts:
+        job.Status = JobDead
+        job.LastError = err.Error()
+        logger.Error("Job failed; moved to dead letters", "job", job.ID, "type", job.Type, "attempts", job.Attempts, "error", err)
+    default:
+        job.Status = JobPending
+        job.LastError = err.Error()
+        job.RunAt = now.Add(q.backoff(job.Attempts))
+        logger.Warn("Job failed; will retry", "job", job.ID, "type", job.Type, "attempt", job.Attempts, "retry_at", job.RunAt, "error", err)
+    }
+    if err := q.store.Save(ctx, job); err != nil {
+        logger.Error("Saving job failed", "job", job.ID, "error", err)
+    }
+}
+
+// call runs job's handler with the attempt timeout, turning a panic into
+// an error so one bad job can't take the server down.
+func (q *JobQueue) call(ctx context.Context, job *Job) (err error) {
+    q.handlersMu.RLock()
+    handler := q.handlers[job.Type]
+    q.handlersMu.RUnlock()
+    if handler == nil {
+        return fmt.Errorf("no handler for %s jobs", job.Type)
+    }
+    ctx, cancel := context.WithTimeout(ctx, q.cfg.Timeout)
+    defer cancel()
+    defer func() {
+        if v := recover(); v != nil {
+            err = fmt.Errorf("panic: %v", v)
+        }
+    }()
+    return handler(ctx, job)
+}
+
+// backoff is the wait after a job's attempt-th failure: full jitter over
+// InitialBackoff doubled per earlier failure, capped at MaxBackoff.
+func (q *JobQueue) backoff(attempt int) time.Duration {
+    backoff := q.cfg.InitialBackoff
+    for i := 1; i < attempt && backoff < q.cfg.MaxBackoff; i++ {
+        backoff *= 2
+    }
+    backoff = min(backoff, q.cfg.MaxBackoff)
+    return time.Duration(mrand.Int64N(int64(backoff)) + 1)
+}
+
+// requeueLost puts back jobs left running by a process that stopped
+// without finishing them, counting that as a failed attempt.
+func (q *JobQueue) requeueLost(ctx context.Context) error {
+    running, err := q.store.FindByStatus(ctx, JobRunning)
+    if err != nil {
+        return err
+    }
+    cutoff := time.Now().Add(-2 * q.cfg.Timeout)
+    for _, job := range running {
+        if job.UpdatedAt.After(cutoff) {
+            continue
+        }
+        job.LastError = "lost while running"
+        job.Status = JobPending
+        if job.Attempts >= job.MaxAttempts {
+            job.Status = JobDead
+        }
+        job.RunAt = time.Now()
+        job.UpdatedAt = job.RunAt
+        q.logger.Warn("Requeueing lost job", "job", job.ID, "type", job.Type, "status", job.Status)
+        if err := q.store.Save(ctx, job); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// SendEmailHandler runs SendEmailJobs through sender.
+func SendEmailHandler(sender EmailSender) func(context.Context, SendEmailJob) error {
+    return func(ctx context.Context, job SendEmailJob) error {
+        return sender.SendEmail(ctx, job.To, job.Subject, job.Body)
+    }
+}
+
+// JobEmailSender is an EmailSender that enqueues SendEmailJobs, so a
+// Mailer's messages are retried and survive restarts. The queue needs
+// SendEmailHandler for the real sender.
+type JobEmailSender struct {
+    Queue *JobQueue
+}
+
+func (s JobEmailSender) SendEmail(ctx context.Context, to, subject, body string) error {
+    _, err := s.Queue.Enqueue(ctx, SendEmailJob{To: to, Subject: subject, Body: body})
+    return err
+}
+
+// DeliverWebhookHandler runs DeliverWebhookJobs through d, one attempt
+// per run. Retries come from the queue rather than the dispatcher.
+// Deliveries the receiver rejected outright are not retried.
+func DeliverWebhookHandler(d *WebhookDispatcher) func(context.Context, DeliverWebhookJob) error {
+    return func(ctx context.Context, job DeliverWebhookJob) error {
+        delivery, err := d.Deliver(ctx, job.WebhookID, job.Event)
+        if errors.Is(err, ErrNotFound) {
+            return fmt.Errorf("%w: %w", err, ErrJobPermanent) // unregistered since
+        }
+        if err != nil || delivery.Status == DeliverySucceeded {
+            return err
+        }
+        err = fmt.Errorf("webhook %d delivery %d: %s", job.WebhookID, delivery.ID, delivery.LastError)
+        if delivery.LastStatusCode != 0 && !retryableStatus(delivery.LastStatusCode) {
+            return fmt.Errorf("%w: %w", err, ErrJobPermanent)
+        }
+        return err
+    }
+}
+
+// QueueWebhooks returns a Subscriber that enqueues a DeliverWebhookJob
+// for each of d's webhooks that wants the event. Subscribe it instead of
+// d.HandleEvent for deliveries that survive restarts.
+func QueueWebhooks(q *JobQueue, d *WebhookDispatcher) Subscriber {
+    return func(ctx context.Context, event UserEvent) error {
+        hooks, err := d.Webhooks(ctx)
+        if err != nil {
+            return err
+        }
+        var errs []error
+        for _, hook := range hooks {
+            if hook.wants(event.Type) {
+                if _, err := q.Enqueue(ctx, DeliverWebhookJob{WebhookID: hook.ID, Event: event}); err != nil {
+                    errs = append(errs, err)
+                }
+            }
+        }
+        return errors.Join(errs...)
+    }
+}
+
+// AnonymizeUserHandler runs AnonymizeUserJobs through svc, as the user
+// who requested them.
+func AnonymizeUserHandler(svc *UserService) func(context.Context, AnonymizeUserJob) error {
+    return func(ctx context.Context, job AnonymizeUserJob) error {
+        if job.Tenant != "" {
+            ctx = WithTenant(ctx, job.Tenant)
+        }
+        if job.RequestedBy != 0 {
+            actor, err := svc.repo.FindByID(ctx, job.RequestedBy)
+            if errors.Is(err, ErrNotFound) {
+                return fmt.Errorf("requester: %w: %w", err, ErrJobPermanent)
+            } else if err != nil {
+                return err
+            }
+            ctx = WithCurrentUser(ctx, actor)
+        }
+        _, err := svc.AnonymizeUser(ctx, job.UserID)
+        if errors.Is(err, ErrNotFound) || errors.Is(err, ErrForbidden) {
+            return fmt.Errorf("%w: %w", err, ErrJobPermanent)
+        }
+        return err
+    }
+}
+
+// HTTP API
+//
+// UserAPI serves users over JSON:
+//
+//     POST   /users        create from a CreateUserRequest; 201 with Location
+//     GET    /users        list a Page; ?offset=&limit=&sort=<field>&desc=true
+//     GET    /users/{id}
+//     PUT    /users/{id}   apply a UserPatch
+//     DELETE /users/{id}   soft-delete; 204
+//     GET    /stats        UserStats
+//     /graphql             see GraphQLHandler
+//     GET    /openapi.json OpenAPI 3.0 description of the above
+//     GET    /docs         Swagger UI for /openapi.json
+//     GET    /api.proto    protobuf schema of the responses
+//
+// Responses are JSON, XML or protobuf as the Accept header asks; see
+// RegisterEncoder. Request bodies are always JSON.
+// Errors are reported as an APIError body with a status from httpStatus.
+// POST honours an Idempotency-Key header. Wrap the API in
+// TokenService.Middleware or APIKeyService.Middleware so the service's
+// authorizer and tenant scoping see the caller.
+
+// maxRequestBody caps JSON request bodies.
+const maxRequestBody = 1 << 20
+
+type APIError struct {
+    Error string `json:"error"`
+}
+
+type UserAPI struct {
+    svc      *UserService
+    logger   Logger
+    mux      *http.ServeMux
+    routes   []apiRoute
+    encoders []apiEncoder // in order of preference
+}
+
+// apiRoute describes one endpoint for both the mux and OpenAPI. Request
+// and response are zero values of the body types, or nil for no body.
+type apiRoute struct {
+    method, path string
+    id, summary  string
+    handler      http.Handler
+    query        []apiParam
+    headers      []apiParam
+    request      any
+    status       int
+    response     any
+    jsonOnly     bool // the handler writes JSON itself, ignoring Accept
+}
+
+// apiParam is a query or header parameter; example's type sets its schema.
+type apiParam struct {
+    name, description string
+    example           any
+}
+
+func NewUserAPI(svc *UserService, logger Logger) *UserAPI {
+    a := &UserAPI{svc: svc, logger: logger, mux: http.NewServeMux()}
+    a.RegisterEncoder("application/json", encodeJSON)
+    a.RegisterEncoder("application/xml", encodeXML)
+    a.RegisterEncoder("application/x-protobuf", encodeProtobuf)
+    graphql := NewGraphQLHandler(svc, logger)
+    a.routes = []apiRoute{
+        {method: "POST", path: "/users", id: "createUser", summary: "Create a user",
+            handler: http.HandlerFunc(a.createUser),
+            headers: []apiParam{{"Idempotency-Key", "Replays the first response for repeated requests", ""}},
+            request: CreateUserRequest{}, status: http.StatusCreated, response: User{}},
+        {method: "GET", path: "/users", id: "listUsers", summary: "List users a page at a time",
+            handler: http.HandlerFunc(a.listUsers),
+            query: []apiParam{
+                {"offset", "Number of users to skip", 0},
+                {"limit", "Page size; defaults to DefaultPageSize", 0},
+                {"sort", "Sort field: id, name, created_at or age", ""},
+                {"desc", "Sort in descending order", false},
+            },
+            status: http.StatusOK, response: Page{}},
+        {method: "GET", path: "/users/{id}", id: "getUser", summary: "Get a user",
+            handler: http.HandlerFunc(a.getUser), status: http.StatusOK, response: User{}},
+        {method: "PUT", path: "/users/{id}", id: "updateUser", summary: "Update the fields set in the patch",
+            handler: http.HandlerFunc(a.updateUser), request: UserPatch{}, status: http.StatusOK, response: User{}},
+        {method: "DELETE", path: "/users/{id}", id: "deleteUser", summary: "Soft-delete a user",
+            handler: http.HandlerFunc(a.deleteUser), status: http.StatusNoContent},
+        {method: "GET", path: "/stats", id: "getStats", summary: "Statistics over live users",
+            handler: http.HandlerFunc(a.stats), status: http.StatusOK, response: UserStats{}},
+        {method: "GET", path: "/graphql", id: "graphqlQuery", summary: "Run a GraphQL query",
+            handler: graphql,
+            query: []apiParam{
+                {"query", "GraphQL document", ""},
+                {"operationName", "Operation to run from the document", ""},
+                {"variables", "JSON object of variable values", ""},
+            },
+            status: http.StatusOK, response: GraphQLResponse{}, jsonOnly: true},
+        {method: "POST", path: "/graphql", id: "graphql", summary: "Run a GraphQL query or mutation",
+            handler: graphql, request: GraphQLRequest{}, status: http.StatusOK, response: GraphQLResponse{}, jsonOnly: true},
+    }
+    for _, rt := range a.routes {
+        a.mux.Handle(rt.method+" "+rt.path, rt.handler)
+    }
+    a.mux.HandleFunc("GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
+        writeJSON(w, http.StatusOK, a.OpenAPI())
+    })
+    a.mux.HandleFunc("GET /docs", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        io.WriteString(w, swaggerUIPage)
+    })
+    a.mux.HandleFunc("GET /api.proto", func(w http.ResponseWriter, r *http.Request) {
+        types := []reflect.Type{reflect.TypeFor[APIError]()}
+        for _, rt := range a.routes {
+            if rt.response != nil && !rt.jsonOnly {
+                types = append(types, reflect.TypeOf(rt.response))
+            }
+        }
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        io.WriteString(w, ProtoSchema(types...))
+    })
+    return a
+}
+
+func (a *UserAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    a.mux.ServeHTTP(w, r)
+    noteRoute(r)
+}
+
+// Handle serves h alongside the API, like http.ServeMux.Handle. Such
+// endpoints aren't described by OpenAPI.
+func (a *UserAPI) Handle(pattern string, h http.Handler) {
+    a.mux.Handle(pattern, h)
+}
+
+func (a *UserAPI) createUser(w http.ResponseWriter, r *http.Request) {
+    var req CreateUserRequest
+    if !a.decode(w, r, &req) {
+        return
+    }
+    ctx := r.Context()
+    if key := r.Header.Get("Idempotency-Key"); key != "" {
+        ctx = WithIdempotencyKey(ctx, key)
+    }
+    user, err := a.svc.CreateUserWith(ctx, req)
+    if err != nil {
+        a.fail(w, r, err)
+        return
+    }
+    w.Header().Set("Location", fmt.Sprintf("/users/%d", user.ID))
+    a.write(w, r, http.StatusCreated, user)
+}
+
+func (a *UserAPI) listUsers(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    var req PageRequest
+    var err error
+    if v := q.Get("offset"); v != "" {
+        if req.Offset, err = strconv.Atoi(v); err != nil {
+            a.fail(w, r, invalidInput(fmt.Errorf("invalid offset %q", v)))
+            return
+        }
+    }
+    if v := q.Get("limit"); v != "" {
+        if req.Limit, err = strconv.Atoi(v); err != nil {
+            a.fail(w, r, invalidInput(fmt.Errorf("invalid limit %q", v)))
+            return
+        }
+    }
+    req.Sort.Field = SortField(q.Get("sort"))
+    if v := q.Get("desc"); v != "" {
+        if req.Sort.Desc, err = strconv.ParseBool(v); err != nil {
+            a.fail(w, r, invalidInput(fmt.Errorf("invalid desc %q", v)))
+            return
+        }
+    }
+    page, err := a.svc.ListUsers(r.Context(), req)
+    if err != nil {
+        a.fail(w, r, err)
+        return
+    }
+    a.write(w, r, http.StatusOK, page)
+}
+
+func (a *UserAPI) getUser(w http.ResponseWriter, r *http.Request) {
+    id, ok := a.pathID(w, r)
+    if !ok {
+        return
+    }
+    user, err := a.svc.GetUser(r.Context(), id)
+    if err != nil {
+        a.fail(w, r, err)
+        return
+    }
+    a.write(w, r, http.StatusOK, user)
+}
+
+func (a *UserAPI) updateUser(w http.ResponseWriter, r *http.Request) {
+    id, ok := a.pathID(w, r)
+    if !ok {
+        return
+    }
+    var patch UserPatch
+    if !a.decode(w, r, &patch) {
+        return
+    }
+    user, err := a.svc.PatchUser(r.Context(), id, patch)
+    if err != nil {
+        a.fail(w, r, err)
+        return
+    }
+    a.write(w, r, http.StatusOK, user)
+}
+
+func (a *UserAPI) deleteUser(w http.ResponseWriter, r *http.Request) {
+    id, ok := a.pathID(w, r)
+    if !ok {
+        return
+    }
+    if err := a.svc.DeleteUser(r.Context(), id); err != nil {
+        a.fail(w, r, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *UserAPI) stats(w http.ResponseWriter, r *http.Request) {
+    stats, err := a.svc.GetUserStats(r.Context())
+    if err != nil {
+        a.fail(w, r, err)
+        return
+    }
+    a.write(w, r, http.StatusOK, stats)
+}
+
+func (a *UserAPI) pathID(w http.ResponseWriter, r *http.Request) (UserID, bool) {
+    raw := r.PathValue("id")
+    id, err := strconv.Atoi(raw)
+    if err != nil || id <= 0 {
+        a.fail(w, r, invalidInput(fmt.Errorf("invalid user ID %q", raw)))
+        return 0, false
+    }
+    return UserID(id), true
+}
+
+// decode reads a JSON body into v, rejecting unknown fields so typos in
+// a patch don't silently do nothing.
+func (a *UserAPI) decode(w http.ResponseWriter, r *http.Request, v any) bool {
+    dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(v); err != nil {
+        a.fail(w, r, invalidInput(fmt.Errorf("invalid request body: %v", err)))
+        return false
+    }
+    return true
+}
+
+// fail writes err as an APIError. Server-side failures are logged and
+// reported without detail; 501 is a missing feature, not a failure.
+func (a *UserAPI) fail(w http.ResponseWriter, r *http.Request, err error) {
+    status := httpStatus(err)
+    msg := err.Error()
+    if status >= http.StatusInternalServerError && status != http.StatusNotImplemented {
+        loggerFor(r.Context(), a.logger).Error("HTTP API failed", "error", err)
+        msg = http.StatusText(status)
+    }
+    a.write(w, r, status, APIError{Error: msg})
+}
+
+// httpStatus maps service errors to HTTP status codes.
+func httpStatus(err error) int {
+    switch {
+    case errors.Is(err, ErrNotFound):
+        return http.StatusNotFound
+    case errors.Is(err, ErrEmailTaken), errors.Is(err, ErrAlreadyExists),
+        errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrIdempotencyConflict):
+        return http.StatusConflict
+    case errors.Is(err, ErrForbidden):
+        return http.StatusForbidden
+    case errors.Is(err, ErrInvalidCredentials), errors.Is(err, ErrInvalidToken):
+        return http.StatusUnauthorized
+    case errors.Is(err, ErrRateLimited):
+        return http.StatusTooManyRequests
+    case errors.Is(err, ErrAccountLocked):
+        return http.StatusLocked
+    case errors.Is(err, ErrInvalidInput):
+        return http.StatusBadRequest
+    case errors.Is(err, ErrNotSupported):
+        return http.StatusNotImplemented
+    case errors.Is(err, context.DeadlineExceeded):
+        return http.StatusGatewayTimeout
+    case errors.Is(err, ErrCircuitOpen), IsTransient(err):
+        return http.StatusServiceUnavailable
+    }
+    return http.StatusInternalServerError
+}
+
+// OpenAPI describes the API as an OpenAPI 3.0 document, with schemas
+// derived from the request and response types' JSON encoding.
+func (a *UserAPI) OpenAPI() map[string]any {
+    schemas := map[string]any{}
+    // Every response can come in any registered format; the schema
+    // describes the JSON form, which the others mirror.
+    content := func(schema map[string]any, jsonOnly bool) map[string]any {
+        c := map[string]any{"application/json": map[string]any{"schema": schema}}
+        if !jsonOnly {
+            for _, enc := range a.encoders {
+                c[enc.contentType] = map[string]any{"schema": schema}
+            }
+        }
+        return c
+    }
+    errorResponse := map[string]any{
+        "description": "Error",
+        "content":     content(openAPISchema(reflect.TypeFor[APIError](), schemas), false),
+    }
+    paths := map[string]map[string]any{}
+    for _, rt := range a.routes {
+        var params []any
+        for _, part := range strings.Split(rt.path, "/") {
+            if name, ok := strings.CutPrefix(part, "{"); ok {
+                params = append(params, map[string]any{
+                    "name": strings.TrimSuffix(name, "}"), "in": "path", "required": true,
+                    "schema": map[string]any{"type": "integer", "minimum": 1},
+                })
+            }
+        }
+        for _, in := range []struct {
+            where  string
+            params []apiParam
+        }{{"query", rt.query}, {"header", rt.headers}} {
+            for _, p := range in.params {
+                params = append(params, map[string]any{
+                    "name": p.name, "in": in.where, "description": p.description,
+                    "schema": openAPISchema(reflect.TypeOf(p.example), schemas),
+                })
+            }
+        }
+
+        success := map[string]any{"description": http.StatusText(rt.status)}
+        if rt.response != nil {
+            success["content"] = content(openAPISchema(reflect.TypeOf(rt.response), schemas), rt.jsonOnly)
+        }
+        op := map[string]any{
+            "operationId": rt.id,
+            "summary":     rt.summary,
+            "responses":   map[string]any{strconv.Itoa(rt.status): success, "default": errorResponse},
+        }
+        if len(params) > 0 {
+            op["parameters"] = params
+        }
+        if rt.request != nil {
+            op["requestBody"] = map[string]any{
+                "required": true,
+                "content":  map[string]any{"application/json": map[string]any{"schema": openAPISchema(reflect.TypeOf(rt.request), schemas)}},
+            }
+        }
+        if paths[rt.path] == nil {
+            paths[rt.path] = map[string]any{}
+        }
+        paths[rt.path][strings.ToLower(rt.method)] = op
+    }
+
+    return map[string]any{
+        "openapi": "3.0.3",
+        "info":    map[string]any{"title": AppName, "version": Version},
+        "paths":   paths,
+        "components": map[string]any{
+            "schemas": schemas,
+            "securitySchemes": map[string]any{
+                "bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+                "apiKey":     map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+            },
+        },
+        "security": []any{map[string]any{"bearerAuth": []any{}}, map[string]any{"apiKey": []any{}}},
+    }
+}
+
+// openAPISchema returns the schema for t's JSON encoding. Named structs
+// are added to schemas once and referenced from then on.
+func openAPISchema(t reflect.Type, schemas map[string]any) map[string]any {
+    if t == reflect.TypeFor[time.Time]() {
+        return map[string]any{"type": "string", "format": "date-time"}
+    }
+    switch t.Kind() {
+    case reflect.Pointer:
+        elem := openAPISchema(t.Elem(), schemas)
+        if _, ok := elem["$ref"]; ok {
+            // OpenAPI 3.0 ignores siblings of $ref.
+            return map[string]any{"allOf": []any{elem}, "nullable": true}
+        }
+        elem = maps.Clone(elem)
+        elem["nullable"] = true
+        return elem
+    case reflect.Bool:
+        return map[string]any{"type": "boolean"}
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+        return map[string]any{"type": "integer"}
+    case reflect.Int64, reflect.Uint64:
+        return map[string]any{"type": "integer", "format": "int64"}
+    case reflect.Float32, reflect.Float64:
+        return map[string]any{"type": "number"}
+    case reflect.String:
+        return map[string]any{"type": "string"}
+    case reflect.Slice, reflect.Array:
+        if t.Elem().Kind() == reflect.Uint8 {
+            return map[string]any{"type": "string", "format": "byte"}
+        }
+        return map[string]any{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+    case reflect.Map:
+        return map[string]any{"type": "object", "additionalProperties": openAPISchema(t.Elem(), schemas)}
+    case reflect.Struct:
+        if t.Name() == "" {
+            return openAPIObject(t, schemas)
+        }
+        if _, ok := schemas[t.Name()]; !ok {
+            schemas[t.Name()] = nil // placeholder, so recursive types terminate
+            schemas[t.Name()] = openAPIObject(t, schemas)
+        }
+        return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+    }
+    return map[string]any{}
+}
+
+func openAPIObject(t reflect.Type, schemas map[string]any) map[string]any {
+    props := map[string]any{}
+    var required []string
+    for i := range t.NumField() {
+        sf := t.Field(i)
+        if !sf.IsExported() {
+            continue
+        }
+        name, opts, _ := strings.Cut(sf.Tag.Get("json"), ",")
+        if name == "-" {
+            continue
+        }
+        if name == "" {
+            name = sf.Name
+        }
+        props[name] = openAPISchema(sf.Type, schemas)
+        if !strings.Contains(opts, "omitempty") && !strings.Contains(opts, "omitzero") {
+            required = append(required, name)
+        }
+    }
+    schema := map[string]any{"type": "object", "properties": props}
+    if len(required) > 0 {
+        schema["required"] = required
+    }
+    return schema
+}
+
+// swaggerUIPage renders /openapi.json with Swagger UI from a CDN.
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>API docs</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+// Admin API
+//
+// AdminAPI is the operator's route group, kept apart from the public API
+// and served under /admin:
+//
+//     GET    /admin/users/deleted             soft-deleted users; ?offset=&limit=
+//     POST   /admin/users/{id}/restore        undo a delete
+//     POST   /admin/users/purge               ?older_than=720h; {"purged": n}
+//     GET    /admin/users/{id}/lockout        LockStatus
+//     DELETE /admin/users/{id}/lockout        lift a lockout; 204
+//     GET    /admin/audit                     ?actor=&target=&action=&since=&until=&limit=
+//     GET    /admin/webhooks                  registered webhooks
+//     GET    /admin/webhooks/{id}/deliveries  ?status=pending|succeeded|failed
+//     POST   /admin/reindex                   rebuild repository indexes; 204
+//     GET    /admin/log-level                 {"level": "INFO"}
+//     PUT    /admin/log-level                 {"level": "debug"}; takes effect at once
+//     GET    /admin/slo                       SLOStatus per operation
+//     GET    /admin/jobs                      ?status=pending|running|dead, dead by default
+//     POST   /admin/jobs/{id}/retry           give a dead job fresh attempts
+//     POST   /admin/users/{id}/anonymize      queue an AnonymizeUserJob; 202
+//
+// Every route checks its Action with Authorizer before doing anything, in
+// addition to the checks UserService makes, so the group stays closed to
+// non-admins even on a service configured without an authorizer. The
+// lockout, audit, webhook, log level, SLO and job routes answer 501 until
+// Auth, Audit, Webhooks, LogLevel, SLOs or Jobs is set. Responses are
+// negotiated like the public API's.
+
+type AdminAPI struct {
+    // Authorizer guards every route; RBACAuthorizer with
+    // DefaultRolePolicy, admins only, when nil.
+    Authorizer Authorizer
+    // Audit defaults to the service's audit log when that answers queries.
+    Audit    AuditQuerier
+    Webhooks *WebhookDispatcher
+    Auth     *AuthService
+    // LogLevel is the level the server's log handler filters on.
+    LogLevel *slog.LevelVar
+    SLOs     *SLOTracker
+    Jobs     *JobQueue
+
+    api *UserAPI
+    mux *http.ServeMux
+}
+
+// NewAdminAPI serves the admin routes for api's service, sharing its
+// response formats. Mount it with api.Handle("/admin/", admin).
+func NewAdminAPI(api *UserAPI) *AdminAPI {
+    a := &AdminAPI{api: api, mux: http.NewServeMux()}
+    if q, ok := api.svc.audit.(AuditQuerier); ok {
+        a.Audit = q
+    }
+    a.mux.Handle("GET /admin/users/deleted", a.guard(ActionViewDeleted, a.listDeleted))
+    a.mux.Handle("POST /admin/users/{id}/restore", a.guardUser(ActionRestoreUser, a.restore))
+    a.mux.Handle("POST /admin/users/purge", a.guard(ActionPurgeUsers, a.purge))
+    a.mux.Handle("GET /admin/users/{id}/lockout", a.guardUser(ActionViewLockout, a.lockStatus))
+    a.mux.Handle("DELETE /admin/users/{id}/lockout", a.guardUser(ActionUnlockUser, a.unlock))
+    a.mux.Handle("GET /admin/audit", a.guard(ActionViewAudit, a.audit))
+    a.mux.Handle("GET /admin/webhooks", a.guard(ActionViewWebhooks, a.webhooks))
+    a.mux.Handle("GET /admin/webhooks/{id}/deliveries", a.guard(ActionViewWebhooks, a.deliveries))
+    a.mux.Handle("POST /admin/reindex", a.guard(ActionReindex, a.reindex))
+    a.mux.Handle("GET /admin/log-level", a.guard(ActionSetLogLevel, a.logLevel))
+    a.mux.Handle("PUT /admin/log-level", a.guard(ActionSetLogLevel, a.setLogLevel))
+    a.mux.Handle("GET /admin/slo", a.guard(ActionViewSLOs, a.slo))
+    a.mux.Handle("GET /admin/jobs", a.guard(ActionViewJobs, a.jobs))
+    a.mux.Handle("POST /admin/jobs/{id}/retry", a.guard(ActionRetryJobs, a.retryJob))
+    a.mux.Handle("POST /admin/users/{id}/anonymize", a.guardUser(ActionAnonymizeUsers, a.anonymize))
+    return a
+}
+
+func (a *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    a.mux.ServeHTTP(w, r)
+}
+
+// guard runs h only for callers allowed to perform action.
+func (a *AdminAPI) guard(action Action, h http.HandlerFunc) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if a.allowed(w, r, action, 0) {
+            h(w, r)
+        }
+    })
+}
+
+// guardUser is guard for routes about the user {id} in the path.
+func (a *AdminAPI) guardUser(action Action, h http.HandlerFunc) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id, ok := a.api.pathID(w, r)
+        if ok && a.allowed(w, r, action, id) {
+            h(w, r)
+        }
+    })
+}
+
+func (a *AdminAPI) allowed(w http.ResponseWriter, r *http.Request, action Action, target UserID) bool {
+    authorizer := a.Authorizer
+    if authorizer == nil {
+        authorizer = RBACAuthorizer{}
+    }
+    if err := authorizer.Authorize(r.Context(), action, target); err != nil {
+        loggerFor(r.Context(), a.api.logger).Warn("Admin API denied", "method", r.Method, "path", r.URL.Path, "error", err)
+        a.api.fail(w, r, err)
+        return false
+    }
+    return true
+}
+
+func (a *AdminAPI) listDeleted(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    var req PageRequest
+    var err error
+    if req.Offset, err = queryInt(q, "offset"); err != nil {
+        a.api.fail(w, r, err)
+        return
+    }
+    if req.Limit, err = queryInt(q, "limit"); err != nil {
+        a.api.fail(w, r, err)
+        return
+    }
+    page, err := a.api.svc.ListDeletedUsers(r.Context(), req)
+    if err != nil {
+        a.api.fail(w, r, err)
+        return
+    }
+    a.api.write(w, r, http.StatusOK, page)
+}
+
+func (a *AdminAPI) restore(w http.ResponseWriter, r *http.Request) {
+    id, ok := a.api.pathID(w, r)
+    if !ok {
+        return
+    }
+    user, err := a.api.svc.RestoreUser(r.Context(), id)
+    if err != nil {
+        a.api.fail(w, r, err)
+        return
+    }
+    a.api.write(w, r, http.StatusOK, user)
+}
+
+// PurgeResult reports how many users a purge removed.
+type PurgeResult struct {
+    Purged int `json:"purged"`
+}
+
+func (a *AdminAPI) purge(w http.ResponseWriter, r *http.Request) {
+    raw := r.URL.Query().Get("older_than")
+    if raw == "" {
+        // Purging is irreversible, so the cutoff is never implied.
+        a.api.fail(w, r, invalidInput(errors.New("older_than is required, e.g. 720h")))
+        return
+    }
+    olderThan, err := time.ParseDuration(raw)
+    if err != nil {
+        a.api.fail(w, r, invalidInput(fmt.Errorf("invalid older_than %q", raw)))
+        return
+    }
+    purged, err := a.api.svc.PurgeDeletedUsers(r.Context(), olderThan)
+    if err != nil {
+        a.api.fail(w, r, err)
+        return
+    }
+    a.api.write(w, r, http.StatusOK, PurgeResult{Purged: purged})
+}
+
+func (a *AdminAPI) lockStatus(w http.ResponseWriter, r *http.Request) {
+    if a.Auth == nil {
+        a.api.fail(w, r, fmt.Errorf("lockouts: %w", ErrNotSupported))
+        return
+    }
+    id, ok := a.api.pathID(w, r)
+    if !ok {
+        return
+    }
+    a.api.write(w, r, http.StatusOK, a.Auth.LockStatus(id))
+}
+
+func (a *AdminAPI) unlock(w http.ResponseWriter, r *http.Request) {
+    if a.Auth == nil {
+        a.api.fail(w, r, fmt.Errorf("lockouts: %w", ErrNotSupported))
+        return
+    }
+    id, ok := a.api.pathID(w, r)
+    if !ok {
+        return
+    }
+    a.Auth.Unlock(id)
+    a.api.svc.record(r.Context(), ActionUnlockUser, id, "")
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminAPI) audit(w http.ResponseWriter, r *http.Request) {
+    if a.Audit == nil {
+        a.api.fail(w, r, fmt.Errorf("audit queries: %w", ErrNotSupported))
+        return
+    }
+    q := r.URL.Query()
+    query := AuditQuery{Action: Action(q.Get("action"))}
+    var actor, target int
+    var err error
+    if actor, err = queryInt(q, "actor"); err == nil {
+        target, err = queryInt(q, "target")
+    }
+    if err == nil {
+        query.Limit, err = queryInt(q, "limit")
+    }
+    if err == nil {
+        query.Since, err = queryTime(q, "since")
+    }
+    if err == nil {
+        query.Until, err = queryTime(q, "until")
+    }
+    if err != nil {
+        a.api.fail(w, r, err)
+        return
+    }
+    query.Actor, query.Target = UserID(actor), UserID(target)
+    entries, err := a.Audit.Query(r.Context(), query)
+    if err != nil {
+        a.api.fail(w, r, err)
+        return
+    }
+    a.api.write(w, r, http.StatusOK, nonNil(entries))
+}
+
+func (a *AdminAPI) webhooks(w http.ResponseWriter, r *http.Request) {
+    if a.Webhooks == nil {
+        a.api.fail(w, r, fmt.Errorf("webhooks: %w", ErrNotSupported))
+        return
+    }
+    hooks, err := a.Webhooks.Webhooks(r.Context())
+    if err != nil {
+        a.api.fail(w, r, err)
+        return
+    }
+    a.api.write(w, r, http.StatusOK, hooks)
+}
+
+func (a *AdminAPI) deliveries(w http.ResponseWriter, r *http.Request) {
+    if a.Webhooks == nil {
+        a.api.fail(w, r, fmt.Errorf("webhooks: %w", ErrNotSupported))
+        return
+    }
+    raw := r.PathValue("id")
+    id, err := strconv.Atoi(raw)
+    if err != nil || id <= 0 {
+        a.api.fail(w, r, invalidInput(fmt.Errorf("invalid webhook ID %q", raw)))
+        return
+    }
+    deliveries, err := a.Webhooks.Deliveries(r.Context(), WebhookID(id))
+    if err != nil {
+        a.api.fail(w, r, err)
+        return
+    }
+    if status := DeliveryStatus(r.URL.Query().Get("status")); status != "" {
+        deliveries = slices.DeleteFunc(deliveries, func(d Delivery) bool { return d.Status != status })
+    }
+    a.api.write(w, r, http.StatusOK, nonNil(deliveries))
+}
+
+func (a *AdminAPI) reindex(w http.ResponseWriter, r *http.Request) {
+    if err := a.api.svc.Reindex(r.Context()); err != nil {
+        a.api.fail(w, r, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// LogLevelSetting is the body of the log level routes.
+type LogLevelSetting struct {
+    Level string `json:"level"`
+}
+
+func (a *AdminAPI) logLevel(w http.ResponseWriter, r *http.Request) {
+    if a.LogLevel == nil {
+        a.api.fail(w, r, fmt.Errorf("log level: %w", ErrNotSupported))
+        return
+    }
+    a.api.write(w, r, http.StatusOK, LogLevelSetting{Level: a.LogLevel.Level().String()})
+}
+
+func (a *AdminAPI) setLogLevel(w http.ResponseWriter, r *http.Request) {
+    if a.LogLevel == nil {
+        a.api.fail(w, r, fmt.Errorf("log level: %w", ErrNotSupported))
+        return
+    }
+    var req LogLevelSetting
+    if !a.api.decode(w, r, &req) {
+        return
+    }
+    level, err := ParseLogLevel(req.Level)
+    if err != nil {
+        a.api.fail(w, r, err)
+        return
+    }
+    old := a.LogLevel.Level()
+    a.LogLevel.Set(level)
+    loggerFor(r.Context(), a.api.logger).Warn("Log level changed", "from", old, "to", level)
+    a.api.svc.record(r.Context(), ActionSetLogLevel, 0, level.String())
+    a.api.write(w, r, http.StatusOK, LogLevelSetting{Level: level.String()})
+}
+
+func (a *AdminAPI) slo(w http.ResponseWriter, r *http.Request) {
+    if a.SLOs == nil {
+        a.api.fail(w, r, fmt.Errorf("SLOs: %w", ErrNotSupported))
+        return
+    }
+    a.api.write(w, r, http.StatusOK, a.SLOs.Report())
+}
+
+// jobs lists jobs by status, dead ones unless ?status= says otherwise.
+func (a *AdminAPI) jobs(w http.ResponseWriter, r *http.Request) {
+    if a.Jobs == nil {
+        a.api.fail(w, r, fmt.Errorf("jobs: %w", ErrNotSupported))
+        return
+    }
+    status := JobStatus(r.URL.Query().Get("status"))
+    switch status {
+    case "":
+        status = JobDead
+    case JobPending, JobRunning, JobDead:
+    default:
+        a.api.fail(w, r, invalidInput(fmt.Errorf("invalid job status %q", status)))
+        return
+    }
+    jobs, err := a.Jobs.Jobs(r.Context(), status)
+    if err != nil {
+        a.api.fail(w, r, err)
+        return
+    }
+    for i, job := range jobs {
+        jobs[i] = job.Redacted()
+    }
+    a.api.write(w, r, http.StatusOK, nonNil(jobs))
+}
+
+func (a *AdminAPI) retryJob(w http.ResponseWriter, r *http.Request) {
+    if a.Jobs == nil {
+        a.api.fail(w, r, fmt.Errorf("jobs: %w", ErrNotSupported))
+        return
+    }
+    raw := r.PathValue("id")
+    id, err := strconv.Atoi(raw)
+    if err != nil || id <= 0 {
+        a.api.fail(w, r, invalidInput(fmt.Errorf("invalid job ID %q", raw)))
+        return
+    }
+    job, err := a.Jobs.Retry(r.Context(), JobID(id))
+    if err != nil {
+        a.api.fail(w, r, err)
+        return
+    }
+    a.api.write(w, r, http.StatusOK, job.Redacted())
+}
+
+// anonymize queues the user's anonymization and answers 202 with the job.
+func (a *AdminAPI) anonymize(w http.ResponseWriter, r *http.Request) {
+    if a.Jobs == nil {
+        a.api.fail(w, r, fmt.Errorf("jobs: %w", ErrNotSupported))
+        return
+    }
+    id, ok := a.api.pathID(w, r)
+    if !ok {
+        return
+    }
+    job, err := a.Jobs.Enqueue(r.Context(), NewAnonymizeUserJob(r.Context(), id))
+    if err != nil {
+        a.api.fail(w, r, err)
+        return
+    }
+    a.api.write(w, r, http.StatusAccepted, job)
+}
+
+// nonNil makes empty results encode as [] rather than null.
+func nonNil[T any](s []T) []T {
+    if s == nil {
+        return []T{}
+    }
+    return s
+}
+
+// queryInt parses an optional integer query parameter; absent is zero.
+func queryInt(q url.Values, name string) (int, error) {
+    v := q.Get(name)
+    if v == "" {
+        return 0, nil
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil {
+        return 0, invalidInput(fmt.Errorf("invalid %s %q", name, v))
+    }
+    return n, nil
+}
+
+// queryTime parses an optional RFC 3339 query parameter.
+func queryTime(q url.Values, name string) (time.Time, error) {
+    v := q.Get(name)
+    if v == "" {
+        return time.Time{}, nil
+    }
+    t, err := time.Parse(time.RFC3339, v)
+    if err != nil {
+        return time.Time{}, invalidInput(fmt.Errorf("invalid %s %q; want RFC 3339", name, v))
+    }
+    return t, nil
+}
+
+// Content negotiation
+//
+// UserAPI picks the response format from the Accept header: the
+// registered encoder with the highest quality value, earliest registered
+// on ties. Clients with no preference, or none the API can meet, get the
+// first one, JSON, rather than a 406 after the request has had its
+// effect.
+//
+// XML mirrors the JSON encoding. The root element is named after the Go
+// type (user, page, user_stats, api_error), object members are child
+// elements, array items are <item> elements and nulls are left out. Keys
+// that aren't XML names, as in Metadata, become <entry key="...">.
+//
+// Protobuf is proto3 derived from the Go types, as GET /api.proto
+// describes. A field's number is its 1-based position in its struct, so
+// struct fields must only ever be appended. json:"-" fields are left out
+// but keep their numbers. Times are google.protobuf.Timestamp.
+
+// EncodeFunc writes v in one content type.
+type EncodeFunc func(w io.Writer, v any) error
+
+type apiEncoder struct {
+    contentType string
+    encode      EncodeFunc
+}
+
+// RegisterEncoder adds or replaces the encoder for contentType. New
+// content types are least preferred when a client accepts several.
+func (a *UserAPI) RegisterEncoder(contentType string, encode EncodeFunc) {
+    for i := range a.encoders {
+        if a.encoders[i].contentType == contentType {
+            a.encoders[i].encode = encode
+            return
+        }
+    }
+    a.encoders = append(a.encoders, apiEncoder{contentType, encode})
+}
+
+// write sends v in the negotiated format. It encodes v before writing the
+// status, so an encoding failure can still become a 500.
+func (a *UserAPI) write(w http.ResponseWriter, r *http.Request, status int, v any) {
+    w.Header().Add("Vary", "Accept")
+    enc := a.negotiate(r.Header.Values("Accept"))
+    var buf bytes.Buffer
+    if err := enc.encode(&buf, v); err != nil {
+        loggerFor(r.Context(), a.logger).Error("HTTP API encoding failed", "type", fmt.Sprintf("%T", v), "content_type", enc.contentType, "error", err)
+        writeJSON(w, http.StatusInternalServerError, APIError{Error: http.StatusText(http.StatusInternalServerError)})
+        return
+    }
+    w.Header().Set("Content-Type", enc.contentType)
+    w.WriteHeader(status)
+    w.Write(buf.Bytes())
+}
+
+func (a *UserAPI) negotiate(accept []string) apiEncoder {
+    best, bestQ := a.encoders[0], 0.0
+    for _, enc := range a.encoders {
+        if q := acceptQuality(accept, enc.contentType); q > bestQ {
+            best, bestQ = enc, q
+        }
+    }
+    return best
+}
+
+// acceptQuality returns the q value the Accept header gives contentType,
+// taken from the most specific media range that matches it.
+func acceptQuality(accept []string, contentType string) float64 {
+    typ, sub, _ := strings.Cut(contentType, "/")
+    q, specificity := 0.0, -1
+    for _, header := range accept {
+        for _, part := range strings.Split(header, ",") {
+            mediaType, params, err := mime.ParseMediaType(part)
+            if err != nil {
+                continue
+            }
+            rangeTyp, rangeSub, _ := strings.Cut(mediaType, "/")
+            s := 0
+            switch {
+            case rangeTyp == typ && rangeSub == sub:
+                s = 2
+            case rangeTyp == typ && rangeSub == "*":
+                s = 1
+            case rangeTyp != "*" || rangeSub != "*":
+                continue
+            }
+            if s <= specificity {
+                continue
+            }
+            specificity, q = s, 1
+            if v, ok := params["q"]; ok {
+                if f, err := strconv.ParseFloat(v, 64); err == nil {
+                    q = f
+                }
+            }
+        }
+    }
+    return q
+}
+
+func encodeJSON(w io.Writer, v any) error {
+    return json.NewEncoder(w).Encode(v)
+}
+
+func encodeXML(w io.Writer, v any) error {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.UseNumber()
+    bw := bufio.NewWriter(w)
+    bw.WriteString(xml.Header)
+    if err := xmlElement(bw, dec, xmlRootName(reflect.TypeOf(v))); err != nil {
+        return err
+    }
+    bw.WriteString("\n")
+    return bw.Flush()
+}
+
+// xmlElement writes the next JSON value from dec as element name.
+func xmlElement(w *bufio.Writer, dec *json.Decoder, name string) error {
+    tok, err := dec.Token()
+    if err != nil || tok == nil {
+        return err
+    }
+    open, close := "<"+name+">", "</"+name+">"
+    if !isXMLName(name) {
+        var b strings.Builder
+        b.WriteString(`<entry key="`)
+        xml.EscapeText(&b, []byte(name))
+        b.WriteString(`">`)
+        open, close = b.String(), "</entry>"
+    }
+    w.WriteString(open)
+    switch t := tok.(type) {
+    case json.Delim:
+        for dec.More() {
+            child := "item"
+            if t == '{' {
+                key, err := dec.Token()
+                if err != nil {
+                    return err
+                }
+                child = key.(string)
+            }
+            if err := xmlElement(w, dec, child); err != nil {
+                return err
+            }
+        }
+        if _, err := dec.Token(); err != nil { // the closing delimiter
+            return err
+        }
+    case string:
+        xml.EscapeText(w, []byte(t))
+    default: // json.Number or bool
+        fmt.Fprint(w, t)
+    }
+    w.WriteString(close)
+    return nil
+}
+
+// isXMLName accepts ASCII names that are safe as element names.
+func isXMLName(name string) bool {
+    if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+        return false
+    }
+    for i, c := range name {
+        switch {
+        case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+        case i > 0 && (c >= '0' && c <= '9' || c == '-' || c == '.'):
+        default:
+            return false
+        }
+    }
+    return true
+}
+
+// xmlRootName turns a Go type name into snake case: UserStats is
+// user_stats and APIError is api_error.
+func xmlRootName(t reflect.Type) string {
+    for t != nil && t.Kind() == reflect.Pointer {
+        t = t.Elem()
+    }
+    if t == nil || t.Name() == "" {
+        return "response"
+    }
+    name := []rune(t.Name())
+    var b strings.Builder
+    for i, c := range name {
+        upper := unicode.IsUpper(c)
+        if upper && i > 0 && (unicode.IsLower(name[i-1]) || i+1 < len(name) && unicode.IsLower(name[i+1])) {
+            b.WriteByte('_')
+        }
+        b.WriteRune(unicode.ToLower(c))
+    }
+    return b.String()
+}
+
+func encodeProtobuf(w io.Writer, v any) error {
+    rv := reflect.Indirect(reflect.ValueOf(v))
+    if rv.Kind() != reflect.Struct {
+        return fmt.Errorf("protobuf: %T is not a message", v)
+    }
+    b, err := protoMessage(nil, rv)
+    if err != nil {
+        return err
+    }
+    _, err = w.Write(b)
+    return err
+}
+
+// Protobuf wire types.
+const (
+    protoVarint  = 0
+    protoFixed64 = 1
+    protoBytes   = 2
+    protoFixed32 = 5
+)
+
+func protoMessage(b []byte, v reflect.Value) ([]byte, error) {
+    if v.Type() == reflect.TypeFor[time.Time]() {
+        t := v.Interface().(time.Time)
+        b = protoTag(b, 1, protoVarint)
+        b = binary.AppendUvarint(b, uint64(t.Unix()))
+        if n := t.Nanosecond(); n != 0 {
+            b = protoTag(b, 2, protoVarint)
+            b = binary.AppendUvarint(b, uint64(n))
+        }
+        return b, nil
+    }
+    t := v.Type()
+    for i := range t.NumField() {
+        f := t.Field(i)
+        if !f.IsExported() || f.Tag.Get("json") == "-" {
+            continue
+        }
+        var err error
+        if b, err = protoField(b, i+1, v.Field(i)); err != nil {
+            return nil, fmt.Errorf("protobuf: %s.%s: %w", t.Name(), f.Name, err)
+        }
+    }
+    return b, nil
+}
+
+// protoField encodes struct field number num, leaving out proto3 default
+// values, nil pointers and empty collections.
+func protoField(b []byte, num int, v reflect.Value) ([]byte, error) {
+    switch v.Kind() {
+    case reflect.Pointer:
+        if v.IsNil() {
+            return b, nil
+        }
+        return protoValue(b, num, v.Elem())
+    case reflect.Slice:
+        if v.Len() == 0 {
+            return b, nil
+        }
+        if v.Type().Elem().Kind() == reflect.Uint8 {
+            return protoValue(b, num, v)
+        }
+        if _, scalar := protoScalarWire(v.Type().Elem().Kind()); scalar {
+            var packed []byte
+            for i := range v.Len() {
+                packed = protoScalar(packed, v.Index(i))
+            }
+            b = protoTag(b, num, protoBytes)
+            b = binary.AppendUvarint(b, uint64(len(packed)))
+            return append(b, packed...), nil
+        }
+        for i := range v.Len() {
+            var err error
+            if b, err = protoValue(b, num, v.Index(i)); err != nil {
+                return nil, err
+            }
+        }
+        return b, nil
+    case reflect.Map:
+        keys := v.MapKeys()
+        slices.SortFunc(keys, func(x, y reflect.Value) int { return strings.Compare(fmt.Sprint(x), fmt.Sprint(y)) })
+        for _, k := range keys {
+            entry, err := protoValue(nil, 1, k)
+            if err != nil {
+                return nil, err
+            }
+            if entry, err = protoValue(entry, 2, v.MapIndex(k)); err != nil {
+                return nil, err
+            }
+            b = protoTag(b, num, protoBytes)
+            b = binary.AppendUvarint(b, uint64(len(entry)))
+            b = append(b, entry...)
+        }
+        return b, nil
+    case reflect.Struct:
+        return protoValue(b, num, v)
+    }
+    if v.IsZero() {
+        return b, nil
+    }
+    return protoValue(b, num, v)
+}
+
+// protoValue encodes v as field num even if it is a default value.
+func protoValue(b []byte, num int, v reflect.Value) ([]byte, error) {
+    if wire, ok := protoScalarWire(v.Kind()); ok {
+        return protoScalar(protoTag(b, num, wire), v), nil
+    }
+    var data []byte
+    switch v.Kind() {
+    case reflect.Pointer:
+        if v.IsNil() {
+            return b, nil
+        }
+        return protoValue(b, num, v.Elem())
+    case reflect.String:
+        data = []byte(v.String())
+    case reflect.Slice:
+        if v.Type().Elem().Kind() != reflect.Uint8 {
+            return nil, fmt.Errorf("nested repeated field %s", v.Type())
+        }
+        data = v.Bytes()
+    case reflect.Struct:
+        var err error
+        if data, err = protoMessage(nil, v); err != nil {
+            return nil, err
+        }
+    default:
+        return nil, fmt.Errorf("unsupported type %s", v.Type())
+    }
+    b = protoTag(b, num, protoBytes)
+    b = binary.AppendUvarint(b, uint64(len(data)))
+    return append(b, data...), nil
+}
+
+func protoTag(b []byte, num, wire int) []byte {
+    return binary.AppendUvarint(b, uint64(num)<<3|uint64(wire))
+}
+
+func protoScalarWire(k reflect.Kind) (int, bool) {
+    switch k {
+    case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return protoVarint, true
+    case reflect.Float64:
+        return protoFixed64, true
+    case reflect.Float32:
+        return protoFixed32, true
+    }
+    return 0, false
+}
+
+// protoScalar appends v without a tag. Signed integers are int64 on the
+// wire, so negative values take ten bytes, as protobuf specifies.
+func protoScalar(b []byte, v reflect.Value) []byte {
+    switch v.Kind() {
+    case reflect.Bool:
+        if v.Bool() {
+            return append(b, 1)
+        }
+        return append(b, 0)
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return binary.AppendUvarint(b, uint64(v.Int()))
+    case reflect.Float64:
+        return binary.LittleEndian.AppendUint64(b, math.Float64bits(v.Float()))
+    case reflect.Float32:
+        return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(v.Float())))
+    }
+    return binary.AppendUvarint(b, v.Uint())
+}
+
+// ProtoSchema writes the proto3 messages encodeProtobuf produces for
+// types and the structs they contain.
+func ProtoSchema(types ...reflect.Type) string {
+    var b strings.Builder
+    b.WriteString("syntax = \"proto3\";\n\npackage zaai.v1;\n\nimport \"google/protobuf/timestamp.proto\";\n")
+    seen := map[reflect.Type]bool{}
+    queue := slices.Clone(types)
+    for len(queue) > 0 {
+        t := queue[0]
+        queue = queue[1:]
+        for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8 {
+            t = t.Elem()
+        }
+        if t.Kind() != reflect.Struct || t == reflect.TypeFor[time.Time]() || seen[t] {
+            continue
+        }
+        seen[t] = true
+        fmt.Fprintf(&b, "\nmessage %s {\n", t.Name())
+        for i := range t.NumField() {
+            f := t.Field(i)
+            if !f.IsExported() {
+                continue
+            }
+            name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+            if name == "-" {
+                fmt.Fprintf(&b, "    reserved %d;\n", i+1)
+                continue
+            }
+            if name == "" {
+                name = strings.ToLower(f.Name)
+            }
+            fmt.Fprintf(&b, "    %s %s = %d;\n", protoFieldType(f.Type), name, i+1)
+            queue = append(queue, f.Type)
+            if f.Type.Kind() == reflect.Map {
+                queue = append(queue, f.Type.Elem())
+            }
+        }
+        b.WriteString("}\n")
+    }
+    return b.String()
+}
+
+func protoFieldType(t reflect.Type) string {
+    switch t.Kind() {
+    case reflect.Pointer:
+        if t.Elem().Kind() == reflect.Struct {
+            return protoFieldType(t.Elem())
+        }
+        return "optional " + protoFieldType(t.Elem())
+    case reflect.Slice:
+        if t.Elem().Kind() == reflect.Uint8 {
+            return "bytes"
+        }
+        return "repeated " + protoFieldType(t.Elem())
+    case reflect.Map:
+        return fmt.Sprintf("map<%s, %s>", protoFieldType(t.Key()), protoFieldType(t.Elem()))
+    case reflect.Struct:
+        if t == reflect.TypeFor[time.Time]() {
+            return "google.protobuf.Timestamp"
+        }
+        return t.Name()
+    case reflect.Bool:
+        return "bool"
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return "int64"
+    case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return "uint64"
+    case reflect.Float32:
+        return "float"
+    case reflect.Float64:
+        return "double"
+    }
+    return "string"
+}
+
+// Server runs a handler with timeouts suited to a JSON API. Run manages
+// the whole lifecycle; ListenAndServe and Shutdown are the pieces it is
+// built from.
+type Server struct {
+    // ShutdownTimeout bounds how long Run waits for in-flight requests;
+    // zero means DefaultShutdownTimeout.
+    ShutdownTimeout time.Duration
+    // TLS, if set, serves HTTPS; see NewTLSConfig.
+    TLS *tls.Config
+
+    srv    *http.Server
+    logger Logger
+    mu     sync.Mutex
+    before []func()
+    after  []func() error
+}
+
+const DefaultShutdownTimeout = 15 * time.Second
+
+// LogFlusher is implemented by loggers that buffer output; Run flushes
+// them last.
+type LogFlusher interface {
+    Flush() error
+}
+
+func NewServer(addr string, handler http.Handler, logger Logger) *Server {
+    return &Server{
+        srv: &http.Server{
+            Addr:              addr,
+            Handler:           handler,
+            ReadHeaderTimeout: 5 * time.Second,
+            ReadTimeout:       30 * time.Second,
+            WriteTimeout:      30 * time.Second,
+            IdleTimeout:       2 * time.Minute,
+        },
+        logger: logger,
+    }
+}
+
+// ListenAndServe serves until Shutdown, and then returns nil.
+func (s *Server) ListenAndServe() error {
+    var err error
+    if s.TLS != nil {
+        s.logger.Info("HTTPS server listening", "addr", s.srv.Addr)
+        s.srv.TLSConfig = s.TLS
+        err = s.srv.ListenAndServeTLS("", "")
+    } else {
+        s.logger.Info("HTTP server listening", "addr", s.srv.Addr)
+        err = s.srv.ListenAndServe()
+    }
+    if !errors.Is(err, http.ErrServerClosed) {
+        return err
+    }
+    return nil
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests
+// until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+    s.logger.Info("HTTP server shutting down")
+    return s.srv.Shutdown(ctx)
+}
+
+// BeforeShutdown registers fn to run as shutdown begins, before requests
+// drain: failing readiness, or ending streams that would never drain.
+func (s *Server) BeforeShutdown(fn func()) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.before = append(s.before, fn)
+}
+
+// AfterShutdown registers a cleanup, such as closing the repository, to
+// run once requests have drained. Cleanups run in reverse order of
+// registration, like defers.
+func (s *Server) AfterShutdown(fn func() error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.after = append(s.after, fn)
+}
+
+// Run serves until ctx is done or the process gets SIGINT or SIGTERM. It
+// then stops accepting connections, gives in-flight requests
+// ShutdownTimeout to finish before cutting them off, runs the cleanups,
+// and flushes the logger. A second signal kills the process outright.
+func (s *Server) Run(ctx context.Context) error {
+    ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    errc := make(chan error, 1)
+    go func() { errc <- s.ListenAndServe() }()
+    select {
+    case err := <-errc:
+        // Never started, e.g. the port is taken; still clean up.
+        return errors.Join(err, s.cleanup())
+    case <-ctx.Done():
+    }
+    stop()
+
+    s.mu.Lock()
+    before := slices.Clone(s.before)
+    s.mu.Unlock()
+    for _, fn := range before {
+        fn()
+    }
+
+    timeout := s.ShutdownTimeout
+    if timeout <= 0 {
+        timeout = DefaultShutdownTimeout
+    }
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    err := s.Shutdown(shutdownCtx)
+    if errors.Is(err, context.DeadlineExceeded) {
+        s.logger.Warn("Requests still running; closing their connections", "timeout", timeout)
+        err = s.srv.Close()
+    }
+    if serveErr := <-errc; serveErr != nil {
+        err = errors.Join(err, serveErr)
+    }
+    return errors.Join(err, s.cleanup())
+}
+
+func (s *Server) cleanup() error {
+    s.mu.Lock()
+    after := slices.Clone(s.after)
+    s.mu.Unlock()
+    var errs []error
+    for i := len(after) - 1; i >= 0; i-- {
+        errs = append(errs, after[i]())
+    }
+    s.logger.Info("HTTP server stopped")
+    if f, ok := s.logger.(LogFlusher); ok {
+        errs = append(errs, f.Flush())
+    }
+    return errors.Join(errs...)
+}
+
+// TLS
+//
+// NewTLSConfig serves a certificate and key from PEM files and, when
+// ClientCAFile is set, requires clients to present a certificate signed by
+// one of its CAs (mutual TLS). The files are checked for changes at most
+// every tlsReloadCheck as clients connect, so rotated certificates take
+// effect without a restart. A rotation that fails to load, such as a new
+// certificate whose key hasn't been written yet, is logged and retried,
+// and the previous files stay in use meanwhile. serve fills a TLSConfig
+// from its -tls-* flags, which a -settings file can also set.
+
+const tlsReloadCheck = 10 * time.Second
+
+type TLSConfig struct {
+    CertFile, KeyFile string
+    // ClientCAFile is a PEM bundle of CAs trusted to sign client
+    // certificates. Empty means no client verification.
+    ClientCAFile string
+    // OptionalClientCert accepts clients without a certificate, while
+    // still rejecting any that present an untrusted one.
+    OptionalClientCert bool
+}
+
+func NewTLSConfig(cfg TLSConfig, logger Logger) (*tls.Config, error) {
+    if cfg.CertFile == "" || cfg.KeyFile == "" {
+        return nil, errors.New("tls: both a certificate and a key file are needed")
+    }
+    r := &tlsReloader{cfg: cfg, logger: logger}
+    stamp, err := r.fingerprint()
+    if err != nil {
+        return nil, err
+    }
+    if r.current, err = r.load(); err != nil {
+        return nil, err
+    }
+    r.stamp, r.checked = stamp, time.Now()
+    return &tls.Config{MinVersion: tls.VersionTLS12, GetConfigForClient: r.config}, nil
+}
+
+type tlsReloader struct {
+    cfg    TLSConfig
+    logger Logger
+
+    mu      sync.Mutex
+    current *tls.Config
+    stamp   string // sizes and modification times of the files in current
+    checked time.Time
+}
+
+func (r *tlsReloader) config(*tls.ClientHelloInfo) (*tls.Config, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if time.Since(r.checked) < tlsReloadCheck {
+        return r.current, nil
+    }
+    r.checked = time.Now()
+    stamp, err := r.fingerprint()
+    if err == nil && stamp == r.stamp {
+        return r.current, nil
+    }
+    var next *tls.Config
+    if err == nil {
+        next, err = r.load()
+    }
+    if err != nil {
+        r.logger.Warn("TLS reload failed; keeping the current certificate", "error", err)
+        return r.current, nil
+    }
+    r.current, r.stamp = next, stamp
+    r.logger.Info("TLS certificate reloaded", "path", r.cfg.CertFile)
+    return r.current, nil
+}
+
+func (r *tlsReloader) fingerprint() (string, error) {
+    var b strings.Builder
+    for _, name := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.ClientCAFile} {
+        if name == "" {
+            continue
+        }
+        fi, err := os.Stat(name)
+        if err != nil {
+            return "", fmt.Errorf("tls: %w", err)
+        }
+        fmt.Fprintf(&b, "%d/%d;", fi.Size(), fi.ModTime().UnixNano())
+    }
+    return b.String(), nil
+}
+
+func (r *tlsReloader) load() (*tls.Config, error) {
+    cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+    if err != nil {
+        return nil, fmt.Errorf("tls: %w", err)
+    }
+    cfg := &tls.Config{
+        MinVersion:   tls.VersionTLS12,
+        Certificates: []tls.Certificate{cert},
+        NextProtos:   []string{"h2", "http/1.1"},
+    }
+    if r.cfg.ClientCAFile != "" {
+        data, err := os.ReadFile(r.cfg.ClientCAFile)
+        if err != nil {
+            return nil, fmt.Errorf("tls: %w", err)
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(data) {
+            return nil, fmt.Errorf("tls: no certificates in %s", r.cfg.ClientCAFile)
+        }
+        cfg.ClientCAs = pool
+        cfg.ClientAuth = tls.RequireAndVerifyClientCert
+        if r.cfg.OptionalClientCert {
+            cfg.ClientAuth = tls.VerifyClientCertIfGiven
+        }
+    }
+    return cfg, nil
+}
+
+// ClientCertificate returns the verified certificate a mutual TLS client
+// connected with.
+func ClientCertificate(r *http.Request) (*x509.Certificate, bool) {
+    if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+        return nil, false
+    }
+    return r.TLS.VerifiedChains[0][0], true
+}
+
+// HTTP middleware
+//
+// Middleware wraps a handler with cross-cutting behaviour. Wrappers of the
+// ResponseWriter implement Unwrap, so http.ResponseController can still
+// reach Flush and Hijack through them. A typical stack:
+//
+//     Chain(Recover(logger), RequestID(), RequestLogging(logger), Gzip(),
+//         Authenticate(tokens, keys), RateLimit(600, time.Minute))(api)
+
+type Middleware func(http.Handler) http.Handler
+
+// except applies mw to every request but those for the given paths.
+func except(mw Middleware, paths ...string) Middleware {
+    return func(next http.Handler) http.Handler {
+        wrapped := mw(next)
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if slices.Contains(paths, r.URL.Path) {
+                next.ServeHTTP(w, r)
+                return
+            }
+            wrapped.ServeHTTP(w, r)
+        })
+    }
+}
+
+// FeatureGate answers requests for the given paths with 404, as if the
+// route didn't exist, while the named feature is off.
+func FeatureGate(flags *FeatureFlags, name string, paths ...string) Middleware {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if slices.Contains(paths, r.URL.Path) && !flags.Enabled(name) {
+                writeJSON(w, http.StatusNotFound, APIError{Error: fmt.Sprintf("%s is switched off", name)})
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// Chain composes middleware so the first listed sees the request first:
+// Chain(a, b)(h) is a(b(h)).
+func Chain(mws ...Middleware) Middleware {
+    return func(h http.Handler) http.Handler {
+        for i := len(mws) - 1; i >= 0; i-- {
+            h = mws[i](h)
+        }
+        return h
+    }
+}
+
+// statusWriter records the status and size of a response.
+type statusWriter struct {
+    http.ResponseWriter
+    status int
+    bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+    if w.status == 0 {
+        w.status = status
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+    if w.status == 0 {
+        w.status = http.StatusOK
+    }
+    n, err := w.ResponseWriter.Write(b)
+    w.bytes += int64(n)
+    return n, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// RequestLogging logs one line per request once it completes, and makes
+// logger the request's LoggerFromContext.
+func RequestLogging(logger Logger) Middleware {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            start := time.Now()
+            r = r.WithContext(WithLogger(r.Context(), logger))
+            sw := &statusWriter{ResponseWriter: w}
+            next.ServeHTTP(sw, r)
+            if sw.status == 0 {
+                sw.status = http.StatusOK // nothing written, or hijacked
+            }
+            loggerFor(r.Context(), logger).Info("HTTP request",
+                "method", r.Method, "uri", r.URL.RequestURI(), "status", sw.status,
+                "bytes", sw.bytes, "duration", time.Since(start).Round(time.Microsecond))
+        })
+    }
+}
+
+// Recover turns a panicking handler into a 500 response and logs the
+// stack. http.ErrAbortHandler is re-raised, as net/http expects.
+func Recover(logger Logger) Middleware {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            sw := &statusWriter{ResponseWriter: w}
+            defer func() {
+                p := recover()
+                if p == nil {
+                    return
+                }
+                if p == http.ErrAbortHandler {
+                    panic(p)
+                }
+                loggerFor(r.Context(), logger).Error("Panic serving HTTP request",
+                    "method", r.Method, "path", r.URL.Path, "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+                if sw.status == 0 {
+                    writeJSON(sw, http.StatusInternalServerError, APIError{Error: http.StatusText(http.StatusInternalServerError)})
+                }
+            }()
+            next.ServeHTTP(sw, r)
+        })
+    }
+}
+
+// RequestID tags each request with the client's X-Request-ID (or
+// X-Correlation-ID), or a new random one, and echoes it in the response.
+// The ID then appears in log lines from loggers that implement
+// ContextLogger (see LoggerFromContext), in audit entries and events, and on outbound webhook,
+// notification and S3 calls. Put it first in the chain so every other
+// middleware sees it.
+func RequestID() Middleware {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            id := r.Header.Get("X-Request-ID")
+            if id == "" {
+                id = r.Header.Get("X-Correlation-ID")
+            }
+            if !validRequestID(id) {
+                id = newRequestID()
+            }
+            w.Header().Set("X-Request-ID", id)
+            next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+        })
+    }
+}
+
+// WithRequestID returns a copy of ctx carrying request ID id, for work
+// that doesn't come in over HTTP, such as CLI commands and jobs.
+func WithRequestID(ctx context.Context, id string) context.Context {
+    return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestIDFrom returns the ID set by the RequestID middleware or
+// WithRequestID.
+func RequestIDFrom(ctx context.Context) (string, bool) {
+    id, ok := ctx.Value(requestIDKey).(string)
+    return id, ok && id != ""
+}
+
+func newRequestID() string {
+    b := make([]byte, 12)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+// validRequestID accepts short IDs of visible ASCII, which can't forge
+// log lines or header values.
+func validRequestID(id string) bool {
+    if id == "" || len(id) > 128 {
+        return false
+    }
+    for i := 0; i < len(id); i++ {
+        if id[i] <= ' ' || id[i] > '~' {
+            return false
+        }
+    }
+    return true
+}
+
+// propagateContext copies the request ID and trace context in ctx onto
+// an outbound
+// request, so the receiver can correlate it with ours.
+func propagateContext(ctx context.Context, req *http.Request) {
+    if id, ok := RequestIDFrom(ctx); ok {
+        req.Header.Set("X-Request-ID", id)
+    }
+    if sc, ok := spanContextFrom(ctx); ok {
+        req.Header.Set("Traceparent", sc.traceparent())
+    }
+}
+
+// Authenticate accepts either credential the deployment supports: an
+// X-API-Key when keys is set, otherwise a bearer token when tokens is
+// set. See the two services' Middleware for what reaches next.
+func Authenticate(tokens *TokenService, keys *APIKeyService) Middleware {
+    return func(next http.Handler) http.Handler {
+        var bearer, apiKey http.Handler
+        if tokens != nil {
+            bearer = tokens.Middleware(next)
+        }
+        if keys != nil {
+            apiKey = keys.Middleware(next)
+        }
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            switch {
+            case apiKey != nil && (r.Header.Get("X-API-Key") != "" || bearer == nil):
+                apiKey.ServeHTTP(w, r)
+            case bearer != nil:
+                bearer.ServeHTTP(w, r)
+            default:
+                http.Error(w, "authentication is not configured", http.StatusUnauthorized)
+            }
+        })
+    }
+}
+
+// RateLimit gives each client a token bucket holding max requests that
+// refills completely over per, so clients can burst up to max and then
+// sustain max per per. Requests without a token get 429 with Retry-After;
+// every response reports X-RateLimit-Limit and X-RateLimit-Remaining.
+// Clients are told apart by API key, then authenticated user, then remote
+// IP, so place it after Authenticate to limit per key. Buckets live in
+// memory unless WithRateLimitStore shares them between instances.
+func RateLimit(max int, per time.Duration, opts ...RateLimitOption) Middleware {
+    cfg := rateLimitConfig{key: clientKey}
+    for _, opt := range opts {
+        opt(&cfg)
+    }
+    if cfg.store == nil {
+        cfg.store = NewMemoryRateLimitStore()
+    }
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            max := max
+            if cfg.max != nil {
+                if max = int(cfg.max.Load()); max <= 0 {
+                    next.ServeHTTP(w, r)
+                    return
+                }
+            }
+            d := cfg.store.Take(r.Context(), cfg.key(r), max, per)
+            w.Header().Set("X-RateLimit-Limit", strconv.Itoa(max))
+            w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(d.Remaining))
+            if !d.Allowed {
+                // Retry-After is in whole seconds; round up so a client
+                // that honours it finds a token waiting.
+                w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.RetryAfter.Seconds()))))
+                writeJSON(w, http.StatusTooManyRequests, APIError{Error: ErrRateLimited.Error()})
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+type rateLimitConfig struct {
+    store RateLimitStore
+    key   func(*http.Request) string
+    max   *atomic.Int64
+}
+
+type RateLimitOption func(*rateLimitConfig)
+
+// WithRateLimitStore keeps buckets in store, such as a
+// RedisRateLimitStore shared by every instance behind a load balancer.
+func WithRateLimitStore(store RateLimitStore) RateLimitOption {
+    return func(c *rateLimitConfig) { c.store = store }
+}
+
+// WithRateLimitVar reads the limit from max on every request instead,
+// so that it can change while serving (see ConfigWatcher). While it is
+// zero or less, requests aren't limited.
+func WithRateLimitVar(max *atomic.Int64) RateLimitOption {
+    return func(c *rateLimitConfig) { c.max = max }
+}
+
+// WithRateLimitKey replaces clientKey, for example to limit by tenant.
+func WithRateLimitKey(key func(*http.Request) string) RateLimitOption {
+    return func(c *rateLimitConfig) { c.key = key }
+}
+
+// RateLimitStore keeps token buckets. Take spends a token from key's
+// bucket, which holds max tokens and refills completely over per. Stores
+// that can fail, like Redis, fail open: an outage mustn't take the API
+// down with it.
+type RateLimitStore interface {
+    Take(ctx context.Context, key string, max int, per time.Duration) RateDecision
+}
+
+// MemoryRateLimitStore keeps buckets for a single instance in a Limiter.
+type MemoryRateLimitStore struct {
+    limiter *Limiter
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+    return &MemoryRateLimitStore{limiter: NewLimiter(Limit{}, 0)}
+}
+
+func (m *MemoryRateLimitStore) Take(ctx context.Context, key string, max int, per time.Duration) RateDecision {
+    return m.limiter.TakeLimit(key, Limit{Burst: max, Per: per})
+}
+
+// RedisRateLimitStore shares buckets through Redis, so a client's limit
+// holds across instances. Each Take is one atomic script run on the Redis
+// clock, which keeps instances with skewed clocks from disagreeing.
+// Buckets expire once they would be full again.
+//
+// Takes run on a small pool of connections, each bounded by a short
+// timeout. A circuit breaker guards the server: once it stops answering,
+// Takes fail open at once rather than each waiting out the timeout, and
+// a single probe per cooldown checks whether it is back.
+type RedisRateLimitStore struct {
+    addr, password string
+    prefix         string
+    timeout        time.Duration
+    logger         Logger
+    breaker        *CircuitBreaker
+
+    slots chan struct{}   // one per connection in use or idle
+    idle  chan *redisConn
+}
+
+const (
+    DefaultRedisPoolSize = 8
+    DefaultRedisTimeout  = 250 * time.Millisecond
+)
+
+type RedisOption func(*RedisRateLimitStore)
+
+// WithRedisPoolSize caps the connections open at once; Takes beyond it
+// wait for one to free up, within the timeout.
+func WithRedisPoolSize(n int) RedisOption {
+    return func(s *RedisRateLimitStore) {
+        if n > 0 {
+            s.slots, s.idle = make(chan struct{}, n), make(chan *redisConn, n)
+        }
+    }
+}
+
+// WithRedisTimeout bounds each Take, including dialing and waiting for a
+// connection.
+func WithRedisTimeout(d time.Duration) RedisOption {
+    return func(s *RedisRateLimitStore) { s.timeout = d }
+}
+
+// WithRedisBreaker replaces the default breaker, which opens after 3
+// failures in a row and probes every 5 seconds. A nil IsFailure counts
+// every error except Redis's own error replies, which mean the server is
+// up.
+func WithRedisBreaker(cfg BreakerConfig) RedisOption {
+    return func(s *RedisRateLimitStore) {
+        if cfg.IsFailure == nil {
+            cfg.IsFailure = isRedisFailure
+        }
+        s.breaker = NewCircuitBreaker(cfg)
+    }
+}
+
+func isRedisFailure(err error) bool {
+    var redisErr redisError
+    return err != nil && !errors.As(err, &redisErr) && !errors.Is(err, context.Canceled)
+}
+
+// NewRedisRateLimitStore talks to the Redis server at addr (host:port),
+// authenticating with password if it isn't empty. Connections are made on
+// first use and remade after errors.
+func NewRedisRateLimitStore(addr, password string, logger Logger, opts ...RedisOption) *RedisRateLimitStore {
+    s := &RedisRateLimitStore{addr: addr, password: password, prefix: "zaai:ratelimit:", timeout: DefaultRedisTimeout, logger: logger}
+    WithRedisPoolSize(DefaultRedisPoolSize)(s)
+    WithRedisBreaker(BreakerConfig{Threshold: 3, Cooldown: 5 * time.Second})(s)
+    for _, opt := range opts {
+        opt(s)
+    }
+    s.breaker.OnStateChange(func(from, to BreakerState) {
+        switch to {
+        case BreakerOpen:
+            logger.Warn("Rate limit store unreachable; allowing requests unchecked", "addr", addr)
+        case BreakerClosed:
+            logger.Info("Rate limit store reachable again", "addr", addr)
+        }
+    })
+    return s
+}
+
+// tokenBucketScript is Take in Lua. KEYS[1] is the bucket; ARGV holds max
+// and the refill period in microseconds. It returns allowed (0 or 1),
+// whole tokens remaining, and microseconds until the next token.
+const tokenBucketScript = `
+local max = tonumber(ARGV[1])
+local per = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1]) or max
+local ts = tonumber(b[2]) or now
+tokens = math.min(max, tokens + (now - ts) * max / per)
+local allowed, wait = 0, 0
+if tokens >= 1 then
+    tokens = tokens - 1
+    allowed = 1
+else
+    wait = math.ceil((1 - tokens) * per / max)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((max - tokens) * per / max / 1000) + 1)
+return {allowed, math.floor(tokens), wait}
+`
+
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, max int, per time.Duration) RateDecision {
+    reply, err := Protect(ctx, s.breaker, func(ctx context.Context) (any, error) {
+        return s.do(ctx, "EVAL", tokenBucketScript, "1", s.prefix+key, strconv.Itoa(max), strconv.FormatInt(per.Microseconds(), 10))
+    })
+    if err == nil {
+        if vals, ok := reply.([]any); ok && len(vals) == 3 {
+            allowed, _ := vals[0].(int64)
+            remaining, _ := vals[1].(int64)
+            wait, _ := vals[2].(int64)
+            return RateDecision{Allowed: allowed == 1, Remaining: int(remaining), RetryAfter: time.Duration(wait) * time.Microsecond}
+        }
+        err = fmt.Errorf("unexpected reply %v", reply)
+    }
+    // While the breaker is open, the state change has been logged once.
+    if !errors.Is(err, ErrCircuitOpen) {
+        loggerFor(ctx, s.logger).Warn("Rate limit store unavailable, allowing request", "error", err)
+    }
+    return RateDecision{Allowed: true, Remaining: max}
+}
+
+// do runs one command on a pooled connection, waiting for one to free up
+// if all are in use. The timeout covers the wait, any dial and the
+// command.
+func (s *RedisRateLimitStore) do(ctx context.Context, args ...string) (any, error) {
+    ctx, cancel := context.WithTimeout(ctx, s.timeout)
+    defer cancel()
+    select {
+    case s.slots <- struct{}{}:
+    case <-ctx.Done():
+        return nil, fmt.Errorf("waiting for a redis connection: %w", context.Cause(ctx))
+    }
+    defer func() { <-s.slots }()
+    var conn *redisConn
+    select {
+    case conn = <-s.idle:
+    default:
+        var err error
+        if conn, err = dialRedis(ctx, s.addr, s.password, s.timeout); err != nil {
+            return nil, err
+        }
+    }
+    deadline, _ := ctx.Deadline()
+    reply, err := conn.do(deadline, args...)
+    var redisErr redisError
+    if err != nil && !errors.As(err, &redisErr) {
+        // The connection is in an unknown state; start afresh next time.
+        conn.Close()
+        return reply, err
+    }
+    select {
+    case s.idle <- conn:
+    default: // can't happen while connections are only made holding a slot
+        conn.Close()
+    }
+    return reply, err
+}
+
+// Close closes the idle connections; call it once serving has stopped.
+func (s *RedisRateLimitStore) Close() error {
+    var errs []error
+    for {
+        select {
+        case conn := <-s.idle:
+            errs = append(errs, conn.Close())
+        default:
+            return errors.Join(errs...)
+        }
+    }
+}
+
+// redisConn speaks just enough RESP2 to send commands and read replies.
+type redisConn struct {
+    net.Conn
+    r *bufio.Reader
+}
+
+// redisError is an error reply; the connection is still usable after one.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func dialRedis(ctx context.Context, addr, password string, timeout time.Duration) (*redisConn, error) {
+    d := net.Dialer{Timeout: timeout}
+    nc, err := d.DialContext(ctx, "tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    c := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+    if password != "" {
+        if _, err := c.do(time.Now().Add(timeout), "AUTH", password); err != nil {
+            nc.Close()
+            return nil, err
+        }
+    }
+    return c, nil
+}
+
+func (c *redisConn) do(deadline time.Time, args ...string) (any, error) {
+    c.SetDeadline(deadline)
+    var b strings.Builder
+    fmt.Fprintf(&b, "*%d\r\n", len(args))
+    for _, a := range args {
+        fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+    }
+    if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+        return nil, err
+    }
+    return c.read()
+}
+
+func (c *redisConn) read() (any, error) {
+    line, err := c.r.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    line = strings.TrimSuffix(line, "\r\n")
+    if line == "" {
+        return nil, errors.New("redis: empty reply")
+    }
+    switch body := line[1:]; line[0] {
+    case '+':
+        return body, nil
+    case '-':
+        return nil, redisError(body)
+    case ':':
+        return strconv.ParseInt(body, 10, 64)
+    case '$':
+        n, err := strconv.Atoi(body)
+        if err != nil || n < 0 {
+            return nil, err
+        }
+        buf := make([]byte, n+2)
+        if _, err := io.ReadFull(c.r, buf); err != nil {
+            return nil, err
+        }
+        return string(buf[:n]), nil
+    case '*':
+        n, err := strconv.Atoi(body)
+        if err != nil || n < 0 {
+            return nil, err
+        }
+        vals := make([]any, n)
+        for i := range vals {
+            if vals[i], err = c.read(); err != nil {
+                var redisErr redisError
+                if !errors.As(err, &redisErr) {
+                    return nil, err
+                }
+                vals[i] = err
+            }
+        }
+        return vals, nil
+    }
+    return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// clientKey identifies the caller for per-client limits.
+func clientKey(r *http.Request) string {
+    if key, ok := APIKeyFrom(r.Context()); ok {
+        return fmt.Sprintf("key:%d", key.ID)
+    }
+    if user, ok := CurrentUser(r.Context()); ok {
+        return fmt.Sprintf("user:%d", user.ID)
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    return "ip:" + host
+}
+
+// CORSConfig says which browser origins may call the API. Zero fields
+// take the defaults below, which cover every route UserAPI serves.
+type CORSConfig struct {
+    // AllowedOrigins are exact origins such as "https://app.example.com",
+    // patterns such as "https://*.example.com" for any subdomain, or "*"
+    // for any origin.
+    AllowedOrigins []string
+    AllowedMethods []string
+    AllowedHeaders []string
+    // ExposedHeaders are the response headers scripts may read.
+    ExposedHeaders []string
+    // AllowCredentials lets requests carry cookies and Authorization. It
+    // can't be combined with a "*" origin, which would let any site make
+    // credentialed reads; list the origins instead.
+    AllowCredentials bool
+    // MaxAge is how long browsers may cache a preflight answer; zero
+    // leaves it to the browser.
+    MaxAge time.Duration
+}
+
+var (
+    defaultCORSMethods = []string{"GET", "POST", "PUT", "DELETE"}
+    defaultCORSHeaders = []string{"Accept", "Authorization", "Content-Type", "Idempotency-Key", "X-API-Key", "X-Request-ID"}
+    defaultCORSExposed = []string{"Location", "Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-Request-ID"}
+)
+
+// Validate rejects a "*" origin with AllowCredentials.
+func (cfg CORSConfig) Validate() error {
+    if cfg.AllowCredentials && slices.Contains(cfg.AllowedOrigins, "*") {
+        return errors.New(`CORS: credentials can't be allowed for origin "*"; list the origins`)
+    }
+    return nil
+}
+
+// CORS answers preflight requests itself and adds the CORS headers to
+// responses for allowed origins. Requests from other origins go through
+// untouched, so the browser withholds the response; their preflights get
+// 403. Place it before RateLimit and Authenticate, which would otherwise
+// reject preflights, as browsers send them without credentials. It panics
+// if cfg doesn't Validate.
+func CORS(cfg CORSConfig) Middleware {
+    if err := cfg.Validate(); err != nil {
+        panic(err)
+    }
+    methods, headers, exposed := cfg.AllowedMethods, cfg.AllowedHeaders, cfg.ExposedHeaders
+    if len(methods) == 0 {
+        methods = defaultCORSMethods
+    }
+    if len(headers) == 0 {
+        headers = defaultCORSHeaders
+    }
+    if len(exposed) == 0 {
+        exposed = defaultCORSExposed
+    }
+    exposedList := strings.Join(exposed, ", ")
+    // Never true with credentials, so no origin is echoed for "*".
+    anyOrigin := slices.Contains(cfg.AllowedOrigins, "*") && !cfg.AllowCredentials
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            origin := r.Header.Get("Origin")
+            w.Header().Add("Vary", "Origin")
+            if origin == "" {
+                next.ServeHTTP(w, r)
+                return
+            }
+            preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+            if !anyOrigin && !slices.ContainsFunc(cfg.AllowedOrigins, func(pattern string) bool { return originMatches(pattern, origin) }) {
+                if preflight {
+                    w.WriteHeader(http.StatusForbidden)
+                    return
+                }
+                next.ServeHTTP(w, r)
+                return
+            }
+
+            h := w.Header()
+            if anyOrigin {
+                h.Set("Access-Control-Allow-Origin", "*")
+            } else {
+                h.Set("Access-Control-Allow-Origin", origin)
+            }
+            if cfg.AllowCredentials {
+                h.Set("Access-Control-Allow-Credentials", "true")
+            }
+            if !preflight {
+                h.Set("Access-Control-Expose-Headers", exposedList)
+                next.ServeHTTP(w, r)
+                return
+            }
+
+            h.Add("Vary", "Access-Control-Request-Method")
+            h.Add("Vary", "Access-Control-Request-Headers")
+            method := r.Header.Get("Access-Control-Request-Method")
+            if !slices.Contains(methods, method) {
+                w.WriteHeader(http.StatusForbidden)
+                return
+            }
+            for _, name := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+                name = strings.TrimSpace(name)
+                if name != "" && !slices.ContainsFunc(headers, func(allowed string) bool { return strings.EqualFold(allowed, name) }) {
+                    w.WriteHeader(http.StatusForbidden)
+                    return
+                }
+            }
+            h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+            h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+            if cfg.MaxAge > 0 {
+                h.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+            }
+            w.WriteHeader(http.StatusNoContent)
+        })
+    }
+}
+
+// originMatches reports whether origin fits pattern, which may put "*."
+// in front of the host to match any subdomain (but not the bare domain).
+func originMatches(pattern, origin string) bool {
+    if strings.EqualFold(pattern, origin) {
+        return true
+    }
+    scheme, host, ok := strings.Cut(pattern, "://*.")
+    if !ok {
+        return false
+    }
+    rest, ok := strings.CutPrefix(strings.ToLower(origin), strings.ToLower(scheme)+"://")
+    return ok && strings.HasSuffix(rest, "."+strings.ToLower(host)) && !strings.ContainsAny(rest, "/@")
+}
+
+// Gzip compresses responses for clients that accept it. WebSocket
+// upgrades and responses that are already encoded pass through.
+func Gzip() Middleware {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            w.Header().Add("Vary", "Accept-Encoding")
+            if !headerHasToken(r.Header, "Accept-Encoding", "gzip") || r.Header.Get("Upgrade") != "" {
+                next.ServeHTTP(w, r)
+                return
+            }
+            gw := &gzipWriter{ResponseWriter: w}
+            defer gw.close()
+            next.ServeHTTP(gw, r)
+        })
+    }
+}
+
+// gzipWriter decides at WriteHeader whether to compress, since only then
+// are the response headers known.
+type gzipWriter struct {
+    http.ResponseWriter
+    gz          *gzip.Writer
+    wroteHeader bool
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+    if w.wroteHeader {
+        return
+    }
+    w.wroteHeader = true
+    h := w.Header()
+    if status != http.StatusNoContent && status != http.StatusNotModified && status >= 200 && h.Get("Content-Encoding") == "" {
+        h.Set("Content-Encoding", "gzip")
+        h.Del("Content-Length")
+        w.gz = gzip.NewWriter(w.ResponseWriter)
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+    if !w.wroteHeader {
+        w.WriteHeader(http.StatusOK)
+    }
+    if w.gz == nil {
+        return w.ResponseWriter.Write(b)
+    }
+    return w.gz.Write(b)
+}
+
+// FlushError pushes buffered compressed data to the client, for streams;
+// http.ResponseController.Flush calls it.
+func (w *gzipWriter) FlushError() error {
+    if w.gz != nil {
+        if err := w.gz.Flush(); err != nil {
+            return err
+        }
+    }
+    return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *gzipWriter) Flush() { w.FlushError() }
+
+func (w *gzipWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *gzipWriter) close() {
+    if w.gz != nil {
+        w.gz.Close()
+    }
+}
+
+// GraphQL
+//
+// GraphQLHandler serves a small GraphQL subset over the same service as
+// UserAPI. Object fields are named as in the JSON API, and input objects
+// take the JSON API's request shapes:
+//
+//     type Query {
+//         user(id: ID!): User
+//         users(filter: UserFilter, page: PageRequest): Page!
+//         stats: UserStats!
+//     }
+//     type Mutation {
+//         createUser(input: CreateUserRequest!): User!
+//         updateUser(id: ID!, patch: UserPatch!): User!
+//     }
+//
+// Queries, mutations, aliases, variables and __typename are supported;
+// fragments, directives and subscriptions are not. Maps such as
+// Metadata and UserStats.by_status are returned whole, as JSON scalars.
+// The user fields of one query are fetched together (see userLoader), so
+// asking for many users by ID costs one repository call.
+
+type GraphQLRequest struct {
+    Query         string         `json:"query"`
+    OperationName string         `json:"operationName,omitempty"`
+    Variables     map[string]any `json:"variables,omitempty"`
+}
+
+type GraphQLResponse struct {
+    Data   any            `json:"data,omitempty"`
+    Errors []GraphQLError `json:"errors,omitempty"`
+}
+
+type GraphQLError struct {
+    Message string `json:"message"`
+    Path    []any  `json:"path,omitempty"`
+}
+
+type GraphQLHandler struct {
+    svc    *UserService
+    logger Logger
+}
+
+func NewGraphQLHandler(svc *UserService, logger Logger) *GraphQLHandler {
+    return &GraphQLHandler{svc: svc, logger: logger}
+}
+
+// ServeHTTP accepts a GraphQLRequest as a JSON POST body, or as query
+// parameters on GET, which may only run queries.
+func (h *GraphQLHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var req GraphQLRequest
+    switch r.Method {
+    case http.MethodGet:
+        q := r.URL.Query()
+        req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+        if v := q.Get("variables"); v != "" {
+            if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+                writeJSON(w, http.StatusBadRequest, GraphQLResponse{Errors: []GraphQLError{{Message: "invalid variables: " + err.Error()}}})
+                return
+            }
+        }
+    case http.MethodPost:
+        if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&req); err != nil {
+            writeJSON(w, http.StatusBadRequest, GraphQLResponse{Errors: []GraphQLError{{Message: "invalid request body: " + err.Error()}}})
+            return
+        }
+    default:
+        w.Header().Set("Allow", "GET, POST")
+        writeJSON(w, http.StatusMethodNotAllowed, APIError{Error: "GraphQL takes GET or POST"})
+        return
+    }
+
+    op, err := parseGraphQLOperation(req.Query, req.OperationName)
+    if err == nil && op.kind == "mutation" && r.Method == http.MethodGet {
+        err = errors.New("mutations must be sent with POST")
+    }
+    if err != nil {
+        writeJSON(w, http.StatusBadRequest, GraphQLResponse{Errors: []GraphQLError{{Message: err.Error()}}})
+        return
+    }
+    writeJSON(w, http.StatusOK, h.execute(r.Context(), op, req.Variables))
+}
+
+// Execute runs a GraphQL request without HTTP.
+func (h *GraphQLHandler) Execute(ctx context.Context, req GraphQLRequest) *GraphQLResponse {
+    op, err := parseGraphQLOperation(req.Query, req.OperationName)
+    if err != nil {
+        return &GraphQLResponse{Errors: []GraphQLError{{Message: err.Error()}}}
+    }
+    return h.execute(ctx, op, req.Variables)
+}
+
+func (h *GraphQLHandler) execute(ctx context.Context, op *gqlOperation, vars map[string]any) *GraphQLResponse {
+    ex := &gqlExec{
+        ctx:   ctx,
+        svc:   h.svc,
+        vars:  map[string]any{},
+        users: &userLoader{svc: h.svc, loaded: map[UserID]*User{}},
+    }
+    for name, def := range op.vars {
+        v, ok := vars[name]
+        switch {
+        case ok:
+            ex.vars[name] = v
+        case def.hasDefault:
+            ex.vars[name] = def.value
+        case def.nonNull:
+            return &GraphQLResponse{Errors: []GraphQLError{{Message: fmt.Sprintf("variable $%s is required", name)}}}
+        }
+    }
+    data := ex.run(op)
+    for _, e := range ex.errs {
+        if e.status >= http.StatusInternalServerError {
+            loggerFor(ctx, h.logger).Error("GraphQL resolver failed", "path", e.Path, "error", e.err)
+        }
+    }
+    resp := &GraphQLResponse{Data: data}
+    for _, e := range ex.errs {
+        resp.Errors = append(resp.Errors, e.GraphQLError)
+    }
+    return resp
+}
+
+// userLoader batches user lookups within one GraphQL request: IDs queued
+// with want are fetched together by the next get, and every result,
+// including misses, is cached for the rest of the request.
+type userLoader struct {
+    svc     *UserService
+    pending []UserID
+    loaded  map[UserID]*User
+}
+
+func (l *userLoader) want(id UserID) {
+    if _, ok := l.loaded[id]; !ok && !slices.Contains(l.pending, id) {
+        l.pending = append(l.pending, id)
+    }
+}
+
+func (l *userLoader) get(ctx context.Context, id UserID) (*User, error) {
+    if _, ok := l.loaded[id]; !ok {
+        l.want(id)
+        found, err := l.svc.GetUsers(ctx, l.pending)
+        if err != nil {
+            return nil, err
+        }
+        for _, pid := range l.pending {
+            l.loaded[pid] = found[pid]
+        }
+        l.pending = nil
+    }
+    if user := l.loaded[id]; user != nil {
+        return user, nil
+    }
+    return nil, fmt.Errorf("user with ID %d %w", id, ErrNotFound)
+}
+
+type gqlExec struct {
+    ctx   context.Context
+    svc   *UserService
+    vars  map[string]any
+    users *userLoader
+    errs  []gqlFieldError
+}
+
+type gqlFieldError struct {
+    GraphQLError
+    err    error
+    status int
+}
+
+func (ex *gqlExec) fail(path []any, err error) {
+    status := httpStatus(err)
+    msg := err.Error()
+    if status >= http.StatusInternalServerError {
+        msg = http.StatusText(status)
+    }
+    ex.errs = append(ex.errs, gqlFieldError{GraphQLError{Message: msg, Path: path}, err, status})
+}
+
+// gqlRootArgs lists the arguments each root field accepts.
+var gqlRootArgs = map[string][]string{
+    "query.user":          {"id"},
+    "query.users":         {"filter", "page"},
+    "query.stats":         {},
+    "mutation.createUser": {"input"},
+    "mutation.updateUser": {"id", "patch"},
+}
+
+func (ex *gqlExec) run(op *gqlOperation) gqlObject {
+    if op.kind == "query" {
+        for _, f := range op.selection {
+            if f.name == "user" {
+                if id, err := ex.argID(f, "id"); err == nil {
+                    ex.users.want(id)
+                }
+            }
+        }
+    }
+    // Mutations run in order, one at a time, as the spec requires; this
+    // loop is sequential for queries too.
+    data := gqlObject{}
+    for _, f := range op.selection {
+        path := []any{f.key()}
+        if f.name == "__typename" {
+            data = append(data, gqlEntry{f.key(), strings.ToUpper(op.kind[:1]) + op.kind[1:]})
+            continue
+        }
+        v, err := ex.resolveRoot(op.kind, f)
+        if err != nil {
+            ex.fail(path, err)
+            data = append(data, gqlEntry{f.key(), nil})
+            continue
+        }
+        data = append(data, gqlEntry{f.key(), ex.complete(v, f.selection, path)})
+    }
+    return data
+}
+
+func (ex *gqlExec) resolveRoot(kind string, f gqlField) (any, error) {
+    allowed, ok := gqlRootArgs[kind+"."+f.name]
+    if !ok {
+        return nil, invalidInput(fmt.Errorf("cannot query field %q on type %q", f.name, strings.ToUpper(kind[:1])+kind[1:]))
+    }
+    for name := range f.args {
+        if !slices.Contains(allowed, name) {
+            return nil, invalidInput(fmt.Errorf("unknown argument %q on field %q", name, f.name))
+        }
+    }
+
+    switch kind + "." + f.name {
+    case "query.user":
+        id, err := ex.argID(f, "id")
+        if err != nil {
+            return nil, err
+        }
+        user, err := ex.users.get(ex.ctx, id)
+        if errors.Is(err, ErrNotFound) {
+            return (*User)(nil), nil
+        }
+        return user, err
+    case "query.users":
+        var filter UserFilter
+        var page PageRequest
+        if err := ex.decodeArg(f, "filter", &filter, false); err != nil {
+            return nil, err
+        }
+        if err := ex.decodeArg(f, "page", &page, false); err != nil {
+            return nil, err
+        }
+        return ex.svc.FindUsers(ex.ctx, filter, page)
+    case "query.stats":
+        return ex.svc.GetUserStats(ex.ctx)
+    case "mutation.createUser":
+        var input CreateUserRequest
+        if err := ex.decodeArg(f, "input", &input, true); err != nil {
+            return nil, err
+        }
+        return ex.svc.CreateUserWith(ex.ctx, input)
+    default: // mutation.updateUser
+        id, err := ex.argID(f, "id")
+        if err != nil {
+            return nil, err
+        }
+        var patch UserPatch
+        if err := ex.decodeArg(f, "patch", &patch, true); err != nil {
+            return nil, err
+        }
+        return ex.svc.PatchUser(ex.ctx, id, patch)
+    }
+}
+
+// arg resolves variables in a field argument; ok is false when the
+// argument is absent or null.
+func (ex *gqlExec) arg(f gqlField, name string) (v any, ok bool, err error) {
+    raw, ok := f.args[name]
+    if !ok {
+        return nil, false, nil
+    }
+    v, err = ex.value(raw)
+    return v, err == nil && v != nil, err
+}
+
+func (ex *gqlExec) value(raw any) (any, error) {
+    switch raw := raw.(type) {
+    case gqlVariable:
+        v, ok := ex.vars[string(raw)]
+        if !ok {
+            return nil, invalidInput(fmt.Errorf("variable $%s is not defined", raw))
+        }
+        return v, nil
+    case gqlEnum:
+        return string(raw), nil
+    case []any:
+        out := make([]any, len(raw))
+        for i, item := range raw {
+            v, err := ex.value(item)
+            if err != nil {
+                return nil, err
+            }
+            out[i] = v
+        }
+        return out, nil
+    case map[string]any:
+        out := make(map[string]any, len(raw))
+        for k, item := range raw {
+            v, err := ex.value(item)
+            if err != nil {
+                return nil, err
+            }
+            out[k] = v
+        }
+        return out, nil
+    }
+    return raw, nil
+}
+
+// decodeArg converts an input-object argument into dst through its JSON
+// form, so the Go types' JSON tags define the GraphQL input shapes.
+func (ex *gqlExec) decodeArg(f gqlField, name string, dst any, required bool) error {
+    v, ok, err := ex.arg(f, name)
+    if err != nil {
+        return err
+    }
+    if !ok {
+        if required {
+            return invalidInput(fmt.Errorf("argument %q of field %q is required", name, f.name))
+        }
+        return nil
+    }
+    b, err := json.Marshal(v)
+    if err != nil {
+        return invalidInput(fmt.Errorf("argument %q: %v", name, err))
+    }
+    dec := json.NewDecoder(bytes.NewReader(b))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(dst); err != nil {
+        return invalidInput(fmt.Errorf("argument %q: %v", name, err))
+    }
+    return nil
+}
+
+// argID accepts an ID as an integer or a numeric string, as GraphQL's ID
+// type allows either.
+func (ex *gqlExec) argID(f gqlField, name string) (UserID, error) {
+    v, ok, err := ex.arg(f, name)
+    if err != nil {
+        return 0, err
+    }
+    var id int64
+    switch v := v.(type) {
+    case int64:
+        id = v
+    case float64:
+        if v == math.Trunc(v) {
+            id = int64(v)
+        }
+    case string:
+        id, _ = strconv.ParseInt(v, 10, 64)
+    }
+    if !ok || id <= 0 {
+        return 0, invalidInput(fmt.Errorf("argument %q of field %q must be a user ID", name, f.name))
+    }
+    return UserID(id), nil
+}
+
+// complete projects a resolved Go value onto a selection set. The value
+// goes through its JSON form, and its Go type says which fields exist.
+func (ex *gqlExec) complete(v any, selection []gqlField, path []any) any {
+    b, err := json.Marshal(v)
+    if err != nil {
+        ex.fail(path, err)
+        return nil
+    }
+    var decoded any
+    dec := json.NewDecoder(bytes.NewReader(b))
+    dec.UseNumber()
+    if err := dec.Decode(&decoded); err != nil {
+        ex.fail(path, err)
+        return nil
+    }
+    return ex.project(decoded, reflect.TypeOf(v), selection, path)
+}
+
+func (ex *gqlExec) project(v any, t reflect.Type, selection []gqlField, path []any) any {
+    for t.Kind() == reflect.Pointer {
+        t = t.Elem()
+    }
+    if v == nil {
+        return nil
+    }
+    if t.Kind() == reflect.Struct && t != reflect.TypeFor[time.Time]() {
+        if len(selection) == 0 {
+            ex.fail(path, invalidInput(fmt.Errorf("field %v of type %q must have a selection of subfields", path[len(path)-1], t.Name())))
+            return nil
+        }
+        obj, _ := v.(map[string]any)
+        fields := gqlFields(t)
+        out := gqlObject{}
+        for _, f := range selection {
+            fieldPath := append(slices.Clone(path), f.key())
+            if f.name == "__typename" {
+                out = append(out, gqlEntry{f.key(), t.Name()})
+                continue
+            }
+            ft, ok := fields[f.name]
+            if !ok {
+                ex.fail(fieldPath, invalidInput(fmt.Errorf("cannot query field %q on type %q", f.name, t.Name())))
+                continue
+            }
+            if len(f.args) > 0 {
+                ex.fail(fieldPath, invalidInput(fmt.Errorf("field %q takes no arguments", f.name)))
+                continue
+            }
+            out = append(out, gqlEntry{f.key(), ex.project(obj[f.name], ft, f.selection, fieldPath)})
+        }
+        return out
+    }
+    if t.Kind() == reflect.Slice {
+        items, _ := v.([]any)
+        out := make([]any, len(items))
+        for i, item := range items {
+            out[i] = ex.project(item, t.Elem(), selection, append(slices.Clone(path), i))
+        }
+        return out
+    }
+    if len(selection) > 0 {
+        ex.fail(path, invalidInput(fmt.Errorf("field %v of type %q has no subfields", path[len(path)-1], t.Name())))
+        return nil
+    }
+    return v
+}
+
+// gqlFields maps a struct's JSON field names to their types.
+func gqlFields(t reflect.Type) map[string]reflect.Type {
+    fields := map[string]reflect.Type{}
+    for i := range t.NumField() {
+        sf := t.Field(i)
+        if !sf.IsExported() {
+            continue
+        }
+        name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+        if name == "-" {
+            continue
+        }
+        if name == "" {
+            name = sf.Name
+        }
+        fields[name] = sf.Type
+    }
+    return fields
+}
+
+// gqlObject is a JSON object that keeps the order of the selection set,
+// as GraphQL responses must.
+type gqlObject []gqlEntry
+
+type gqlEntry struct {
+    key   string
+    value any
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+    var buf bytes.Buffer
+    buf.WriteByte('{')
+    for i, e := range o {
+        if i > 0 {
+            buf.WriteByte(',')
+        }
+        key, err := json.Marshal(e.key)
+        if err != nil {
+            return nil, err
+        }
+        value, err := json.Marshal(e.value)
+        if err != nil {
+            return nil, err
+        }
+        buf.Write(key)
+        buf.WriteByte(':')
+        buf.Write(value)
+    }
+    buf.WriteByte('}')
+    return buf.Bytes(), nil
+}
+
+// GraphQL parsing
+
+type gqlOperation struct {
+    kind      string // "query" or "mutation"
+    name      string
+    vars      map[string]gqlVarDef
+    selection []gqlField
+}
+
+type gqlVarDef struct {
+    nonNull    bool
+    hasDefault bool
+    value      any
+}
+
+type gqlField struct {
+    alias, name string
+    args        map[string]any
+    selection   []gqlField
+}
+
+func (f gqlField) key() string {
+    if f.alias != "" {
+        return f.alias
+    }
+    return f.name
+}
+
+// Argument values parse to int64, float64, string, bool, nil, []any,
+// map[string]any, or these two:
+type (
+    gqlVariable string
+    gqlEnum     string
+)
+
+type gqlToken struct {
+    kind byte // 'n'ame, 'i'nt, 'f'loat, 's'tring, 'p'unctuator, or 0 at the end
+    text string
+}
+
+// parseGraphQLOperation parses a document and picks the operation to run:
+// the one named name, or the only one when name is empty.
+func parseGraphQLOperation(src, name string) (*gqlOperation, error) {
+    toks, err := lexGraphQL(src)
+    if err != nil {
+        return nil, err
+    }
+    p := &gqlParser{toks: toks}
+    var ops []*gqlOperation
+    for p.peek().kind != 0 {
+        op, err := p.operation()
+        if err != nil {
+            return nil, err
+        }
+        ops = append(ops, op)
+    }
+    if len(ops) == 0 {
+        return nil, errors.New("document has no operations")
+    }
+    if name == "" {
+        if len(ops) > 1 {
+            return nil, errors.New("operationName is required for a document with several operations")
+        }
+        return ops[0], nil
+    }
+    for _, op := range ops {
+        if op.name == name {
+            return op, nil
+        }
+    }
+    return nil, fmt.Errorf("unknown operation %q", name)
+}
+
+func lexGraphQL(src string) ([]gqlToken, error) {
+    var toks []gqlToken
+    for i := 0; i < len(src); {
+        c := src[i]
+        switch {
+        case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+            i++
+        case c == '#':
+            for i < len(src) && src[i] != '\n' {
+                i++
+            }
+        case strings.HasPrefix(src[i:], "..."):
+            toks = append(toks, gqlToken{'p', "..."})
+            i += 3
+        case strings.IndexByte("!$():=@[]{|}", c) >= 0:
+            toks = append(toks, gqlToken{'p', string(c)})
+            i++
+        case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+            j := i + 1
+            for j < len(src) && (src[j] == '_' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= '0' && src[j] <= '9') {
+                j++
+            }
+            toks = append(toks, gqlToken{'n', src[i:j]})
+            i = j
+        case c == '-' || c >= '0' && c <= '9':
+            j, kind := i+1, byte('i')
+            for j < len(src) && (src[j] >= '0' && src[j] <= '9' || strings.IndexByte(".eE+-", src[j]) >= 0) {
+                if strings.IndexByte(".eE", src[j]) >= 0 {
+                    kind = 'f'
+                }
+                j++
+            }
+            toks = append(toks, gqlToken{kind, src[i:j]})
+            i = j
+        case strings.HasPrefix(src[i:], `"""`):
+            end := strings.Index(src[i+3:], `"""`)
+            if end < 0 {
+                return nil, errors.New("unterminated block string")
+            }
+            toks = append(toks, gqlToken{'s', src[i+3 : i+3+end]})
+            i += end + 6
+        case c == '"':
+            j := i + 1
+            for j < len(src) && src[j] != '"' && src[j] != '\n' {
+                if src[j] == '\\' {
+                    j++
+                }
+                j++
+            }
+            var str string
+            // GraphQL string escapes are a subset of JSON's.
+            if j >= len(src) || json.Unmarshal([]byte(src[i:j+1]), &str) != nil {
+                return nil, fmt.Errorf("invalid string at offset %d", i)
+            }
+            toks = append(toks, gqlToken{'s', str})
+            i = j + 1
+        default:
+            return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+        }
+    }
+    return toks, nil
+}
+
+type gqlParser struct {
+    toks []gqlToken
+    i    int
+}
+
+func (p *gqlParser) peek() gqlToken {
+    if p.i < len(p.toks) {
+        return p.toks[p.i]
+    }
+    return gqlToken{}
+}
+
+func (p *gqlParser) next() gqlToken {
+    t := p.peek()
+    p.i++
+    return t
+}
+
+// skip consumes punctuator text if it comes next.
+func (p *gqlParser) skip(text string) bool {
+    if t := p.peek(); t.kind == 'p' && t.text == text {
+        p.i++
+        return true
+    }
+    return false
+}
+
+func (p *gqlParser) expect(text string) error {
+    if !p.skip(text) {
+        return p.unexpected("\"" + text + "\"")
+    }
+    return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+    if t := p.peek(); t.kind == 'n' {
+        p.i++
+        return t.text, nil
+    }
+    return "", p.unexpected("a name")
+}
+
+func (p *gqlParser) unexpected(want string) error {
+    t := p.peek()
+    if t.kind == 0 {
+        return fmt.Errorf("syntax error: expected %s, found end of document", want)
+    }
+    return fmt.Errorf("syntax error: expected %s, found %q", want, t.text)
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+    op := &gqlOperation{kind: "query", vars: map[string]gqlVarDef{}}
+    if !p.skip("{") {
+        kind, err := p.name()
+        if err != nil {
+            return nil, err
+        }
+        switch kind {
+        case "query", "mutation":
+            op.kind = kind
+        case "subscription", "fragment":
+            return nil, fmt.Errorf("%ss are not supported", kind)
+        default:
+            return nil, fmt.Errorf("syntax error: unexpected %q", kind)
+        }
+        if p.peek().kind == 'n' {
+            op.name = p.next().text
+        }
+        if p.skip("(") {
+            for !p.skip(")") {
+                if err := p.varDef(op); err != nil {
+                    return nil, err
+                }
+            }
+        }
+        if p.peek().text == "@" {
+            return nil, errors.New("directives are not supported")
+        }
+        if err := p.expect("{"); err != nil {
+            return nil, err
+        }
+    }
+    sel, err := p.selectionSet()
+    if err != nil {
+        return nil, err
+    }
+    op.selection = sel
+    return op, nil
+}
+
+func (p *gqlParser) varDef(op *gqlOperation) error {
+    if err := p.expect("$"); err != nil {
+        return err
+    }
+    name, err := p.name()
+    if err != nil {
+        return err
+    }
+    if err := p.expect(":"); err != nil {
+        return err
+    }
+    var def gqlVarDef
+    if def.nonNull, err = p.typeRef(); err != nil {
+        return err
+    }
+    if p.skip("=") {
+        def.hasDefault = true
+        if def.value, err = p.value(); err != nil {
+            return err
+        }
+    }
+    op.vars[name] = def
+    return nil
+}
+
+// typeRef skips a type reference, reporting whether it is non-null. The
+// executor checks values against the service's types, not these.
+func (p *gqlParser) typeRef() (bool, error) {
+    if p.skip("[") {
+        if _, err := p.typeRef(); err != nil {
+            return false, err
+        }
+        if err := p.expect("]"); err != nil {
+            return false, err
+        }
+    } else if _, err := p.name(); err != nil {
+        return false, err
+    }
+    return p.skip("!"), nil
+}
+
+// selectionSet parses fields up to the closing brace; the opening one has
+// been consumed.
+func (p *gqlParser) selectionSet() ([]gqlField, error) {
+    var fields []gqlField
+    for !p.skip("}") {
+        if p.peek().text == "..." {
+            return nil, errors.New("fragments are not supported")
+        }
+        var f gqlField
+        var err error
+        if f.name, err = p.name(); err != nil {
+            return nil, err
+        }
+        if p.skip(":") {
+            f.alias = f.name
+            if f.name, err = p.name(); err != nil {
+                return nil, err
+            }
+        }
+        if p.skip("(") {
+            f.args = map[string]any{}
+            for !p.skip(")") {
+                name, err := p.name()
+                if err != nil {
+                    return nil, err
+                }
+                if err := p.expect(":"); err != nil {
+                    return nil, err
+                }
+                if f.args[name], err = p.value(); err != nil {
+                    return nil, err
+                }
+            }
+        }
+        if p.peek().text == "@" {
+            return nil, errors.New("directives are not supported")
+        }
+        if p.skip("{") {
+            if f.selection, err = p.selectionSet(); err != nil {
+                return nil, err
+            }
+        }
+        fields = append(fields, f)
+    }
+    if len(fields) == 0 {
+        return nil, errors.New("syntax error: empty selection set")
+    }
+    return fields, nil
+}
+
+func (p *gqlParser) value() (any, error) {
+    t := p.next()
+    switch t.kind {
+    case 'i':
+        return strconv.ParseInt(t.text, 10, 64)
+    case 'f':
+        return strconv.ParseFloat(t.text, 64)
+    case 's':
+        return t.text, nil
+    case 'n':
+        switch t.text {
+        case "true":
+            return true, nil
+        case "false":
+            return false, nil
+        case "null":
+            return nil, nil
+        }
+        return gqlEnum(t.text), nil
+    case 'p':
+        switch t.text {
+        case "$":
+            name, err := p.name()
+            return gqlVariable(name), err
+        case "[":
+            list := []any{}
+            for !p.skip("]") {
+                v, err := p.value()
+                if err != nil {
+                    return nil, err
+                }
+                list = append(list, v)
+            }
+            return list, nil
+        case "{":
+            obj := map[string]any{}
+            for !p.skip("}") {
+                name, err := p.name()
+                if err != nil {
+                    return nil, err
+                }
+                if err := p.expect(":"); err != nil {
+                    return nil, err
+                }
+                if obj[name], err = p.value(); err != nil {
+                    return nil, err
+                }
+            }
+            return obj, nil
+        }
+    }
+    p.i--
+    return nil, p.unexpected("a value")
+}
+
+// WebSocket events
+//
+// EventStream pushes user lifecycle events to WebSocket clients, as JSON
+// StreamedEvents in text messages. Subscribe its Publish to an EventBus
+// and serve it on /ws, behind Authenticate: connections need a user or
+// API key in the context unless WithAnonymousStream is given, and
+// browsers may only connect from the API's own origin or one allowed by
+// WithStreamOrigins. A connection's EventFilter comes from the query string
+// (?types=user.created,user.deleted&user_id=4) and is replaced whenever
+// the client sends an EventFilter as a text message. Connections made
+// with a tenant in the context (see TenantRepository) only see that
+// tenant's users, which leaves out deletions, as those events carry no
+// user. Clients that fall DefaultStreamBuffer messages behind are
+// disconnected so they can't stall the bus.
+
+// DefaultStreamBuffer is how many messages may queue per connection.
+const DefaultStreamBuffer = 64
+
+// streamedEvents are the events EventStream forwards; security events,
+// such as password resets, stay server-side.
+var streamedEvents = []EventType{
+    EventUserCreated, EventUserUpdated, EventUserDeleted, EventUserDeactivated, EventUserMerged,
+    EventUserRestored,
+}
+
+// EventFilter selects events by type and user; empty fields match all.
+type EventFilter struct {
+    Types   []EventType `json:"types,omitempty"`
+    UserIDs []UserID    `json:"user_ids,omitempty"`
+}
+
+func (f EventFilter) Matches(event UserEvent) bool {
+    return (len(f.Types) == 0 || slices.Contains(f.Types, event.Type)) &&
+        (len(f.UserIDs) == 0 || slices.Contains(f.UserIDs, event.UserID))
+}
+
+// StreamedEvent is a UserEvent without the user. Clients fetch the user
+// through the API if they need more, where reads are authorized.
+type StreamedEvent struct {
+    Type      EventType `json:"type"`
+    UserID    UserID    `json:"user_id"`
+    At        time.Time `json:"at"`
+    RequestID string    `json:"request_id,omitempty"`
+}
+
+type EventStream struct {
+    logger    Logger
+    origins   []string
+    anonymous bool
+    mu        sync.Mutex
+    conns     map[*wsConn]struct{}
+}
+
+type StreamOption func(*EventStream)
+
+// WithStreamOrigins lets browsers connect from origins other than the
+// API's own. Patterns are as for CORSConfig.AllowedOrigins, including "*".
+func WithStreamOrigins(origins ...string) StreamOption {
+    return func(s *EventStream) { s.origins = append(s.origins, origins...) }
+}
+
+// WithAnonymousStream accepts connections without a user or API key, for
+// servers running without authentication.
+func WithAnonymousStream() StreamOption {
+    return func(s *EventStream) { s.anonymous = true }
+}
+
+func NewEventStream(logger Logger, opts ...StreamOption) *EventStream {
+    s := &EventStream{logger: logger, conns: map[*wsConn]struct{}{}}
+    for _, opt := range opts {
+        opt(s)
+    }
+    return s
+}
+
+// Publish queues event for every matching connection. It is a Subscriber.
+func (s *EventStream) Publish(ctx context.Context, event UserEvent) error {
+    if !slices.Contains(streamedEvents, event.Type) {
+        return nil
+    }
+    msg, err := json.Marshal(StreamedEvent{Type: event.Type, UserID: event.UserID, At: event.At, RequestID: event.RequestID})
+    if err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for c := range s.conns {
+        if c.tenant != nil && (event.User == nil || event.User.TenantID != *c.tenant) {
+            continue
+        }
+        if !c.filter.Load().Matches(event) {
+            continue
+        }
+        select {
+        case c.send <- msg:
+        default:
+            s.logger.Warn("WebSocket client too slow; disconnecting", "remote", c.conn.RemoteAddr().String())
+            // Don't block the bus on a write to the stuck client.
+            go c.close(wsClosePolicy, "too slow")
+        }
+    }
+    return nil
+}
+
+// Close disconnects every client.
+func (s *EventStream) Close() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for c := range s.conns {
+        c.close(wsCloseGoingAway, "server shutting down")
+    }
+}
+
+func (s *EventStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if _, ok := CurrentUser(r.Context()); !ok && !s.anonymous {
+        if _, ok := APIKeyFrom(r.Context()); !ok {
+            writeJSON(w, http.StatusUnauthorized, APIError{Error: "authentication required"})
+            return
+        }
+    }
+    // Browsers send cookies with WebSocket handshakes from any page, so
+    // only trusted pages may open one.
+    if origin := r.Header.Get("Origin"); origin != "" && !s.originAllowed(r, origin) {
+        writeJSON(w, http.StatusForbidden, APIError{Error: fmt.Sprintf("origin %s may not connect", origin)})
+        return
+    }
+    filter, err := parseEventFilter(r.URL.Query())
+    if err != nil {
+        writeJSON(w, http.StatusBadRequest, APIError{Error: err.Error()})
+        return
+    }
+    c, err := wsAccept(w, r)
+    if err != nil {
+        loggerFor(r.Context(), s.logger).Error("WebSocket handshake failed", "remote", r.RemoteAddr, "error", err)
+        return
+    }
+    c.filter.Store(&filter)
+    if tenant, ok := TenantFrom(r.Context()); ok {
+        c.tenant = &tenant
+    }
+
+    s.mu.Lock()
+    s.conns[c] = struct{}{}
+    s.mu.Unlock()
+    s.logger.Info("WebSocket client connected", "remote", c.conn.RemoteAddr().String())
+    defer func() {
+        s.mu.Lock()
+        delete(s.conns, c)
+        s.mu.Unlock()
+        s.logger.Info("WebSocket client disconnected", "remote", c.conn.RemoteAddr().String())
+    }()
+
+    go c.writeLoop()
+    c.readLoop(func(msg []byte) {
+        var f EventFilter
+        if err := json.Unmarshal(msg, &f); err != nil {
+            c.close(wsCloseInvalidData, "expected an EventFilter")
+            return
+        }
+        c.filter.Store(&f)
+    })
+}
+
+// originAllowed reports whether a browser on origin may connect: it is
+// the API's own origin or matches WithStreamOrigins.
+func (s *EventStream) originAllowed(r *http.Request, origin string) bool {
+    if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+        return true
+    }
+    return slices.ContainsFunc(s.origins, func(pattern string) bool {
+        return pattern == "*" || originMatches(pattern, origin)
+    })
+}
+
+func parseEventFilter(q url.Values) (EventFilter, error) {
+    var f EventFilter
+    if v := q.Get("types"); v != "" {
+        for _, t := range strings.Split(v, ",") {
+            if !slices.Contains(streamedEvents, EventType(t)) {
+                return f, fmt.Errorf("event type %q is not streamed", t)
+            }
+            f.Types = append(f.Types, EventType(t))
+        }
+    }
+    for _, v := range q["user_id"] {
+        id, err := strconv.Atoi(v)
+        if err != nil {
+            return f, fmt.Errorf("invalid user_id %q", v)
+        }
+        f.UserIDs = append(f.UserIDs, UserID(id))
+    }
+    return f, nil
+}
+
+// Minimal RFC 6455 server: unfragmented text messages out, text and
+// control frames in.
+
+const (
+    wsOpText  = 0x1
+    wsOpClose = 0x8
+    wsOpPing  = 0x9
+    wsOpPong  = 0xA
+
+    wsCloseNormal      = 1000
+    wsCloseGoingAway   = 1001
+    wsCloseProtocol    = 1002
+    wsCloseInvalidData = 1007
+    wsClosePolicy      = 1008
+    wsCloseTooBig      = 1009
+
+    wsMaxMessage   = 64 << 10
+    wsPingInterval = 30 * time.Second
+    wsWriteTimeout = 10 * time.Second
+)
+
+type wsConn struct {
+    conn   net.Conn
+    br     *bufio.Reader
+    wmu    sync.Mutex // serializes frame writes
+    send   chan []byte
+    filter atomic.Pointer[EventFilter]
+    tenant *TenantID
+    done   chan struct{}
+    once   sync.Once
+}
+
+func wsAccept(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+    if r.Method != http.MethodGet ||
+        !headerHasToken(r.Header, "Connection", "upgrade") ||
+        !headerHasToken(r.Header, "Upgrade", "websocket") {
+        http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+        return nil, errors.New("not a WebSocket upgrade")
+    }
+    if r.Header.Get("Sec-WebSocket-Version") != "13" {
+        w.Header().Set("Sec-WebSocket-Version", "13")
+        http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+        return nil, errors.New("unsupported WebSocket version")
+    }
+    key := r.Header.Get("Sec-WebSocket-Key")
+    if key == "" {
+        http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+        return nil, errors.New("missing Sec-WebSocket-Key")
+    }
+    // ResponseController sees through middleware that wraps w.
+    conn, rw, err := http.NewResponseController(w).Hijack()
+    if err != nil {
+        http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+        return nil, err
+    }
+    sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+    fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+        base64.StdEncoding.EncodeToString(sum[:]))
+    if err := rw.Flush(); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    // Drop the server's request timeouts, which would otherwise cut the
+    // connection off; writeFrame sets its own deadlines.
+    conn.SetDeadline(time.Time{})
+    return &wsConn{
+        conn: conn,
+        br:   rw.Reader,
+        send: make(chan []byte, DefaultStreamBuffer),
+        done: make(chan struct{}),
+    }, nil
+}
+
+// headerHasToken reports whether a comma-separated header lists token.
+func headerHasToken(h http.Header, name, token string) bool {
+    for _, v := range h.Values(name) {
+        for _, t := range strings.Split(v, ",") {
+            if strings.EqualFold(strings.TrimSpace(t), token) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// close sends a close frame and drops the connection; later calls do
+// nothing.
+func (c *wsConn) close(code int, reason string) {
+    c.once.Do(func() {
+        close(c.done)
+        c.writeFrame(wsOpClose, append([]byte{byte(code >> 8), byte(code)}, reason...))
+        c.conn.Close()
+    })
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+    c.wmu.Lock()
+    defer c.wmu.Unlock()
+    header := []byte{0x80 | op} // FIN
+    switch n := len(payload); {
+    case n < 126:
+        header = append(header, byte(n))
+    case n <= 0xFFFF:
+        header = append(header, 126, byte(n>>8), byte(n))
+    default:
+        header = append(header, 127)
+        for i := 7; i >= 0; i-- {
+            header = append(header, byte(uint64(n)>>(8*i)))
+        }
+    }
+    c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+    _, err := c.conn.Write(append(header, payload...))
+    return err
+}
+
+func (c *wsConn) writeLoop() {
+    ping := time.NewTicker(wsPingInterval)
+    defer ping.Stop()
+    for {
+        var err error
+        select {
+        case msg := <-c.send:
+            err = c.writeFrame(wsOpText, msg)
+        case <-ping.C:
+            err = c.writeFrame(wsOpPing, nil)
+        case <-c.done:
+            return
+        }
+        if err != nil {
+            c.close(wsCloseGoingAway, "")
+            return
+        }
+    }
+}
+
+// readLoop handles control frames and passes text messages to onText
+// until the connection closes.
+func (c *wsConn) readLoop(onText func([]byte)) {
+    defer c.close(wsCloseNormal, "")
+    var head [2]byte
+    for {
+        if _, err := io.ReadFull(c.br, head[:]); err != nil {
+            return
+        }
+        fin, op, masked := head[0]&0x80 != 0, head[0]&0x0F, head[1]&0x80 != 0
+        n := uint64(head[1] & 0x7F)
+        switch n {
+        case 126:
+            var ext [2]byte
+            if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+                return
+            }
+            n = uint64(ext[0])<<8 | uint64(ext[1])
+        case 127:
+            var ext [8]byte
+            if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+                return
+            }
+            n = 0
+            for _, b := range ext {
+                n = n<<8 | uint64(b)
+            }
+        }
+        if !masked || !fin {
+            c.close(wsCloseProtocol, "expected masked, unfragmented frames")
+            return
+        }
+        if n > wsMaxMessage {
+            c.close(wsCloseTooBig, "message too big")
+            return
+        }
+        var mask [4]byte
+        payload := make([]byte, n)
+        if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+            return
+        }
+        if _, err := io.ReadFull(c.br, payload); err != nil {
+            return
+        }
+        for i := range payload {
+            payload[i] ^= mask[i%4]
+        }
+
+        switch op {
+        case wsOpText:
+            onText(payload)
+        case wsOpPing:
+            c.writeFrame(wsOpPong, payload)
+        case wsOpPong:
+        case wsOpClose:
+            return
+        default:
+            c.close(wsCloseProtocol, "unsupported frame type")
+            return
+        }
+    }
+}
+
+// Server-Sent Events
+//
+// StatsStream serves UserStats as an SSE feed on GET /stats/stream. Each
+// client gets the stats on connecting, then again every interval and
+// whenever an event changes users. Subscribe its Publish to an EventBus
+// for the change pushes. ?interval=30s overrides the default, down to
+// MinStatsInterval; ?interval=0 pushes on change only. Bursts of changes
+// are coalesced so stats are recomputed at most once per MinStatsInterval.
+//
+//     event: stats
+//     data: {"total":2,...}
+
+const (
+    DefaultStatsInterval = 10 * time.Second
+    MinStatsInterval     = time.Second
+    // sseKeepAlive is how often an idle stream sends a comment so proxies
+    // don't time it out.
+    sseKeepAlive = 15 * time.Second
+)
+
+type StatsStream struct {
+    svc      *UserService
+    logger   Logger
+    interval time.Duration
+
+    mu      sync.Mutex
+    clients map[chan struct{}]struct{}
+    done    chan struct{}
+    closed  bool
+}
+
+// NewStatsStream pushes every interval by default; zero means on change
+// only.
+func NewStatsStream(svc *UserService, logger Logger, interval time.Duration) *StatsStream {
+    return &StatsStream{
+        svc:      svc,
+        logger:   logger,
+        interval: interval,
+        clients:  map[chan struct{}]struct{}{},
+        done:     make(chan struct{}),
+    }
+}
+
+// Publish marks every client's stats as stale. It is a Subscriber.
+func (s *StatsStream) Publish(ctx context.Context, event UserEvent) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for changed := range s.clients {
+        select {
+        case changed <- struct{}{}:
+        default: // a recompute is already pending
+        }
+    }
+    return nil
+}
+
+// Close ends every stream. http.Server.Shutdown waits for active
+// requests, so call it first.
+func (s *StatsStream) Close() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if !s.closed {
+        s.closed = true
+        close(s.done)
+    }
+}
+
+func (s *StatsStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    interval := s.interval
+    if v := r.URL.Query().Get("interval"); v != "" {
+        d, err := time.ParseDuration(v)
+        if err != nil || d < 0 || (d > 0 && d < MinStatsInterval) {
+            writeJSON(w, http.StatusBadRequest, APIError{Error: fmt.Sprintf("interval must be 0 or at least %s", MinStatsInterval)})
+            return
+        }
+        interval = d
+    }
+    ctx := r.Context()
+    stats, err := s.svc.GetUserStats(ctx)
+    if err != nil {
+        writeJSON(w, httpStatus(err), APIError{Error: err.Error()})
+        return
+    }
+
+    rc := http.NewResponseController(w)
+    // The stream outlives the server's write timeout by design.
+    if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+        loggerFor(r.Context(), s.logger).Error("SSE failed", "error", err)
+    }
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("X-Accel-Buffering", "no")
+    w.WriteHeader(http.StatusOK)
+
+    changed := make(chan struct{}, 1)
+    s.mu.Lock()
+    if s.closed {
+        s.mu.Unlock()
+        return
+    }
+    s.clients[changed] = struct{}{}
+    s.mu.Unlock()
+    defer func() {
+        s.mu.Lock()
+        delete(s.clients, changed)
+        s.mu.Unlock()
+    }()
+
+    send := func(event string, v any) error {
+        data, err := json.Marshal(v)
+        if err != nil {
+            return err
+        }
+        if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+            return err
+        }
+        return rc.Flush()
+    }
+    if err := send("stats", stats); err != nil {
+        return
+    }
+
+    var tick <-chan time.Time
+    if interval > 0 {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        tick = ticker.C
+    }
+    keepAlive := time.NewTicker(sseKeepAlive)
+    defer keepAlive.Stop()
+    var lastPush time.Time
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-s.done:
+            return
+        case <-keepAlive.C:
+            if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil || rc.Flush() != nil {
+                return
+            }
+            continue
+        case <-tick:
+        case <-changed:
+            if wait := MinStatsInterval - time.Since(lastPush); wait > 0 {
+                select {
+                case <-time.After(wait):
+                case <-ctx.Done():
+                    return
+                case <-s.done:
+                    return
+                }
+            }
+        }
+        lastPush = time.Now()
+        stats, err := s.svc.GetUserStats(ctx)
+        if err != nil {
+            loggerFor(r.Context(), s.logger).Error("SSE stats failed", "error", err)
+            err = send("error", APIError{Error: http.StatusText(httpStatus(err))})
+        } else {
+            err = send("stats", stats)
+        }
+        if err != nil {
+            return
+        }
+    }
+}
+
+// Health checks
+//
+// HealthHandler serves Kubernetes probes:
+//
+//     GET /healthz  liveness; never touches dependencies, so an outage
+//                   elsewhere doesn't get the process restarted
+//     GET /readyz   readiness; every registered check must pass
+//
+// Both answer with a HealthReport, and status 503 when not ready. Mount
+// them outside any authentication middleware.
+
+// DefaultHealthTimeout bounds each readiness check.
+const DefaultHealthTimeout = 2 * time.Second
+
+type HealthCheck func(ctx context.Context) error
+
+// Pinger is implemented by repositories that can cheaply check their
+// connection, such as the SQL ones.
+type Pinger interface {
+    Ping(ctx context.Context) error
+}
+
+type HealthReport struct {
+    Status  string                 `json:"status"` // "ok", "unavailable" or "draining"
+    Version string                 `json:"version"`
+    Uptime  string                 `json:"uptime"`
+    Checks  map[string]CheckResult `json:"checks,omitempty"`
+}
+
+type CheckResult struct {
+    Status   string `json:"status"`
+    Error    string `json:"error,omitempty"`
+    Duration string `json:"duration"`
+}
+
+type HealthHandler struct {
+    started  time.Time
+    timeout  time.Duration
+    draining atomic.Bool
+    mu       sync.RWMutex
+    checks   map[string]HealthCheck
+}
+
+// NewHealthHandler bounds each check by timeout, or DefaultHealthTimeout
+// when it is zero.
+func NewHealthHandler(timeout time.Duration) *HealthHandler {
+    if timeout <= 0 {
+        timeout = DefaultHealthTimeout
+    }
+    return &HealthHandler{started: time.Now(), timeout: timeout, checks: map[string]HealthCheck{}}
+}
+
+// AddCheck registers a readiness check, replacing any of the same name.
+func (h *HealthHandler) AddCheck(name string, check HealthCheck) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.checks[name] = check
+}
+
+// RepositoryCheck pings repo when it is a Pinger, and otherwise reads one
+// page of users across all tenants.
+func RepositoryCheck(repo UserRepository) HealthCheck {
+    return func(ctx context.Context) error {
+        if p, ok := repo.(Pinger); ok {
+            return p.Ping(ctx)
+        }
+        _, err := repo.FindPage(WithAllTenants(ctx), PageRequest{Limit: 1})
+        return err
+    }
+}
+
+// Drain makes readiness fail from now on, so load balancers stop sending
+// traffic while the server finishes what it has. Register it with
+// Server.BeforeShutdown.
+func (h *HealthHandler) Drain() {
+    h.draining.Store(true)
+}
+
+func (h *HealthHandler) Live(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, h.report(nil))
+}
+
+func (h *HealthHandler) Ready(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Cache-Control", "no-store")
+    if h.draining.Load() {
+        report := h.report(nil)
+        report.Status = "draining"
+        writeJSON(w, http.StatusServiceUnavailable, report)
+        return
+    }
+    h.mu.RLock()
+    checks := maps.Clone(h.checks)
+    h.mu.RUnlock()
+
+    results := make(map[string]CheckResult, len(checks))
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    for name, check := range checks {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            result := h.run(r.Context(), check)
+            mu.Lock()
+            results[name] = result
+            mu.Unlock()
+        }()
+    }
+    wg.Wait()
+
+    report := h.report(results)
+    status := http.StatusOK
+    if report.Status != "ok" {
+        status = http.StatusServiceUnavailable
+    }
+    writeJSON(w, status, report)
+}
+
+// run applies the timeout even to checks that ignore their context.
+func (h *HealthHandler) run(ctx context.Context, check HealthCheck) CheckResult {
+    ctx, cancel := context.WithTimeout(ctx, h.timeout)
+    defer cancel()
+    start := time.Now()
+    errc := make(chan error, 1)
+    go func() { errc <- check(ctx) }()
+    var err error
+    select {
+    case err = <-errc:
+    case <-ctx.Done():
+        err = ctx.Err()
+    }
+    result := CheckResult{Status: "ok", Duration: time.Since(start).Round(time.Microsecond).String()}
+    if err != nil {
+        result.Status, result.Error = "unavailable", err.Error()
+    }
+    return result
+}
+
+func (h *HealthHandler) report(checks map[string]CheckResult) HealthReport {
+    report := HealthReport{
+        Status:  "ok",
+        Version: Version,
+        Uptime:  time.Since(h.started).Round(time.Second).String(),
+        Checks:  checks,
+    }
+    for _, c := range checks {
+        if c.Status != "ok" {
+            report.Status = "unavailable"
+        }
+    }
+    return report
+}
+
+// Secrets
+//
+// Credentials such as database passwords, JWT signing keys and SMTP
+// passwords come from a SecretSource rather than from flags or config
+// files:
+//
+//     EnvSecrets     ZAAI_DB_PASSWORD, or a file named by ZAAI_DB_PASSWORD_FILE
+//     FileSecrets    one file per secret, as Docker and Kubernetes mount them
+//     VaultSecrets   a KV version 2 secret in HashiCorp Vault
+//
+// SecretChain tries several in order. What they return is a Secret, which
+// prints, logs and marshals as [REDACTED], so a config struct holding one
+// can be logged whole; only Reveal gives the value, at the point of use.
+
+// Secret is a credential that doesn't show itself. Its zero value is
+// empty.
+type Secret struct {
+    value string
+}
+
+const redactedSecret = "[REDACTED]"
+
+func NewSecret(value string) Secret {
+    return Secret{value: value}
+}
+
+// Reveal returns the value, for handing to whatever authenticates with it.
+func (s Secret) Reveal() string {
+    return s.value
+}
+
+func (s Secret) IsZero() bool {
+    return s.value == ""
+}
+
+func (s Secret) String() string {
+    return redactedSecret
+}
+
+func (s Secret) GoString() string {
+    return "Secret(" + redactedSecret + ")"
+}
+
+func (s Secret) LogValue() slog.Value {
+    return slog.StringValue(redactedSecret)
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+    return json.Marshal(redactedSecret)
+}
+
+// SecretSource looks secrets up by name, like "db_password". A secret it
+// doesn't hold is an error wrapping ErrNotFound.
+type SecretSource interface {
+    Secret(ctx context.Context, name string) (Secret, error)
+}
+
+// Secret names the CLI looks up.
+const (
+    SecretDBPassword    = "db_password"
+    SecretRedisPassword = "redis_password"
+    SecretSMTPPassword  = "smtp_password"
+    // S3 backup credentials, when not in the AWS environment variables.
+    SecretS3AccessKeyID = "s3_access_key_id"
+    SecretS3SecretKey   = "s3_secret_access_key"
+    // SecretJWTKeyPrefix precedes a key ID; see ReadTokenKeys.
+    SecretJWTKeyPrefix = "jwt_key_"
+)
+
+// EnvSecrets reads the variable named by Prefix and the upper-cased
+// secret name, or if that's unset, the file named by the same variable
+// with _FILE appended.
+type EnvSecrets struct {
+    Prefix string
+}
+
+func (e EnvSecrets) Secret(ctx context.Context, name string) (Secret, error) {
+    key := e.Prefix + strings.ToUpper(name)
+    if v, ok := os.LookupEnv(key); ok {
+        return NewSecret(v), nil
+    }
+    if path := os.Getenv(key + "_FILE"); path != "" {
+        return readSecretFile(path)
+    }
+    return Secret{}, fmt.Errorf("secret %s: $%s: %w", name, key, ErrNotFound)
+}
+
+// FileSecrets reads each secret from the file of that name in Dir,
+// /run/secrets if empty.
+type FileSecrets struct {
+    Dir string
+}
+
+func (f FileSecrets) Secret(ctx context.Context, name string) (Secret, error) {
+    if !filepath.IsLocal(name) {
+        return Secret{}, fmt.Errorf("secret %s: %w: bad name", name, ErrInvalidInput)
+    }
+    s, err := readSecretFile(filepath.Join(cmp.Or(f.Dir, "/run/secrets"), name))
+    if errors.Is(err, os.ErrNotExist) {
+        return Secret{}, fmt.Errorf("secret %s: %w", name, ErrNotFound)
+    }
+    return s, err
+}
+
+// readSecretFile reads a secret, dropping the trailing newline editors
+// and echo leave.
+func readSecretFile(path string) (Secret, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return Secret{}, err
+    }
+    return NewSecret(strings.TrimRight(string(data), "\r\n")), nil
+}
+
+// VaultSecrets reads secrets from one KV version 2 secret in Vault, each
+// a key of it. The secret is fetched on first use and kept.
+type VaultSecrets struct {
+    Addr      string // e.g. https://vault.example.com:8200
+    Token     Secret
+    Namespace string // Vault Enterprise namespace, if any
+    Mount     string // the KV engine's mount; "secret" if empty
+    Path      string // the secret within the mount, e.g. "zaai/prod"
+    Client    *http.Client
+
+    mu   sync.Mutex
+    data map[string]string
+}
+
+// NewVaultSecrets reads path (mount/secret, e.g. "secret/zaai") from the
+// Vault at $VAULT_ADDR with $VAULT_TOKEN, as the vault CLI does.
+func NewVaultSecrets(path string) *VaultSecrets {
+    mount, secret, _ := strings.Cut(path, "/")
+    return &VaultSecrets{
+        Addr:      os.Getenv("VAULT_ADDR"),
+        Token:     NewSecret(os.Getenv("VAULT_TOKEN")),
+        Namespace: os.Getenv("VAULT_NAMESPACE"),
+        Mount:     mount,
+        Path:      secret,
+    }
+}
+
+func (v *VaultSecrets) Secret(ctx context.Context, name string) (Secret, error) {
+    v.mu.Lock()
+    defer v.mu.Unlock()
+    if v.data == nil {
+        data, err := v.fetch(ctx)
+        if err != nil {
+            return Secret{}, fmt.Errorf("secret %s: vault: %w", name, err)
+        }
+        v.data = data
+    }
+    value, ok := v.data[name]
+    if !ok {
+        return Secret{}, fmt.Errorf("secret %s: vault %s/%s: %w", name, cmp.Or(v.Mount, "secret"), v.Path, ErrNotFound)
+    }
+    return NewSecret(value), nil
+}
+
+func (v *VaultSecrets) fetch(ctx context.Context) (map[string]string, error) {
+    if v.Addr == "" || v.Token.IsZero() {
+        return nil, errors.New("needs an address and a token")
+    }
+    u := strings.TrimRight(v.Addr, "/") + "/v1/" + cmp.Or(v.Mount, "secret") + "/data/" + v.Path
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("X-Vault-Token", v.Token.Reveal())
+    if v.Namespace != "" {
+        req.Header.Set("X-Vault-Namespace", v.Namespace)
+    }
+    client := v.Client
+    if client == nil {
+        client = &http.Client{Timeout: 10 * time.Second}
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+    }
+    var body struct {
+        Data struct {
+            Data map[string]string `json:"data"`
+        } `json:"data"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+        return nil, fmt.Errorf("GET %s: %w", u, err)
+    }
+    return body.Data.Data, nil
+}
+
+// SecretChain returns the secret from the first source that has it.
+type SecretChain []SecretSource
+
+func (c SecretChain) Secret(ctx context.Context, name string) (Secret, error) {
+    err := fmt.Errorf("secret %s: no sources: %w", name, ErrNotFound)
+    for _, src := range c {
+        var s Secret
+        if s, err = src.Secret(ctx, name); !errors.Is(err, ErrNotFound) {
+            return s, err
+        }
+    }
+    return Secret{}, err
+}
+
+// ParseSecretSources builds a SecretChain from a comma-separated list of
+// "env", "file" or "file:DIR", and "vault:MOUNT/PATH".
+func ParseSecretSources(spec string) (SecretChain, error) {
+    var chain SecretChain
+    for _, item := range strings.Split(spec, ",") {
+        kind, arg, _ := strings.Cut(strings.TrimSpace(item), ":")
+        switch kind {
+        case "":
+        case "env":
+            chain = append(chain, EnvSecrets{Prefix: "ZAAI_"})
+        case "file":
+            chain = append(chain, FileSecrets{Dir: arg})
+        case "vault":
+            if arg == "" {
+                return nil, errors.New("vault secrets need a path, as in vault:secret/zaai")
+            }
+            chain = append(chain, NewVaultSecrets(arg))
+        default:
+            return nil, fmt.Errorf("unknown secret source %q", item)
+        }
+    }
+    return chain, nil
+}
+
+// OptionalSecret is src.Secret, but a secret src doesn't have is the
+// zero Secret rather than an error.
+func OptionalSecret(ctx context.Context, src SecretSource, name string) (Secret, error) {
+    s, err := src.Secret(ctx, name)
+    if errors.Is(err, ErrNotFound) {
+        return Secret{}, nil
+    }
+    return s, err
+}
+
+// ReadTokenKeys reads the JWT signing keys with the given IDs, each from
+// the secret SecretJWTKeyPrefix+id, for TokenConfig.Keys.
+func ReadTokenKeys(ctx context.Context, src SecretSource, ids ...string) (map[string][]byte, error) {
+    keys := make(map[string][]byte, len(ids))
+    for _, id := range ids {
+        s, err := src.Secret(ctx, SecretJWTKeyPrefix+id)
+        if err != nil {
+            return nil, err
+        }
+        keys[id] = []byte(s.Reveal())
+    }
+    return keys, nil
+}
+
+// dsnWithPassword sets the password in a PostgreSQL connection string,
+// either a URL or key=value pairs.
+func dsnWithPassword(dsn string, password Secret) string {
+    if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+        u.User = url.UserPassword(u.User.Username(), password.Reveal())
+        return u.String()
+    }
+    quoted := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(password.Reveal())
+    return strings.TrimSpace(dsn + " password='" + quoted + "'")
+}
+
+// Runtime configuration
+//
+// Some settings are safe to change while serving: the log level, the
+// rate limit and feature flags. serve -config names a JSON file holding
+// them, a RuntimeConfig, and a ConfigWatcher applies its edits without a
+// restart, logging (and, with an audit log, auditing) what changed.
+
+// DefaultConfigPollInterval is how often ConfigWatcher checks its file.
+const DefaultConfigPollInterval = 2 * time.Second
+
+// RuntimeConfig is the reloadable configuration. Absent fields leave the
+// running setting alone; a present "features" sets every flag, and flags
+// it leaves out go back to their defaults.
+//
+//     {"log_level": "debug", "rate_limit": 120, "features": {"graphql": false}}
+type RuntimeConfig struct {
+    LogLevel string `json:"log_level,omitempty"`
+    // RateLimit is requests per minute per client; 0 lifts the limit.
+    RateLimit *int            `json:"rate_limit,omitempty"`
+    Features  map[string]bool `json:"features,omitempty"`
+}
+
+func ReadRuntimeConfig(path string) (RuntimeConfig, error) {
+    var cfg RuntimeConfig
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return cfg, err
+    }
+    if err := json.Unmarshal(data, &cfg); err != nil {
+        return cfg, fmt.Errorf("%s: %w", path, err)
+    }
+    if cfg.LogLevel != "" {
+        if _, err := ParseLogLevel(cfg.LogLevel); err != nil {
+            return cfg, fmt.Errorf("%s: %w", path, err)
+        }
+    }
+    if cfg.RateLimit != nil && *cfg.RateLimit < 0 {
+        return cfg, fmt.Errorf("%s: negative rate_limit", path)
+    }
+    return cfg, nil
+}
+
+// FeatureFlags are named switches that can change while serving. A flag
+// without a default is off until set, as is every flag of a nil
+// *FeatureFlags.
+type FeatureFlags struct {
+    mu       sync.RWMutex
+    defaults map[string]bool
+    flags    map[string]bool
+}
+
+// Features serve can switch off while running, with FeatureGate on their
+// routes. They are on by default.
+const (
+    FeatureGraphQL     = "graphql"      // GET and POST /graphql
+    FeatureEventStream = "event_stream" // GET /ws
+    FeatureStatsStream = "stats_stream" // GET /stats/stream
+)
+
+var DefaultFeatures = map[string]bool{FeatureGraphQL: true, FeatureEventStream: true, FeatureStatsStream: true}
+
+func NewFeatureFlags(defaults map[string]bool) *FeatureFlags {
+    f := &FeatureFlags{defaults: maps.Clone(defaults)}
+    f.Set(nil)
+    return f
+}
+
+func (f *FeatureFlags) Enabled(name string) bool {
+    if f == nil {
+        return false
+    }
+    f.mu.RLock()
+    defer f.mu.RUnlock()
+    return f.flags[name]
+}
+
+// Set replaces every flag with flags, over the defaults.
+func (f *FeatureFlags) Set(flags map[string]bool) {
+    merged := make(map[string]bool, len(f.defaults)+len(flags))
+    maps.Copy(merged, f.defaults)
+    maps.Copy(merged, flags)
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.flags = merged
+}
+
+// All returns a copy of the flags.
+func (f *FeatureFlags) All() map[string]bool {
+    f.mu.RLock()
+    defer f.mu.RUnlock()
+    return maps.Clone(f.flags)
+}
+
+// ConfigWatcher applies a RuntimeConfig file to the settings it is given;
+// nil ones are left alone. The standard library has no file
+// notifications, so it polls the file's size and modification time,
+// which also catches a file replaced by rename, as editors and config
+// management tools do. A version of the file that fails to parse is
+// logged once and skipped, leaving the last good settings in force.
+type ConfigWatcher struct {
+    LogLevel *slog.LevelVar
+    // RateLimit is the variable passed to WithRateLimitVar.
+    RateLimit *atomic.Int64
+    Features  *FeatureFlags
+    // Audit, if set, records each reload that changed something as
+    // ActionReloadConfig.
+    Audit AuditLog
+
+    path     string
+    interval time.Duration
+    logger   Logger
+
+    mu      sync.Mutex
+    modTime time.Time
+    size    int64
+    cancel  context.CancelFunc
+    done    chan struct{}
+}
+
+// NewConfigWatcher watches path, checking every interval or
+// DefaultConfigPollInterval if zero.
+func NewConfigWatcher(path string, interval time.Duration, logger Logger) *ConfigWatcher {
+    if interval <= 0 {
+        interval = DefaultConfigPollInterval
+    }
+    return &ConfigWatcher{path: path, interval: interval, logger: logger}
+}
+
+// Start polls in the background until Stop is called or ctx ends.
+// Calling Start on a running watcher does nothing.
+func (w *ConfigWatcher) Start(ctx context.Context) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if w.cancel != nil {
+        return
+    }
+    ctx, w.cancel = context.WithCancel(ctx)
+    w.done = make(chan struct{})
+
+    go func() {
+        defer close(w.done)
+        ticker := time.NewTicker(w.interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+                if err := w.Reload(ctx); err != nil {
+                    w.logger.Error("Configuration reload failed; keeping current settings", "path", w.path, "error", err)
+                }
+            }
+        }
+    }()
+}
+
+// Stop halts polling and waits for a reload in progress.
+func (w *ConfigWatcher) Stop() {
+    w.mu.Lock()
+    cancel, done := w.cancel, w.done
+    w.cancel, w.done = nil, nil
+    w.mu.Unlock()
+    if cancel != nil {
+        cancel()
+        <-done
+    }
+}
+
+// Reload applies the file if it has changed since the last check, or
+// hasn't been loaded yet; serve calls it once before starting
+// so that a bad file stops startup.
+func (w *ConfigWatcher) Reload(ctx context.Context) error {
+    info, err := os.Stat(w.path)
+    if err != nil {
+        return err
+    }
+    w.mu.Lock()
+    unchanged := info.ModTime().Equal(w.modTime) && info.Size() == w.size
+    w.modTime, w.size = info.ModTime(), info.Size()
+    w.mu.Unlock()
+    if unchanged {
+        return nil
+    }
+    cfg, err := ReadRuntimeConfig(w.path)
+    if err != nil {
+        return err
+    }
+
+    changes := w.apply(cfg)
+    if len(changes) == 0 {
+        return nil
+    }
+    w.logger.Warn("Configuration reloaded", "path", w.path, "changes", changes)
+    if w.Audit != nil {
+        entry := AuditEntry{At: time.Now(), Action: ActionReloadConfig, Detail: strings.Join(changes, "; ")}
+        if err := w.Audit.Record(ctx, entry); err != nil {
+            w.logger.Error("Failed to audit configuration reload", "error", err)
+        }
+    }
+    return nil
+}
+
+// apply sets what cfg holds and describes each setting it changed.
+func (w *ConfigWatcher) apply(cfg RuntimeConfig) []string {
+    var changes []string
+    if cfg.LogLevel != "" && w.LogLevel != nil {
+        level, _ := ParseLogLevel(cfg.LogLevel) // checked by ReadRuntimeConfig
+        if old := w.LogLevel.Level(); old != level {
+            w.LogLevel.Set(level)
+            changes = append(changes, fmt.Sprintf("log_level %s -> %s", old, level))
+        }
+    }
+    if cfg.RateLimit != nil && w.RateLimit != nil {
+        if old := w.RateLimit.Swap(int64(*cfg.RateLimit)); old != int64(*cfg.RateLimit) {
+            changes = append(changes, fmt.Sprintf("rate_limit %d -> %d", old, *cfg.RateLimit))
+        }
+    }
+    if cfg.Features != nil && w.Features != nil {
+        old := w.Features.All()
+        w.Features.Set(cfg.Features)
+        now := w.Features.All()
+        names := slices.Collect(maps.Keys(now))
+        for name := range old {
+            if _, ok := now[name]; !ok {
+                names = append(names, name)
+            }
+        }
+        slices.Sort(names)
+        for _, name := range names {
+            if old[name] != now[name] {
+                changes = append(changes, fmt.Sprintf("feature %s %s", name, onOff(now[name])))
+            }
+        }
+    }
+    return changes
+}
+
+func onOff(on bool) string {
+    if on {
+        return "on"
+    }
+    return "off"
+}
+
+// Metrics
+//
+// Metrics is a small registry of counters, histograms and gauges served
+// in the Prometheus text format (version 0.0.4), enough for this service
+// without a client library. AppMetrics holds the service's own series:
+//
+//     zaai_users_created_total                  counter
+//     zaai_users_deleted_total                  counter
+//     zaai_repository_call_duration_seconds     histogram by method
+//     zaai_repository_errors_total              counter by method
+//     zaai_http_request_duration_seconds        histogram by method, route, status
+//     zaai_event_bus_queue_depth                gauge
+//     zaai_circuit_breaker_state                gauge: 0 closed, 1 half-open, 2 open
+//     zaai_circuit_breaker_transitions_total    counter by state entered
+//     zaai_slo_*                                gauges by op; see SLOTracker
+//
+// Instrumentation wraps rather than changes: MetricsRepository decorates
+// any UserRepository, Middleware times requests, and CountEvents
+// subscribes to the event bus.
+
+// DefaultBuckets are Prometheus's default histogram buckets, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type Metrics struct {
+    mu       sync.Mutex
+    families []metricFamily
+}
+
+type metricFamily interface {
+    writeTo(w io.Writer)
+}
+
+func NewMetrics() *Metrics {
+    return &Metrics{}
+}
+
+func (m *Metrics) register(f metricFamily) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.families = append(m.families, f)
+}
+
+// ServeHTTP writes every series in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    m.mu.Lock()
+    families := slices.Clone(m.families)
+    m.mu.Unlock()
+    var b bytes.Buffer
+    for _, f := range families {
+        f.writeTo(&b)
+    }
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    w.Write(b.Bytes())
+}
+
+// metricSeries maps label values to one series' state.
+type metricSeries[T any] struct {
+    mu     sync.Mutex
+    series map[string]*labeledValue[T]
+}
+
+type labeledValue[T any] struct {
+    labels []string
+    v      T
+}
+
+func (s *metricSeries[T]) get(labels []string, want int) *labeledValue[T] {
+    if len(labels) != want {
+        panic(fmt.Sprintf("metrics: got %d label values, want %d", len(labels), want))
+    }
+    key := strings.Join(labels, "\xff")
+    lv, ok := s.series[key]
+    if !ok {
+        if s.series == nil {
+            s.series = make(map[string]*labeledValue[T])
+        }
+        lv = &labeledValue[T]{labels: slices.Clone(labels)}
+        s.series[key] = lv
+    }
+    return lv
+}
+
+// sorted returns the series ordered by label values, for stable output.
+func (s *metricSeries[T]) sorted() []*labeledValue[T] {
+    all := slices.Collect(maps.Values(s.series))
+    slices.SortFunc(all, func(a, b *labeledValue[T]) int { return slices.Compare(a.labels, b.labels) })
+    return all
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+    name, help string
+    labels     []string
+    metricSeries[float64]
+}
+
+func (m *Metrics) Counter(name, help string, labels ...string) *CounterVec {
+    c := &CounterVec{name: name, help: help, labels: labels}
+    m.register(c)
+    return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+    c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.get(labelValues, len(c.labels)).v += v
+}
+
+func (c *CounterVec) writeTo(w io.Writer) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    writeMetricHeader(w, c.name, c.help, "counter")
+    if len(c.labels) == 0 && len(c.series) == 0 {
+        fmt.Fprintf(w, "%s 0\n", c.name)
+    }
+    for _, s := range c.sorted() {
+        fmt.Fprintf(w, "%s%s %s\n", c.name, metricLabels(c.labels, s.labels), formatMetric(s.v))
+    }
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+    name, help string
+    labels     []string
+    buckets    []float64
+    metricSeries[histogram]
+}
+
+type histogram struct {
+    counts []uint64 // per bucket, not cumulative
+    sum    float64
+    count  uint64
+}
+
+// Histogram registers a histogram with buckets, upper bounds in
+// increasing order, or DefaultBuckets if nil.
+func (m *Metrics) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+    if buckets == nil {
+        buckets = DefaultBuckets
+    }
+    h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets}
+    m.register(h)
+    return h
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    s := h.get(labelValues, len(h.labels))
+    if s.v.counts == nil {
+        s.v.counts = make([]uint64, len(h.buckets))
+    }
+    if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.buckets) {
+        s.v.counts[i]++
+    }
+    s.v.sum += v
+    s.v.count++
+}
+
+func (h *HistogramVec) writeTo(w io.Writer) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    writeMetricHeader(w, h.name, h.help, "histogram")
+    names := append(slices.Clip(h.labels), "le")
+    for _, s := range h.sorted() {
+        var cumulative uint64
+        for i, le := range h.buckets {
+            cumulative += s.v.counts[i]
+            fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, metricLabels(names, append(slices.Clip(s.labels), formatMetric(le))), cumulative)
+        }
+        fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, metricLabels(names, append(slices.Clip(s.labels), "+Inf")), s.v.count)
+        fmt.Fprintf(w, "%s_sum%s %s\n", h.name, metricLabels(h.labels, s.labels), formatMetric(s.v.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", h.name, metricLabels(h.labels, s.labels), s.v.count)
+    }
+}
+
+// gaugeFunc is a gauge read when metrics are scraped.
+type gaugeFunc struct {
+    name, help string
+    fn         func() float64
+}
+
+func (m *Metrics) GaugeFunc(name, help string, fn func() float64) {
+    m.register(&gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+    writeMetricHeader(w, g.name, g.help, "gauge")
+    fmt.Fprintf(w, "%s %s\n", g.name, formatMetric(g.fn()))
+}
+
+func writeMetricHeader(w io.Writer, name, help, typ string) {
+    help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var metricLabelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricLabels(names, values []string) string {
+    if len(names) == 0 {
+        return ""
+    }
+    var b strings.Builder
+    b.WriteByte('{')
+    for i, name := range names {
+        if i > 0 {
+            b.WriteByte(',')
+        }
+        fmt.Fprintf(&b, `%s="%s"`, name, metricLabelValue.Replace(values[i]))
+    }
+    b.WriteByte('}')
+    return b.String()
+}
+
+func formatMetric(v float64) string {
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// AppMetrics is the registry with this service's series; see Metrics.
+type AppMetrics struct {
+    *Metrics
+    usersCreated *CounterVec
+    usersDeleted *CounterVec
+    repoDuration *HistogramVec
+    repoErrors   *CounterVec
+    httpDuration *HistogramVec
+    slo          *SLOTracker
+}
+
+func NewAppMetrics() *AppMetrics {
+    m := &AppMetrics{Metrics: NewMetrics()}
+    m.usersCreated = m.Counter("zaai_users_created_total", "Users created.")
+    m.usersDeleted = m.Counter("zaai_users_deleted_total", "Users deleted.")
+    m.repoDuration = m.Histogram("zaai_repository_call_duration_seconds", "Repository call latency.", nil, "method")
+    m.repoErrors = m.Counter("zaai_repository_errors_total", "Repository calls that failed.", "method")
+    m.httpDuration = m.Histogram("zaai_http_request_duration_seconds", "HTTP request latency.", nil, "method", "route", "status")
+    return m
+}
+
+// CountEvents is a Subscriber counting created and deleted users.
+func (m *AppMetrics) CountEvents(ctx context.Context, event UserEvent) error {
+    switch event.Type {
+    case EventUserCreated:
+        m.usersCreated.Inc()
+    case EventUserDeleted:
+        m.usersDeleted.Inc()
+    }
+    return nil
+}
+
+// WatchEventBus reports b's queue depth.
+func (m *AppMetrics) WatchEventBus(b *EventBus) {
+    m.GaugeFunc("zaai_event_bus_queue_depth", "Events waiting for async delivery.", func() float64 {
+        return float64(b.QueueDepth())
+    })
+}
+
+// WatchBreaker reports b's state and counts its transitions.
+func (m *AppMetrics) WatchBreaker(b *CircuitBreaker) {
+    m.GaugeFunc("zaai_circuit_breaker_state", "Repository circuit breaker state: 0 closed, 1 half-open, 2 open.", func() float64 {
+        return float64(b.State())
+    })
+    transitions := m.Counter("zaai_circuit_breaker_transitions_total", "Repository circuit breaker state changes, by state entered.", "state")
+    b.OnStateChange(func(from, to BreakerState) { transitions.Inc(to.String()) })
+}
+
+// TrackSLOs feeds t every request and repository call timed here and
+// adds its gauges to the registry. Call it before serving.
+func (m *AppMetrics) TrackSLOs(t *SLOTracker) {
+    m.slo = t
+    m.register(t)
+}
+
+// Middleware times each request, labelled by the route pattern that
+// served it (see UserAPI.ServeHTTP) rather than the raw path, so IDs
+// don't multiply series. Unrouted requests count as "unmatched".
+func (m *AppMetrics) Middleware() Middleware {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            start := time.Now()
+            route, r := routeHolder(r)
+            sw := &statusWriter{ResponseWriter: w}
+            next.ServeHTTP(sw, r)
+            if sw.status == 0 {
+                sw.status = http.StatusOK
+            }
+            elapsed := time.Since(start)
+            m.httpDuration.Observe(elapsed.Seconds(),
+                r.Method, cmp.Or(*route, "unmatched"), strconv.Itoa(sw.status))
+            if m.slo != nil && *route != "" {
+                m.slo.Observe(*route, elapsed, sw.status >= 500)
+            }
+        })
+    }
+}
+
+// routeHolder returns where noteRoute will record the pattern that
+// serves r, adding it to r's context if no outer middleware did.
+func routeHolder(r *http.Request) (*string, *http.Request) {
+    if route, ok := r.Context().Value(routeKey).(*string); ok {
+        return route, r
+    }
+    route := new(string)
+    return route, r.WithContext(context.WithValue(r.Context(), routeKey, route))
+}
+
+// noteRoute tells the metrics and tracing middleware, if any, which
+// pattern served r.
+func noteRoute(r *http.Request) {
+    if route, ok := r.Context().Value(routeKey).(*string); ok && r.Pattern != "" {
+        *route = r.Pattern
+    }
+}
+
+// MetricsRepository records the latency and failures of every call to
+// the repository it wraps, by method.
+var _ UserRepository = (*MetricsRepository)(nil)
+
+type MetricsRepository struct {
+    next    UserRepository
+    metrics *AppMetrics
+}
+
+func NewMetricsRepository(next UserRepository, metrics *AppMetrics) *MetricsRepository {
+    return &MetricsRepository{next: next, metrics: metrics}
+}
+
+// Unwrap returns the decorated repository; see findRepository.
+func (r *MetricsRepository) Unwrap() UserRepository {
+    return r.next
+}
+
+// observe is deferred by every method: defer r.observe("Op", time.Now(), &err).
+func (r *MetricsRepository) observe(method string, start time.Time, err *error) {
+    elapsed := time.Since(start)
+    r.metrics.repoDuration.Observe(elapsed.Seconds(), method)
+    if *err != nil {
+        r.metrics.repoErrors.Inc(method)
+    }
+    if r.metrics.slo != nil {
+        r.metrics.slo.Observe("repository."+method, elapsed, *err != nil && !errors.Is(*err, ErrNotFound))
+    }
+}
+
+func (r *MetricsRepository) Save(ctx context.Context, user *User) (err error) {
+    defer r.observe("Save", time.Now(), &err)
+    return r.next.Save(ctx, user)
+}
+
+func (r *MetricsRepository) Insert(ctx context.Context, user *User) (err error) {
+    defer r.observe("Insert", time.Now(), &err)
+    return r.next.Insert(ctx, user)
+}
+
+func (r *MetricsRepository) FindByID(ctx context.Context, id UserID) (_ *User, err error) {
+    defer r.observe("FindByID", time.Now(), &err)
+    return r.next.FindByID(ctx, id)
+}
+
+func (r *MetricsRepository) FindAll(ctx context.Context, order SortSpec) (_ []*User, err error) {
+    defer r.observe("FindAll", time.Now(), &err)
+    return r.next.FindAll(ctx, order)
+}
+
+// FindAllIter is timed until the stream is fully consumed or abandoned.
+func (r *MetricsRepository) FindAllIter(ctx context.Context) iter.Seq2[*User, error] {
+    return func(yield func(*User, error) bool) {
+        var err error
+        defer r.observe("FindAllIter", time.Now(), &err)
+        for user, iterErr := range r.next.FindAllIter(ctx) {
+            err = iterErr
+            if !yield(user, iterErr) {
+                return
+            }
+        }
+    }
+}
+
+func (r *MetricsRepository) FindPage(ctx context.Context, page PageRequest) (_ *Page, err error) {
+    defer r.observe("FindPage", time.Now(), &err)
+    return r.next.FindPage(ctx, page)
+}
+
+func (r *MetricsRepository) Delete(ctx context.Context, id UserID) (err error) {
+    defer r.observe("Delete", time.Now(), &err)
+    return r.next.Delete(ctx, id)
+}
+
+func (r *MetricsRepository) FindByEmail(ctx context.Context, email string) (_ *User, err error) {
+    defer r.observe("FindByEmail", time.Now(), &err)
+    return r.next.FindByEmail(ctx, email)
+}
+
+func (r *MetricsRepository) Restore(ctx context.Context, id UserID) (err error) {
+    defer r.observe("Restore", time.Now(), &err)
+    return r.next.Restore(ctx, id)
+}
+
+func (r *MetricsRepository) PurgeDeleted(ctx context.Context, olderThan time.Duration) (_ int, err error) {
+    defer r.observe("PurgeDeleted", time.Now(), &err)
+    return r.next.PurgeDeleted(ctx, olderThan)
+}
+
+func (r *MetricsRepository) SaveAll(ctx context.Context, users []*User) (err error) {
+    defer r.observe("SaveAll", time.Now(), &err)
+    return r.next.SaveAll(ctx, users)
+}
+
+func (r *MetricsRepository) DeleteAll(ctx context.Context, ids []UserID) (err error) {
+    defer r.observe("DeleteAll", time.Now(), &err)
+    return r.next.DeleteAll(ctx, ids)
+}
+
+func (r *MetricsRepository) FindWhere(ctx context.Context, filter UserFilter) (_ []*User, err error) {
+    defer r.observe("FindWhere", time.Now(), &err)
+    return r.next.FindWhere(ctx, filter)
+}
+
+// WithinTx also records the calls made inside the transaction.
+func (r *MetricsRepository) WithinTx(ctx context.Context, fn func(UserRepository) error) (err error) {
+    defer r.observe("WithinTx", time.Now(), &err)
+    return WithinTx(ctx, r.next, func(tx UserRepository) error {
+        return fn(NewMetricsRepository(tx, r.metrics))
+    })
+}
+
+// SLOs
+//
+// SLOTracker keeps rolling error rates and latency percentiles for each
+// operation and checks them against service level objectives. AppMetrics
+// feeds it (see TrackSLOs): an HTTP route is an operation named by its
+// pattern, e.g. "GET /users/{id}", and fails when it answers 5xx; a
+// repository method is one named like "repository.Save", and fails on
+// any error but ErrNotFound.
+//
+// An SLO's error budget is the share of calls allowed to go wrong,
+// 1-Objective, and with a Latency target slow calls count against it too.
+// The burn rate is how fast the window spends it: at 1 the budget lasts
+// exactly, and at the default alert threshold of 14.4 a 30-day budget
+// is gone in two days. Alert callbacks run when an operation starts
+// burning that fast and again when it stops, as checked on each call.
+
+const (
+    sloSlots   = 60
+    sloBuckets = 4 * 27 // four per doubling, from 1µs to about two minutes
+)
+
+// SLO is the objective for one operation.
+type SLO struct {
+    Op string
+    // Objective is the fraction of calls that must go right, e.g. 0.999.
+    Objective float64
+    // Latency, if set, counts successful calls slower than this as bad.
+    Latency time.Duration
+}
+
+// SLOStatus is one operation's record over the tracker's window.
+// Percentiles are in seconds and accurate to within about 10%.
+type SLOStatus struct {
+    Op        string     `json:"op"`
+    Calls     int64      `json:"calls"`
+    Errors    int64      `json:"errors"`
+    ErrorRate float64    `json:"error_rate"`
+    P50       float64    `json:"p50_seconds"`
+    P90       float64    `json:"p90_seconds"`
+    P99       float64    `json:"p99_seconds"`
+    Budget    *SLOBudget `json:"budget,omitempty"` // operations with an SLO
+}
+
+// SLOBudget is how an operation stands against its SLO.
+type SLOBudget struct {
+    Objective float64 `json:"objective"`
+    Latency   float64 `json:"latency_seconds,omitempty"`
+    // Bad counts errors and, with a Latency target, slow calls.
+    Bad int64 `json:"bad"`
+    // Remaining is the unspent fraction of the window's budget; negative
+    // once overspent.
+    Remaining float64 `json:"remaining"`
+    BurnRate  float64 `json:"burn_rate"`
+    Burning   bool    `json:"burning"`
+}
+
+// SLOAlert reports an operation starting, or with Burning false
+// ceasing, to burn its budget at the tracker's alert rate.
+type SLOAlert struct {
+    SLO     SLO
+    Status  SLOStatus
+    Burning bool
+}
+
+type SLOTracker struct {
+    // BurnRate is the burn rate that raises an alert; 14.4 if zero.
+    BurnRate float64
+    // MinCalls is how many calls the window must hold before an alert,
+    // so that one early failure doesn't raise one; 100 if zero.
+    MinCalls int64
+
+    window time.Duration
+    mu     sync.Mutex
+    slos   map[string]SLO
+    ops    map[string]*sloOp
+    alerts []func(SLOAlert)
+}
+
+type sloOp struct {
+    slots   [sloSlots]sloSlot
+    burning bool
+}
+
+// sloSlot holds one sixtieth of the window.
+type sloSlot struct {
+    epoch               int64
+    calls, errors, slow int64
+    latency             [sloBuckets]uint32
+}
+
+// NewSLOTracker tracks operations over the last window, an hour if zero.
+func NewSLOTracker(window time.Duration, slos ...SLO) *SLOTracker {
+    if window <= 0 {
+        window = time.Hour
+    }
+    t := &SLOTracker{window: window, slos: make(map[string]SLO), ops: make(map[string]*sloOp)}
+    for _, slo := range slos {
+        t.Define(slo)
+    }
+    return t
+}
+
+// ReadSLOs reads a JSON array of objectives from path:
+//
+//     [{"op": "GET /users/{id}", "objective": 0.999, "latency": "250ms"}]
+func ReadSLOs(path string) ([]SLO, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var cfgs []struct {
+        Op        string  `json:"op"`
+        Objective float64 `json:"objective"`
+        Latency   string  `json:"latency"`
+    }
+    if err := json.Unmarshal(data, &cfgs); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    slos := make([]SLO, len(cfgs))
+    for i, cfg := range cfgs {
+        if cfg.Op == "" || cfg.Objective <= 0 || cfg.Objective >= 1 {
+            return nil, fmt.Errorf("%s: SLO %d needs an op and an objective between 0 and 1", path, i)
+        }
+        slos[i] = SLO{Op: cfg.Op, Objective: cfg.Objective}
+        if cfg.Latency != "" {
+            if slos[i].Latency, err = time.ParseDuration(cfg.Latency); err != nil {
+                return nil, fmt.Errorf("%s: SLO %q: %w", path, cfg.Op, err)
+            }
+        }
+    }
+    return slos, nil
+}
+
+// Define sets the objective for slo.Op. Operations without one are
+// still tracked, just never alerted on.
+func (t *SLOTracker) Define(slo SLO) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.slos[slo.Op] = slo
+}
+
+// OnAlert adds a callback for burn alerts. Callbacks run on the calling
+// request's goroutine, so slow ones should hand off.
+func (t *SLOTracker) OnAlert(fn func(SLOAlert)) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.alerts = append(t.alerts, fn)
+}
+
+// Observe records one call to op taking d.
+func (t *SLOTracker) Observe(op string, d time.Duration, failed bool) {
+    t.mu.Lock()
+    epoch := t.epoch()
+    o := t.ops[op]
+    if o == nil {
+        o = new(sloOp)
+        t.ops[op] = o
+    }
+    slo, ok := t.slos[op]
+    s := o.slot(epoch)
+    s.calls++
+    if failed {
+        s.errors++
+    } else if ok && slo.Latency > 0 && d > slo.Latency {
+        s.slow++
+    }
+    s.latency[sloBucket(d)]++
+    if !ok {
+        t.mu.Unlock()
+        return
+    }
+    calls, bad := o.budgetTotals(epoch)
+    burning := calls >= cmp.Or(t.MinCalls, 100) && burnRate(calls, bad, slo) >= cmp.Or(t.BurnRate, 14.4)
+    if burning == o.burning {
+        t.mu.Unlock()
+        return
+    }
+    o.burning = burning
+    alert := SLOAlert{SLO: slo, Status: t.status(op, o, epoch), Burning: burning}
+    alerts := slices.Clone(t.alerts)
+    t.mu.Unlock()
+    for _, fn := range alerts {
+        fn(alert)
+    }
+}
+
+// Report returns every operation's status, by name.
+func (t *SLOTracker) Report() []SLOStatus {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    epoch := t.epoch()
+    report := make([]SLOStatus, 0, len(t.ops))
+    for _, op := range slices.Sorted(maps.Keys(t.ops)) {
+        report = append(report, t.status(op, t.ops[op], epoch))
+    }
+    return report
+}
+
+// epoch numbers the slot now falls in.
+func (t *SLOTracker) epoch() int64 {
+    return time.Now().UnixNano() / int64(t.window/sloSlots)
+}
+
+func (t *SLOTracker) status(op string, o *sloOp, epoch int64) SLOStatus {
+    st := SLOStatus{Op: op}
+    var latency [sloBuckets]int64
+    var slow int64
+    for i := range o.slots {
+        s := &o.slots[i]
+        if epoch-s.epoch >= sloSlots {
+            continue
+        }
+        st.Calls += s.calls
+        st.Errors += s.errors
+        slow += s.slow
+        for b, n := range s.latency {
+            latency[b] += int64(n)
+        }
+    }
+    if st.Calls > 0 {
+        st.ErrorRate = float64(st.Errors) / float64(st.Calls)
+    }
+    st.P50 = sloPercentile(&latency, st.Calls, 0.5)
+    st.P90 = sloPercentile(&latency, st.Calls, 0.9)
+    st.P99 = sloPercentile(&latency, st.Calls, 0.99)
+    if slo, ok := t.slos[op]; ok {
+        bad := st.Errors + slow
+        st.Budget = &SLOBudget{
+            Objective: slo.Objective,
+            Latency:   slo.Latency.Seconds(),
+            Bad:       bad,
+            Remaining: 1,
+            BurnRate:  burnRate(st.Calls, bad, slo),
+            Burning:   o.burning,
+        }
+        if st.Calls > 0 {
+            st.Budget.Remaining = 1 - float64(bad)/(float64(st.Calls)*(1-slo.Objective))
+        }
+    }
+    return st
+}
+
+// slot returns the slot for epoch, clearing what it held a window ago.
+func (o *sloOp) slot(epoch int64) *sloSlot {
+    s := &o.slots[epoch%sloSlots]
+    if s.epoch != epoch {
+        *s = sloSlot{epoch: epoch}
+    }
+    return s
+}
+
+// budgetTotals counts the window's calls and those against the budget.
+func (o *sloOp) budgetTotals(epoch int64) (calls, bad int64) {
+    for i := range o.slots {
+        if s := &o.slots[i]; epoch-s.epoch < sloSlots {
+            calls += s.calls
+            bad += s.errors + s.slow
+        }
+    }
+    return calls, bad
+}
+
+func burnRate(calls, bad int64, slo SLO) float64 {
+    if calls == 0 || slo.Objective >= 1 {
+        return 0
+    }
+    return float64(bad) / float64(calls) / (1 - slo.Objective)
+}
+
+// sloBucket places d in a logarithmic bucket: bucket i holds durations
+// from 2^(i/4) to 2^((i+1)/4) microseconds.
+func sloBucket(d time.Duration) int {
+    us := float64(d) / float64(time.Microsecond)
+    if us < 1 {
+        return 0
+    }
+    return min(int(4*math.Log2(us)), sloBuckets-1)
+}
+
+// sloPercentile returns the q-th percentile of n calls in seconds, the
+// geometric middle of the bucket it falls in.
+func sloPercentile(latency *[sloBuckets]int64, n int64, q float64) float64 {
+    if n == 0 {
+        return 0
+    }
+    rank := int64(math.Ceil(q * float64(n)))
+    var seen int64
+    for i, count := range latency {
+        if seen += count; seen >= rank {
+            return math.Exp2((float64(i)+0.5)/4) * 1e-6
+        }
+    }
+    return 0
+}
+
+// writeTo makes SLOTracker a metricFamily; see AppMetrics.TrackSLOs.
+func (t *SLOTracker) writeTo(w io.Writer) {
+    report := t.Report()
+    writeMetricHeader(w, "zaai_slo_error_ratio", "Share of calls that failed over the SLO window.", "gauge")
+    for _, st := range report {
+        fmt.Fprintf(w, "zaai_slo_error_ratio%s %s\n", metricLabels([]string{"op"}, []string{st.Op}), formatMetric(st.ErrorRate))
+    }
+    writeMetricHeader(w, "zaai_slo_latency_seconds", "Latency percentiles over the SLO window.", "gauge")
+    for _, st := range report {
+        for _, p := range []struct {
+            q string
+            v float64
+        }{{"0.5", st.P50}, {"0.9", st.P90}, {"0.99", st.P99}} {
+            fmt.Fprintf(w, "zaai_slo_latency_seconds%s %s\n", metricLabels([]string{"op", "quantile"}, []string{st.Op, p.q}), formatMetric(p.v))
+        }
+    }
+    writeMetricHeader(w, "zaai_slo_budget_remaining", "Unspent fraction of the error budget over the SLO window.", "gauge")
+    for _, st := range report {
+        if st.Budget != nil {
+            fmt.Fprintf(w, "zaai_slo_budget_remaining%s %s\n", metricLabels([]string{"op"}, []string{st.Op}), formatMetric(st.Budget.Remaining))
+        }
+    }
+    writeMetricHeader(w, "zaai_slo_burn_rate", "Rate the error budget is being spent; 1 lasts exactly.", "gauge")
+    for _, st := range report {
+        if st.Budget != nil {
+            fmt.Fprintf(w, "zaai_slo_burn_rate%s %s\n", metricLabels([]string{"op"}, []string{st.Op}), formatMetric(st.Budget.BurnRate))
+        }
+    }
+}
+
+// Tracing
+//
+// Tracer records spans in the OpenTelemetry model and OTLPExporter sends
+// them to a collector over OTLP/HTTP with JSON encoding, so traces join
+// those of other services without the OpenTelemetry SDK. Trace context
+// crosses process boundaries in the W3C traceparent header: Tracing
+// continues an incoming trace, and outbound calls made with a traced
+// context (S3, notifications, Client) carry it on. Spans are made by:
+//
+//     Tracing                 one server span per HTTP request, named by route
+//     WithTracer              one span per UserService method
+//     TracingRepository       one span per repository call, errors recorded
+//
+// A nil *Tracer and a nil *Span do nothing, so instrumented code needn't
+// check whether tracing is on. Log lines from context-bound loggers carry
+// trace_id and span_id for correlation.
+
+type SpanKind int
+
+// Span kinds, numbered as in OTLP.
+const (
+    SpanKindInternal SpanKind = 1
+    SpanKindServer   SpanKind = 2
+    SpanKindClient   SpanKind = 3
+)
+
+// SpanExporter receives spans as they end.
+type SpanExporter interface {
+    ExportSpan(span *Span)
+}
+
+type Tracer struct {
+    exporter SpanExporter
+}
+
+func NewTracer(exporter SpanExporter) *Tracer {
+    return &Tracer{exporter: exporter}
+}
+
+// spanContext identifies a span, possibly in another process.
+type spanContext struct {
+    traceID [16]byte
+    spanID  [8]byte
+    sampled bool
+}
+
+// Span is one timed operation. Its methods are safe for concurrent use.
+type Span struct {
+    tracer   *Tracer
+    sc       spanContext
+    parentID [8]byte
+    kind     SpanKind
+    start    time.Time
+
+    mu         sync.Mutex
+    name       string
+    end        time.Time
+    attrs      []slog.Attr
+    failed     bool
+    statusText string
+}
+
+// Start begins a span as a child of the span, local or remote, in ctx,
+// or of a new trace, and returns ctx carrying it. End the span when the
+// operation finishes.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+    if t == nil {
+        return ctx, nil
+    }
+    span := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+    if parent, ok := spanContextFrom(ctx); ok {
+        span.sc.traceID, span.sc.sampled, span.parentID = parent.traceID, parent.sampled, parent.spanID
+    } else {
+        rand.Read(span.sc.traceID[:])
+        span.sc.sampled = true
+    }
+    rand.Read(span.sc.spanID[:])
+    return context.WithValue(ctx, spanKey, span), span
+}
+
+// SpanFromContext returns the span started in ctx, if any.
+func SpanFromContext(ctx context.Context) *Span {
+    span, _ := ctx.Value(spanKey).(*Span)
+    return span
+}
+
+func spanContextFrom(ctx context.Context) (spanContext, bool) {
+    if span := SpanFromContext(ctx); span != nil {
+        return span.sc, true
+    }
+    sc, ok := ctx.Value(remoteSpanKey).(spanContext)
+    return sc, ok
+}
+
+func (s *Span) SetName(name string) {
+    if s == nil {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.name = name
+}
+
+// SetAttributes adds attributes given as alternating keys and values or
+// slog.Attr, like Logger.
+func (s *Span) SetAttributes(attrs ...any) {
+    if s == nil {
+        return
+    }
+    var r slog.Record
+    r.Add(attrs...)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    r.Attrs(func(a slog.Attr) bool {
+        s.attrs = append(s.attrs, a)
+        return true
+    })
+}
+
+// RecordError marks the span failed with err, if err is not nil.
+func (s *Span) RecordError(err error) {
+    if s == nil || err == nil {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.failed, s.statusText = true, err.Error()
+}
+
+// End finishes the span and exports it if sampled. Later calls do
+// nothing.
+func (s *Span) End() {
+    if s == nil {
+        return
+    }
+    s.mu.Lock()
+    if !s.end.IsZero() {
+        s.mu.Unlock()
+        return
+    }
+    s.end = time.Now()
+    s.mu.Unlock()
+    if s.sc.sampled && s.tracer.exporter != nil {
+        s.tracer.exporter.ExportSpan(s)
+    }
+}
+
+func (s *Span) TraceID() string {
+    return hex.EncodeToString(s.sc.traceID[:])
+}
+
+func (s *Span) SpanID() string {
+    return hex.EncodeToString(s.sc.spanID[:])
+}
+
+// traceparent formats sc as a W3C traceparent header value.
+func (sc spanContext) traceparent() string {
+    flags := "00"
+    if sc.sampled {
+        flags = "01"
+    }
+    return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-" + flags
+}
+
+// parseTraceparent reads a W3C traceparent header value. Unknown future
+// versions are read as version 00, as the spec asks.
+func parseTraceparent(v string) (spanContext, bool) {
+    var sc spanContext
+    parts := strings.Split(strings.TrimSpace(v), "-")
+    if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+        return sc, false
+    }
+    traceID, err1 := hex.DecodeString(parts[1])
+    spanID, err2 := hex.DecodeString(parts[2])
+    flags, err3 := hex.DecodeString(parts[3])
+    if err1 != nil || err2 != nil || err3 != nil || len(traceID) != 16 || len(spanID) != 8 || len(flags) != 1 {
+        return sc, false
+    }
+    copy(sc.traceID[:], traceID)
+    copy(sc.spanID[:], spanID)
+    if sc.traceID == ([16]byte{}) || sc.spanID == ([8]byte{}) {
+        return sc, false
+    }
+    sc.sampled = flags[0]&1 == 1
+    return sc, true
+}
+
+// Tracing starts a server span for each request, continuing the trace in
+// its traceparent header if it has a valid one.
+func Tracing(t *Tracer) Middleware {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            ctx := r.Context()
+            if sc, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+                ctx = context.WithValue(ctx, remoteSpanKey, sc)
+            }
+            ctx, span := t.Start(ctx, r.Method, SpanKindServer)
+            defer span.End()
+            route, r := routeHolder(r.WithContext(ctx))
+            sw := &statusWriter{ResponseWriter: w}
+            next.ServeHTTP(sw, r)
+            if sw.status == 0 {
+                sw.status = http.StatusOK
+            }
+            span.SetAttributes("http.request.method", r.Method, "url.path", r.URL.Path,
+                "http.response.status_code", sw.status)
+            if *route != "" {
+                span.SetName(*route)
+                span.SetAttributes("http.route", *route)
+            }
+            if sw.status >= http.StatusInternalServerError {
+                span.RecordError(errors.New(http.StatusText(sw.status)))
+            }
+        })
+    }
+}
+
+// OTLPExporter batches spans and POSTs them to an OpenTelemetry
+// collector's /v1/traces as OTLP JSON, every five seconds or once 512
+// spans are waiting. At most 2048 spans wait; more are dropped and
+// counted. A failed batch is logged and not retried.
+type OTLPExporter struct {
+    // Headers are added to every export, e.g. for collector auth.
+    Headers map[string]string
+
+    url     string
+    service string
+    client  *http.Client
+    logger  Logger
+
+    mu      sync.Mutex
+    spans   []*Span
+    dropped int64
+    kick    chan struct{}
+    stop    chan struct{}
+    done    chan struct{}
+}
+
+const (
+    otlpBatchSize  = 512
+    otlpQueueLimit = 2048
+)
+
+// NewOTLPExporter exports to the collector at endpoint, such as
+// http://localhost:4318, as service.
+func NewOTLPExporter(endpoint, service string, logger Logger) *OTLPExporter {
+    e := &OTLPExporter{
+        url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+        service: service,
+        client:  &http.Client{Timeout: 10 * time.Second},
+        logger:  logger,
+        kick:    make(chan struct{}, 1),
+        stop:    make(chan struct{}),
+        done:    make(chan struct{}),
+    }
+    go e.loop()
+    return e
+}
+
+func (e *OTLPExporter) ExportSpan(span *Span) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if len(e.spans) >= otlpQueueLimit {
+        e.dropped++
+        return
+    }
+    e.spans = append(e.spans, span)
+    if len(e.spans) >= otlpBatchSize {
+        select {
+        case e.kick <- struct{}{}:
+        default:
+        }
+    }
+}
+
+func (e *OTLPExporter) loop() {
+    defer close(e.done)
+    tick := time.NewTicker(5 * time.Second)
+    defer tick.Stop()
+    for {
+        select {
+        case <-tick.C:
+        case <-e.kick:
+        case <-e.stop:
+            e.flush()
+            return
+        }
+        e.flush()
+    }
+}
+
+func (e *OTLPExporter) flush() {
+    e.mu.Lock()
+    spans := e.spans
+    e.spans = nil
+    dropped := e.dropped
+    e.dropped = 0
+    e.mu.Unlock()
+    if dropped > 0 {
+        e.logger.Warn("Trace export queue full; spans dropped", "dropped", dropped)
+    }
+    for batch := range slices.Chunk(spans, otlpBatchSize) {
+        if err := e.send(batch); err != nil {
+            e.logger.Error("Trace export failed", "spans", len(batch), "error", err)
+        }
+    }
+}
+
+func (e *OTLPExporter) send(spans []*Span) error {
+    body, err := json.Marshal(otlpRequest(e.service, spans))
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    for k, v := range e.Headers {
+        req.Header.Set(k, v)
+    }
+    resp, err := e.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    io.Copy(io.Discard, resp.Body)
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("collector answered %s", resp.Status)
+    }
+    return nil
+}
+
+// Close exports what is waiting and stops the exporter.
+func (e *OTLPExporter) Close() error {
+    close(e.stop)
+    <-e.done
+    return nil
+}
+
+// otlpRequest builds an ExportTraceServiceRequest in OTLP's JSON
+// mapping: IDs in hex, 64-bit times as decimal strings.
+func otlpRequest(service string, spans []*Span) map[string]any {
+    out := make([]map[string]any, 0, len(spans))
+    for _, s := range spans {
+        s.mu.Lock()
+        span := map[string]any{
+            "traceId":           hex.EncodeToString(s.sc.traceID[:]),
+            "spanId":            hex.EncodeToString(s.sc.spanID[:]),
+            "name":              s.name,
+            "kind":              int(s.kind),
+            "startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+            "endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+            "attributes":        otlpAttributes(s.attrs),
+        }
+        if s.parentID != ([8]byte{}) {
+            span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+        }
+        if s.failed {
+            span["status"] = map[string]any{"code": 2, "message": s.statusText}
+        }
+        s.mu.Unlock()
+        out = append(out, span)
+    }
+    return map[string]any{"resourceSpans": []any{map[string]any{
+        "resource": map[string]any{"attributes": otlpAttributes([]slog.Attr{
+            slog.String("service.name", service),
+            slog.String("service.version", Version),
+        })},
+        "scopeSpans": []any{map[string]any{
+            "scope": map[string]any{"name": "zaai", "version": Version},
+            "spans": out,
+        }},
+    }}}
+}
+
+func otlpAttributes(attrs []slog.Attr) []map[string]any {
+    out := make([]map[string]any, 0, len(attrs))
+    for _, a := range attrs {
+        v := a.Value.Resolve()
+        var value map[string]any
+        switch v.Kind() {
+        case slog.KindBool:
+            value = map[string]any{"boolValue": v.Bool()}
+        case slog.KindInt64:
+            value = map[string]any{"intValue": strconv.FormatInt(v.Int64(), 10)}
+        case slog.KindUint64:
+            value = map[string]any{"intValue": strconv.FormatUint(v.Uint64(), 10)}
+        case slog.KindFloat64:
+            value = map[string]any{"doubleValue": v.Float64()}
+        default:
+            value = map[string]any{"stringValue": v.String()}
+        }
+        out = append(out, map[string]any{"key": a.Key, "value": value})
+    }
+    return out
+}
+
+// TracingRepository records a span for every call to the repository it
+// wraps.
+var _ UserRepository = (*TracingRepository)(nil)
+
+type TracingRepository struct {
+    next   UserRepository
+    tracer *Tracer
+}
+
+func NewTracingRepository(next UserRepository, tracer *Tracer) *TracingRepository {
+    return &TracingRepository{next: next, tracer: tracer}
+}
+
+// Unwrap returns the decorated repository; see findRepository.
+func (r *TracingRepository) Unwrap() UserRepository {
+    return r.next
+}
+
+// start begins a span for method; end it with defer span.end(&err).
+func (r *TracingRepository) start(ctx context.Context, method string) (context.Context, repoSpan) {
+    ctx, span := r.tracer.Start(ctx, "UserRepository."+method, SpanKindInternal)
+    return ctx, repoSpan{span}
+}
+
+type repoSpan struct {
+    *Span
+}
+
+func (s repoSpan) end(err *error) {
+    s.RecordError(*err)
+    s.End()
+}
+
+func (r *TracingRepository) Save(ctx context.Context, user *User) (err error) {
+    ctx, span := r.start(ctx, "Save")
+    defer span.end(&err)
+    return r.next.Save(ctx, user)
+}
+
+func (r *TracingRepository) Insert(ctx context.Context, user *User) (err error) {
+    ctx, span := r.start(ctx, "Insert")
+    defer span.end(&err)
+    return r.next.Insert(ctx, user)
+}
+
+func (r *TracingRepository) FindByID(ctx context.Context, id UserID) (_ *User, err error) {
+    ctx, span := r.start(ctx, "FindByID")
+    defer span.end(&err)
+    span.SetAttributes("user.id", int64(id))
+    return r.next.FindByID(ctx, id)
+}
+
+func (r *TracingRepository) FindAll(ctx context.Context, order SortSpec) (_ []*User, err error) {
+    ctx, span := r.start(ctx, "FindAll")
+    defer span.end(&err)
+    return r.next.FindAll(ctx, order)
+}
+
+// FindAllIter's span lasts until the stream is fully consumed or
+// abandoned.
+func (r *TracingRepository) FindAllIter(ctx context.Context) iter.Seq2[*User, error] {
+    return func(yield func(*User, error) bool) {
+        var err error
+        ctx, span := r.start(ctx, "FindAllIter")
+        defer span.end(&err)
+        for user, iterErr := range r.next.FindAllIter(ctx) {
+            err = iterErr
+            if !yield(user, iterErr) {
+                return
+            }
+        }
+    }
+}
+
+func (r *TracingRepository) FindPage(ctx context.Context, page PageRequest) (_ *Page, err error) {
+    ctx, span := r.start(ctx, "FindPage")
+    defer span.end(&err)
+    return r.next.FindPage(ctx, page)
+}
+
+func (r *TracingRepository) Delete(ctx context.Context, id UserID) (err error) {
+    ctx, span := r.start(ctx, "Delete")
+    defer span.end(&err)
+    span.SetAttributes("user.id", int64(id))
+    return r.next.Delete(ctx, id)
+}
+
+func (r *TracingRepository) FindByEmail(ctx context.Context, email string) (_ *User, err error) {
+    ctx, span := r.start(ctx, "FindByEmail")
+    defer span.end(&err)
+    return r.next.FindByEmail(ctx, email)
+}
+
+func (r *TracingRepository) Restore(ctx context.Context, id UserID) (err error) {
+    ctx, span := r.start(ctx, "Restore")
+    defer span.end(&err)
+    span.SetAttributes("user.id", int64(id))
+    return r.next.Restore(ctx, id)
+}
+
+func (r *TracingRepository) PurgeDeleted(ctx context.Context, olderThan time.Duration) (_ int, err error) {
+    ctx, span := r.start(ctx, "PurgeDeleted")
+    defer span.end(&err)
+    return r.next.PurgeDeleted(ctx, olderThan)
+}
+
+func (r *TracingRepository) SaveAll(ctx context.Context, users []*User) (err error) {
+    ctx, span := r.start(ctx, "SaveAll")
+    defer span.end(&err)
+    span.SetAttributes("users", len(users))
+    return r.next.SaveAll(ctx, users)
+}
+
+func (r *TracingRepository) DeleteAll(ctx context.Context, ids []UserID) (err error) {
+    ctx, span := r.start(ctx, "DeleteAll")
+    defer span.end(&err)
+    span.SetAttributes("users", len(ids))
+    return r.next.DeleteAll(ctx, ids)
+}
+
+func (r *TracingRepository) FindWhere(ctx context.Context, filter UserFilter) (_ []*User, err error) {
+    ctx, span := r.start(ctx, "FindWhere")
+    defer span.end(&err)
+    return r.next.FindWhere(ctx, filter)
+}
+
+// WithinTx traces the calls made inside the transaction as children of
+// its span.
+func (r *TracingRepository) WithinTx(ctx context.Context, fn func(UserRepository) error) (err error) {
+    ctx, span := r.start(ctx, "WithinTx")
+    defer span.end(&err)
+    return WithinTx(ctx, r.next, func(tx UserRepository) error {
+        return fn(NewTracingRepository(tx, r.tracer))
+    })
+}
+
+// Diagnostics
+//
+// DiagnosticsHandler serves net/http/pprof and an expvar-style
+// /debug/vars. Profiles expose internals and can be expensive, so serve
+// it on its own internal address, never next to the public API:
+//
+//     GET /debug/pprof/...  the standard pprof endpoints
+//     GET /debug/vars       expvar's variables (cmdline, memstats) plus
+//                           goroutines, repository sizes and AddVar's
+//
+// Repository sizes are counted on each request, which reads every user
+// on backends without an index; this endpoint is for humans, not for
+// scraping (see Metrics).
+
+type DiagnosticsHandler struct {
+    repo    UserRepository
+    started time.Time
+    mux     *http.ServeMux
+
+    mu   sync.Mutex
+    vars map[string]func() any
+}
+
+func NewDiagnosticsHandler(repo UserRepository) *DiagnosticsHandler {
+    d := &DiagnosticsHandler{repo: repo, started: time.Now(), mux: http.NewServeMux(), vars: make(map[string]func() any)}
+    d.mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+    d.mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+    d.mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+    d.mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+    d.mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+    d.mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+    d.mux.HandleFunc("GET /debug/vars", d.serveVars)
+    return d
+}
+
+// AddVar adds a variable to /debug/vars, computed on each request.
+func (d *DiagnosticsHandler) AddVar(name string, fn func() any) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.vars[name] = fn
+}
+
+func (d *DiagnosticsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    d.mux.ServeHTTP(w, r)
+}
+
+// RepositorySizes counts users for /debug/vars.
+type RepositorySizes struct {
+    Users   int    `json:"users"`
+    Deleted int    `json:"deleted"`
+    Error   string `json:"error,omitempty"`
+}
+
+func (d *DiagnosticsHandler) sizes(ctx context.Context) RepositorySizes {
+    var sizes RepositorySizes
+    ctx = WithAllTenants(ctx)
+    all, err := d.repo.FindWhere(ctx, UserFilter{IncludeDeleted: true})
+    if err != nil {
+        sizes.Error = err.Error()
+        return sizes
+    }
+    for _, u := range all {
+        if u.DeletedAt != nil {
+            sizes.Deleted++
+        } else {
+            sizes.Users++
+        }
+    }
+    return sizes
+}
+
+func (d *DiagnosticsHandler) serveVars(w http.ResponseWriter, r *http.Request) {
+    vars := map[string]any{
+        "goroutines": runtime.NumGoroutine(),
+        "go_version": runtime.Version(),
+        "version":    Version,
+        "uptime":     time.Since(d.started).Round(time.Second).String(),
+        "repository": d.sizes(r.Context()),
+    }
+    d.mu.Lock()
+    for name, fn := range d.vars {
+        vars[name] = fn()
+    }
+    d.mu.Unlock()
+    expvar.Do(func(kv expvar.KeyValue) {
+        vars[kv.Key] = json.RawMessage(kv.Value.String())
+    })
+    writeJSON(w, http.StatusOK, vars)
+}
+
+// Client
+//
+// Client calls UserAPI over HTTP with the same methods as UserService, so
+// other services don't hand-roll requests. Failed calls return a
+// *ClientError, which unwraps to the sentinel error the server reported,
+// so errors.Is(err, ErrNotFound) works on either side of the wire.
+// Connection failures and 5xx responses are retried under the client's
+// RetryPolicy; creates send an Idempotency-Key, so a retried create can't
+// make a second user when the server has an IdempotencyStore. Every
+// request carries the caller's request ID from ctx.
+
+type Client struct {
+    base   *url.URL
+    http   *http.Client
+    retry  RetryPolicy
+    token  string
+    apiKey string
+}
+
+type ClientOption func(*Client)
+
+// WithHTTPClient replaces http.DefaultClient, for custom transports and
+// timeouts.
+func WithHTTPClient(hc *http.Client) ClientOption {
+    return func(c *Client) { c.http = hc }
+}
+
+// WithClientRetryPolicy replaces DefaultRetryPolicy. A nil Retryable
+// retries 5xx responses and connection failures; a zero policy turns
+// retries off.
+func WithClientRetryPolicy(p RetryPolicy) ClientOption {
+    return func(c *Client) { c.retry = p }
+}
+
+// WithBearerToken authenticates as the holder of a TokenService token.
+func WithBearerToken(token string) ClientOption {
+    return func(c *Client) { c.token = token }
+}
+
+// WithAPIKey authenticates with a key from APIKeyService.Issue.
+func WithAPIKey(key string) ClientOption {
+    return func(c *Client) { c.apiKey = key }
+}
+
+// NewClient returns a client for the UserAPI served at baseURL, such as
+// "https://users.internal/api".
+func NewClient(baseURL string, opts ...ClientOption) (*Client, error) {
+    base, err := url.Parse(baseURL)
+    if err != nil {
+        return nil, fmt.Errorf("client: invalid base URL: %w", err)
+    }
+    if base.Scheme != "http" && base.Scheme != "https" || base.Host == "" {
+        return nil, fmt.Errorf("client: base URL %q must be absolute http(s)", baseURL)
+    }
+    base.Path = strings.TrimSuffix(base.Path, "/")
+    c := &Client{base: base, http: http.DefaultClient, retry: DefaultRetryPolicy}
+    for _, opt := range opts {
+        opt(c)
+    }
+    if c.retry.Retryable == nil {
+        c.retry.Retryable = retryableClientError
+    }
+    return c, nil
+}
+
+// ClientError is a non-2xx response from the API.
+type ClientError struct {
+    StatusCode int
+    Message    string
+}
+
+func (e *ClientError) Error() string {
+    return fmt.Sprintf("%s: %s", http.StatusText(e.StatusCode), e.Message)
+}
+
+// Unwrap maps the response back to the sentinel error httpStatus turned
+// into it. Statuses shared by several sentinels are told apart by the
+// message, which ends with the sentinel's text.
+func (e *ClientError) Unwrap() error {
+    candidates := statusErrors[e.StatusCode]
+    for _, err := range candidates {
+        if strings.HasSuffix(e.Message, err.Error()) {
+            return err
+        }
+    }
+    if len(candidates) > 0 {
+        return candidates[0]
+    }
+    return nil
+}
+
+var statusErrors = map[int][]error{
+    http.StatusNotFound:        {ErrNotFound},
+    http.StatusConflict:        {ErrEmailTaken, ErrAlreadyExists, ErrInvalidTransition, ErrIdempotencyConflict},
+    http.StatusForbidden:       {ErrForbidden},
+    http.StatusUnauthorized:    {ErrInvalidToken, ErrInvalidCredentials},
+    http.StatusTooManyRequests: {ErrRateLimited},
+    http.StatusLocked:          {ErrAccountLocked},
+    http.StatusBadRequest:      {ErrInvalidInput},
+    http.StatusGatewayTimeout:  {context.DeadlineExceeded},
+    http.StatusNotImplemented:  {ErrNotSupported},
+}
+
+func retryableClientError(err error) bool {
+    var ce *ClientError
+    if errors.As(err, &ce) {
+        return ce.StatusCode >= 500 && ce.StatusCode != http.StatusNotImplemented
+    }
+    return IsTransient(err) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (c *Client) CreateUser(ctx context.Context, name, email string, age *int) (*User, error) {
+    return c.CreateUserWith(ctx, CreateUserRequest{Name: name, Email: email, Age: age})
+}
+
+// CreateUserWith sends the idempotency key from ctx, or a new random one
+// shared by all of this call's retries.
+func (c *Client) CreateUserWith(ctx context.Context, req CreateUserRequest) (*User, error) {
+    key, ok := IdempotencyKeyFrom(ctx)
+    if !ok {
+        key = newRequestID()
+    }
+    var user User
+    header := http.Header{"Idempotency-Key": {key}}
+    if err := c.do(ctx, http.MethodPost, "/users", nil, header, req, &user); err != nil {
+        return nil, err
+    }
+    return &user, nil
+}
+
+func (c *Client) GetUser(ctx context.Context, id UserID) (*User, error) {
+    var user User
+    if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/users/%d", id), nil, nil, nil, &user); err != nil {
+        return nil, err
+    }
+    return &user, nil
+}
+
+func (c *Client) ListUsers(ctx context.Context, req PageRequest) (*Page, error) {
+    q := url.Values{}
+    if req.Offset != 0 {
+        q.Set("offset", strconv.Itoa(req.Offset))
+    }
+    if req.Limit != 0 {
+        q.Set("limit", strconv.Itoa(req.Limit))
+    }
+    if req.Sort.Field != "" {
+        q.Set("sort", string(req.Sort.Field))
+    }
+    if req.Sort.Desc {
+        q.Set("desc", "true")
+    }
+    var page Page
+    if err := c.do(ctx, http.MethodGet, "/users", q, nil, nil, &page); err != nil {
+        return nil, err
+    }
+    return &page, nil
+}
+
+// AllUsers walks every page of users in order, fetching pageSize at a
+// time (DefaultPageSize if zero). Users created or deleted during the walk
+// may shift page boundaries, so a user can be seen twice or missed.
+func (c *Client) AllUsers(ctx context.Context, order SortSpec, pageSize int) iter.Seq2[*User, error] {
+    return func(yield func(*User, error) bool) {
+        req := PageRequest{Limit: pageSize, Sort: order}
+        for {
+            page, err := c.ListUsers(ctx, req)
+            if err != nil {
+                yield(nil, err)
+                return
+            }
+            for _, u := range page.Users {
+                if !yield(u, nil) {
+                    return
+                }
+            }
+            req.Offset = page.Offset + len(page.Users)
+            if len(page.Users) == 0 || req.Offset >= page.Total {
+                return
+            }
+        }
+    }
+}
+
+func (c *Client) PatchUser(ctx context.Context, id UserID, patch UserPatch) (*User, error) {
+    var user User
+    if err := c.do(ctx, http.MethodPut, fmt.Sprintf("/users/%d", id), nil, nil, patch, &user); err != nil {
+        return nil, err
+    }
+    return &user, nil
+}
+
+func (c *Client) DeleteUser(ctx context.Context, id UserID) error {
+    return c.do(ctx, http.MethodDelete, fmt.Sprintf("/users/%d", id), nil, nil, nil, nil)
+}
+
+func (c *Client) GetUserStats(ctx context.Context) (*UserStats, error) {
+    var stats UserStats
+    if err := c.do(ctx, http.MethodGet, "/stats", nil, nil, nil, &stats); err != nil {
+        return nil, err
+    }
+    return &stats, nil
+}
+
+// do sends one API call, retrying it under c.retry, and decodes a 2xx
+// response body into out when out is non-nil.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, header http.Header, in, out any) error {
+    var body []byte
+    if in != nil {
+        var err error
+        if body, err = json.Marshal(in); err != nil {
+            return err
+        }
+    }
+    u := *c.base
+    u.Path += path
+    u.RawQuery = query.Encode()
+    return RetryDo(ctx, c.retry, func(ctx context.Context) error {
+        req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+        if err != nil {
+            return err
+        }
+        maps.Copy(req.Header, header)
+        req.Header.Set("Accept", "application/json")
+        if in != nil {
+            req.Header.Set("Content-Type", "application/json")
+        }
+        switch {
+        case c.apiKey != "":
+            req.Header.Set("X-API-Key", c.apiKey)
+        case c.token != "":
+            req.Header.Set("Authorization", "Bearer "+c.token)
+        }
+        propagateContext(ctx, req)
+
+        resp, err := c.http.Do(req)
+        if err != nil {
+            return err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode >= 300 {
+            var apiErr APIError
+            data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+            if json.Unmarshal(data, &apiErr) != nil || apiErr.Error == "" {
+                apiErr.Error = strings.TrimSpace(string(data))
+            }
+            return &ClientError{StatusCode: resp.StatusCode, Message: apiErr.Error}
+        }
+        if out == nil {
+            io.Copy(io.Discard, resp.Body)
+            return nil
+        }
+        return json.NewDecoder(resp.Body).Decode(out)
+    })
+}
+
+// Utility functions
+
+// NormalizeEmail parses a bare RFC 5322 address (display names and
+// quoted local parts are rejected), requires a dotted domain, and returns
+// it trimmed and lowercased so equal addresses compare equal before
+// uniqueness checks.
+func NormalizeEmail(email string) (string, error) {
+    trimmed := strings.TrimSpace(email)
+    addr, err := mail.ParseAddress(trimmed)
+    if err != nil || addr.Name != "" || addr.Address != trimmed {
+        return "", fmt.Errorf("invalid email format: %s", email)
+    }
+    _, domain, _ := strings.Cut(addr.Address, "@")
+    if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+        return "", fmt.Errorf("invalid email format: %s", email)
+    }
+    return strings.ToLower(addr.Address), nil
+}
+
+// verifyMailDomain checks that email's domain accepts mail: it has MX
+// records or, failing that, an address record (the implicit MX of RFC 5321).
+func verifyMailDomain(ctx context.Context, email string) error {
+    _, domain, _ := strings.Cut(email, "@")
+    if mx, err := net.DefaultResolver.LookupMX(ctx, domain); err == nil && len(mx) > 0 {
+        return nil
+    }
+    if addrs, err := net.DefaultResolver.LookupHost(ctx, domain); err == nil && len(addrs) > 0 {
+        return nil
+    }
+    return fmt.Errorf("email domain %s has no mail server", domain)
 }
 
-type UserPrefs struct {
-    Theme         string `json:"theme"`
-    Notifications bool   `json:"notifications"`
-    Language      string `json:"language"`
+func intPtr(i int) *int {
+    return &i
 }
 
-// Interfaces
-type Repository interface {
-    Save(user *User) error
-    FindByID(id UserID) (*User, error)
-    FindAll() ([]*User, error)
-    Delete(id UserID) error
+// Math utilities
+func calculateCircleArea(radius float64) float64 {
+    return math.Pi * radius * radius
 }
 
-type Logger interface {
-    Info(msg string)
-    Error(msg string)
-    Debug(msg string)
+func fibonacci(n int) []int {
+    if n <= 0 {
+        return []int{}
+    }
+    if n == 1 {
+        return []int{0}
+    }
+    
+    fib := make([]int, n)
+    fib[0], fib[1] = 0, 1
+    
+    for i := 2; i < n; i++ {
+        fib[i] = fib[i-1] + fib[i-2]
+    }
+    
+    return fib
 }
 
-// Implementations
-type InMemoryRepository struct {
-    users  map[UserID]*User
-    nextID UserID
+// CLI
+//
+//     zaai [-profile dev|staging|prod] [-settings FILE] [-backend memory|file|postgres] [-dsn DSN] [-o json|table]
+//          [-log-format auto|text|json|dev] [-log-level debug|info|warn|error] [-log-file PATH] <command>
+//
+// Commands are serve, user create|list|get|delete, stats, import and
+// demo, which also runs when no command is given. -backend, -dsn,
+// -log-format and -log-level default to $ZAAI_BACKEND, $ZAAI_DSN,
+// $ZAAI_LOG_FORMAT and $ZAAI_LOG_LEVEL. serve's level can be changed
+// while it runs through PUT /admin/log-level. -log-file ($ZAAI_LOG_FILE)
+// logs to a RotatingFile instead of stderr; by default it rotates daily
+// or at 100MB and keeps seven gzipped files. -log-sinks ($ZAAI_LOG_SINKS)
+// names a JSON file of LogSinkConfig for a TeeLogger instead, and
+// -log-buffer makes logging asynchronous through an AsyncLogger. Logs are
+// redacted (see Redactor) unless -log-redact=false. The file backend
+// keeps users in the JSON file named by -dsn and writes it back after
+// each change. Passwords are kept out of -dsn and the environment's plain
+// settings: the db_password secret completes a postgres DSN and
+// redis_password is serve's Redis password, both looked up in the
+// -secrets sources ($ZAAI_SECRETS, by default env then /run/secrets).
+// -profile ($ZAAI_PROFILE) picks defaults for an environment: dev runs in
+// memory with debug logs, on a terminal colored, and no /metrics; staging
+// and prod use postgres if a driver is linked in and the file backend if
+// not, JSON logs, metrics and a 500ms slow-call threshold. -settings
+// ($ZAAI_SETTINGS) reads further flag values, global and serve's alike,
+// from a JSON file (see ReadProfile), such as the TLS certificate paths.
+// Settings layer in this order, each overriding the last: flag defaults,
+// the profile, the settings file, the environment, the command line.
+
+// errUsage reports a malformed command line; the usage has been printed.
+var errUsage = errors.New("usage error")
+
+type cli struct {
+    stdout, stderr io.Writer
+    logger         Logger
+    logLevel       *slog.LevelVar
+    slow           time.Duration
+    secrets        SecretSource
+    profile        Profile
+    backend, dsn   string
+    repoOpts       []RepoOption
+    output         string
 }
 
-func NewInMemoryRepository() *InMemoryRepository {
-    return &InMemoryRepository{
-        users:  make(map[UserID]*User),
-        nextID: 1,
+// runCLI runs a command line and returns the process exit status.
+func runCLI(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+    c := &cli{stdout: stdout, stderr: stderr, logger: &SimpleLogger{}}
+    err := c.run(ctx, args)
+    switch {
+    case err == nil:
+        return 0
+    case errors.Is(err, errUsage), errors.Is(err, flag.ErrHelp):
+        return 2
     }
+    fmt.Fprintf(stderr, "zaai: %v\n", err)
+    return 1
 }
 
-func (r *InMemoryRepository) Save(user *User) error {
-    if user.ID == 0 {
-        user.ID = r.nextID
-        r.nextID++
+func (c *cli) run(ctx context.Context, args []string) error {
+    fs := c.flags("zaai", "[flags] <command> [args]")
+    fs.StringVar(&c.backend, "backend", envOr("ZAAI_BACKEND", "memory"), "storage `backend`: memory, file or postgres")
+    fs.StringVar(&c.dsn, "dsn", os.Getenv("ZAAI_DSN"), "file path or connection string for the backend")
+    fs.StringVar(&c.output, "o", "table", "output `format`: json or table")
+    profile := fs.String("profile", os.Getenv("ZAAI_PROFILE"), "`name` of a Profile of defaults: dev, staging or prod")
+    settings := fs.String("settings", os.Getenv("ZAAI_SETTINGS"), "JSON `file` of flag values by flag name, layered over -profile")
+    logFormat := fs.String("log-format", envOr("ZAAI_LOG_FORMAT", "auto"), "log `format`: text, json, dev, or auto for dev on a terminal in the dev profile and text otherwise")
+    logLevel := fs.String("log-level", envOr("ZAAI_LOG_LEVEL", "info"), "minimum log `level`: debug, info, warn or error")
+    rotate := RotateConfig{Path: os.Getenv("ZAAI_LOG_FILE"), Compress: true}
+    fs.StringVar(&rotate.Path, "log-file", rotate.Path, "write logs to `path` instead of stderr")
+    logMaxSize := fs.Int64("log-max-size", 100, "rotate the log file at this many `MB`; 0 for no limit")
+    fs.DurationVar(&rotate.MaxAge, "log-max-age", 24*time.Hour, "rotate the log file after this `long`; 0 for no limit")
+    fs.IntVar(&rotate.MaxBackups, "log-max-backups", 7, "keep this many rotated log files; 0 for all")
+    fs.DurationVar(&rotate.Retain, "log-retain", 0, "remove rotated log files older than this `age`")
+    fs.BoolVar(&rotate.Compress, "log-compress", rotate.Compress, "gzip rotated log files")
+    logSinks := fs.String("log-sinks", os.Getenv("ZAAI_LOG_SINKS"), "JSON `file` of log sinks; overrides -log-file and -log-format")
+    logRedact := fs.Bool("log-redact", true, "mask emails, names and tokens in logs")
+    redactFields := fs.String("log-redact-fields", strings.Join(DefaultRedactFields, ","), "comma-separated attribute `keys` to mask")
+    secrets := fs.String("secrets", envOr("ZAAI_SECRETS", "env,file"), "comma-separated secret `sources` tried in order: env, file[:DIR] and vault:MOUNT/PATH")
+    slow := fs.String("slow-threshold", envOr("ZAAI_SLOW_THRESHOLD", "0"), "log repository and service calls taking this `long` or longer at WARN; 0 disables")
+    logBuffer := fs.Int("log-buffer", 0, "log asynchronously through a buffer of this many `lines`; 0 logs synchronously")
+    idNode := fs.Int("id-node", -1, "give new users snowflake IDs from this `node`, 0-1023, unique per instance (IDs exceed 2^53, so JavaScript clients need BigInt parsing); -1 counts or lets the database choose")
+    if err := fs.Parse(args); err != nil {
+        return err
     }
-    user.CreatedAt = time.Now()
-    r.users[user.ID] = user
-    return nil
+    if *profile != "" {
+        var ok bool
+        if c.profile, ok = Profiles[*profile]; !ok {
+            return c.usageError(fs, "unknown profile %q", *profile)
+        }
+    }
+    if *settings != "" {
+        file, err := ReadProfile(*settings)
+        if err != nil {
+            return err
+        }
+        merged := make(Profile, len(c.profile)+len(file))
+        maps.Copy(merged, c.profile)
+        maps.Copy(merged, file)
+        c.profile = merged
+    }
+    if err := c.profile.apply(fs); err != nil {
+        return c.usageError(fs, "%v", err)
+    }
+    if c.output != "json" && c.output != "table" {
+        return c.usageError(fs, "unknown output format %q", c.output)
+    }
+    if *idNode >= 0 {
+        gen, err := NewSnowflake[UserID](*idNode)
+        if err != nil {
+            return c.usageError(fs, "%v", err)
+        }
+        c.repoOpts = append(c.repoOpts, WithIDGenerator(gen))
+    }
+    level, err := ParseLogLevel(*logLevel)
+    if err != nil {
+        return c.usageError(fs, "%v", err)
+    }
+    c.logLevel = new(slog.LevelVar)
+    c.logLevel.Set(level)
+    if c.slow, err = time.ParseDuration(*slow); err != nil {
+        return c.usageError(fs, "invalid -slow-threshold: %v", err)
+    }
+    if c.secrets, err = ParseSecretSources(*secrets); err != nil {
+        return c.usageError(fs, "%v", err)
+    }
+    var redactor *Redactor
+    if *logRedact {
+        redactor = NewRedactor(strings.Split(*redactFields, ",")...)
+    }
+    if *logSinks != "" {
+        cfgs, err := ReadLogSinks(*logSinks)
+        if err != nil {
+            return err
+        }
+        tee, err := OpenTeeLogger(cfgs, c.logLevel, redactor)
+        if err != nil {
+            return err
+        }
+        defer tee.Close()
+        c.logger = tee
+    } else {
+        logOut := c.stderr
+        if rotate.Path != "" {
+            rotate.MaxSize = *logMaxSize << 20
+            rotate.OnError = func(err error) { fmt.Fprintln(c.stderr, err) }
+            f, err := OpenRotatingFile(rotate)
+            if err != nil {
+                return err
+            }
+            defer f.Close()
+            logOut = f
+        }
+        if *logFormat == "auto" {
+            *logFormat = "text"
+            if *profile == "dev" && isTerminal(logOut) {
+                *logFormat = "dev"
+            }
+        }
+        handler, err := NewLogHandler(logOut, *logFormat, c.logLevel)
+        if err != nil {
+            return c.usageError(fs, "%v", err)
+        }
+        if redactor != nil {
+            handler = redactor.Handler(handler)
+        }
+        if *logBuffer > 0 {
+            async := NewAsyncLogger(handler, *logBuffer)
+            defer async.Close()
+            c.logger = async
+        } else {
+            c.logger = NewSimpleLogger(handler)
+        }
+    }
+    args = fs.Args()
+    if len(args) == 0 {
+        return runDemo()
+    }
+
+    switch args[0] {
+    case "serve":
+        return c.serve(ctx, args[1:])
+    case "user":
+        if len(args) < 2 {
+            return c.usageError(fs, "user needs a subcommand: create, list, get or delete")
+        }
+        switch args[1] {
+        case "create":
+            return c.userCreate(ctx, args[2:])
+        case "list":
+            return c.userList(ctx, args[2:])
+        case "get", "delete":
+            return c.userByID(ctx, args[1], args[2:])
+        }
+        return c.usageError(fs, "unknown user subcommand %q", args[1])
+    case "stats":
+        return c.stats(ctx, args[1:])
+    case "import":
+        return c.importCSV(ctx, args[1:])
+    case "export":
+        return c.exportJSON(ctx, args[1:])
+    case "demo":
+        return runDemo()
+    case "help":
+        fs.Usage()
+        return nil
+    }
+    return c.usageError(fs, "unknown command %q", args[0])
 }
 
-func (r *InMemoryRepository) FindByID(id UserID) (*User, error) {
-    user, exists := r.users[id]
-    if !exists {
-        return nil, fmt.Errorf("user with ID %d not found", id)
+func envOr(key, fallback string) string {
+    if v := os.Getenv(key); v != "" {
+        return v
     }
-    return user, nil
+    return fallback
 }
 
-func (r *InMemoryRepository) FindAll() ([]*User, error) {
-    users := make([]*User, 0, len(r.users))
-    for _, user := range r.users {
-        users = append(users, user)
+// Profile bundles flag defaults for an environment, flag values by flag
+// name. It covers the global flags and serve's alike, applied to each
+// set after parsing. A flag given on the command line, or through its
+// environment variable, wins. Names no flag set defines are ignored, as
+// each set only takes its own.
+type Profile map[string]string
+
+// ReadProfile reads a Profile from a JSON object of flag values by flag
+// name, as in {"tls-cert": "/etc/zaai/tls.crt", "rate-limit": 600,
+// "metrics": false}. Values may be strings, numbers or booleans.
+func ReadProfile(path string) (Profile, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
     }
-    return users, nil
+    var raw map[string]any
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.UseNumber()
+    if err := dec.Decode(&raw); err != nil {
+        return nil, fmt.Errorf("settings %s: %w", path, err)
+    }
+    p := make(Profile, len(raw))
+    for name, value := range raw {
+        switch v := value.(type) {
+        case string:
+            p[name] = v
+        case json.Number:
+            p[name] = v.String()
+        case bool:
+            p[name] = strconv.FormatBool(v)
+        default:
+            return nil, fmt.Errorf("settings %s: %q must be a string, number or boolean", path, name)
+        }
+    }
+    return p, nil
+}
+
+var Profiles = map[string]Profile{
+    "dev":     {"backend": "memory", "no-auth": "true", "log-format": "auto", "log-level": "debug", "metrics": "false"},
+    "staging": {"backend": driverOr("postgres", "file"), "log-format": "json", "log-level": "debug", "metrics": "true", "slow-threshold": "500ms"},
+    "prod":    {"backend": driverOr("postgres", "file"), "log-format": "json", "log-level": "info", "metrics": "true", "slow-threshold": "500ms"},
+}
+
+// driverOr returns backend if the binary links a database/sql driver
+// for it, and fallback otherwise. Drivers register in their packages'
+// init, which runs before Profiles is built.
+func driverOr(backend, fallback string) string {
+    if slices.Contains(sql.Drivers(), backend) {
+        return backend
+    }
+    return fallback
+}
+
+// profileEnv names the environment variables that override a profile,
+// one for each flag that defaults to a variable.
+var profileEnv = map[string]string{
+    "backend":        "ZAAI_BACKEND",
+    "dsn":            "ZAAI_DSN",
+    "log-format":     "ZAAI_LOG_FORMAT",
+    "log-level":      "ZAAI_LOG_LEVEL",
+    "log-file":       "ZAAI_LOG_FILE",
+    "log-sinks":      "ZAAI_LOG_SINKS",
+    "secrets":        "ZAAI_SECRETS",
+    "slow-threshold": "ZAAI_SLOW_THRESHOLD",
+    "config":         "ZAAI_CONFIG",
+    "redis":          "ZAAI_REDIS_ADDR",
+    "cors-origins":   "ZAAI_CORS_ORIGINS",
+    "debug-addr":     "ZAAI_DEBUG_ADDR",
+    "slos":           "ZAAI_SLOS",
+    "jwt-keys":       "ZAAI_JWT_KEYS",
+    "backup":         "ZAAI_BACKUP",
+    "otlp-endpoint":  "OTEL_EXPORTER_OTLP_ENDPOINT",
+    "tls-cert":       "ZAAI_TLS_CERT",
+    "tls-key":        "ZAAI_TLS_KEY",
+    "tls-client-ca":  "ZAAI_TLS_CLIENT_CA",
 }
 
-func (r *InMemoryRepository) Delete(id UserID) error {
-    if _, exists := r.users[id]; !exists {
-        return fmt.Errorf("user with ID %d not found", id)
+// apply sets the flags of fs that p has values for and that weren't set
+// on the command line or through the environment.
+func (p Profile) apply(fs *flag.FlagSet) error {
+    set := make(map[string]bool)
+    fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+    for name, value := range p {
+        if set[name] || fs.Lookup(name) == nil {
+            continue
+        }
+        if env := profileEnv[name]; env != "" && os.Getenv(env) != "" {
+            continue
+        }
+        if err := fs.Set(name, value); err != nil {
+            return fmt.Errorf("profile: -%s: %w", name, err)
+        }
     }
-    delete(r.users, id)
     return nil
 }
 
-// Simple logger implementation
-type SimpleLogger struct{}
+func (c *cli) flags(name, synopsis string) *flag.FlagSet {
+    fs := flag.NewFlagSet(name, flag.ContinueOnError)
+    fs.SetOutput(c.stderr)
+    fs.Usage = func() {
+        fmt.Fprintf(c.stderr, "Usage: %s %s\n", name, synopsis)
+        if name == "zaai" {
+            fmt.Fprintln(c.stderr, "Commands: serve, user create|list|get|delete, stats, import, export, demo")
+        }
+        fs.PrintDefaults()
+    }
+    return fs
+}
 
-func (l *SimpleLogger) Info(msg string) {
-    log.Printf("[INFO] %s", msg)
+func (c *cli) usageError(fs *flag.FlagSet, format string, args ...any) error {
+    fmt.Fprintf(c.stderr, "zaai: "+format+"\n", args...)
+    fs.Usage()
+    return errUsage
 }
 
-func (l *SimpleLogger) Error(msg string) {
-    log.Printf("[ERROR] %s", msg)
+// open connects to the configured backend. commit persists changes for
+// backends that need it and must be called after successful writes;
+// close releases the backend.
+func (c *cli) open(ctx context.Context) (repo UserRepository, commit, close func() error, err error) {
+    nop := func() error { return nil }
+    switch c.backend {
+    case "memory":
+        return c.logSlow(NewInMemoryRepository(c.repoOpts...)), nop, nop, nil
+    case "file":
+        if c.dsn == "" {
+            return nil, nil, nil, errors.New("the file backend needs -dsn <path>")
+        }
+        mem := NewInMemoryRepository(c.repoOpts...)
+        if err := mem.Load(c.dsn); err != nil {
+            return nil, nil, nil, err
+        }
+        return c.logSlow(mem), func() error { return mem.Persist(c.dsn) }, nop, nil
+    case "postgres":
+        // The driver isn't a dependency of this package; a binary that
+        // wants this backend imports one registered as "postgres".
+        if !slices.Contains(sql.Drivers(), "postgres") {
+            return nil, nil, nil, errors.New(`the postgres backend needs a database/sql driver registered as "postgres", and this build links none; use -backend file or memory`)
+        }
+        if c.dsn == "" {
+            return nil, nil, nil, errors.New("the postgres backend needs -dsn")
+        }
+        var password Secret
+        if password, err = OptionalSecret(ctx, c.secrets, SecretDBPassword); err != nil {
+            return nil, nil, nil, err
+        }
+        dsn := c.dsn
+        if !password.IsZero() {
+            dsn = dsnWithPassword(dsn, password)
+        }
+        var db *sql.DB
+        if db, err = sql.Open("postgres", dsn); err != nil {
+            return nil, nil, nil, err
+        }
+        repo, err = NewPostgresRepository(db, PoolConfig{}, c.repoOpts...)
+        if err != nil {
+            db.Close()
+            return nil, nil, nil, err
+        }
+        return c.logSlow(repo), nop, db.Close, nil
+    }
+    return nil, nil, nil, fmt.Errorf("unknown backend %q", c.backend)
 }
 
-func (l *SimpleLogger) Debug(msg string) {
-    log.Printf("[DEBUG] %s", msg)
+// openJobs returns the job store for the backend behind repo: its own
+// database for postgres, memory otherwise. With the file
+// backend, jobs are kept next to the users in <dsn>.jobs, and persist
+// writes them there.
+func (c *cli) openJobs(repo UserRepository) (store JobStore, persist func() error, err error) {
+    nop := func() error { return nil }
+    if db, ok := findRepository[interface{ Jobs() *SQLJobStore }](repo); ok {
+        return db.Jobs(), nop, nil
+    }
+    mem := NewMemoryJobStore()
+    if c.backend != "file" {
+        return mem, nop, nil
+    }
+    path := c.dsn + ".jobs"
+    if err := mem.Load(path); err != nil {
+        return nil, nil, err
+    }
+    return mem, func() error { return mem.Persist(path) }, nil
 }
 
-// Service layer
-type UserService struct {
-    repo   Repository
-    logger Logger
+// logSlow wraps repo to report slow calls when -slow-threshold is set.
+func (c *cli) logSlow(repo UserRepository) UserRepository {
+    if c.slow <= 0 {
+        return repo
+    }
+    return NewLoggingRepository(repo, c.logger, WithSlowRepoThreshold(c.slow), WithSlowCallsOnly())
 }
 
-func NewUserService(repo Repository, logger Logger) *UserService {
-    return &UserService{
-        repo:   repo,
-        logger: logger,
+// withService opens the backend, runs fn, and commits if fn succeeded.
+func (c *cli) withService(ctx context.Context, fn func(*UserService) error) error {
+    repo, commit, close, err := c.open(ctx)
+    if err != nil {
+        return err
+    }
+    defer close()
+    if err := fn(NewUserService(repo, c.logger, WithSlowCallThreshold(c.slow))); err != nil {
+        return err
     }
+    return commit()
 }
 
-func (s *UserService) CreateUser(name, email string, age *int) (*User, error) {
-    s.logger.Info(fmt.Sprintf("Creating user: %s", email))
-    
-    if !isValidEmail(email) {
-        return nil, fmt.Errorf("invalid email format: %s", email)
+func (c *cli) serve(ctx context.Context, args []string) error {
+    fs := c.flags("zaai serve", "[-addr host:port] [-shutdown-timeout d] [-rate-limit n [-redis host:port]] [-tls-cert file -tls-key file [-tls-client-ca file]]")
+    addr := fs.String("addr", ":8080", "listen `address`")
+    timeout := fs.Duration("shutdown-timeout", DefaultShutdownTimeout, "how long to let requests finish on shutdown")
+    rate := fs.Int("rate-limit", 0, "requests per minute per client; 0 disables")
+    configFile := fs.String("config", os.Getenv("ZAAI_CONFIG"), "JSON `file` of settings applied again whenever it changes: log_level, rate_limit and features; see RuntimeConfig")
+    redisAddr := fs.String("redis", os.Getenv("ZAAI_REDIS_ADDR"), "share rate limits through Redis at `host:port`; password from the redis_password secret")
+    corsOrigins := fs.String("cors-origins", os.Getenv("ZAAI_CORS_ORIGINS"), "comma-separated `origins` browsers may call from, or *")
+    corsCredentials := fs.Bool("cors-credentials", false, "let cross-origin requests carry credentials")
+    debugAddr := fs.String("debug-addr", os.Getenv("ZAAI_DEBUG_ADDR"), "serve pprof and /debug/vars on this internal `address`, e.g. localhost:6060; off if empty")
+    sloFile := fs.String("slos", os.Getenv("ZAAI_SLOS"), "JSON `file` of service level objectives to alert on; see ReadSLOs")
+    sloWindow := fs.Duration("slo-window", time.Hour, "`window` for SLO error rates, percentiles and budgets")
+    exposeMetrics := fs.Bool("metrics", true, "serve Prometheus metrics at /metrics")
+    jobWorkers := fs.Int("job-workers", DefaultJobWorkers, "background jobs run at once")
+    jwtKeys := fs.String("jwt-keys", os.Getenv("ZAAI_JWT_KEYS"), "comma-separated `IDs` of the keys bearer tokens are verified with, each read from the jwt_key_<id> secret; the first signs")
+    noAuth := fs.Bool("no-auth", false, "serve without authentication or authorization, for local development only")
+    backupDest := fs.String("backup", os.Getenv("ZAAI_BACKUP"), "back users up to this `directory` or s3://bucket/prefix URL, with the memory or file backend; off if empty")
+    backupCfg := BackupConfig{Keep: DefaultBackupKeep}
+    fs.DurationVar(&backupCfg.Interval, "backup-interval", DefaultBackupInterval, "time between backups")
+    fs.IntVar(&backupCfg.Keep, "backup-keep", DefaultBackupKeep, "backups to keep; 0 keeps all")
+    fs.DurationVar(&backupCfg.MaxAge, "backup-max-age", 0, "prune backups older than this; 0 disables")
+    var breakerCfg BreakerConfig
+    fs.IntVar(&breakerCfg.Threshold, "breaker-threshold", DefaultBreakerThreshold, "consecutive repository failures that make calls fail fast; 0 disables the circuit breaker")
+    fs.DurationVar(&breakerCfg.Cooldown, "breaker-cooldown", DefaultBreakerCooldown, "how long calls fail fast before the repository is probed again")
+    otlpEndpoint := fs.String("otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "export traces to the OTLP/HTTP collector at `URL`, e.g. http://localhost:4318")
+    var tlsCfg TLSConfig
+    fs.StringVar(&tlsCfg.CertFile, "tls-cert", os.Getenv("ZAAI_TLS_CERT"), "PEM certificate `file`; serves HTTPS with -tls-key")
+    fs.StringVar(&tlsCfg.KeyFile, "tls-key", os.Getenv("ZAAI_TLS_KEY"), "PEM private key `file`")
+    fs.StringVar(&tlsCfg.ClientCAFile, "tls-client-ca", os.Getenv("ZAAI_TLS_CLIENT_CA"), "PEM CA bundle `file`; requires client certificates signed by it")
+    fs.BoolVar(&tlsCfg.OptionalClientCert, "tls-client-optional", false, "with -tls-client-ca, also accept clients without a certificate")
+    if err := fs.Parse(args); err != nil {
+        return err
     }
-    
-    user := &User{
-        Name:   name,
-        Email:  email,
-        Age:    age,
-        Status: StatusActive,
-        Preferences: UserPrefs{
-            Theme:         "light",
-            Notifications: true,
-            Language:      "en",
-        },
+    if err := c.profile.apply(fs); err != nil {
+        return c.usageError(fs, "%v", err)
     }
-    
-    if err := s.repo.Save(user); err != nil {
-        s.logger.Error(fmt.Sprintf("Failed to save user: %v", err))
-        return nil, err
+    if *jwtKeys == "" && !*noAuth {
+        return c.usageError(fs, "serve needs -jwt-keys to authenticate requests, or -no-auth")
     }
-    
-    s.logger.Info(fmt.Sprintf("User created with ID: %d", user.ID))
-    return user, nil
+    var tlsConfig *tls.Config
+    if tlsCfg.CertFile != "" || tlsCfg.KeyFile != "" {
+        var err error
+        if tlsConfig, err = NewTLSConfig(tlsCfg, c.logger); err != nil {
+            return err
+        }
+    } else if tlsCfg.ClientCAFile != "" {
+        return c.usageError(fs, "-tls-client-ca needs -tls-cert and -tls-key")
+    }
+    var slos []SLO
+    if *sloFile != "" {
+        var err error
+        if slos, err = ReadSLOs(*sloFile); err != nil {
+            return err
+        }
+    }
+    features := NewFeatureFlags(DefaultFeatures)
+    rateLimit := new(atomic.Int64)
+    rateLimit.Store(int64(*rate))
+    var watcher *ConfigWatcher
+    if *configFile != "" {
+        watcher = NewConfigWatcher(*configFile, 0, c.logger)
+        watcher.LogLevel = c.logLevel
+        watcher.RateLimit = rateLimit
+        watcher.Features = features
+        if err := watcher.Reload(ctx); err != nil {
+            return err
+        }
+    }
+
+    repo, commit, close, err := c.open(ctx)
+    if err != nil {
+        return err
+    }
+    jobStore, persistJobs, err := c.openJobs(repo)
+    if err != nil {
+        close()
+        return err
+    }
+    var backups *BackupScheduler
+    if *backupDest != "" {
+        if backups, err = c.backupScheduler(ctx, repo, *backupDest, backupCfg); err != nil {
+            close()
+            return err
+        }
+    }
+    var tracer *Tracer
+    var exporter *OTLPExporter
+    if *otlpEndpoint != "" {
+        exporter = NewOTLPExporter(*otlpEndpoint, envOr("OTEL_SERVICE_NAME", "zaai"), c.logger)
+        tracer = NewTracer(exporter)
+        repo = NewTracingRepository(repo, tracer)
+    }
+    var breaker *CircuitBreaker
+    if breakerCfg.Threshold > 0 {
+        breaker = NewCircuitBreaker(breakerCfg)
+        breaker.OnStateChange(func(from, to BreakerState) {
+            if to == BreakerOpen {
+                c.logger.Error("Repository circuit breaker open; failing fast", "from", from.String(), "cooldown", breakerCfg.Cooldown)
+            } else {
+                c.logger.Warn("Repository circuit breaker state changed", "from", from.String(), "to", to.String())
+            }
+        })
+        repo = NewCircuitBreakerRepository(repo, breaker)
+    }
+    sloTracker := NewSLOTracker(*sloWindow, slos...)
+    sloTracker.OnAlert(func(alert SLOAlert) {
+        st := alert.Status
+        if alert.Burning {
+            c.logger.Error("SLO budget burning", "op", st.Op, "burn_rate", st.Budget.BurnRate,
+                "error_rate", st.ErrorRate, "p99", st.P99, "budget_remaining", st.Budget.Remaining)
+        } else {
+            c.logger.Info("SLO budget burn stopped", "op", st.Op, "burn_rate", st.Budget.BurnRate)
+        }
+    })
+    metrics := NewAppMetrics()
+    metrics.TrackSLOs(sloTracker)
+    if breaker != nil {
+        metrics.WatchBreaker(breaker)
+    }
+    repo = NewMetricsRepository(repo, metrics)
+    bus := NewEventBus(DispatchAsync, c.logger)
+    bus.Subscribe(metrics.CountEvents)
+    metrics.WatchEventBus(bus)
+    var tokens *TokenService
+    svcOpts := []ServiceOption{WithEventHandler(bus.Publish), WithTracer(tracer), WithSlowCallThreshold(c.slow), WithParallelStats(0)}
+    if *noAuth {
+        c.logger.Warn("Serving without authentication: every caller may do anything")
+    } else {
+        ids := strings.Split(*jwtKeys, ",")
+        keys, err := ReadTokenKeys(ctx, c.secrets, ids...)
+        if err != nil {
+            close()
+            return err
+        }
+        if tokens, err = NewTokenService(repo, TokenConfig{Keys: keys, SigningKeyID: ids[0]}); err != nil {
+            close()
+            return err
+        }
+        svcOpts = append(svcOpts, WithAuthorizer(RBACAuthorizer{}))
+    }
+    svc := NewUserService(repo, c.logger, svcOpts...)
+    jobs := NewJobQueue(jobStore, JobConfig{Workers: *jobWorkers}, c.logger)
+    HandleJob(jobs, AnonymizeUserHandler(svc))
+    var origins []string
+    if *corsOrigins != "" {
+        origins = strings.Split(*corsOrigins, ",")
+        for i := range origins {
+            origins[i] = strings.TrimSpace(origins[i])
+        }
+    }
+    streamOpts := []StreamOption{WithStreamOrigins(origins...)}
+    if *noAuth {
+        streamOpts = append(streamOpts, WithAnonymousStream())
+    }
+    stream := NewEventStream(c.logger, streamOpts...)
+    bus.Subscribe(stream.Publish)
+    stats := NewStatsStream(svc, c.logger, DefaultStatsInterval)
+    bus.Subscribe(stats.Publish)
+    health := NewHealthHandler(0)
+    health.AddCheck("repository", RepositoryCheck(repo))
+
+    api := NewUserAPI(svc, c.logger)
+    api.Handle("GET /ws", stream)
+    api.Handle("GET /stats/stream", stats)
+    api.Handle("GET /healthz", http.HandlerFunc(health.Live))
+    api.Handle("GET /readyz", http.HandlerFunc(health.Ready))
+    if *exposeMetrics {
+        api.Handle("GET /metrics", metrics)
+    }
+    admin := NewAdminAPI(api)
+    admin.LogLevel = c.logLevel
+    admin.SLOs = sloTracker
+    admin.Jobs = jobs
+    api.Handle("/admin/", admin)
+
+    mws := []Middleware{RequestID()}
+    if tracer != nil {
+        mws = append(mws, Tracing(tracer))
+    }
+    mws = append(mws, metrics.Middleware(), Recover(c.logger), RequestLogging(c.logger), Gzip())
+    if len(origins) > 0 {
+        cors := CORSConfig{
+            AllowedOrigins:   origins,
+            AllowCredentials: *corsCredentials,
+            MaxAge:           10 * time.Minute,
+        }
+        if err := cors.Validate(); err != nil {
+            close()
+            return c.usageError(fs, "%v", err)
+        }
+        mws = append(mws, CORS(cors))
+    }
+    if tokens != nil {
+        // Probes must work without credentials.
+        mws = append(mws, except(Authenticate(tokens, nil), "/healthz", "/readyz"))
+    }
+    if *rate > 0 || watcher != nil {
+        opts := []RateLimitOption{WithRateLimitVar(rateLimit)}
+        if *redisAddr != "" {
+            password, err := OptionalSecret(ctx, c.secrets, SecretRedisPassword)
+            if err != nil {
+                close()
+                return err
+            }
+            store := NewRedisRateLimitStore(*redisAddr, password.Reveal(), c.logger)
+            defer store.Close()
+            opts = append(opts, WithRateLimitStore(store))
+        }
+        mws = append(mws, RateLimit(*rate, time.Minute, opts...))
+    }
+    // Switching a stream off refuses new connections; open ones stay.
+    mws = append(mws,
+        FeatureGate(features, FeatureGraphQL, "/graphql"),
+        FeatureGate(features, FeatureEventStream, "/ws"),
+        FeatureGate(features, FeatureStatsStream, "/stats/stream"))
+    if *debugAddr != "" {
+        diag := NewDiagnosticsHandler(repo)
+        diag.AddVar("event_bus_queue_depth", func() any { return bus.QueueDepth() })
+        debugSrv := &http.Server{Addr: *debugAddr, Handler: diag, ReadHeaderTimeout: 5 * time.Second}
+        go func() {
+            if err := debugSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+                c.logger.Error("Diagnostics server failed", "addr", *debugAddr, "error", err)
+            }
+        }()
+        defer debugSrv.Close()
+        c.logger.Info("Diagnostics listening", "addr", *debugAddr)
+    }
+    srv := NewServer(*addr, Chain(mws...)(api), c.logger)
+    srv.ShutdownTimeout = *timeout
+    srv.TLS = tlsConfig
+    srv.BeforeShutdown(health.Drain)
+    // Shutdown doesn't track hijacked connections, and would wait out
+    // its deadline on streaming responses.
+    srv.BeforeShutdown(stream.Close)
+    srv.BeforeShutdown(stats.Close)
+    if watcher != nil {
+        watcher.Start(ctx)
+        srv.BeforeShutdown(watcher.Stop)
+    }
+    jobs.Start(ctx)
+    srv.BeforeShutdown(jobs.Stop)
+    if backups != nil {
+        backups.Start(ctx)
+        srv.BeforeShutdown(backups.Stop)
+    }
+    if exporter != nil {
+        // Registered first so it runs last, once nothing records spans.
+        srv.AfterShutdown(exporter.Close)
+    }
+    srv.AfterShutdown(close)
+    srv.AfterShutdown(commit)
+    srv.AfterShutdown(persistJobs) // jobs enqueued while requests drained
+    srv.AfterShutdown(func() error {
+        bus.Close() // deliver events queued by the last requests
+        return nil
+    })
+    return srv.Run(ctx)
 }
 
-func (s *UserService) GetUserStats() (map[string]interface{}, error) {
-    users, err := s.repo.FindAll()
+// backupScheduler schedules backups of repo to dest, a ParseBackupStore
+// spec. S3 credentials in the secrets take precedence over the
+// environment's.
+func (c *cli) backupScheduler(ctx context.Context, repo UserRepository, dest string, cfg BackupConfig) (*BackupScheduler, error) {
+    source, ok := findRepository[Snapshotter](repo)
+    if !ok {
+        return nil, errors.New("-backup needs the memory or file backend; back up a database with its own tools")
+    }
+    store, err := ParseBackupStore(dest)
     if err != nil {
         return nil, err
     }
-    
-    stats := map[string]interface{}{
-        "total": len(users),
-        "by_status": make(map[Status]int),
-        "average_age": 0.0,
-    }
-    
-    statusCounts := make(map[Status]int)
-    ageSum := 0
-    ageCount := 0
-    
-    for _, user := range users {
-        statusCounts[user.Status]++
-        if user.Age != nil {
-            ageSum += *user.Age
-            ageCount++
+    if s3, ok := store.(*S3BackupStore); ok {
+        id, err := OptionalSecret(ctx, c.secrets, SecretS3AccessKeyID)
+        if err != nil {
+            return nil, err
+        }
+        key, err := OptionalSecret(ctx, c.secrets, SecretS3SecretKey)
+        if err != nil {
+            return nil, err
+        }
+        if !id.IsZero() {
+            s3.AccessKeyID, s3.SecretAccessKey, s3.SessionToken = id.Reveal(), key, Secret{}
+        }
+        if s3.AccessKeyID == "" || s3.SecretAccessKey.IsZero() {
+            return nil, fmt.Errorf("backups to s3://%s need credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or the %s and %s secrets",
+                s3.Bucket, SecretS3AccessKeyID, SecretS3SecretKey)
         }
     }
-    
-    stats["by_status"] = statusCounts
-    if ageCount > 0 {
-        stats["average_age"] = float64(ageSum) / float64(ageCount)
+    c.logger.Info("Backing up users", "destination", dest, "interval", cfg.Interval)
+    return NewBackupScheduler(source, store, cfg, c.logger), nil
+}
+
+func (c *cli) userCreate(ctx context.Context, args []string) error {
+    fs := c.flags("zaai user create", "-name NAME -email EMAIL [-age N]")
+    name := fs.String("name", "", "display name")
+    email := fs.String("email", "", "email address")
+    age := fs.Int("age", -1, "age in years; omitted when negative")
+    if err := fs.Parse(args); err != nil {
+        return err
     }
-    
-    return stats, nil
+    if *name == "" || *email == "" {
+        return c.usageError(fs, "user create needs -name and -email")
+    }
+    req := CreateUserRequest{Name: *name, Email: *email}
+    if *age >= 0 {
+        req.Age = age
+    }
+    return c.withService(ctx, func(svc *UserService) error {
+        user, err := svc.CreateUserWith(ctx, req)
+        if err != nil {
+            return err
+        }
+        return c.print(user)
+    })
 }
 
-// Utility functions
-func isValidEmail(email string) bool {
-    return strings.Contains(email, "@") && strings.Contains(email, ".")
+func (c *cli) userList(ctx context.Context, args []string) error {
+    fs := c.flags("zaai user list", "[-offset N] [-limit N] [-sort FIELD] [-desc]")
+    var req PageRequest
+    fs.IntVar(&req.Offset, "offset", 0, "users to skip")
+    fs.IntVar(&req.Limit, "limit", DefaultPageSize, "page size")
+    sortField := fs.String("sort", "id", "sort by id, name, created_at or age")
+    fs.BoolVar(&req.Sort.Desc, "desc", false, "sort descending")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    req.Sort.Field = SortField(*sortField)
+    return c.withService(ctx, func(svc *UserService) error {
+        page, err := svc.ListUsers(ctx, req)
+        if err != nil {
+            return err
+        }
+        return c.print(page)
+    })
 }
 
-func intPtr(i int) *int {
-    return &i
+// userByID runs get or delete.
+func (c *cli) userByID(ctx context.Context, action string, args []string) error {
+    fs := c.flags("zaai user "+action, "<id>")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if fs.NArg() != 1 {
+        return c.usageError(fs, "user %s takes one user ID", action)
+    }
+    id, err := strconv.Atoi(fs.Arg(0))
+    if err != nil || id <= 0 {
+        return c.usageError(fs, "invalid user ID %q", fs.Arg(0))
+    }
+    return c.withService(ctx, func(svc *UserService) error {
+        if action == "delete" {
+            return svc.DeleteUser(ctx, UserID(id))
+        }
+        user, err := svc.GetUser(ctx, UserID(id))
+        if err != nil {
+            return err
+        }
+        return c.print(user)
+    })
 }
 
-// Math utilities
-func calculateCircleArea(radius float64) float64 {
-    return math.Pi * radius * radius
+func (c *cli) stats(ctx context.Context, args []string) error {
+    fs := c.flags("zaai stats", "")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    return c.withService(ctx, func(svc *UserService) error {
+        stats, err := svc.GetUserStats(ctx)
+        if err != nil {
+            return err
+        }
+        return c.print(stats)
+    })
 }
 
-func fibonacci(n int) []int {
-    if n <= 0 {
-        return []int{}
+func (c *cli) importCSV(ctx context.Context, args []string) error {
+    fs := c.flags("zaai import", "[-batch N] <file.csv | ->")
+    batch := fs.Int("batch", DefaultImportBatchSize, "users saved per batch")
+    workers := fs.Int("workers", 0, "batches saved at once; by default 4 with the postgres backend and 1 otherwise")
+    if err := fs.Parse(args); err != nil {
+        return err
     }
-    if n == 1 {
-        return []int{0}
+    if fs.NArg() != 1 {
+        return c.usageError(fs, "import takes one CSV file, or - for stdin")
     }
-    
-    fib := make([]int, n)
-    fib[0], fib[1] = 0, 1
-    
-    for i := 2; i < n; i++ {
-        fib[i] = fib[i-1] + fib[i-2]
+    in := io.Reader(os.Stdin)
+    if path := fs.Arg(0); path != "-" {
+        f, err := os.Open(path)
+        if err != nil {
+            return err
+        }
+        defer f.Close()
+        in = f
     }
-    
-    return fib
+    repo, commit, close, err := c.open(ctx)
+    if err != nil {
+        return err
+    }
+    defer close()
+    if *workers == 0 && c.backend == "postgres" {
+        *workers = DefaultImportWorkers
+    }
+    report, err := ImportUsersCSVWith(ctx, repo, in, ImportOptions{BatchSize: *batch, Workers: *workers})
+    if err != nil {
+        return err
+    }
+    // Persist what was imported even when some rows were rejected.
+    if err := commit(); err != nil {
+        return err
+    }
+    return c.print(report)
 }
 
-// Goroutine example
-func processNumbers(numbers []int, results chan<- int) {
-    sum := 0
-    for _, num := range numbers {
-        sum += num * num // Square each number
+// exportJSON writes every user as NDJSON to stdout, or to a file with -out.
+func (c *cli) exportJSON(ctx context.Context, args []string) error {
+    fs := c.flags("zaai export", "[-out file.ndjson]")
+    path := fs.String("out", "", "write to `file` instead of stdout")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if fs.NArg() != 0 {
+        return c.usageError(fs, "export takes no arguments")
+    }
+    repo, _, close, err := c.open(ctx)
+    if err != nil {
+        return err
     }
-    results <- sum
+    defer close()
+    if *path == "" {
+        n, err := ExportUsersJSON(ctx, repo, c.stdout)
+        if err != nil {
+            return err
+        }
+        c.logger.Info("Exported users", "count", n)
+        return nil
+    }
+
+    // Stream into a temp file next to -out and rename it into place, like
+    // writeFileAtomic, so a failed export never leaves a truncated file.
+    tmp, err := os.CreateTemp(filepath.Dir(*path), "."+filepath.Base(*path)+".*.tmp")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name()) // no-op once the rename succeeds
+
+    n, err := ExportUsersJSON(ctx, repo, tmp)
+    if err == nil {
+        err = tmp.Sync()
+    }
+    if cerr := tmp.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = os.Rename(tmp.Name(), *path)
+    }
+    if err != nil {
+        return err
+    }
+    c.logger.Info("Exported users", "count", n, "path", *path)
+    return nil
+}
+
+// print writes v as indented JSON or, for the types it knows, a table.
+func (c *cli) print(v any) error {
+    if c.output == "json" {
+        enc := json.NewEncoder(c.stdout)
+        enc.SetIndent("", "  ")
+        return enc.Encode(v)
+    }
+
+    tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+    row := func(cols ...any) {
+        for i, col := range cols {
+            if i > 0 {
+                fmt.Fprint(tw, "\t")
+            }
+            fmt.Fprint(tw, col)
+        }
+        fmt.Fprintln(tw)
+    }
+    users := func(list ...*User) {
+        row("ID", "NAME", "EMAIL", "AGE", "STATUS", "ROLE", "CREATED")
+        for _, u := range list {
+            age := "-"
+            if u.Age != nil {
+                age = strconv.Itoa(*u.Age)
+            }
+            row(u.ID, u.Name, u.Email, age, u.Status, u.Role, u.CreatedAt.Format(time.DateTime))
+        }
+    }
+
+    switch v := v.(type) {
+    case *User:
+        users(v)
+    case *Page:
+        users(v.Users...)
+        tw.Flush()
+        fmt.Fprintf(c.stdout, "\n%d-%d of %d\n", min(v.Offset+1, v.Total), min(v.Offset+len(v.Users), v.Total), v.Total)
+    case *UserStats:
+        row("Total", v.Total)
+        for _, status := range slices.Sorted(maps.Keys(v.ByStatus)) {
+            row("Status "+string(status), v.ByStatus[status])
+        }
+        row("With age", v.WithAge)
+        row("Average age", fmt.Sprintf("%.1f", v.AverageAge))
+        row("Median age", fmt.Sprintf("%.1f", v.MedianAge))
+    case *ImportReport:
+        row("Imported", v.Imported)
+        row("Duplicates", len(v.Duplicates))
+        row("Invalid", len(v.Invalid))
+        row("Failed", len(v.Failed))
+        for _, rows := range [][]ImportRow{v.Duplicates, v.Invalid, v.Failed} {
+            for _, r := range rows {
+                row(fmt.Sprintf("  line %d", r.Line), r.Email, r.Reason)
+            }
+        }
+    default:
+        return fmt.Errorf("no table format for %T", v)
+    }
+    return tw.Flush()
 }
 
 func main() {
+    os.Exit(runCLI(context.Background(), os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// runDemo is the original walkthrough: a few users, their stats, and some
+// language examples.
+func runDemo() error {
     fmt.Printf("%s v%s\n", AppName, Version)
     fmt.Println(strings.Repeat("=", 30))
     
     // Initialize dependencies
+    ctx := context.Background()
     logger := &SimpleLogger{}
     repo := NewInMemoryRepository()
     userService := NewUserService(repo, logger)
     
     // Create sample users
-    user1, err := userService.CreateUser("Alice Johnson", "alice@example.com", intPtr(28))
+    user1, err := userService.CreateUser(ctx, "Alice Johnson", "alice@example.com", intPtr(28))
     if err != nil {
-        logger.Error(fmt.Sprintf("Failed to create user: %v", err))
-        return
+        logger.Error("Failed to create user", "error", err)
+        return err
     }
     
-    user2, err := userService.CreateUser("Bob Smith", "bob@example.com", nil)
+    user2, err := userService.CreateUser(ctx, "Bob Smith", "bob@example.com", nil)
     if err != nil {
-        logger.Error(fmt.Sprintf("Failed to create user: %v", err))
-        return
+        logger.Error("Failed to create user", "error", err)
+        return err
     }
     
     // Display users as JSON
@@ -307,10 +19706,10 @@ func main() {
     }
     
     // Get and display statistics
-    stats, err := userService.GetUserStats()
+    stats, err := userService.GetUserStats(ctx)
     if err != nil {
-        logger.Error(fmt.Sprintf("Failed to get stats: %v", err))
-        return
+        logger.Error("Failed to get stats", "error", err)
+        return err
     }
     
     fmt.Println("\nUser Statistics:")
@@ -324,13 +19723,17 @@ func main() {
     fibNumbers := fibonacci(10)
     fmt.Printf("First 10 Fibonacci numbers: %v\n", fibNumbers)
     
-    // Goroutine example
+    // Worker pool example
     numbers := []int{1, 2, 3, 4, 5}
-    results := make(chan int, 1)
-    go processNumbers(numbers, results)
-    
-    squareSum := <-results
+    squares := RunPool(ctx, 2, numbers, func(ctx context.Context, num int) (int, error) {
+        return num * num, nil
+    })
+    squareSum := 0
+    for _, r := range squares {
+        squareSum += r.Value
+    }
     fmt.Printf("Sum of squares of %v: %d\n", numbers, squareSum)
     
     logger.Info("Application completed successfully")
+    return nil
 }
\ No newline at end of file